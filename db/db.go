@@ -296,3 +296,153 @@ func (m *mergingIter) Close() error {
 	m.index = -2
 	return m.err
 }
+
+// NewCopyingIterator returns an iterator that walks iter, but whose Key and
+// Value methods return fresh copies of iter's keys and values. Unlike the
+// slices returned by most iterators, those copies remain valid after the next
+// call to Next and after Close, and the caller may modify them. For example,
+// a table iterator's keys and values may refer to block memory that is reused
+// once the block is evicted from a cache, and copying decouples the caller
+// from that block's lifetime. The cost is two allocations per key/value pair,
+// and so the zero-copy iterators are preferable unless the caller retains
+// keys or values.
+//
+// Closing the returned iterator closes iter.
+func NewCopyingIterator(iter Iterator) Iterator {
+	return &copyingIter{
+		iter: iter,
+	}
+}
+
+type copyingIter struct {
+	iter       Iterator
+	key, value []byte
+}
+
+func (i *copyingIter) Next() bool {
+	if !i.iter.Next() {
+		i.key, i.value = nil, nil
+		return false
+	}
+	i.key = append([]byte(nil), i.iter.Key()...)
+	i.value = append([]byte(nil), i.iter.Value()...)
+	return true
+}
+
+func (i *copyingIter) Key() []byte {
+	return i.key
+}
+
+func (i *copyingIter) Value() []byte {
+	return i.value
+}
+
+func (i *copyingIter) Close() error {
+	i.key, i.value = nil, nil
+	return i.iter.Close()
+}
+
+// NewLimitingIterator returns an iterator that walks iter until the
+// cumulative length of the keys and values it has returned exceeds budget
+// bytes. The budget is checked on each call to Next, so the final key/value
+// pair returned may take the total over budget: a page always contains at
+// least one key/value pair if iter is non-empty.
+//
+// To tell that the budget is used, the returned iterator advances iter one
+// entry past the last key/value pair that it returns. That entry is not
+// returned, but its key is available from NextKey, so that the next page can
+// start from it.
+//
+// Closing the returned iterator closes iter.
+func NewLimitingIterator(iter Iterator, budget int) *LimitingIterator {
+	return &LimitingIterator{
+		iter:   iter,
+		budget: budget,
+	}
+}
+
+// LimitingIterator is an iterator that stops once a byte budget has been
+// used. It is returned by NewLimitingIterator.
+type LimitingIterator struct {
+	iter      Iterator
+	budget    int
+	nBytes    int
+	nEntries  int
+	truncated bool
+	done      bool
+	// nextKey is a copy of the key of the entry that iter was advanced to,
+	// but which was not returned, if truncated is true.
+	nextKey []byte
+}
+
+// LimitingIterator implements the Iterator interface.
+var _ Iterator = (*LimitingIterator)(nil)
+
+// Next implements Iterator.Next.
+func (i *LimitingIterator) Next() bool {
+	if i.done {
+		return false
+	}
+	if !i.iter.Next() {
+		i.done = true
+		return false
+	}
+	if i.nBytes > i.budget {
+		// The underlying iterator has another key/value pair, but it is over
+		// budget. Its key is kept, as iter has been consumed past it.
+		i.truncated = true
+		i.done = true
+		i.nextKey = append([]byte(nil), i.iter.Key()...)
+		return false
+	}
+	i.nBytes += len(i.iter.Key()) + len(i.iter.Value())
+	i.nEntries++
+	return true
+}
+
+// Key implements Iterator.Key.
+func (i *LimitingIterator) Key() []byte {
+	if i.done {
+		return nil
+	}
+	return i.iter.Key()
+}
+
+// Value implements Iterator.Value.
+func (i *LimitingIterator) Value() []byte {
+	if i.done {
+		return nil
+	}
+	return i.iter.Value()
+}
+
+// Close implements Iterator.Close.
+func (i *LimitingIterator) Close() error {
+	i.done = true
+	return i.iter.Close()
+}
+
+// Count returns the number of key/value pairs returned so far.
+func (i *LimitingIterator) Count() int {
+	return i.nEntries
+}
+
+// Bytes returns the cumulative length of the keys and values returned so far.
+func (i *LimitingIterator) Bytes() int {
+	return i.nBytes
+}
+
+// Truncated returns whether iteration stopped because the budget was used,
+// rather than because the underlying iterator was exhausted. An iterator that
+// is exhausted just as the budget is used is not truncated.
+func (i *LimitingIterator) Truncated() bool {
+	return i.truncated
+}
+
+// NextKey returns the key of the first key/value pair that was not returned
+// because the budget was used, or nil if the iterator is not truncated. The
+// underlying iterator has been advanced past that pair, so the next page
+// should start from, and include, that key.
+func (i *LimitingIterator) NextKey() []byte {
+	return i.nextKey
+}
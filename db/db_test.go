@@ -206,3 +206,160 @@ func TestMergingIterator(t *testing.T) {
 		return splits
 	})
 }
+
+func TestLimitingIterator(t *testing.T) {
+	// Each of testKeyValuePairs has a 2 byte key, and a value between 3 and 9
+	// bytes long.
+	testCases := []struct {
+		budget    int
+		want      string
+		truncated bool
+	}{
+		{0, "<10:ten>", true},
+		{4, "<10:ten>", true},
+		{5, "<10:ten><11:eleven>", true},
+		{12, "<10:ten><11:eleven>", true},
+		{13, "<10:ten><11:eleven><12:twelve>", true},
+		// The pairs total 90 bytes, so the budget is used by the last one.
+		{89, "<10:ten><11:eleven><12:twelve><13:thirteen><14:fourteen>" +
+			"<15:fifteen><16:sixteen><17:seventeen><18:eighteen><19:nineteen>", false},
+		{1000, "<10:ten><11:eleven><12:twelve><13:thirteen><14:fourteen>" +
+			"<15:fifteen><16:sixteen><17:seventeen><18:eighteen><19:nineteen>", false},
+	}
+	for _, tc := range testCases {
+		var b bytes.Buffer
+		iter := NewLimitingIterator(newFakeIterator(nil, testKeyValuePairs...), tc.budget)
+		n, nBytes := 0, 0
+		for iter.Next() {
+			fmt.Fprintf(&b, "<%s:%s>", iter.Key(), iter.Value())
+			n++
+			nBytes += len(iter.Key()) + len(iter.Value())
+		}
+		if iter.Next() {
+			t.Errorf("budget=%d: Next after exhaustion returned true", tc.budget)
+		}
+		if err := iter.Close(); err != nil {
+			t.Errorf("budget=%d: Close: %v", tc.budget, err)
+			continue
+		}
+		if got := b.String(); got != tc.want {
+			t.Errorf("budget=%d:\ngot  %q\nwant %q", tc.budget, got, tc.want)
+		}
+		if got := iter.Count(); got != n {
+			t.Errorf("budget=%d: Count: got %d, want %d", tc.budget, got, n)
+		}
+		if got := iter.Bytes(); got != nBytes {
+			t.Errorf("budget=%d: Bytes: got %d, want %d", tc.budget, got, nBytes)
+		}
+		if got := iter.Truncated(); got != tc.truncated {
+			t.Errorf("budget=%d: Truncated: got %t, want %t", tc.budget, got, tc.truncated)
+		}
+		wantNextKey := ""
+		if tc.truncated {
+			wantNextKey = testKeyValuePairs[n][:2]
+		}
+		if got := string(iter.NextKey()); got != wantNextKey {
+			t.Errorf("budget=%d: NextKey: got %q, want %q", tc.budget, got, wantNextKey)
+		}
+	}
+
+	// Paging through the pairs, starting each page at the previous page's
+	// NextKey, returns every pair exactly once.
+	var b bytes.Buffer
+	nPages, start := 0, 0
+	for {
+		iter := NewLimitingIterator(newFakeIterator(nil, testKeyValuePairs[start:]...), 20)
+		for iter.Next() {
+			fmt.Fprintf(&b, "<%s:%s>", iter.Key(), iter.Value())
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatalf("paging: Close: %v", err)
+		}
+		nPages++
+		if !iter.Truncated() {
+			break
+		}
+		// Seek to the next key, as a caller resuming from a saved key would.
+		next := start
+		for next < len(testKeyValuePairs) && !strings.HasPrefix(testKeyValuePairs[next], string(iter.NextKey())+":") {
+			next++
+		}
+		if next != start+iter.Count() {
+			t.Fatalf("paging: page %d: NextKey %q is not the first pair after the page", nPages, iter.NextKey())
+		}
+		start = next
+	}
+	if got, want := b.String(), "<10:ten><11:eleven><12:twelve><13:thirteen><14:fourteen>"+
+		"<15:fifteen><16:sixteen><17:seventeen><18:eighteen><19:nineteen>"; got != want {
+		t.Errorf("paging:\ngot  %q\nwant %q", got, want)
+	}
+	if nPages < 2 {
+		t.Errorf("paging: got %d pages, want more than one", nPages)
+	}
+
+	// Errors from the underlying iterator are passed through.
+	iter := NewLimitingIterator(newFakeIterator(errors.New("oops"), "a:b"), 100)
+	for iter.Next() {
+	}
+	if err := iter.Close(); err == nil || err.Error() != "oops" {
+		t.Errorf("error pass-through: got %v, want oops", err)
+	}
+}
+
+// reusingIter is an iterator whose keys and values share a buffer that is
+// overwritten on each call to Next.
+type reusingIter struct {
+	Iterator
+	buf []byte
+	n   int
+}
+
+func (i *reusingIter) Next() bool {
+	if !i.Iterator.Next() {
+		return false
+	}
+	i.buf = append(append(i.buf[:0], i.Iterator.Key()...), i.Iterator.Value()...)
+	i.n = len(i.Iterator.Key())
+	return true
+}
+
+func (i *reusingIter) Key() []byte {
+	return i.buf[:i.n]
+}
+
+func (i *reusingIter) Value() []byte {
+	return i.buf[i.n:]
+}
+
+func TestCopyingIterator(t *testing.T) {
+	iter := NewCopyingIterator(&reusingIter{
+		Iterator: newFakeIterator(nil, testKeyValuePairs...),
+		buf:      make([]byte, 0, 64),
+	})
+	var keys, values [][]byte
+	for iter.Next() {
+		keys = append(keys, iter.Key())
+		values = append(values, iter.Value())
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(testKeyValuePairs) {
+		t.Fatalf("got %d key/value pairs, want %d", len(keys), len(testKeyValuePairs))
+	}
+	// The retained keys and values were not overwritten by later calls to the
+	// underlying iterator's Next.
+	for j, kv := range testKeyValuePairs {
+		if got := fmt.Sprintf("%s:%s", keys[j], values[j]); got != kv {
+			t.Errorf("pair %d: got %q, want %q", j, got, kv)
+		}
+	}
+
+	// Errors from the underlying iterator are passed through.
+	iter = NewCopyingIterator(newFakeIterator(errors.New("oops"), "a:b"))
+	for iter.Next() {
+	}
+	if err := iter.Close(); err == nil || err.Error() != "oops" {
+		t.Fatalf("got %v, want oops", err)
+	}
+}
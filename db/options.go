@@ -40,6 +40,72 @@ type FilterPolicy interface {
 	MayContain(filter, key []byte) bool
 }
 
+// PrefixExtractor maps keys to their prefixes, so that a table's filter can
+// also hold the prefixes of the table's keys. Iterating over the keys with a
+// given prefix can then skip the data blocks whose filters do not contain that
+// prefix.
+//
+// The name is written to tables, and prefix filtering is only done if the
+// PrefixExtractor name at the time of writing equals the name at the time of
+// reading. Otherwise, the prefixes in the filters are ignored, which will not
+// affect correctness but may affect performance.
+type PrefixExtractor interface {
+	// Name names the prefix extractor.
+	Name() string
+
+	// Prefix returns the prefix of key, or nil if key has no prefix.
+	Prefix(key []byte) []byte
+}
+
+// Logger defines an interface for writing informational messages, such as
+// warnings about poorly built tables.
+type Logger interface {
+	// Infof logs a message, formatted according to a format specifier.
+	Infof(format string, args ...interface{})
+}
+
+// BlockReadInfo describes a table block that was read from a file and
+// decompressed, as reported to Options.OnBlockRead.
+type BlockReadInfo struct {
+	// Offset is the block's offset in the file.
+	Offset uint64
+	// CompressedLen is the block's length in the file, excluding its trailer.
+	CompressedLen int
+	// DecompressedLen is the block's length after decompression.
+	DecompressedLen int
+	// Compression is the block's compression algorithm.
+	Compression Compression
+}
+
+// Allocator provides the memory of the blocks that a table reader reads and
+// decompresses, such as from a slab allocator or an arena. Alloc returns a
+// slice of length n. Free is passed memory, from the start of a slice
+// returned by Alloc, that the reader no longer references. A block that may
+// still be referenced by the block cache or by the caller, such as a value
+// returned by Get or the last value of a closed iterator, is never passed to
+// Free, so that an Allocator whose memory is not managed by the garbage
+// collector must outlive the reader and the values that it returned.
+type Allocator interface {
+	Alloc(n int) []byte
+	Free(b []byte)
+}
+
+// BlockCache caches the decompressed data blocks of a table, such as in a
+// cache that is shared with other processes. A block is identified by its
+// offset and length in the table file, excluding its trailer; a BlockCache
+// shared by several tables must distinguish their blocks itself. The blocks
+// passed to Put and returned by Get must not be modified. A BlockCache must
+// be safe for concurrent use.
+type BlockCache interface {
+	// Get returns the cached block with the given offset and length, and
+	// whether there was such a block.
+	Get(offset, length uint64) (b []byte, ok bool)
+
+	// Put caches b as the block with the given offset and length. It may
+	// instead discard b, or evict other blocks.
+	Put(offset, length uint64, b []byte)
+}
+
 // Options holds the optional parameters for leveldb's DB implementations.
 // These options apply to the DB at large; per-query options are defined by
 // the ReadOptions and WriteOptions types.
@@ -53,30 +119,103 @@ type FilterPolicy interface {
 //   - Comparer
 //   - FileSystem
 //   - FilterPolicy
+//   - Logger
 //   - MaxOpenFiles
+//   - PrefixExtractor
+//   - VerifyDecompressed
+//
 // Read options:
+//   - Allocator
+//   - BlockCache
+//   - BlockCacheSize
+//   - BlockSeekLimit
+//   - BlockSeekWarnThreshold
+//   - CheckKey
+//   - CheckKeyContinue
+//   - LinearSeekThreshold
+//   - MaxBlockSize
+//   - OnBlockRead
+//   - ParanoidChecks
+//   - ReadaheadBlocks
+//   - ReadChunkSize
+//   - TimeReads
 //   - VerifyChecksums
+//
 // Write options:
 //   - BlockRestartInterval
 //   - BlockSize
 //   - Compression
 //   - ErrorIfDBExists
+//   - ValuePrefixCompression
 //   - WriteBufferSize
 type Options struct {
+	// Allocator, if non-nil, provides the memory for the blocks that table
+	// readers read from files and decompress.
+	//
+	// The default value means to allocate blocks with make, and to pool the
+	// memory of the blocks read by iterators.
+	Allocator Allocator
+
+	// BlockCache, if non-nil, is the cache of each table's decompressed data
+	// blocks, in place of a cache of BlockCacheSize bytes.
+	//
+	// The default value means to use an LRU cache of BlockCacheSize bytes.
+	BlockCache BlockCache
+
+	// BlockCacheSize is the capacity in bytes of each table's cache of
+	// decompressed data blocks. It is ignored if BlockCache is non-nil.
+	//
+	// The default value is 0, which means to not cache blocks.
+	BlockCacheSize int
+
 	// BlockRestartInterval is the number of keys between restart points
 	// for delta encoding of keys.
 	//
 	// The default value is 16.
 	BlockRestartInterval int
 
+	// BlockSeekLimit is the maximum number of key/value pairs that seeking
+	// within a table's data block may step over, after binary searching that
+	// block's restart points. Exceeding it is an error, as it indicates a
+	// poorly built table, such as one with an excessive restart interval.
+	//
+	// The default value is 0, which means no limit.
+	BlockSeekLimit int
+
+	// BlockSeekWarnThreshold is like BlockSeekLimit, except that exceeding it
+	// only logs a warning to the Logger.
+	//
+	// The default value is 0, which means to not warn.
+	BlockSeekWarnThreshold int
+
 	// BlockSize is the minimum uncompressed size in bytes of each table block.
 	//
 	// The default value is 4096.
 	BlockSize int
 
+	// CheckKey, if non-nil, is called with each key that a table iterator
+	// visits, to check an invariant of the keys, such as that they are valid
+	// UTF-8 or have a fixed length. It is for debugging the code that
+	// encodes keys. If it returns an error, the iterator stops, and its
+	// Close returns an error that also holds the key and the offset of its
+	// data block, unless CheckKeyContinue is set.
+	//
+	// The default value means to not check keys.
+	CheckKey func(key []byte) error
+
+	// CheckKeyContinue is whether a table iterator continues past a key that
+	// fails CheckKey. The table's reader then records the failure, along with
+	// the key and the offset of its data block, for later inspection. Each
+	// failing key is recorded once, until the failures are inspected.
+	//
+	// The default value is false.
+	CheckKeyContinue bool
+
 	// Comparer defines a total ordering over the space of []byte keys: a 'less
 	// than' relationship. The same comparison algorithm must be used for reads
-	// and writes over the lifetime of the DB.
+	// and writes over the lifetime of the DB. If it is set, a table reader
+	// rejects a table that records that it was written with a differently
+	// named Comparer.
 	//
 	// The default value uses the same ordering as bytes.Compare.
 	Comparer Comparer
@@ -105,12 +244,94 @@ type Options struct {
 	// The default value means to use no filter.
 	FilterPolicy FilterPolicy
 
+	// LinearSeekThreshold is the number of restart points below which seeking
+	// within a table's data block scans the block's restart points linearly
+	// instead of binary searching them. For a block with only a few restart
+	// points, the scan can be slightly cheaper.
+	//
+	// The default value is 0, which means to always binary search.
+	LinearSeekThreshold int
+
+	// Logger is where to log informational messages.
+	//
+	// The default value discards all messages.
+	Logger Logger
+
+	// MaxBlockSize is the maximum decompressed length in bytes of a table
+	// block that may be read. A block that would decompress to more than this
+	// is treated as corrupt, without decompressing it. This guards against a
+	// corrupt or malicious table that claims that a small block decompresses
+	// to an excessive length.
+	//
+	// The default value is 0, which means no limit.
+	MaxBlockSize int
+
 	// MaxOpenFiles is a soft limit on the number of open files that can be
 	// used by the DB.
 	//
 	// The default value is 1000.
 	MaxOpenFiles int
 
+	// OnBlockRead, if non-nil, is called for each data block or index
+	// partition that a table reader reads from a file, after decompressing
+	// it. Blocks found in the block cache are not reported. It may be called
+	// concurrently by concurrent iterators.
+	//
+	// The default value means to not report block reads.
+	OnBlockRead func(BlockReadInfo)
+
+	// ParanoidChecks is whether to check, as each table data block is read by
+	// an iterator or Get, that its keys are in increasing order and lie
+	// between the index separators of the previous block and of that block.
+	// A violation, which would otherwise make seeks silently skip keys, is
+	// reported as a corruption error. The checks decode every key of each
+	// block read, so they are mostly useful for testing.
+	//
+	// The default value is false.
+	ParanoidChecks bool
+
+	// PrefixExtractor defines the prefixes of keys. If both it and the
+	// FilterPolicy are set, each table's filter also holds the prefixes of
+	// the table's keys, so that iterating over the keys with a given prefix
+	// can skip data blocks that do not contain that prefix.
+	//
+	// The default value means to not filter prefixes.
+	PrefixExtractor PrefixExtractor
+
+	// ReadaheadBlocks is the number of subsequent data blocks that a table
+	// iterator reads ahead, in a single read, when it loads a data block.
+	// Reading ahead can speed up sequential scans over large tables, at the
+	// cost of reading blocks that may not be used.
+	//
+	// The default value is 0, which means to not read ahead.
+	ReadaheadBlocks int
+
+	// ReadChunkSize, if positive, is the alignment and minimum length of the
+	// reads of blocks from table files that are not mapped into memory. A
+	// read is extended to start and end at multiples of ReadChunkSize, and
+	// the extra bytes are kept to serve reads of adjacent blocks. On some
+	// file systems, such aligned reads are faster.
+	//
+	// The default value is 0, which means to read exactly the bytes needed.
+	ReadChunkSize int
+
+	// TimeReads is whether a table's reader measures the time spent reading
+	// from the table's file and decompressing its blocks. Measuring costs two
+	// calls to time.Now for each read and each decompression.
+	//
+	// The default value is false.
+	TimeReads bool
+
+	// ValuePrefixCompression is whether to encode each table data block
+	// entry's value as a prefix shared with the previous entry's value plus
+	// the remaining bytes, in the same way as keys. It can make blocks
+	// smaller if consecutive values share long prefixes. Tables written this
+	// way record it in a property, which this package's readers check. Other
+	// LevelDB implementations cannot read such tables.
+	//
+	// The default value is false.
+	ValuePrefixCompression bool
+
 	// WriteBufferSize is the amount of data to build up in memory (backed by
 	// an unsorted log on disk) before converting to a sorted on-disk file.
 	//
@@ -127,6 +348,37 @@ type Options struct {
 	//
 	// The default value is false.
 	VerifyChecksums bool
+
+	// VerifyDecompressed is whether to also checksum each data block's
+	// decompressed contents. A Writer records those checksums in the table's
+	// properties, and a Reader verifies each compressed data block that it
+	// decompresses against the recorded checksum, if there is one. This
+	// catches corruption introduced by decompression, which the checksum of
+	// the block as stored in the file cannot.
+	//
+	// The default value is false.
+	VerifyDecompressed bool
+}
+
+func (o *Options) GetAllocator() Allocator {
+	if o == nil {
+		return nil
+	}
+	return o.Allocator
+}
+
+func (o *Options) GetBlockCache() BlockCache {
+	if o == nil {
+		return nil
+	}
+	return o.BlockCache
+}
+
+func (o *Options) GetBlockCacheSize() int {
+	if o == nil || o.BlockCacheSize < 0 {
+		return 0
+	}
+	return o.BlockCacheSize
 }
 
 func (o *Options) GetBlockRestartInterval() int {
@@ -136,6 +388,20 @@ func (o *Options) GetBlockRestartInterval() int {
 	return o.BlockRestartInterval
 }
 
+func (o *Options) GetBlockSeekLimit() int {
+	if o == nil || o.BlockSeekLimit < 0 {
+		return 0
+	}
+	return o.BlockSeekLimit
+}
+
+func (o *Options) GetBlockSeekWarnThreshold() int {
+	if o == nil || o.BlockSeekWarnThreshold < 0 {
+		return 0
+	}
+	return o.BlockSeekWarnThreshold
+}
+
 func (o *Options) GetBlockSize() int {
 	if o == nil || o.BlockSize <= 0 {
 		return 4096
@@ -143,6 +409,20 @@ func (o *Options) GetBlockSize() int {
 	return o.BlockSize
 }
 
+func (o *Options) GetCheckKey() func(key []byte) error {
+	if o == nil {
+		return nil
+	}
+	return o.CheckKey
+}
+
+func (o *Options) GetCheckKeyContinue() bool {
+	if o == nil {
+		return false
+	}
+	return o.CheckKeyContinue
+}
+
 func (o *Options) GetComparer() Comparer {
 	if o == nil || o.Comparer == nil {
 		return DefaultComparer
@@ -179,6 +459,31 @@ func (o *Options) GetFilterPolicy() FilterPolicy {
 	return o.FilterPolicy
 }
 
+func (o *Options) GetLinearSeekThreshold() int {
+	if o == nil || o.LinearSeekThreshold < 0 {
+		return 0
+	}
+	return o.LinearSeekThreshold
+}
+
+func (o *Options) GetLogger() Logger {
+	if o == nil || o.Logger == nil {
+		return discardLogger{}
+	}
+	return o.Logger
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Infof(format string, args ...interface{}) {}
+
+func (o *Options) GetMaxBlockSize() int {
+	if o == nil || o.MaxBlockSize < 0 {
+		return 0
+	}
+	return o.MaxBlockSize
+}
+
 func (o *Options) GetMaxOpenFiles() int {
 	if o == nil || o.MaxOpenFiles == 0 {
 		return 1000
@@ -186,6 +491,55 @@ func (o *Options) GetMaxOpenFiles() int {
 	return o.MaxOpenFiles
 }
 
+func (o *Options) GetOnBlockRead() func(BlockReadInfo) {
+	if o == nil {
+		return nil
+	}
+	return o.OnBlockRead
+}
+
+func (o *Options) GetParanoidChecks() bool {
+	if o == nil {
+		return false
+	}
+	return o.ParanoidChecks
+}
+
+func (o *Options) GetPrefixExtractor() PrefixExtractor {
+	if o == nil {
+		return nil
+	}
+	return o.PrefixExtractor
+}
+
+func (o *Options) GetReadaheadBlocks() int {
+	if o == nil || o.ReadaheadBlocks < 0 {
+		return 0
+	}
+	return o.ReadaheadBlocks
+}
+
+func (o *Options) GetReadChunkSize() int {
+	if o == nil || o.ReadChunkSize < 0 {
+		return 0
+	}
+	return o.ReadChunkSize
+}
+
+func (o *Options) GetTimeReads() bool {
+	if o == nil {
+		return false
+	}
+	return o.TimeReads
+}
+
+func (o *Options) GetValuePrefixCompression() bool {
+	if o == nil {
+		return false
+	}
+	return o.ValuePrefixCompression
+}
+
 func (o *Options) GetWriteBufferSize() int {
 	if o == nil || o.WriteBufferSize <= 0 {
 		return 4 * 1024 * 1024
@@ -200,13 +554,57 @@ func (o *Options) GetVerifyChecksums() bool {
 	return o.VerifyChecksums
 }
 
+func (o *Options) GetVerifyDecompressed() bool {
+	if o == nil {
+		return false
+	}
+	return o.VerifyDecompressed
+}
+
+// ChecksumVerification is whether a read verifies the per-block checksums of
+// the blocks that it reads.
+type ChecksumVerification int
+
+const (
+	// DefaultChecksumVerification means to verify checksums if and only if
+	// Options.VerifyChecksums is set.
+	DefaultChecksumVerification ChecksumVerification = iota
+	// ChecksumsAlways means to always verify checksums.
+	ChecksumsAlways
+	// ChecksumsNever means to never verify checksums.
+	ChecksumsNever
+)
+
 // ReadOptions hold the optional per-query parameters for Get and Find
 // operations.
 //
 // Like Options, a nil *ReadOptions is valid and means to use the default
 // values.
 type ReadOptions struct {
-	// No fields so far.
+	// ChecksumVerification overrides the VerifyChecksums option for the data
+	// blocks read by this query. Blocks that were read earlier and are in the
+	// block cache are not verified again. Index and meta blocks are still
+	// verified according to the VerifyChecksums option. It is honored by the
+	// table package's readers; package leveldb's DB does not yet pass it
+	// through to its tables.
+	//
+	// The default value (DefaultChecksumVerification) defers to that option.
+	ChecksumVerification ChecksumVerification
+}
+
+// GetVerifyChecksums returns whether to verify checksums, where dflt is the
+// VerifyChecksums option that applies if o does not override it.
+func (o *ReadOptions) GetVerifyChecksums(dflt bool) bool {
+	if o == nil {
+		return dflt
+	}
+	switch o.ChecksumVerification {
+	case ChecksumsAlways:
+		return true
+	case ChecksumsNever:
+		return false
+	}
+	return dflt
 }
 
 // WriteOptions hold the optional per-query parameters for Set and Delete
@@ -20,6 +20,7 @@ import (
 
 	"github.com/golang/leveldb/db"
 	"github.com/golang/leveldb/memfs"
+	"github.com/golang/leveldb/table"
 )
 
 // try repeatedly calls f, sleeping between calls with exponential back-off,
@@ -546,3 +547,58 @@ func TestOpenCloseOpenClose(t *testing.T) {
 		}
 	}
 }
+
+func TestTablesOpenWithDefaultOptions(t *testing.T) {
+	fs := memfs.New()
+	opts := &db.Options{
+		FileSystem: fs,
+	}
+	// Reopening the DB writes the log's entries to a table.
+	for j := 0; j < 2; j++ {
+		d, err := Open("db", opts)
+		if err != nil {
+			t.Fatalf("Open #%d: %v", j, err)
+		}
+		if j == 0 {
+			if err := d.Set([]byte("key"), []byte("value"), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Close(); err != nil {
+			t.Fatalf("Close #%d: %v", j, err)
+		}
+	}
+	ls, err := fs.List("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	numTables := 0
+	for _, filename := range ls {
+		if ft, _, ok := parseDBFilename(filename); !ok || ft != fileTypeTable {
+			continue
+		}
+		numTables++
+		// The table records that it was written with the internal key
+		// comparer, but opens without a Comparer option, as ldbdump does.
+		for _, o := range []*db.Options{nil, {}} {
+			f, err := fs.Open(filepath.Join("db", filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := table.NewReader(f, o)
+			i := r.Find(nil, nil)
+			if !i.Next() || !bytes.HasPrefix(i.Key(), []byte("key")) || string(i.Value()) != "value" {
+				t.Errorf("%s, options %v: got %q:%q, want the key's entry", filename, o, i.Key(), i.Value())
+			}
+			if err := i.Close(); err != nil {
+				t.Errorf("%s, options %v: %v", filename, o, err)
+			}
+			if err := r.Close(); err != nil {
+				t.Errorf("%s, options %v: %v", filename, o, err)
+			}
+		}
+	}
+	if numTables == 0 {
+		t.Fatal("got no tables, want one")
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"github.com/golang/snappy"
+)
+
+// alloc returns a buffer of length n for a block, from the Allocator option
+// if it is set.
+func (r *Reader) alloc(n int) []byte {
+	if r.allocator != nil {
+		return r.allocator.Alloc(n)
+	}
+	return make([]byte, n)
+}
+
+// free passes b, a buffer from alloc, to the Allocator option, if it is set,
+// as b is no longer referenced. Otherwise, b is left to the garbage collector.
+func (r *Reader) free(b []byte) {
+	if r.allocator != nil {
+		r.allocator.Free(b)
+	}
+}
+
+// freeRaw frees raw, the bytes of a block as read by readRawBlock, once its
+// decompressed form is all that is referenced. An uncompressed block is its
+// own decompressed form, and a memory-mapped block is not from alloc.
+func (r *Reader) freeRaw(raw []byte, blockType byte) {
+	if blockType != noCompressionBlockType && r.mmap == nil {
+		r.free(raw)
+	}
+}
+
+// freeRead frees b, the bytes of a block and its trailer as returned by
+// readBlockAndTrailer, unless they alias the file's mapping.
+func (r *Reader) freeRead(b []byte) {
+	if r.mmap == nil {
+		r.free(b)
+	}
+}
+
+// freeBlock frees b, the decompressed form of a block of the given type as
+// read by readRawBlock, once it is no longer referenced. An uncompressed block
+// is the bytes that were read, which are not from alloc if memory-mapped, and
+// only snappy-compressed blocks are decompressed into memory from alloc.
+func (r *Reader) freeBlock(b []byte, blockType byte) {
+	switch blockType {
+	case noCompressionBlockType:
+		if r.mmap == nil {
+			r.free(b)
+		}
+	case snappyCompressionBlockType:
+		r.free(b)
+	}
+}
+
+// getBlockBuf is like the getBlockBuf function, except that the buffer comes
+// from the Allocator option instead of blockBufPool, if that option is set.
+func (r *Reader) getBlockBuf(n int) []byte {
+	if r.allocator != nil {
+		return r.allocator.Alloc(n)
+	}
+	return getBlockBuf(n)
+}
+
+// putBlockBuf returns b, a buffer from r.getBlockBuf, to where it came from.
+func (r *Reader) putBlockBuf(b []byte) {
+	if r.allocator != nil {
+		r.allocator.Free(b)
+		return
+	}
+	putBlockBuf(b)
+}
+
+// decodeSnappy decodes the snappy-compressed block b into memory from alloc.
+func (r *Reader) decodeSnappy(b []byte) (block, error) {
+	n, err := snappy.DecodedLen(b)
+	if err != nil {
+		return nil, err
+	}
+	dst := r.alloc(n)
+	d, err := snappy.Decode(dst, b)
+	if err != nil {
+		r.free(dst)
+		return nil, err
+	}
+	return d, nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"sync"
+
+	"github.com/golang/leveldb/db"
+)
+
+// blockCache is a goroutine-safe LRU cache of a table's decompressed data
+// blocks, keyed by block offset. Its capacity is measured in bytes. It is the
+// default db.BlockCache.
+type blockCache struct {
+	capacity int
+
+	mu    sync.Mutex
+	size  int
+	nodes map[uint64]*blockCacheNode
+	dummy blockCacheNode
+}
+
+// blockCache implements the db.BlockCache interface.
+var _ db.BlockCache = (*blockCache)(nil)
+
+type blockCacheNode struct {
+	offset     uint64
+	b          block
+	next, prev *blockCacheNode
+}
+
+func (c *blockCache) init(capacity int) {
+	c.capacity = capacity
+	c.nodes = make(map[uint64]*blockCacheNode)
+	c.dummy.next = &c.dummy
+	c.dummy.prev = &c.dummy
+}
+
+// get returns the cached block at the given offset, if any, and marks it as
+// the most recently used.
+func (c *blockCache) get(offset uint64) (block, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := c.nodes[offset]
+	if n == nil {
+		return nil, false
+	}
+	c.unlink(n)
+	c.pushFront(n)
+	return n.b, true
+}
+
+// Get implements BlockCache.Get, as documented in the leveldb/db package.
+// Only the offset is the key, as the blocks of a table start at distinct
+// offsets, and Reopen removes the blocks whose lengths have changed.
+func (c *blockCache) Get(offset, length uint64) ([]byte, bool) {
+	return c.get(offset)
+}
+
+// Put implements BlockCache.Put, as documented in the leveldb/db package.
+func (c *blockCache) Put(offset, length uint64, b []byte) {
+	c.set(offset, b)
+}
+
+// set caches the block at the given offset, evicting the least recently used
+// blocks if the cache would otherwise exceed its capacity. Blocks larger than
+// the capacity are not cached.
+func (c *blockCache) set(offset uint64, b block) {
+	if len(b) > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if n := c.nodes[offset]; n != nil {
+		c.size += len(b) - len(n.b)
+		n.b = b
+		c.unlink(n)
+		c.pushFront(n)
+	} else {
+		n = &blockCacheNode{
+			offset: offset,
+			b:      b,
+		}
+		c.nodes[offset] = n
+		c.size += len(b)
+		c.pushFront(n)
+	}
+	for c.size > c.capacity {
+		c.remove(c.dummy.prev)
+	}
+}
+
+// retain removes the blocks whose offsets keep returns false for.
+func (c *blockCache) retain(keep func(offset uint64) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for offset, n := range c.nodes {
+		if !keep(offset) {
+			c.remove(n)
+		}
+	}
+}
+
+// unlink removes n from the doubly-linked list.
+//
+// c.mu must be held when calling this.
+func (c *blockCache) unlink(n *blockCacheNode) {
+	n.next.prev = n.prev
+	n.prev.next = n.next
+}
+
+// pushFront inserts n at the front of the doubly-linked list.
+//
+// c.mu must be held when calling this.
+func (c *blockCache) pushFront(n *blockCacheNode) {
+	n.next = c.dummy.next
+	n.prev = &c.dummy
+	n.next.prev = n
+	n.prev.next = n
+}
+
+// remove removes n from the cache.
+//
+// c.mu must be held when calling this.
+func (c *blockCache) remove(n *blockCacheNode) {
+	delete(c.nodes, n.offset)
+	c.unlink(n)
+	c.size -= len(n.b)
+}
@@ -0,0 +1,214 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"encoding/binary"
+)
+
+// BlockStats summarizes the shape of a table's data blocks, to help tune the
+// BlockSize and BlockRestartInterval options of the Writer.
+type BlockStats struct {
+	// NumBlocks is the number of data blocks.
+	NumBlocks int
+	// NumRestarts is the total number of restart points of the data blocks.
+	NumRestarts int
+	// NumKeys is the estimated total number of keys in the data blocks. It
+	// assumes that, within a block, every restart interval but the last has
+	// as many keys as the first. This is exact for tables written with a
+	// fixed restart interval, such as those written by this package.
+	NumKeys int
+	// EntryBytes is the total decompressed length of the data blocks' entries,
+	// excluding the blocks' restart arrays.
+	EntryBytes uint64
+}
+
+// KeysPerBlock returns the average number of keys per data block.
+func (s BlockStats) KeysPerBlock() float64 {
+	if s.NumBlocks == 0 {
+		return 0
+	}
+	return float64(s.NumKeys) / float64(s.NumBlocks)
+}
+
+// RestartsPerBlock returns the average number of restart points per data
+// block.
+func (s BlockStats) RestartsPerBlock() float64 {
+	if s.NumBlocks == 0 {
+		return 0
+	}
+	return float64(s.NumRestarts) / float64(s.NumBlocks)
+}
+
+// BytesPerRestart returns the average number of entry bytes between
+// consecutive restart points.
+func (s BlockStats) BytesPerRestart() float64 {
+	if s.NumRestarts == 0 {
+		return 0
+	}
+	return float64(s.EntryBytes) / float64(s.NumRestarts)
+}
+
+// BlockStats returns statistics about the table's data blocks. It does not
+// iterate over every entry. For an uncompressed block, it reads only the
+// block's trailer, its restart array and the entries of its first and last
+// restart intervals, and does not verify the block's checksum. A compressed
+// block has to be read and decompressed in full, but only the same parts of
+// it are decoded.
+func (r *Reader) BlockStats() (BlockStats, error) {
+	if r.err != nil {
+		return BlockStats{}, r.err
+	}
+	i, err := r.newIndexIter(nil)
+	if err != nil {
+		return BlockStats{}, err
+	}
+	var (
+		s       BlockStats
+		trailer [blockTrailerLen]byte
+	)
+	for i.Next() {
+		v := i.Value()
+		h, n := decodeBlockHandle(v)
+		if n == 0 || n != len(v) {
+			i.Close()
+			return BlockStats{}, errCorruptIndexEntry
+		}
+		if err := checkBlockHandle(h, r.size, "data"); err != nil {
+			i.Close()
+			return BlockStats{}, err
+		}
+		if err := r.readAt(trailer[:], int64(h.offset+h.length)); err != nil {
+			i.Close()
+			return BlockStats{}, err
+		}
+		var read func(off, n int) ([]byte, error)
+		length := int(h.length)
+		if trailer[0] == noCompressionBlockType {
+			read = func(off, n int) ([]byte, error) {
+				b := make([]byte, n)
+				if err := r.readAt(b, int64(h.offset)+int64(off)); err != nil {
+					return nil, err
+				}
+				return b, nil
+			}
+		} else {
+			b, err := r.readDataBlock(h, r.verifyChecksums, nil)
+			if err != nil {
+				i.Close()
+				return BlockStats{}, err
+			}
+			length = len(b)
+			read = func(off, n int) ([]byte, error) {
+				return b[off : off+n], nil
+			}
+		}
+		if err := r.addBlockStats(&s, h, length, read); err != nil {
+			i.Close()
+			return BlockStats{}, err
+		}
+	}
+	if err := i.Close(); err != nil {
+		return BlockStats{}, err
+	}
+	return s, nil
+}
+
+// addBlockStats adds the statistics of the data block with handle h, whose
+// decompressed length is length, to s. The read function returns the n bytes
+// of the decompressed block starting at offset off.
+func (r *Reader) addBlockStats(s *BlockStats, h blockHandle, length int, read func(off, n int) ([]byte, error)) error {
+	if length < 4 {
+		return corruptionErrorf(int64(h.offset), "block is too short")
+	}
+	b, err := read(length-4, 4)
+	if err != nil {
+		return err
+	}
+	numRestarts := binary.LittleEndian.Uint32(b)
+	if uint64(numRestarts) > uint64(length-4)/4 {
+		return corruptionErrorf(int64(h.offset), "block has too many restart points (%d for %d bytes)", numRestarts, length)
+	}
+	n := length - 4*(1+int(numRestarts))
+	s.NumBlocks++
+	s.NumRestarts += int(numRestarts)
+	s.EntryBytes += uint64(n)
+	if numRestarts == 0 {
+		if n > 0 {
+			return corruptionErrorf(int64(h.offset), "block has no restart points")
+		}
+		return nil
+	}
+	b, err = read(n, 4*int(numRestarts))
+	if err != nil {
+		return err
+	}
+	restarts := make([]int, numRestarts, numRestarts+1)
+	for j := range restarts {
+		restarts[j] = int(binary.LittleEndian.Uint32(b[4*j:]))
+		if restarts[j] > n || (j > 0 && restarts[j] <= restarts[j-1]) {
+			return corruptionErrorf(int64(h.offset), "invalid block restart point %d", j)
+		}
+	}
+	restarts = append(restarts, n)
+
+	// Count the keys of the last restart interval, and of the first if there
+	// is more than one.
+	last := len(restarts) - 2
+	nLast, err := r.countEntries(h, restarts[last], restarts[last+1], read)
+	if err != nil {
+		return err
+	}
+	s.NumKeys += nLast
+	if last > 0 {
+		nFirst, err := r.countEntries(h, restarts[0], restarts[1], read)
+		if err != nil {
+			return err
+		}
+		s.NumKeys += nFirst * last
+	}
+	return nil
+}
+
+// countEntries returns the number of entries of the data block with handle h
+// that are between the offsets start and end of the decompressed block. It
+// decodes only the entries' lengths, and not their keys or values.
+func (r *Reader) countEntries(h blockHandle, start, end int, read func(off, n int) ([]byte, error)) (int, error) {
+	b, err := read(start, end-start)
+	if err != nil {
+		return 0, err
+	}
+	numLengths := 3
+	if r.dataFormat == valuePrefixBlockFormat {
+		numLengths = 4
+	}
+	count := 0
+	for len(b) > 0 {
+		// The unshared key bytes and the (unshared) value bytes follow the
+		// lengths. The other lengths count bytes that are not in the entry.
+		var skip uint64
+		for j := 0; j < numLengths; j++ {
+			v, m := binary.Uvarint(b)
+			if m <= 0 {
+				return 0, corruptionErrorf(int64(h.offset), "corrupt block entry")
+			}
+			b = b[m:]
+			if j == 1 || j == numLengths-1 {
+				// Each length is checked on its own, so that their sum
+				// cannot wrap around.
+				if v > uint64(len(b)) {
+					return 0, corruptionErrorf(int64(h.offset), "corrupt block entry")
+				}
+				skip += v
+			}
+		}
+		if skip > uint64(len(b)) {
+			return 0, corruptionErrorf(int64(h.offset), "corrupt block entry")
+		}
+		b = b[skip:]
+		count++
+	}
+	return count, nil
+}
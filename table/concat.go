@@ -0,0 +1,195 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/golang/leveldb/db"
+)
+
+// Concat returns a read-only DB that presents the given tables as one. The
+// tables must not overlap, and must be in increasing key order: every key of
+// readers[i] must be less than every key of readers[i+1]. Get is routed to
+// the single table whose range may contain the key, and Find iterates over
+// each table in turn, starting with the table that may contain the key.
+// This is cheaper than merging the tables, as only one table is consulted at
+// a time.
+//
+// The Comparer in o, which should be the same as the tables' Comparer, gives
+// the key order. Closing the returned DB will close all of the readers.
+func Concat(readers []*Reader, o *db.Options) db.DB {
+	c := &concatReader{
+		readers:  readers,
+		comparer: o.GetComparer(),
+	}
+	// Find the smallest key of each table. Empty tables may be skipped.
+	for _, r := range readers {
+		i := r.Find(nil, nil)
+		if !i.Next() {
+			if err := i.Close(); err != nil {
+				c.err = err
+				return c
+			}
+			continue
+		}
+		k := append([]byte(nil), i.Key()...)
+		if err := i.Close(); err != nil {
+			c.err = err
+			return c
+		}
+		if n := len(c.smallest); n > 0 && c.comparer.Compare(c.smallest[n-1], k) >= 0 {
+			c.err = fmt.Errorf("leveldb/table: cannot Concat tables out of order: %q, %q", c.smallest[n-1], k)
+			return c
+		}
+		c.nonEmpty = append(c.nonEmpty, r)
+		c.smallest = append(c.smallest, k)
+	}
+	return c
+}
+
+// concatReader is the DB returned by Concat.
+type concatReader struct {
+	// readers are all of the tables, including the empty ones.
+	readers []*Reader
+	// nonEmpty are the non-empty tables, and smallest holds the smallest key
+	// of each of them.
+	nonEmpty []*Reader
+	smallest [][]byte
+	comparer db.Comparer
+	err      error
+}
+
+// concatReader implements the db.DB interface.
+var _ db.DB = (*concatReader)(nil)
+
+// search returns the index in c.nonEmpty of the table that may contain the
+// key: the last table whose smallest key is <= the key, or 0 if there is no
+// such table.
+func (c *concatReader) search(key []byte) int {
+	j := sort.Search(len(c.smallest), func(j int) bool {
+		return c.comparer.Compare(c.smallest[j], key) > 0
+	})
+	if j > 0 {
+		j--
+	}
+	return j
+}
+
+// Get implements DB.Get, as documented in the leveldb/db package.
+func (c *concatReader) Get(key []byte, o *db.ReadOptions) (value []byte, err error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if len(c.nonEmpty) == 0 {
+		return nil, db.ErrNotFound
+	}
+	return c.nonEmpty[c.search(key)].Get(key, o)
+}
+
+// Set is provided to implement the DB interface, but returns an error, as the
+// concatenated tables are read-only.
+func (c *concatReader) Set(key, value []byte, o *db.WriteOptions) error {
+	return errors.New("leveldb/table: cannot Set into a read-only table")
+}
+
+// Delete is provided to implement the DB interface, but returns an error, as
+// the concatenated tables are read-only.
+func (c *concatReader) Delete(key []byte, o *db.WriteOptions) error {
+	return errors.New("leveldb/table: cannot Delete from a read-only table")
+}
+
+// Find implements DB.Find, as documented in the leveldb/db package.
+func (c *concatReader) Find(key []byte, o *db.ReadOptions) db.Iterator {
+	if c.err != nil {
+		return &concatIter{err: c.err}
+	}
+	if len(c.nonEmpty) == 0 {
+		return &concatIter{}
+	}
+	j := c.search(key)
+	return &concatIter{
+		iter:    c.nonEmpty[j].Find(key, o),
+		readers: c.nonEmpty[j+1:],
+		opts:    o,
+	}
+}
+
+// Close implements DB.Close, as documented in the leveldb/db package.
+func (c *concatReader) Close() error {
+	var err error
+	for _, r := range c.readers {
+		if err1 := r.Close(); err == nil {
+			err = err1
+		}
+	}
+	c.readers, c.nonEmpty, c.smallest = nil, nil, nil
+	if c.err != nil {
+		return c.err
+	}
+	// Make any future calls to Get, Find or Close return an error.
+	c.err = errors.New("leveldb/table: reader is closed")
+	return err
+}
+
+// concatIter iterates over a sequence of tables, opening an iterator over
+// each table only once the previous table has been exhausted.
+type concatIter struct {
+	// iter is the iterator over the current table.
+	iter db.Iterator
+	// readers are the tables after the current one.
+	readers []*Reader
+	opts    *db.ReadOptions
+	err     error
+}
+
+// concatIter implements the db.Iterator interface.
+var _ db.Iterator = (*concatIter)(nil)
+
+// Next implements Iterator.Next, as documented in the leveldb/db package.
+func (i *concatIter) Next() bool {
+	for i.iter != nil {
+		if i.iter.Next() {
+			return true
+		}
+		i.err = i.iter.Close()
+		i.iter = nil
+		if i.err != nil || len(i.readers) == 0 {
+			break
+		}
+		i.iter, i.readers = i.readers[0].Find(nil, i.opts), i.readers[1:]
+	}
+	return false
+}
+
+// Key implements Iterator.Key, as documented in the leveldb/db package.
+func (i *concatIter) Key() []byte {
+	if i.iter == nil {
+		return nil
+	}
+	return i.iter.Key()
+}
+
+// Value implements Iterator.Value, as documented in the leveldb/db package.
+func (i *concatIter) Value() []byte {
+	if i.iter == nil {
+		return nil
+	}
+	return i.iter.Value()
+}
+
+// Close implements Iterator.Close, as documented in the leveldb/db package.
+func (i *concatIter) Close() error {
+	if i.iter != nil {
+		if err := i.iter.Close(); i.err == nil {
+			i.err = err
+		}
+		i.iter = nil
+	}
+	i.readers = nil
+	return i.err
+}
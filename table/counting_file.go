@@ -0,0 +1,44 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"sync/atomic"
+
+	"github.com/golang/leveldb/db"
+)
+
+// CountingFile is a db.File that counts the ReadAt calls made on it, and the
+// number of bytes that they read. It can be passed to NewReader to measure
+// the read amplification of opening and reading a table, such as for
+// different block sizes and caching options. Its other methods are passed
+// through to the wrapped File.
+//
+// It is safe for concurrent use if the wrapped File is.
+type CountingFile struct {
+	// reads and bytes are accessed atomically, and are first in the struct so
+	// that they are 64-bit aligned.
+	reads, bytes int64
+	db.File
+}
+
+// NewCountingFile returns a CountingFile that wraps f.
+func NewCountingFile(f db.File) *CountingFile {
+	return &CountingFile{File: f}
+}
+
+// ReadAt implements io.ReaderAt, counting the call and the bytes read.
+func (f *CountingFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	atomic.AddInt64(&f.reads, 1)
+	atomic.AddInt64(&f.bytes, int64(n))
+	return n, err
+}
+
+// Counts returns the number of ReadAt calls so far, and the total number of
+// bytes that they read.
+func (f *CountingFile) Counts() (reads, bytes int64) {
+	return atomic.LoadInt64(&f.reads), atomic.LoadInt64(&f.bytes)
+}
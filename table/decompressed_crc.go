@@ -0,0 +1,57 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"encoding/binary"
+
+	"github.com/golang/leveldb/crc"
+)
+
+// appendDecompressedCRC appends to dst the encoded entry of the
+// decompressedCRCsPropertyName property for the data block at the given
+// offset whose decompressed contents have the given checksum: the offset as
+// a uvarint followed by the checksum as a 4-byte little-endian value.
+func appendDecompressedCRC(dst []byte, offset uint64, checksum uint32) []byte {
+	var tmp [binary.MaxVarintLen64 + 4]byte
+	n := binary.PutUvarint(tmp[:], offset)
+	binary.LittleEndian.PutUint32(tmp[n:], checksum)
+	return append(dst, tmp[:n+4]...)
+}
+
+// parseDecompressedCRCs decodes the value of the decompressedCRCsPropertyName
+// property, mapping data block offsets to the checksums of those blocks'
+// decompressed contents.
+func parseDecompressedCRCs(v []byte) (map[uint64]uint32, bool) {
+	m := map[uint64]uint32{}
+	for len(v) > 0 {
+		offset, n := binary.Uvarint(v)
+		if n <= 0 || len(v) < n+4 {
+			return nil, false
+		}
+		m[offset] = binary.LittleEndian.Uint32(v[n:])
+		v = v[n+4:]
+	}
+	return m, true
+}
+
+// checkDecompressed checks b, the decompressed contents of the data block with
+// handle bh, against the checksum recorded when the table was written, if r
+// verifies decompressed blocks and the table has such a checksum. An
+// uncompressed block is not checked again, as its block checksum already
+// covers its contents.
+func (r *Reader) checkDecompressed(bh blockHandle, blockType byte, b block) error {
+	if r.decompressedCRCs == nil || blockType == noCompressionBlockType {
+		return nil
+	}
+	want, ok := r.decompressedCRCs[bh.offset]
+	if !ok {
+		return nil
+	}
+	if got := crc.New(b).Value(); got != want {
+		return corruptionErrorf(int64(bh.offset), "decompressed block checksum mismatch")
+	}
+	return nil
+}
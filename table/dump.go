@@ -0,0 +1,98 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"fmt"
+	"io"
+)
+
+// DumpOptions holds the optional parameters for Reader.Dump.
+type DumpOptions struct {
+	// Hex is whether keys and values are written in hexadecimal. Otherwise,
+	// they are written as Go-syntax quoted strings, with non-printable bytes
+	// escaped.
+	//
+	// The default value is false.
+	Hex bool
+
+	// MaxValueLen, if positive, is the maximum number of bytes of each value
+	// that are written. Longer values are truncated, followed by their full
+	// length.
+	//
+	// The default value of zero means that values are never truncated.
+	MaxValueLen int
+}
+
+// Dump writes a human-readable description of the table to w, for debugging.
+// For each data block, in order, it writes the block's handle and index key,
+// followed by that block's key/value pairs, one per line.
+//
+// A nil *DumpOptions means to use the default values.
+func (r *Reader) Dump(w io.Writer, o *DumpOptions) error {
+	if r.err != nil {
+		return r.err
+	}
+	var opts DumpOptions
+	if o != nil {
+		opts = *o
+	}
+	i, err := r.newIndexIter(nil)
+	if err != nil {
+		return err
+	}
+	for n := 0; i.Next(); n++ {
+		v := i.Value()
+		h, m := decodeBlockHandle(v)
+		if m == 0 || m != len(v) {
+			i.Close()
+			return errCorruptIndexEntry
+		}
+		_, err := fmt.Fprintf(w, "block %d: offset %d, length %d, index key %s\n",
+			n, h.offset, h.length, opts.format(i.Key(), 0))
+		if err != nil {
+			i.Close()
+			return err
+		}
+		if err := r.dumpBlock(w, h, &opts); err != nil {
+			i.Close()
+			return err
+		}
+	}
+	return i.Close()
+}
+
+// dumpBlock writes the key/value pairs of the data block with handle h to w.
+func (r *Reader) dumpBlock(w io.Writer, h blockHandle, o *DumpOptions) error {
+	b, err := r.readDataBlock(h, r.verifyChecksums, nil)
+	if err != nil {
+		return err
+	}
+	i, err := r.seekDataBlock(b, nil)
+	if err != nil {
+		return err
+	}
+	for i.Next() {
+		if _, err := fmt.Fprintf(w, "  %s: %s\n", o.format(i.Key(), 0), o.format(i.Value(), o.MaxValueLen)); err != nil {
+			i.Close()
+			return err
+		}
+	}
+	return i.Close()
+}
+
+// format formats b as a key or value. If max is positive and b is longer than
+// max bytes, only the first max bytes are formatted.
+func (o *DumpOptions) format(b []byte, max int) string {
+	suffix := ""
+	if max > 0 && len(b) > max {
+		suffix = fmt.Sprintf("... (%d bytes)", len(b))
+		b = b[:max]
+	}
+	if o.Hex {
+		return fmt.Sprintf("%x", b) + suffix
+	}
+	return fmt.Sprintf("%q", b) + suffix
+}
@@ -0,0 +1,47 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"fmt"
+
+	"github.com/golang/leveldb/crc"
+)
+
+// fileChecksumChunkSize is the number of bytes that FileChecksum reads at a
+// time.
+const fileChecksumChunkSize = 64 * 1024
+
+// FileChecksum returns a checksum of the table file's entire contents, for
+// comparing copies of the file, such as to detect corruption in transit or at
+// rest. It uses the same checksum algorithm as the table's blocks, but over
+// the raw bytes of the file, so it depends only on those bytes, and not on
+// how the Reader was opened. It reads the whole file, in chunks, and does not
+// decode or verify any block.
+func (r *Reader) FileChecksum() (uint32, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	stat, err := r.file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("leveldb/table: invalid table (could not stat file): %v", err)
+	}
+	var (
+		c   crc.CRC
+		buf = make([]byte, fileChecksumChunkSize)
+	)
+	for off, size := int64(0), stat.Size(); off < size; {
+		b := buf
+		if n := size - off; n < int64(len(b)) {
+			b = b[:n]
+		}
+		if err := r.readAt(b, off); err != nil {
+			return 0, err
+		}
+		c = c.Update(b)
+		off += int64(len(b))
+	}
+	return c.Value(), nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"encoding/binary"
+)
+
+// footerHandlesLen is the length of the part of a footer that holds the
+// metaindex and index block handles, padded with zeroes, in either format.
+const footerHandlesLen = footerLen - len(magic)
+
+// footer is the decoded footer of a table file. A footer of format version 0,
+// the LevelDB format, is footerLen bytes: the block handles followed by
+// magic. A versioned footer, of format version 1 or later, is
+// versionedFooterLen bytes: the checksum type, the block handles, the format
+// version as a 4-byte little-endian value, and versionedMagic.
+type footer struct {
+	metaindexHandle blockHandle
+	indexHandle     blockHandle
+	// version is the format version, which is 0 for a footer that ends with
+	// magic.
+	version uint32
+	// checksumType is the type of the checksums of the table's blocks. A
+	// version 0 footer does not record it, as its checksums are always of
+	// crc32cChecksumType.
+	checksumType byte
+}
+
+// len returns the length of the encoded footer.
+func (f footer) len() int {
+	if f.version == 0 {
+		return footerLen
+	}
+	return versionedFooterLen
+}
+
+// encode encodes f into dst, which must be at least f.len() bytes long, and
+// returns the number of bytes written.
+func (f footer) encode(dst []byte) int {
+	dst = dst[:f.len()]
+	for i := range dst {
+		dst[i] = 0
+	}
+	handles := dst
+	if f.version != 0 {
+		dst[0] = f.checksumType
+		handles = dst[1:]
+		binary.LittleEndian.PutUint32(dst[versionedFooterLen-len(versionedMagic)-4:], f.version)
+		copy(dst[versionedFooterLen-len(versionedMagic):], versionedMagic)
+	} else {
+		copy(dst[footerLen-len(magic):], magic)
+	}
+	n := encodeBlockHandle(handles, f.metaindexHandle)
+	encodeBlockHandle(handles[n:], f.indexHandle)
+	return len(dst)
+}
+
+// parseFooter decodes the footer at the end of b, the final bytes of a table
+// file, which start at offset off of the file. b must hold at least the
+// footer, and need not hold any more; it may be as short as footerLen if the
+// footer is of version 0. Only the format versions and checksum types that
+// this package reads are accepted. The offsets of the returned errors are
+// file offsets.
+//
+// The block handles are only checked to be well-formed, within the footer;
+// the caller should check that the blocks lie within the file.
+func parseFooter(b []byte, off int64) (footer, error) {
+	if len(b) < footerLen {
+		return footer{}, corruptionErrorf(-1, "file size is too small")
+	}
+	var (
+		f       footer
+		handles []byte
+		start   int
+	)
+	switch string(b[len(b)-len(magic):]) {
+	case magic:
+		start = len(b) - footerLen
+		handles = b[start:]
+		f.checksumType = crc32cChecksumType
+	case versionedMagic:
+		if len(b) < versionedFooterLen {
+			return footer{}, corruptionErrorf(-1, "file size is too small")
+		}
+		start = len(b) - versionedFooterLen
+		versionOffset := start + versionedFooterLen - len(versionedMagic) - 4
+		f.version = binary.LittleEndian.Uint32(b[versionOffset:])
+		if f.version == 0 || f.version > maxFormatVersion {
+			return footer{}, corruptionErrorf(off+int64(versionOffset),
+				"unsupported table format version %d; this package supports versions 0 to %d", f.version, maxFormatVersion)
+		}
+		f.checksumType = b[start]
+		if f.checksumType != crc32cChecksumType {
+			return footer{}, corruptionErrorf(off+int64(start), "unsupported checksum type %d", f.checksumType)
+		}
+		handles = b[start+1:]
+	default:
+		return footer{}, corruptionErrorf(off+int64(len(b)-len(magic)), "bad magic number")
+	}
+	handles = handles[:footerHandlesLen]
+	var n, m int
+	f.metaindexHandle, n = decodeBlockHandle(handles)
+	if n == 0 {
+		return footer{}, corruptionErrorf(off+int64(start), "bad metaindex block handle")
+	}
+	f.indexHandle, m = decodeBlockHandle(handles[n:])
+	if m == 0 {
+		return footer{}, corruptionErrorf(off+int64(start), "bad index block handle")
+	}
+	return f, nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"encoding/binary"
+)
+
+// firstKeyPeekLen is the number of bytes that ForEachBlock first reads from
+// the start of an uncompressed block, which is usually enough to hold its
+// first entry's lengths and key.
+const firstKeyPeekLen = 64
+
+// ForEachBlock calls fn for each data block of the table, in order, with the
+// block's first key and its handle. Blocks with no keys are skipped. It stops
+// and returns fn's error if fn returns a non-nil error.
+//
+// Only the start of each block is decoded. For an uncompressed block, only
+// its restart count, trailer and first entry are read, and its checksum is
+// not verified; a compressed block is read in full. This is much cheaper
+// than a scan for building a sparse index of the table. The firstKey slice
+// is only valid until fn returns.
+func (r *Reader) ForEachBlock(fn func(firstKey []byte, h BlockHandle) error) error {
+	if r.err != nil {
+		return r.err
+	}
+	i, err := r.newIndexIter(nil)
+	if err != nil {
+		return err
+	}
+	var buf []byte
+	for i.Next() {
+		v := i.Value()
+		h, n := decodeBlockHandle(v)
+		if n == 0 || n != len(v) {
+			i.Close()
+			return errCorruptIndexEntry
+		}
+		var key []byte
+		key, buf, err = r.firstKey(h, buf)
+		if err != nil {
+			i.Close()
+			return err
+		}
+		if key == nil {
+			continue
+		}
+		if err := fn(key, BlockHandle{h.offset, h.length}); err != nil {
+			i.Close()
+			return err
+		}
+	}
+	return i.Close()
+}
+
+// firstKey returns the first key of the data block with handle h, or nil if
+// the block has no keys. The key may be stored in buf, which is returned for
+// reuse, possibly grown.
+func (r *Reader) firstKey(h blockHandle, buf []byte) (key, newBuf []byte, err error) {
+	// The handle is checked before its length is used for any reads, so that
+	// a corrupt length cannot wrap around or cause a huge allocation.
+	if err := checkBlockHandle(h, r.size, "data"); err != nil {
+		return nil, buf, err
+	}
+	if h.length < 4 {
+		return nil, buf, corruptionErrorf(int64(h.offset), "block is too short")
+	}
+	// Read the restart count and the trailer together.
+	var tail [4 + blockTrailerLen]byte
+	if err := r.readAt(tail[:], int64(h.offset+h.length-4)); err != nil {
+		return nil, buf, err
+	}
+	if tail[4] != noCompressionBlockType {
+		b, err := r.readDataBlock(h, r.verifyChecksums, nil)
+		if err != nil {
+			return nil, buf, err
+		}
+		i, err := r.seekDataBlock(b, nil)
+		if err != nil {
+			return nil, buf, err
+		}
+		if !i.Next() {
+			return nil, buf, i.Close()
+		}
+		return i.Key(), buf, nil
+	}
+
+	numRestarts := binary.LittleEndian.Uint32(tail[:4])
+	if uint64(numRestarts) > (h.length-4)/4 {
+		return nil, buf, corruptionErrorf(int64(h.offset), "block has too many restart points (%d for %d bytes)", numRestarts, h.length)
+	}
+	entriesLen := h.length - 4*(1+uint64(numRestarts))
+	if entriesLen == 0 {
+		return nil, buf, nil
+	}
+	peekLen := uint64(firstKeyPeekLen)
+	if peekLen > entriesLen {
+		peekLen = entriesLen
+	}
+	if uint64(cap(buf)) < peekLen {
+		buf = make([]byte, peekLen)
+	}
+	b := buf[:peekLen]
+	if err := r.readAt(b, int64(h.offset)); err != nil {
+		return nil, buf, err
+	}
+	// The first entry shares no bytes with a previous key, so its key is all
+	// unshared bytes, following the entry's lengths.
+	numLengths := 3
+	if r.dataFormat == valuePrefixBlockFormat {
+		numLengths = 4
+	}
+	var keyLen uint64
+	n := 0
+	for j := 0; j < numLengths; j++ {
+		v, m := binary.Uvarint(b[n:])
+		if m <= 0 || (j == 0 && v != 0) {
+			return nil, buf, corruptionErrorf(int64(h.offset), "corrupt block entry")
+		}
+		if j == 1 {
+			keyLen = v
+		}
+		n += m
+	}
+	if keyLen > entriesLen-uint64(n) {
+		return nil, buf, corruptionErrorf(int64(h.offset), "corrupt block entry")
+	}
+	end := uint64(n) + keyLen
+	if end > peekLen {
+		// The key is longer than was read, so read the rest of it.
+		if uint64(cap(buf)) < end {
+			buf = append(buf[:peekLen], make([]byte, end-peekLen)...)
+		}
+		b = buf[:end]
+		if err := r.readAt(b[peekLen:], int64(h.offset+peekLen)); err != nil {
+			return nil, buf, err
+		}
+	}
+	// b is in buf, which is not part of any cached block, and so its key may
+	// be modified.
+	key = b[n:end]
+	if r.globalSeqNum != 0 {
+		setGlobalSeqNum(key, r.globalSeqNum)
+	}
+	return key, buf, nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build gofuzz
+// +build gofuzz
+
+package table
+
+import (
+	"github.com/golang/leveldb/db"
+)
+
+// Fuzz is the entry point for go-fuzz (github.com/dvyukov/go-fuzz). It treats
+// data as a decompressed block, and seeks to the start of that block and to
+// the key of each of its entries in turn, iterating to the end of the block
+// after each seek. A malformed block must yield an error rather than a panic.
+func Fuzz(data []byte) int {
+	b := block(data)
+	i, err := b.seek(db.DefaultComparer, nil)
+	if err != nil {
+		return 0
+	}
+	var keys [][]byte
+	for i.Next() {
+		keys = append(keys, append([]byte(nil), i.Key()...))
+	}
+	if i.Close() != nil {
+		return 0
+	}
+	for _, k := range keys {
+		i, err := b.seek(db.DefaultComparer, k)
+		if err != nil {
+			return 0
+		}
+		for i.Next() {
+		}
+		if i.Close() != nil {
+			return 0
+		}
+	}
+	return 1
+}
@@ -0,0 +1,111 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/golang/leveldb/db"
+)
+
+// GzipFile is a read-only db.File that presents the decompressed contents of
+// a gzip-compressed file, such as an archived table. It can be passed to
+// NewReader to read such a table without first decompressing it to disk.
+//
+// A gzip stream cannot be read at random offsets, so the whole file is
+// decompressed into memory on the first call to Read, ReadAt or Stat, and
+// later reads are served from that memory. An error decompressing the file is
+// returned by that call and by every later one.
+//
+// ReadAt and Stat are safe for concurrent use if the wrapped File's ReadAt
+// and Stat are.
+type GzipFile struct {
+	db.File
+
+	once sync.Once
+	data *bytes.Reader
+	err  error
+}
+
+// NewGzipFile returns a GzipFile that decompresses f. Closing the GzipFile
+// closes f.
+func NewGzipFile(f db.File) *GzipFile {
+	return &GzipFile{File: f}
+}
+
+// load decompresses the wrapped file into f.data, if that has not been done.
+func (f *GzipFile) load() error {
+	f.once.Do(func() {
+		stat, err := f.File.Stat()
+		if err != nil {
+			f.err = err
+			return
+		}
+		z, err := gzip.NewReader(io.NewSectionReader(f.File, 0, stat.Size()))
+		if err != nil {
+			f.err = fmt.Errorf("leveldb/table: invalid gzip file: %v", err)
+			return
+		}
+		b, err := ioutil.ReadAll(z)
+		if err != nil {
+			f.err = fmt.Errorf("leveldb/table: invalid gzip file: %v", err)
+			return
+		}
+		f.data = bytes.NewReader(b)
+	})
+	return f.err
+}
+
+// Read implements io.Reader, reading the decompressed contents in order.
+func (f *GzipFile) Read(p []byte) (int, error) {
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	return f.data.Read(p)
+}
+
+// ReadAt implements io.ReaderAt, reading the decompressed contents.
+func (f *GzipFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	return f.data.ReadAt(p, off)
+}
+
+// Write returns an error, as a GzipFile is read-only.
+func (f *GzipFile) Write(p []byte) (int, error) {
+	return 0, errors.New("leveldb/table: cannot Write to a gzip file")
+}
+
+// Stat returns the wrapped file's information, except that the size is that
+// of the decompressed contents.
+func (f *GzipFile) Stat() (os.FileInfo, error) {
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	stat, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return gzipFileInfo{stat, f.data.Size()}, nil
+}
+
+// gzipFileInfo is the os.FileInfo of a GzipFile.
+type gzipFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+// Size returns the length of the decompressed contents.
+func (fi gzipFileInfo) Size() int64 {
+	return fi.size
+}
@@ -0,0 +1,106 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"fmt"
+	"sync"
+)
+
+// KeyCheckError is a key that failed the CheckKey option's check.
+type KeyCheckError struct {
+	// Key is a copy of the key.
+	Key []byte
+	// Offset is the file offset of the key's data block.
+	Offset uint64
+	// Err is the error returned by the check.
+	Err error
+}
+
+func (e KeyCheckError) Error() string {
+	return fmt.Sprintf("leveldb/table: key %q in data block at offset %d failed check: %v", e.Key, e.Offset, e.Err)
+}
+
+// keyChecks holds the keys that failed the CheckKey option's check, if the
+// CheckKeyContinue option is set. It is safe for concurrent use.
+type keyChecks struct {
+	mu   sync.Mutex
+	errs []KeyCheckError
+	// seen holds the block offsets and keys of errs, so that a key that is
+	// visited again is not recorded again. The number of recorded failures
+	// is therefore at most the number of keys in the table.
+	seen map[keyCheckID]bool
+}
+
+// keyCheckID identifies a key of a data block.
+type keyCheckID struct {
+	offset uint64
+	key    string
+}
+
+// KeyCheckErrors returns the keys that have failed the CheckKey option's
+// check since the previous call, in the order that iterators first visited
+// them, if the CheckKeyContinue option is set, and clears them. Each key is
+// returned once, however many times it was visited. The failures are shared
+// with the Reader's clones.
+func (r *Reader) KeyCheckErrors() []KeyCheckError {
+	if r.keyChecks == nil {
+		return nil
+	}
+	r.keyChecks.mu.Lock()
+	defer r.keyChecks.mu.Unlock()
+	errs := r.keyChecks.errs
+	r.keyChecks.errs, r.keyChecks.seen = nil, nil
+	return errs
+}
+
+// checkKey checks the current key of i with the CheckKey option. It returns
+// false if iteration should stop, having set i.err.
+func (i *Iterator) checkKey() bool {
+	if err := i.reader.checkBlockKey(i.data.key, i.cur.bh.offset); err != nil {
+		i.err = err
+		return false
+	}
+	return true
+}
+
+// checkBlockKey checks the given key, of the data block at the given offset,
+// with the CheckKey option, if it is set. It returns the KeyCheckError for a
+// key that fails the check, unless the CheckKeyContinue option is set, in
+// which case the failure is recorded, if it is not already, and checkBlockKey
+// returns nil.
+func (r *Reader) checkBlockKey(key []byte, offset uint64) error {
+	if r.checkKey == nil {
+		return nil
+	}
+	err := r.checkKey(key)
+	if err == nil {
+		return nil
+	}
+	if r.keyChecks == nil {
+		return KeyCheckError{
+			Key:    append([]byte(nil), key...),
+			Offset: offset,
+			Err:    err,
+		}
+	}
+	c := r.keyChecks
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := keyCheckID{offset, string(key)}
+	if c.seen[id] {
+		return nil
+	}
+	if c.seen == nil {
+		c.seen = make(map[keyCheckID]bool)
+	}
+	c.seen[id] = true
+	c.errs = append(c.errs, KeyCheckError{
+		Key:    []byte(id.key),
+		Offset: offset,
+		Err:    err,
+	})
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"time"
+)
+
+// MemFile is a read-only db.File whose contents are a byte slice, for reading
+// a table that is held entirely in memory, such as in tests and benchmarks.
+// Closing a MemFile does nothing.
+//
+// A MemFile is also an MmapFile, whose mapping is the byte slice, so that a
+// Reader for it never copies uncompressed blocks. The slice must therefore not
+// be modified while the Reader, or any key or value that it has returned, is
+// in use.
+//
+// ReadAt, MmapAt and Stat are safe for concurrent use.
+type MemFile struct {
+	data []byte
+	r    *bytes.Reader
+}
+
+// MemFile implements the MmapFile interface.
+var _ MmapFile = (*MemFile)(nil)
+
+// NewMemFile returns a MemFile whose contents are data.
+func NewMemFile(data []byte) *MemFile {
+	return &MemFile{data: data, r: bytes.NewReader(data)}
+}
+
+// Read implements io.Reader, reading the contents in order.
+func (f *MemFile) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *MemFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.r.ReadAt(p, off)
+}
+
+// MmapAt implements MmapFile.MmapAt.
+func (f *MemFile) MmapAt(off int64, n int) []byte {
+	if off < 0 || n < 0 || off > int64(len(f.data)) || int64(n) > int64(len(f.data))-off {
+		return nil
+	}
+	return f.data[off : off+int64(n)]
+}
+
+// Write returns an error, as a MemFile is read-only.
+func (f *MemFile) Write(p []byte) (int, error) {
+	return 0, errors.New("leveldb/table: cannot Write to a memory file")
+}
+
+// Stat returns the file's information, whose size is the length of its
+// contents.
+func (f *MemFile) Stat() (os.FileInfo, error) {
+	return memFileInfo(len(f.data)), nil
+}
+
+// Sync does nothing, as a MemFile is read-only.
+func (f *MemFile) Sync() error {
+	return nil
+}
+
+// Close does nothing.
+func (f *MemFile) Close() error {
+	return nil
+}
+
+// memFileInfo is the os.FileInfo of a MemFile, or of a file of a
+// NewReaderWithSize Reader, whose size it is.
+type memFileInfo int64
+
+func (fi memFileInfo) Name() string       { return "" }
+func (fi memFileInfo) Size() int64        { return int64(fi) }
+func (fi memFileInfo) Mode() os.FileMode  { return 0444 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,216 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"fmt"
+
+	"github.com/golang/leveldb/db"
+)
+
+// These constants mirror the internal key format of package leveldb: a user
+// key followed by an 8-byte trailer of a 1-byte kind and a 7-byte
+// little-endian sequence number.
+const (
+	internalKeyKindDelete = 0
+	internalKeyKindSet    = 1
+	internalKeyKindMax    = 1
+
+	internalKeySeqNumMax = uint64(1<<56 - 1)
+)
+
+// parseInternalKey splits an internal key into its user key, kind and
+// sequence number. It returns ok == false if k is not a valid internal key.
+func parseInternalKey(k []byte) (ukey []byte, kind uint8, seqNum uint64, ok bool) {
+	n := len(k) - 8
+	if n < 0 || k[n] > internalKeyKindMax {
+		return nil, 0, 0, false
+	}
+	for j := 7; j > 0; j-- {
+		seqNum = seqNum<<8 | uint64(k[n+j])
+	}
+	return k[:n], k[n], seqNum, true
+}
+
+// setGlobalSeqNum sets the sequence number of k to seqNum, if k is an internal
+// key whose sequence number is zero, as for the keys of a table with a global
+// sequence number. k is modified in place.
+func setGlobalSeqNum(k []byte, seqNum uint64) {
+	if _, _, s, ok := parseInternalKey(k); !ok || s != 0 {
+		return
+	}
+	n := len(k) - 7
+	for j := 0; j < 7; j++ {
+		k[n+j] = byte(seqNum >> (8 * uint(j)))
+	}
+}
+
+// MergeOptions holds the optional parameters for MergeSortedInto.
+type MergeOptions struct {
+	// UserComparer defines the ordering of the user keys within the tables'
+	// internal keys. It is used to recognize entries for the same user key.
+	//
+	// The default value uses the same ordering as bytes.Compare.
+	UserComparer db.Comparer
+
+	// Snapshot is the sequence number of the oldest snapshot that must still
+	// be readable from the merged output. For each user key, only the newest
+	// entry whose sequence number is <= Snapshot is kept, along with every
+	// entry newer than Snapshot.
+	//
+	// The default value of zero means that there are no snapshots other than
+	// the latest state.
+	Snapshot uint64
+
+	// DropDeletions is whether deletion tombstones whose sequence numbers are
+	// <= Snapshot, including range tombstones, can be dropped entirely. This
+	// is only correct if no other table, such as one at a deeper level, holds
+	// older entries for the same user keys.
+	//
+	// The default value is false.
+	DropDeletions bool
+
+	// Progress, if non-nil, is called after each input key/value pair has been
+	// processed, with the statistics so far.
+	Progress func(MergeStats)
+}
+
+// MergeStats summarizes the progress of a MergeSortedInto call.
+type MergeStats struct {
+	// Read is the number of key/value pairs read from the inputs.
+	Read int
+	// Written is the number of key/value pairs written to the output.
+	Written int
+	// Dropped is the number of key/value pairs that were shadowed by newer
+	// entries, were deleted by range tombstones, or were obsolete tombstones,
+	// and so were not written.
+	Dropped int
+}
+
+// MergeSortedInto merges the key/value pairs of the given Readers and writes
+// them, in order, to w. It is essentially a compaction of overlapping tables
+// into one: the tables' keys must be internal keys, as used by package
+// leveldb, and all of the Readers and w must use the same internal key
+// Comparer. Entries that no snapshot can see, as described by o, are dropped.
+//
+// The inputs' range tombstones are written to w, except for those that
+// o.DropDeletions allows to be dropped. An entry that a range tombstone
+// deletes for every snapshot is dropped. The stats do not count range
+// tombstones.
+//
+// MergeSortedInto does not close the Readers or w; the caller should Close w
+// to finish the output table.
+func MergeSortedInto(w *Writer, rs []*Reader, o *MergeOptions) (MergeStats, error) {
+	var stats MergeStats
+	if len(rs) == 0 {
+		return stats, nil
+	}
+	icmp := rs[0].comparer
+	for _, r := range rs[1:] {
+		if r.comparer.Name() != icmp.Name() {
+			return stats, fmt.Errorf("leveldb/table: cannot merge tables with different comparers %q and %q",
+				icmp.Name(), r.comparer.Name())
+		}
+	}
+	if w.cmp.Name() != icmp.Name() {
+		return stats, fmt.Errorf("leveldb/table: cannot merge tables with comparer %q into a table with comparer %q",
+			icmp.Name(), w.cmp.Name())
+	}
+
+	var (
+		userCmp  db.Comparer = db.DefaultComparer
+		snapshot             = internalKeySeqNumMax
+		dropDels bool
+		progress func(MergeStats)
+	)
+	if o != nil {
+		if o.UserComparer != nil {
+			userCmp = o.UserComparer
+		}
+		if o.Snapshot != 0 {
+			snapshot = o.Snapshot
+		}
+		dropDels = o.DropDeletions
+		progress = o.Progress
+	}
+
+	// tombs are the range tombstones that every snapshot sees, and so that
+	// delete the entries they cover for every snapshot.
+	var tombs []RangeTombstone
+	for _, r := range rs {
+		for _, t := range r.rangeDels {
+			if t.SeqNum <= snapshot {
+				tombs = append(tombs, t)
+				if dropDels {
+					continue
+				}
+			}
+			if err := w.DeleteRange(t.Start, t.End, t.SeqNum); err != nil {
+				return stats, err
+			}
+		}
+	}
+
+	iters := make([]db.Iterator, len(rs))
+	for i, r := range rs {
+		iters[i] = r.Find(nil, nil)
+	}
+	iter := db.NewMergingIterator(icmp, iters...)
+
+	currentUkey := make([]byte, 0, 256)
+	hasCurrentUkey := false
+	// shadowed is whether an entry for the current user key has been seen that
+	// is visible to every snapshot. Older entries for that key are obsolete.
+	shadowed := false
+	for iter.Next() {
+		stats.Read++
+		ikey := iter.Key()
+		ukey, kind, seqNum, ok := parseInternalKey(ikey)
+		drop := false
+		if !ok {
+			// Do not hide invalid keys.
+			hasCurrentUkey = false
+			shadowed = false
+		} else {
+			if !hasCurrentUkey || userCmp.Compare(currentUkey, ukey) != 0 {
+				// This is the first occurrence of this user key.
+				currentUkey = append(currentUkey[:0], ukey...)
+				hasCurrentUkey = true
+				shadowed = false
+			}
+			if shadowed {
+				drop = true
+			} else if kind == internalKeyKindDelete && seqNum <= snapshot && dropDels {
+				drop = true
+			} else {
+				for j := range tombs {
+					if tombs[j].covers(userCmp, ukey, seqNum) {
+						drop = true
+						break
+					}
+				}
+			}
+			if seqNum <= snapshot {
+				shadowed = true
+			}
+		}
+		if drop {
+			stats.Dropped++
+		} else {
+			if err := w.Set(ikey, iter.Value(), nil); err != nil {
+				iter.Close()
+				return stats, err
+			}
+			stats.Written++
+		}
+		if progress != nil {
+			progress(stats)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
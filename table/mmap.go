@@ -0,0 +1,44 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"github.com/golang/leveldb/db"
+)
+
+// MmapFile is a db.File whose contents are mapped into memory. If the file
+// passed to NewReader implements MmapFile, the Reader reads blocks by slicing
+// the mapping instead of copying them: uncompressed blocks, which are most
+// data blocks when not using compression, are then never copied, and keys and
+// values alias the mapping.
+//
+// The mapping must remain valid, and must not be modified, for as long as the
+// Reader, its iterators or any key or value that they have returned is in
+// use. In particular, a value returned by Get is typically only valid until
+// the file is closed, which is when the Reader is closed. The ReadaheadBlocks
+// option has no effect for such files, as the data is already in memory.
+type MmapFile interface {
+	db.File
+
+	// MmapAt returns the n bytes of the mapping starting at file offset off.
+	// It returns nil if those bytes are not all mapped, such as if the file
+	// has grown since it was mapped, in which case the Reader reads them with
+	// ReadAt instead.
+	MmapAt(off int64, n int) []byte
+}
+
+// mmapAt returns the length bytes of r's file at the given offset, aliasing
+// the file's mapping, or nil if r's file is not an MmapFile or the bytes are
+// not mapped.
+func (r *Reader) mmapAt(offset, length uint64) []byte {
+	if r.mmap == nil || offset > uint64(maxInt) || length > uint64(maxInt) {
+		return nil
+	}
+	b := r.mmap.MmapAt(int64(offset), int(length))
+	if uint64(len(b)) != length {
+		return nil
+	}
+	return b
+}
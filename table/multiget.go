@@ -0,0 +1,306 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"sync"
+
+	"github.com/golang/leveldb/db"
+)
+
+// MultiGet looks up each of the given keys, which may be in any order. The
+// results are the same as calling Get for each key: values[j] and errs[j] are
+// the value and error for keys[j], and errs[j] is db.ErrNotFound if the table
+// does not contain that key.
+//
+// MultiGet groups the keys by the data block that may contain them, as found
+// from the index, and reads each of those blocks only once, however many keys
+// it may contain. Distinct blocks are read concurrently, by at most
+// multiGetParallelism (16) goroutines, including the caller's, at a time. As
+// for Get, the index is skipped for a table with a single data block.
+func (r *Reader) MultiGet(keys [][]byte, o *db.ReadOptions) (values [][]byte, errs []error) {
+	values, errs = make([][]byte, len(keys)), make([]error, len(keys))
+	if r.err != nil {
+		for j := range errs {
+			errs[j] = r.err
+		}
+		return values, errs
+	}
+
+	// Group the keys by data block, in the order that each block is first
+	// needed.
+	var (
+		groups   []*multiGetGroup
+		byOffset = map[uint64]*multiGetGroup{}
+		index    indexIter
+		s        = r.singleBlock
+	)
+	for j, key := range keys {
+		var (
+			h   blockHandle
+			sep []byte
+		)
+		if s != nil {
+			if r.comparer.Compare(key, s.sep) > 0 {
+				errs[j] = db.ErrNotFound
+				continue
+			}
+			h, sep = s.bh, s.sep
+		} else {
+			if err := index.seek(r, key, nil); err != nil {
+				errs[j] = err
+				continue
+			}
+			if !index.Next() {
+				// The key is beyond the last data block, unless there was an
+				// error reading the index.
+				errs[j] = index.err
+				if errs[j] == nil {
+					errs[j] = db.ErrNotFound
+				}
+				continue
+			}
+			v := index.Value()
+			var n int
+			h, n = decodeBlockHandle(v)
+			if n == 0 || n != len(v) {
+				errs[j] = errCorruptIndexEntry
+				continue
+			}
+			sep = index.Key()
+		}
+		if r.filter.valid() && !r.filter.mayContain(h.offset, key) {
+			errs[j] = db.ErrNotFound
+			continue
+		}
+		g := byOffset[h.offset]
+		if g == nil {
+			g = &multiGetGroup{h: h}
+			if r.paranoidChecks {
+				g.sep = append([]byte(nil), sep...)
+			}
+			byOffset[h.offset] = g
+			groups = append(groups, g)
+		}
+		g.keys = append(g.keys, j)
+	}
+	index.Close()
+
+	if len(groups) == 0 {
+		return values, errs
+	}
+	verify := o.GetVerifyChecksums(r.verifyChecksums)
+	// Read the blocks on this goroutine and on up to multiGetParallelism-1
+	// others, each of which takes the next block from work until there are
+	// none left.
+	work := make(chan *multiGetGroup, len(groups))
+	for _, g := range groups {
+		work <- g
+	}
+	close(work)
+	read := func() {
+		for g := range work {
+			r.multiGetBlock(g, verify, keys, values, errs)
+		}
+	}
+	n := len(groups)
+	if n > multiGetParallelism {
+		n = multiGetParallelism
+	}
+	var wg sync.WaitGroup
+	for j := 1; j < n; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			read()
+		}()
+	}
+	read()
+	wg.Wait()
+	return values, errs
+}
+
+// multiGetParallelism is the maximum number of data blocks that a MultiGet
+// call reads at a time, so that a batch of keys spread over many blocks does
+// not start as many goroutines and concurrent reads.
+const multiGetParallelism = 16
+
+// multiGetGroup is the keys of a MultiGet call that may be in one data block.
+type multiGetGroup struct {
+	// h is the data block's handle.
+	h blockHandle
+	// sep is the block's index separator, for the ParanoidChecks option.
+	sep []byte
+	// keys are the indexes of the keys in the MultiGet call.
+	keys []int
+}
+
+// multiGetBlock reads the data block for g, verifying its checksum if verify
+// is true, and sets the values and errors of g's keys. Distinct groups have
+// distinct keys, so that concurrent calls write to distinct elements of
+// values and errs.
+func (r *Reader) multiGetBlock(g *multiGetGroup, verify bool, keys, values [][]byte, errs []error) {
+	b, err := r.readDataBlock(g.h, verify, nil)
+	if err == nil && r.paranoidChecks {
+		err = r.checkBlockBounds(b, g.h, nil, g.sep)
+	}
+	if err != nil {
+		for _, j := range g.keys {
+			errs[j] = err
+		}
+		return
+	}
+	for _, j := range g.keys {
+		i, err := r.seekDataBlock(b, keys[j])
+		if err != nil {
+			errs[j] = err
+			continue
+		}
+		// The block's index separator is >= the key, so the key is absent
+		// from the table if it is absent from this block.
+		if !i.Next() {
+			if errs[j] = i.Close(); errs[j] == nil {
+				errs[j] = db.ErrNotFound
+			}
+			continue
+		}
+		// As for Get, the key found is checked, whether or not it is the key
+		// sought.
+		if err := r.checkBlockKey(i.key, g.h.offset); err != nil {
+			errs[j] = err
+			continue
+		}
+		if r.comparer.Compare(keys[j], i.Key()) != 0 {
+			errs[j] = db.ErrNotFound
+			continue
+		}
+		values[j] = i.Value()
+	}
+}
+
+// GetMulti looks up each of the given keys, which should be in increasing
+// order. As for MultiGet, values[j] and errs[j] are the value and error for
+// sortedKeys[j], and errs[j] is db.ErrNotFound if the table does not contain
+// that key.
+//
+// GetMulti walks a single index iterator and a single data block iterator
+// forward across the keys, rather than seeking from the index for each key,
+// so that consecutive keys in the same data block are found by stepping
+// forward from the previous key, and that block is read only once. This
+// suits batches of nearby keys. A key that is less than its predecessor is
+// still looked up correctly, but with a fresh seek.
+func (r *Reader) GetMulti(sortedKeys [][]byte, o *db.ReadOptions) (values [][]byte, errs []error) {
+	values, errs = make([][]byte, len(sortedKeys)), make([]error, len(sortedKeys))
+	if r.err != nil {
+		for j := range errs {
+			errs[j] = r.err
+		}
+		return values, errs
+	}
+
+	var (
+		verify = o.GetVerifyChecksums(r.verifyChecksums)
+		cmp    = r.comparer
+		// index is the index iterator. seeked is whether it has been
+		// positioned, and indexOK is whether it is at an entry.
+		index           indexIter
+		seeked, indexOK bool
+		prev            []byte
+		// cur is the handle of the data block b, if loaded is true, and bErr
+		// is the error reading or iterating over that block.
+		cur    blockHandle
+		b      block
+		bErr   error
+		loaded bool
+		// data, if non-nil, is the iterator over b, and dataOK is whether it
+		// is at an entry.
+		data   *blockIter
+		dataOK bool
+	)
+	for j, key := range sortedKeys {
+		if !seeked || cmp.Compare(key, prev) < 0 {
+			if err := index.seek(r, key, nil); err != nil {
+				errs[j], seeked = err, false
+				continue
+			}
+			seeked, indexOK = true, index.Next()
+			// The data block iterator may be beyond the key.
+			data = nil
+		} else {
+			for indexOK && cmp.Compare(index.Key(), key) < 0 {
+				indexOK = index.Next()
+			}
+		}
+		prev = key
+		if !indexOK {
+			// The key is beyond the last data block, unless there was an
+			// error reading the index.
+			errs[j] = index.err
+			if errs[j] == nil {
+				errs[j] = db.ErrNotFound
+			}
+			continue
+		}
+		v := index.Value()
+		h, n := decodeBlockHandle(v)
+		if n == 0 || n != len(v) {
+			errs[j] = errCorruptIndexEntry
+			continue
+		}
+		if r.filter.valid() && !r.filter.mayContain(h.offset, key) {
+			errs[j] = db.ErrNotFound
+			continue
+		}
+		if !loaded || h.offset != cur.offset {
+			cur, loaded = h, true
+			b, bErr = r.readDataBlock(h, verify, nil)
+			data = nil
+		}
+		if bErr != nil {
+			errs[j] = bErr
+			continue
+		}
+		if data == nil {
+			d, err := r.seekDataBlock(b, key)
+			if err != nil {
+				errs[j] = err
+				continue
+			}
+			data, dataOK = d, d.Next()
+		} else {
+			for dataOK && cmp.Compare(data.Key(), key) < 0 {
+				dataOK = data.Next()
+			}
+		}
+		if !dataOK {
+			// The block's index separator is >= the key, so the key is
+			// absent from the table if it is absent from this block.
+			if bErr = data.err; bErr != nil {
+				errs[j] = bErr
+			} else {
+				errs[j] = db.ErrNotFound
+			}
+			continue
+		}
+		// As for Get, the key found is checked, but not those stepped over.
+		if err := r.checkBlockKey(data.key, cur.offset); err != nil {
+			errs[j] = err
+			continue
+		}
+		if cmp.Compare(key, data.Key()) != 0 {
+			errs[j] = db.ErrNotFound
+			continue
+		}
+		val := data.Value()
+		if data.format == valuePrefixBlockFormat {
+			// The value is in data's buffer, which the next key's entry
+			// overwrites, instead of in b.
+			val = append([]byte(nil), val...)
+		}
+		values[j] = val
+	}
+	index.Close()
+	return values, errs
+}
@@ -0,0 +1,96 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/golang/leveldb/db"
+)
+
+// positionTokenVersion is the first byte of every position token. A position
+// token is that version byte, followed by the table's fingerprint as a 4-byte
+// little-endian value, the encoded block handle of the data block holding the
+// saved key, and finally the saved key itself.
+const positionTokenVersion = 1
+
+// errInvalidPosition is the error returned when resuming from a position
+// token that is malformed, or was not saved from an iterator over the same
+// table.
+var errInvalidPosition = errors.New("leveldb/table: invalid position token, or a token for a different table")
+
+// fingerprint identifies the table, for checking that a position token was
+// saved from an iterator over the same table. Tables with the same index have
+// the same data blocks in the same places. The index must have been loaded.
+func (r *Reader) fingerprint() uint32 {
+	if l := r.lazyIndex; l != nil {
+		return l.fingerprint
+	}
+	return r.indexFingerprint
+}
+
+// SavePosition returns an opaque token for the iterator's current position,
+// which is the key/value pair most recently returned by Next. Passing the
+// token to the Reader's ResumeIterator method returns a new iterator that
+// continues from the pair after that one, even after this iterator has been
+// closed. SavePosition returns nil if the iterator is not positioned at a
+// pair, such as before the first call to Next or after Next returns false.
+func (i *Iterator) SavePosition() []byte {
+	if i.data == nil || i.data.soi || i.data.eoi {
+		return nil
+	}
+	key := i.data.Key()
+	token := make([]byte, 5+2*binary.MaxVarintLen64, 5+2*binary.MaxVarintLen64+len(key))
+	token[0] = positionTokenVersion
+	binary.LittleEndian.PutUint32(token[1:], i.reader.fingerprint())
+	n := encodeBlockHandle(token[5:], i.cur.bh)
+	return append(token[:5+n], key...)
+}
+
+// ResumeIterator returns an iterator that continues from the position saved
+// by an Iterator's SavePosition method: its first call to Next returns the
+// key/value pair after the one at which the position was saved. It is an
+// error if the token was not saved from an iterator over this table, and
+// that error is returned by the iterator's Close method.
+func (r *Reader) ResumeIterator(token []byte, o *db.ReadOptions) db.Iterator {
+	if r.err != nil {
+		return &Iterator{err: r.err}
+	}
+	if _, err := r.loadIndex(); err != nil {
+		return &Iterator{err: err}
+	}
+	if len(token) < 5 || token[0] != positionTokenVersion ||
+		binary.LittleEndian.Uint32(token[1:]) != r.fingerprint() {
+		return &Iterator{err: errInvalidPosition}
+	}
+	bh, n := decodeBlockHandle(token[5:])
+	if n == 0 {
+		return &Iterator{err: errInvalidPosition}
+	}
+	key := token[5+n:]
+	i := r.find(key, o, nil, nil)
+	if i.err != nil {
+		return i
+	}
+	// The saved key should be the first key that the iterator returns, and be
+	// in the saved block. Consume it, so that iteration resumes after it.
+	if i.data == nil || i.cur.bh != bh {
+		i.Close()
+		return &Iterator{err: errInvalidPosition}
+	}
+	if !i.Next() {
+		if err := i.Close(); err != nil {
+			return &Iterator{err: err}
+		}
+		return &Iterator{err: errInvalidPosition}
+	}
+	if !bytes.Equal(i.Key(), key) {
+		i.Close()
+		return &Iterator{err: errInvalidPosition}
+	}
+	return i
+}
@@ -0,0 +1,145 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"bytes"
+
+	"github.com/golang/leveldb/db"
+)
+
+// NewPrefixIterator returns an iterator over the key/value pairs whose keys
+// start with the given prefix, in order. It assumes that the table's Comparer
+// orders all of the keys with a given prefix contiguously, after the prefix
+// itself, as db.DefaultComparer does.
+//
+// If the table was written with a PrefixExtractor of the same name as the
+// PrefixExtractor option, its filter holds the prefixes of its keys, and the
+// iterator skips, without reading them, the data blocks whose filters show
+// that they have no keys with the prefix. For that, the prefix should be one
+// returned by the PrefixExtractor. Otherwise, the iterator reads every data
+// block that may hold keys with the prefix.
+func (r *Reader) NewPrefixIterator(prefix []byte, o *db.ReadOptions) db.Iterator {
+	if r.err != nil {
+		return &prefixIter{err: r.err}
+	}
+	index, err := r.newIndexIter(prefix)
+	if err != nil {
+		return &prefixIter{err: err}
+	}
+	return &prefixIter{
+		reader:    r,
+		prefix:    prefix,
+		verify:    o.GetVerifyChecksums(r.verifyChecksums),
+		useFilter: r.prefixFiltered && r.filter.valid(),
+		index:     index,
+	}
+}
+
+// prefixIter is the iterator returned by NewPrefixIterator.
+type prefixIter struct {
+	reader    *Reader
+	prefix    []byte
+	verify    bool
+	useFilter bool
+	index     *indexIter
+	// data is the iterator over the current data block, or nil if there is
+	// no current block.
+	data *blockIter
+	// last is whether the current block's separator does not start with the
+	// prefix, so that no later block has keys with the prefix.
+	last bool
+	err  error
+}
+
+// prefixIter implements the db.Iterator interface.
+var _ db.Iterator = (*prefixIter)(nil)
+
+// Next implements Iterator.Next, as documented in the leveldb/db package.
+func (i *prefixIter) Next() bool {
+	if i.index == nil {
+		return false
+	}
+	for {
+		if i.data != nil {
+			if i.data.Next() {
+				if bytes.HasPrefix(i.data.Key(), i.prefix) {
+					return true
+				}
+				// The key is after every key with the prefix.
+				break
+			}
+			if i.err = i.data.Close(); i.err != nil {
+				break
+			}
+		}
+		if !i.nextBlock() {
+			break
+		}
+	}
+	i.Close()
+	return false
+}
+
+// nextBlock positions i.data at the first key >= the prefix in the next data
+// block that may have keys with the prefix. It returns false if there is no
+// such block, or on error.
+func (i *prefixIter) nextBlock() bool {
+	r := i.reader
+	for !i.last {
+		if !i.index.Next() {
+			i.err = i.index.err
+			return false
+		}
+		// The index is sought to the prefix, so every separator is >= the
+		// prefix.
+		i.last = !bytes.HasPrefix(i.index.Key(), i.prefix)
+		v := i.index.Value()
+		h, n := decodeBlockHandle(v)
+		if n == 0 || n != len(v) {
+			i.err = errCorruptIndexEntry
+			return false
+		}
+		if i.useFilter && !r.filter.mayContain(h.offset, i.prefix) {
+			continue
+		}
+		b, err := r.readDataBlock(h, i.verify, nil)
+		if err != nil {
+			i.err = err
+			return false
+		}
+		if i.data, i.err = r.seekDataBlock(b, i.prefix); i.err != nil {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// Key implements Iterator.Key, as documented in the leveldb/db package.
+func (i *prefixIter) Key() []byte {
+	if i.data == nil {
+		return nil
+	}
+	return i.data.Key()
+}
+
+// Value implements Iterator.Value, as documented in the leveldb/db package.
+func (i *prefixIter) Value() []byte {
+	if i.data == nil {
+		return nil
+	}
+	return i.data.Value()
+}
+
+// Close implements Iterator.Close, as documented in the leveldb/db package.
+func (i *prefixIter) Close() error {
+	if i.index != nil {
+		i.index.Close()
+		i.index = nil
+	}
+	i.data = nil
+	return i.err
+}
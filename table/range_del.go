@@ -0,0 +1,229 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/golang/leveldb/db"
+)
+
+// RangeTombstone deletes the user keys from Start, inclusive, to End,
+// exclusive, whose sequence numbers are less than SeqNum.
+type RangeTombstone struct {
+	Start, End []byte
+	SeqNum     uint64
+}
+
+// covers returns whether t deletes the entry with the given user key and
+// sequence number.
+func (t *RangeTombstone) covers(ucmp db.Comparer, ukey []byte, seqNum uint64) bool {
+	return seqNum < t.SeqNum && ucmp.Compare(t.Start, ukey) <= 0 && ucmp.Compare(ukey, t.End) < 0
+}
+
+// appendRangeDelKey appends to dst the range deletion block key of a
+// tombstone with the given start key and sequence number.
+func appendRangeDelKey(dst, start []byte, seqNum uint64) []byte {
+	return appendInternalKey(dst, start, rangeDelKind, seqNum)
+}
+
+// readRangeDels reads the range deletion block into r.rangeDels.
+func (r *Reader) readRangeDels(bh blockHandle) error {
+	b, err := r.readCheckedBlock(bh, "range deletion")
+	if err != nil {
+		return err
+	}
+	i, err := b.seek(db.DefaultComparer, nil)
+	if err != nil {
+		return err
+	}
+	for i.Next() {
+		// The keys and values are copied, as the iterator reuses the memory
+		// of its keys, and b may be part of the file's mapping, which the
+		// tombstones returned by RangeTombstones could outlive.
+		k := i.Key()
+		n := len(k) - 8
+		if n < 0 || k[n] != rangeDelKind {
+			i.Close()
+			return corruptionErrorf(int64(bh.offset), "bad range deletion key %q", k)
+		}
+		var seqNum uint64
+		for j := 7; j > 0; j-- {
+			seqNum = seqNum<<8 | uint64(k[n+j])
+		}
+		// As for the point keys, a tombstone of an ingested table that is
+		// stored with a zero sequence number has the global one instead. The
+		// properties, and so r.globalSeqNum, have already been read.
+		if seqNum == 0 {
+			seqNum = r.globalSeqNum
+		}
+		start := append([]byte(nil), k[:n]...)
+		end := append([]byte(nil), i.Value()...)
+		r.rangeDels = append(r.rangeDels, RangeTombstone{start, end, seqNum})
+	}
+	return i.Close()
+}
+
+// RangeTombstones returns the table's range tombstones, such as for a
+// compaction to carry them over into its output. A table without a range
+// deletion block has none. For a table with a global sequence number, a
+// tombstone stored with a zero sequence number has the global one. The caller
+// should not modify the returned keys.
+func (r *Reader) RangeTombstones() []RangeTombstone {
+	return append([]RangeTombstone(nil), r.rangeDels...)
+}
+
+// RangeDelOptions holds the optional parameters for Reader.FindLive.
+type RangeDelOptions struct {
+	// UserComparer defines the ordering of the user keys within the table's
+	// internal keys, and of the range tombstones' start and end keys.
+	//
+	// The default value uses the same ordering as bytes.Compare.
+	UserComparer db.Comparer
+
+	// Snapshot is the sequence number of the state to read. Only tombstones
+	// whose sequence numbers are <= Snapshot delete any keys.
+	//
+	// The default value of zero means to read the latest state, to which
+	// every tombstone applies.
+	Snapshot uint64
+}
+
+// FindLive is like Find, except that the iterator skips the keys that are
+// deleted by the table's range tombstones. The table's keys must be internal
+// keys, as used by package leveldb; keys that are not valid internal keys are
+// never skipped. Each key is checked against every tombstone that applies at
+// the snapshot, which is cheap for the few tombstones that a table usually
+// has. For a table without range tombstones, FindLive is the same as Find.
+//
+// A nil *RangeDelOptions means to use the default values.
+func (r *Reader) FindLive(key []byte, o *db.ReadOptions, ro *RangeDelOptions) db.Iterator {
+	var opts RangeDelOptions
+	if ro != nil {
+		opts = *ro
+	}
+	if opts.UserComparer == nil {
+		opts.UserComparer = db.DefaultComparer
+	}
+	if opts.Snapshot == 0 {
+		opts.Snapshot = internalKeySeqNumMax
+	}
+	var tombs []RangeTombstone
+	for _, t := range r.rangeDels {
+		if t.SeqNum <= opts.Snapshot {
+			tombs = append(tombs, t)
+		}
+	}
+	i := r.Find(key, o)
+	if len(tombs) == 0 {
+		return i
+	}
+	return &rangeDelIter{iter: i, tombs: tombs, ucmp: opts.UserComparer}
+}
+
+// rangeDelIter is the iterator returned by FindLive for a table with range
+// tombstones.
+type rangeDelIter struct {
+	iter  db.Iterator
+	tombs []RangeTombstone
+	ucmp  db.Comparer
+}
+
+// rangeDelIter implements the db.Iterator interface.
+var _ db.Iterator = (*rangeDelIter)(nil)
+
+// Next implements Iterator.Next, as documented in the leveldb/db package.
+func (i *rangeDelIter) Next() bool {
+	for i.iter.Next() {
+		if !i.deleted(i.iter.Key()) {
+			return true
+		}
+	}
+	return false
+}
+
+// deleted returns whether any of i's tombstones deletes the internal key k.
+func (i *rangeDelIter) deleted(k []byte) bool {
+	ukey, _, seqNum, ok := parseInternalKey(k)
+	if !ok {
+		return false
+	}
+	for j := range i.tombs {
+		if i.tombs[j].covers(i.ucmp, ukey, seqNum) {
+			return true
+		}
+	}
+	return false
+}
+
+// Key implements Iterator.Key, as documented in the leveldb/db package.
+func (i *rangeDelIter) Key() []byte {
+	return i.iter.Key()
+}
+
+// Value implements Iterator.Value, as documented in the leveldb/db package.
+func (i *rangeDelIter) Value() []byte {
+	return i.iter.Value()
+}
+
+// Close implements Iterator.Close, as documented in the leveldb/db package.
+func (i *rangeDelIter) Close() error {
+	return i.iter.Close()
+}
+
+// DeleteRange adds a range tombstone to the table, which deletes the user
+// keys from start, inclusive, to end, exclusive, that are older than seqNum.
+// Unlike Set, DeleteRange may be called with tombstones in any order, and
+// they are written, sorted by their start keys, to the table's range
+// deletion block when the Writer is closed.
+func (w *Writer) DeleteRange(start, end []byte, seqNum uint64) error {
+	if w.err != nil {
+		return w.err
+	}
+	if seqNum > internalKeySeqNumMax {
+		return errors.New("leveldb/table: DeleteRange sequence number is too large")
+	}
+	w.rangeDels = append(w.rangeDels, RangeTombstone{
+		Start:  append([]byte(nil), start...),
+		End:    append([]byte(nil), end...),
+		SeqNum: seqNum,
+	})
+	return nil
+}
+
+// writeRangeDels writes the range deletion block, if there are any range
+// tombstones, and returns its block handle. It returns a zero block handle if
+// there are no range tombstones.
+func (w *Writer) writeRangeDels() (blockHandle, error) {
+	if len(w.rangeDels) == 0 {
+		return blockHandle{}, nil
+	}
+	keys := make([][]byte, len(w.rangeDels))
+	for j, t := range w.rangeDels {
+		keys[j] = appendRangeDelKey(nil, t.Start, t.SeqNum)
+	}
+	sort.Stable(rangeDelsByKey{w.rangeDels, keys, w.cmp})
+	for j, t := range w.rangeDels {
+		w.append(keys[j], t.End, true)
+	}
+	return w.finishBlock()
+}
+
+// rangeDelsByKey sorts tombstones by their range deletion block keys.
+type rangeDelsByKey struct {
+	tombs []RangeTombstone
+	keys  [][]byte
+	cmp   db.Comparer
+}
+
+func (s rangeDelsByKey) Len() int { return len(s.tombs) }
+
+func (s rangeDelsByKey) Less(i, j int) bool { return s.cmp.Compare(s.keys[i], s.keys[j]) < 0 }
+
+func (s rangeDelsByKey) Swap(i, j int) {
+	s.tombs[i], s.tombs[j] = s.tombs[j], s.tombs[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
@@ -0,0 +1,56 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"sync"
+)
+
+// readChunk reads a Reader's file in aligned chunks, as per the ReadChunkSize
+// option, and keeps the last chunk read so that reads of adjacent blocks can
+// be served from memory. It is safe for concurrent use.
+type readChunk struct {
+	// size is the ReadChunkSize option.
+	size int64
+
+	mu sync.Mutex
+	// off and data are the file offset and contents of the last chunk read.
+	// A chunk's data is never modified once it has been read, only replaced.
+	off  int64
+	data []byte
+}
+
+// readAt reads len(b) bytes of r's file, starting at offset off, into b.
+func (c *readChunk) readAt(r *Reader, b []byte, off int64) error {
+	end := off + int64(len(b))
+	c.mu.Lock()
+	data, dataOff := c.data, c.off
+	c.mu.Unlock()
+	if off >= dataOff && end <= dataOff+int64(len(data)) {
+		copy(b, data[off-dataOff:])
+		return nil
+	}
+
+	// Extend the read to chunk boundaries, within the file as it was opened.
+	start := off - off%c.size
+	stop := end + c.size - 1
+	stop -= stop % c.size
+	if stop > r.size {
+		stop = r.size
+	}
+	if start < 0 || stop < end {
+		// The read is not within the file as it was opened.
+		return r.readExactlyAt(b, off)
+	}
+	data = make([]byte, stop-start)
+	if err := r.readExactlyAt(data, start); err != nil {
+		return err
+	}
+	copy(b, data[off-start:])
+	c.mu.Lock()
+	c.off, c.data = start, data
+	c.mu.Unlock()
+	return nil
+}
@@ -11,6 +11,9 @@ import (
 	"fmt"
 	"io"
 	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang/leveldb/crc"
 	"github.com/golang/leveldb/db"
@@ -27,8 +30,11 @@ type blockHandle struct {
 // input.
 func decodeBlockHandle(src []byte) (blockHandle, int) {
 	offset, n := binary.Uvarint(src)
+	if n <= 0 {
+		return blockHandle{}, 0
+	}
 	length, m := binary.Uvarint(src[n:])
-	if n == 0 || m == 0 {
+	if m <= 0 {
 		return blockHandle{}, 0
 	}
 	return blockHandle{offset, length}, n + m
@@ -40,6 +46,74 @@ func encodeBlockHandle(dst []byte, b blockHandle) int {
 	return n + m
 }
 
+// BlockHandle is the location of a block within a table file: the offset of
+// its first byte and its length, excluding the block's trailer. It is encoded
+// as the two varints of the offset and length, in that format, in index
+// entries, metaindex entries and the footer.
+type BlockHandle struct {
+	Offset, Length uint64
+}
+
+// MaxBlockHandleLen is the maximum length of an encoded BlockHandle.
+const MaxBlockHandleLen = 2 * binary.MaxVarintLen64
+
+// DecodeBlockHandle returns the block handle encoded at the start of src, as
+// well as the number of bytes it occupies. It returns zero if given invalid
+// input.
+func DecodeBlockHandle(src []byte) (BlockHandle, int) {
+	h, n := decodeBlockHandle(src)
+	return BlockHandle{h.offset, h.length}, n
+}
+
+// EncodeBlockHandle appends the encoding of h to dst, and returns the
+// extended slice.
+func EncodeBlockHandle(dst []byte, h BlockHandle) []byte {
+	var tmp [MaxBlockHandleLen]byte
+	n := encodeBlockHandle(tmp[:], blockHandle{h.Offset, h.Length})
+	return append(dst, tmp[:n]...)
+}
+
+// DecodeBlock returns an iterator over the key/value pairs of b, a block that
+// has already been read and decompressed, such as for a tool that processes
+// tables' blocks itself. The iterator decodes b in the same way as a Reader
+// decodes its blocks, including their shared key prefixes, in the standard
+// block format. A malformed block makes the iterator stop, and its Close
+// return an error, rather than panic.
+//
+// The returned iterator also has a Seek(key []byte) bool method, which is as
+// per Iterator.Seek and uses c to compare keys. A nil c means to use
+// db.DefaultComparer. The iterator's keys and values may alias b.
+func DecodeBlock(b []byte, c db.Comparer) db.Iterator {
+	if c == nil {
+		c = db.DefaultComparer
+	}
+	i := &decodedBlockIter{b: b, c: c}
+	if _, err := i.b.seekInto(&i.blockIter, c, nil, 0); err != nil {
+		i.blockIter = blockIter{err: err}
+	}
+	return i
+}
+
+// decodedBlockIter is the iterator returned by DecodeBlock.
+type decodedBlockIter struct {
+	blockIter
+	b block
+	c db.Comparer
+}
+
+// Seek moves the iterator to the first key/value pair whose key is >= the
+// given key, and returns whether there is such a pair, as per Iterator.Seek.
+func (i *decodedBlockIter) Seek(key []byte) bool {
+	if i.err != nil {
+		return false
+	}
+	if _, err := i.b.seekInto(&i.blockIter, i.c, key, 0); err != nil {
+		i.blockIter = blockIter{err: err}
+		return false
+	}
+	return i.blockIter.Next()
+}
+
 // block is a []byte that holds a sequence of key/value pairs plus an index
 // over those pairs.
 type block []byte
@@ -47,55 +121,254 @@ type block []byte
 // seek returns a blockIter positioned at the first key/value pair whose key is
 // >= the given key. If there is no such key, the blockIter returned is done.
 func (b block) seek(c db.Comparer, key []byte) (*blockIter, error) {
-	numRestarts := int(binary.LittleEndian.Uint32(b[len(b)-4:]))
-	if numRestarts == 0 {
-		return nil, errors.New("leveldb/table: invalid table (block has no restart points)")
-	}
-	n := len(b) - 4*(1+numRestarts)
-	var offset int
-	if len(key) > 0 {
-		// Find the index of the smallest restart point whose key is > the key
-		// sought; index will be numRestarts if there is no such restart point.
-		index := sort.Search(numRestarts, func(i int) bool {
-			o := int(binary.LittleEndian.Uint32(b[n+4*i:]))
-			// For a restart point, there are 0 bytes shared with the previous key.
-			// The varint encoding of 0 occupies 1 byte.
-			o++
-			// Decode the key at that restart point, and compare it to the key sought.
-			v1, n1 := binary.Uvarint(b[o:])
-			_, n2 := binary.Uvarint(b[o+n1:])
-			m := o + n1 + n2
-			s := b[m : m+int(v1)]
-			return c.Compare(s, key) > 0
-		})
-		// Since keys are strictly increasing, if index > 0 then the restart
-		// point at index-1 will be the largest whose key is <= the key sought.
-		// If index == 0, then all keys in this block are larger than the key
-		// sought, and offset remains at zero.
-		if index > 0 {
-			offset = int(binary.LittleEndian.Uint32(b[n+4*(index-1):]))
-		}
+	i, _, err := b.seekLimit(c, key, 0)
+	return i, err
+}
+
+// seekLimit is like seek, except that it also returns the number of key/value
+// pairs stepped over after binary searching the restart points. If limit is
+// positive and more than limit pairs would be stepped over, it returns an
+// error instead.
+func (b block) seekLimit(c db.Comparer, key []byte, limit int) (*blockIter, int, error) {
+	i := &blockIter{}
+	steps, err := b.seekInto(i, c, key, limit)
+	if err != nil {
+		return nil, steps, err
 	}
-	// Initialize the blockIter to the restart point.
-	i := &blockIter{
-		data: b[offset:n],
-		key:  make([]byte, 0, 256),
+	return i, steps, nil
+}
+
+// seekInto is like seekLimit, except that it repositions the given blockIter
+// instead of allocating a new one, reusing its buffers. The blockIter's format
+// linearSeek and globalSeqNum are unchanged, and give the format of the block,
+// how to search its restart points and how to present its keys.
+func (b block) seekInto(i *blockIter, c db.Comparer, key []byte, limit int) (int, error) {
+	offset, n, err := b.restartOffset(i, c, key)
+	if err != nil {
+		return 0, err
 	}
+	i.reset(b, offset, n)
 	// Iterate from that restart point to somewhere >= the key sought.
+	steps := 0
 	for i.Next() && c.Compare(i.key, key) < 0 {
+		steps++
+		if limit > 0 && steps > limit {
+			return steps, corruptionErrorf(-1, "seeking within a block stepped over more than %d entries", limit)
+		}
 	}
 	if i.err != nil {
-		return nil, i.err
+		return steps, i.err
 	}
 	i.soi = !i.eoi
-	return i, nil
+	return steps, nil
+}
+
+// seekBeforeInto repositions i at the last key/value pair of b whose key is
+// < the given key, or <= that key if orEqual is true, such that i's Next
+// returns that pair. It returns false, with i done, if there is no such pair.
+// Only the pairs from the restart point before that pair are stepped over, as
+// the pair is found by stepping from that restart point, and then repositioned
+// at by stepping from it again.
+func (b block) seekBeforeInto(i *blockIter, c db.Comparer, key []byte, orEqual bool) (bool, error) {
+	offset, n, err := b.restartOffset(i, c, key)
+	if err != nil {
+		return false, err
+	}
+	before := func() bool {
+		x := c.Compare(i.key, key)
+		return x < 0 || (orEqual && x == 0)
+	}
+	i.reset(b, offset, n)
+	steps := 0
+	for i.Next() && before() {
+		steps++
+	}
+	if i.err != nil {
+		return false, i.err
+	}
+	if steps == 0 {
+		i.Close()
+		return false, nil
+	}
+	i.reset(b, offset, n)
+	for j := 0; j < steps; j++ {
+		i.Next()
+	}
+	i.soi = true
+	return true, nil
+}
+
+// restartOffset validates the restart points of b, and returns the offset of
+// the entry at the largest restart point whose key is < the given key, or
+// zero if there is none, along with the length of the block's entries. The
+// blockIter i gives the format of the block, and how to search its restart
+// points.
+func (b block) restartOffset(i *blockIter, c db.Comparer, key []byte) (offset, n int, err error) {
+	if len(b) < 4 {
+		return 0, 0, corruptionErrorf(-1, "block is too short")
+	}
+	numRestarts := binary.LittleEndian.Uint32(b[len(b)-4:])
+	if numRestarts == 0 && len(b) > 4 {
+		// A block that is only a zero restart count has no entries, and is
+		// treated as empty, but any other block must have a restart point.
+		return 0, 0, corruptionErrorf(-1, "block has no restart points")
+	}
+	if uint64(numRestarts) > uint64(len(b)-4)/4 {
+		return 0, 0, corruptionErrorf(-1, "block has too many restart points (%d for %d bytes)", numRestarts, len(b))
+	}
+	n = len(b) - 4*(1+int(numRestarts))
+	format := i.format
+	// If n == 0, the block has no entries, and there is nothing to search.
+	if len(key) > 0 && n > 0 {
+		// Find the index of the smallest restart point whose key is >= the key
+		// sought; index will be numRestarts if there is no such restart point.
+		var badRestart error
+		atOrAfter := func(i int) bool {
+			s, ok := restartKey(b[:n], binary.LittleEndian.Uint32(b[n+4*i:]), format)
+			if !ok {
+				if badRestart == nil {
+					badRestart = corruptionErrorf(-1, "invalid block restart point %d", i)
+				}
+				return true
+			}
+			return c.Compare(s, key) >= 0
+		}
+		var index int
+		if int(numRestarts) < i.linearSeek {
+			// For a few restart points, a linear scan is cheaper than the
+			// binary search.
+			for index < int(numRestarts) && !atOrAfter(index) {
+				index++
+			}
+		} else {
+			index = sort.Search(int(numRestarts), atOrAfter)
+		}
+		if badRestart != nil {
+			return 0, 0, badRestart
+		}
+		// If index > 0 then the restart point at index-1 will be the largest
+		// whose key is < the key sought, and any keys equal to the key sought
+		// come after it, even if c orders several keys as equal. If index ==
+		// 0, then no key in this block is smaller than the key sought, and
+		// offset remains at zero.
+		if index > 0 {
+			o := binary.LittleEndian.Uint32(b[n+4*(index-1):])
+			if uint64(o) >= uint64(n) {
+				return 0, 0, corruptionErrorf(-1, "invalid block restart point %d", index-1)
+			}
+			offset = int(o)
+		}
+	}
+	return offset, n, nil
+}
+
+// reset initializes i to iterate over the entries of b, whose length is n,
+// from the restart point at the given offset, reusing i's buffers.
+func (i *blockIter) reset(b block, offset, n int) {
+	keyBuf := i.key[:0]
+	if keyBuf == nil {
+		keyBuf = make([]byte, 0, 256)
+	}
+	*i = blockIter{
+		data:         b[offset:n],
+		key:          keyBuf,
+		valBuf:       i.valBuf[:0],
+		valParts:     i.valParts[:0],
+		format:       i.format,
+		linearSeek:   i.linearSeek,
+		globalSeqNum: i.globalSeqNum,
+		rawKey:       i.rawKey[:0],
+	}
+}
+
+// restartKey returns the key of the entry at offset o of data, the entries of
+// a block of the given format. It returns ok == false if there is no
+// well-formed restart point at that offset.
+func restartKey(data []byte, o uint32, format blockFormat) (key []byte, ok bool) {
+	if uint64(o) >= uint64(len(data)) {
+		return nil, false
+	}
+	data = data[o:]
+	// For a restart point, there are 0 bytes shared with the previous key.
+	// The varint encoding of 0 occupies 1 byte.
+	if data[0] != 0 {
+		return nil, false
+	}
+	data = data[1:]
+	// Decode the key at that restart point.
+	v1, n1 := binary.Uvarint(data)
+	if n1 <= 0 {
+		return nil, false
+	}
+	data = data[n1:]
+	if format == valuePrefixBlockFormat {
+		// Nor are there any bytes shared with the previous value.
+		if len(data) == 0 || data[0] != 0 {
+			return nil, false
+		}
+		data = data[1:]
+	}
+	_, n2 := binary.Uvarint(data)
+	if n2 <= 0 {
+		return nil, false
+	}
+	data = data[n2:]
+	if v1 > uint64(len(data)) {
+		return nil, false
+	}
+	return data[:v1], true
 }
 
+// blockFormat is the encoding of a block's entries.
+type blockFormat uint8
+
+const (
+	// standardBlockFormat is the LevelDB format, where each entry's key may
+	// share a prefix with the previous entry's key.
+	standardBlockFormat blockFormat = iota
+	// valuePrefixBlockFormat is an experimental format where each entry's
+	// value may also share a prefix with the previous entry's value. After
+	// the number of shared key bytes and the number of unshared key bytes, an
+	// entry has the number of shared value bytes, as a varint, before the
+	// number of unshared value bytes. The entry ends with the unshared key
+	// bytes and the unshared value bytes. Values are not shared across restart
+	// points.
+	valuePrefixBlockFormat
+)
+
 // blockIter is an iterator over a single block of data.
+//
+// For a valuePrefixBlockFormat block, Next does not build the current value
+// from the previous value's prefix and the entry's unshared bytes. Instead,
+// it records where those bytes are, in valParts, and Value builds the value
+// when it is called, so that values that are never asked for are never
+// copied. For a standardBlockFormat block, a value is a slice of the block,
+// and nothing is copied either way.
 type blockIter struct {
 	data     []byte
 	key, val []byte
-	err      error
+	// valLen is the length of the current value.
+	valLen int
+	// valBuf holds the current value for a valuePrefixBlockFormat block,
+	// once Value has built it.
+	valBuf []byte
+	// valParts are the parts of the current value that Value has yet to
+	// build, for a valuePrefixBlockFormat block, from the entry after the
+	// last one whose value was built, or after the last restart point, to
+	// the current entry. If valBuilt is true, then Value has built the
+	// current value, and valParts holds just that value.
+	valParts []valuePart
+	valBuilt bool
+	format   blockFormat
+	// linearSeek is the number of restart points below which seeking scans
+	// them linearly instead of binary searching them.
+	linearSeek int
+	// globalSeqNum, if non-zero, is the table's global sequence number, which
+	// replaces a zero sequence number in the internal keys that Key returns.
+	// rawKey then holds the current key as stored.
+	globalSeqNum uint64
+	rawKey       []byte
+	err          error
 	// soi and eoi mark the start and end of iteration.
 	// Both cannot simultaneously be true.
 	soi, eoi bool
@@ -104,6 +377,14 @@ type blockIter struct {
 // blockIter implements the db.Iterator interface.
 var _ db.Iterator = (*blockIter)(nil)
 
+// valuePart is the unshared bytes b of a value in a valuePrefixBlockFormat
+// block, which follow the value's first shared bytes, those that it shares
+// with the previous value.
+type valuePart struct {
+	shared int
+	b      []byte
+}
+
 // Next implements Iterator.Next, as documented in the leveldb/db package.
 func (i *blockIter) Next() bool {
 	if i.eoi || i.err != nil {
@@ -117,16 +398,104 @@ func (i *blockIter) Next() bool {
 		i.Close()
 		return false
 	}
+	// An entry is the number of bytes shared with the previous key, the number
+	// of unshared key bytes and the number of value bytes, as varints, followed
+	// by the unshared key bytes and the value bytes.
 	v0, n0 := binary.Uvarint(i.data)
+	if n0 <= 0 {
+		return i.corrupt()
+	}
 	v1, n1 := binary.Uvarint(i.data[n0:])
-	v2, n2 := binary.Uvarint(i.data[n0+n1:])
-	n := n0 + n1 + n2
-	i.key = append(i.key[:v0], i.data[n:n+int(v1)]...)
-	i.val = i.data[n+int(v1) : n+int(v1+v2)]
+	if n1 <= 0 {
+		return i.corrupt()
+	}
+	n := n0 + n1
+	// vs is the number of bytes shared with the previous value.
+	var vs uint64
+	if i.format == valuePrefixBlockFormat {
+		var ns int
+		vs, ns = binary.Uvarint(i.data[n:])
+		if ns <= 0 || vs > uint64(i.valLen) {
+			return i.corrupt()
+		}
+		n += ns
+	}
+	v2, n2 := binary.Uvarint(i.data[n:])
+	if n2 <= 0 {
+		return i.corrupt()
+	}
+	n += n2
+	// The key shares its first v0 bytes with the previous key as stored,
+	// before any global sequence number was applied to it.
+	prevKey := i.key
+	if i.globalSeqNum != 0 {
+		prevKey = i.rawKey
+	}
+	if v0 > uint64(len(prevKey)) {
+		return i.corrupt()
+	}
+	// Checking v1 and then v2 against the m remaining bytes, rather than
+	// checking their sum, which may wrap around, ensures that both lengths
+	// and their sum fit in an int, even where an int has 32 bits.
+	if m := uint64(len(i.data) - n); v1 > m || v2 > m-v1 {
+		return i.corrupt()
+	}
+	if i.globalSeqNum != 0 {
+		i.rawKey = append(i.rawKey[:v0], i.data[n:n+int(v1)]...)
+		i.key = append(i.key[:0], i.rawKey...)
+		setGlobalSeqNum(i.key, i.globalSeqNum)
+	} else {
+		i.key = append(i.key[:v0], i.data[n:n+int(v1)]...)
+	}
+	if i.format == valuePrefixBlockFormat {
+		if vs == 0 {
+			// The value shares nothing with the previous values.
+			i.valParts = i.valParts[:0]
+		}
+		i.valParts = append(i.valParts, valuePart{int(vs), i.data[n+int(v1) : n+int(v1+v2)]})
+		i.val, i.valBuilt = nil, false
+	} else {
+		i.val = i.data[n+int(v1) : n+int(v1+v2)]
+	}
+	i.valLen = int(vs + v2)
 	i.data = i.data[n+int(v1+v2):]
 	return true
 }
 
+// buildValue builds the current value of a valuePrefixBlockFormat block in
+// i.valBuf. It walks i.valParts from the current entry backwards, so that each
+// byte of the value is copied once, from the part that holds it: the bytes
+// that a value shares with its predecessor are in an earlier part.
+func (i *blockIter) buildValue() {
+	n := i.valLen
+	buf := i.valBuf[:0]
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	// The last value that was built is the first part, and is in i.valBuf, so
+	// the bytes copied from it stay where they are. Those copied from later
+	// parts are beyond any that are yet to be copied.
+	need := n
+	for j := len(i.valParts) - 1; j >= 0 && need > 0; j-- {
+		p := i.valParts[j]
+		if need > p.shared {
+			copy(buf[p.shared:need], p.b)
+			need = p.shared
+		}
+	}
+	i.valBuf, i.val, i.valBuilt = buf, buf, true
+	i.valParts = append(i.valParts[:0], valuePart{0, buf})
+}
+
+// corrupt sets i.err to report a malformed block entry, and returns false.
+func (i *blockIter) corrupt() bool {
+	i.err = corruptionErrorf(-1, "corrupt block entry")
+	i.key = nil
+	i.val, i.valLen, i.valParts = nil, 0, nil
+	return false
+}
+
 // Key implements Iterator.Key, as documented in the leveldb/db package.
 func (i *blockIter) Key() []byte {
 	if i.soi {
@@ -140,211 +509,1070 @@ func (i *blockIter) Value() []byte {
 	if i.soi {
 		return nil
 	}
+	if i.format == valuePrefixBlockFormat && !i.valBuilt && len(i.valParts) > 0 {
+		i.buildValue()
+	}
 	return i.val[:len(i.val):len(i.val)]
 }
 
+// KeyLen returns the length of the current key, as per len(i.Key()).
+func (i *blockIter) KeyLen() int {
+	if i.soi {
+		return 0
+	}
+	return len(i.key)
+}
+
+// ValueLen returns the length of the current value, as per len(i.Value()).
+func (i *blockIter) ValueLen() int {
+	if i.soi {
+		return 0
+	}
+	return i.valLen
+}
+
 // Close implements Iterator.Close, as documented in the leveldb/db package.
 func (i *blockIter) Close() error {
 	i.key = nil
-	i.val = nil
+	i.val, i.valLen, i.valParts = nil, 0, nil
 	i.eoi = true
 	return i.err
 }
 
-// tableIter is an iterator over an entire table of data. It is a two-level
-// iterator: to seek for a given key, it first looks in the index for the
-// block that contains that key, and then looks inside that block.
-type tableIter struct {
+// indexIter is an iterator over the entries of a table's index, which map
+// separator keys to data block handles. If the index is partitioned, its top
+// level maps separator keys to the handles of index partitions, and indexIter
+// iterates over each of those partitions in turn, reading them as needed.
+type indexIter struct {
 	reader *Reader
-	data   *blockIter
-	index  *blockIter
-	err    error
+	// top iterates over the top level of a partitioned index. It is unused if
+	// the index is not partitioned.
+	top blockIter
+	// part iterates over the current index partition, or over the entire index
+	// if it is not partitioned.
+	part blockIter
+	err  error
+	// comparer, if non-nil, overrides the reader's Comparer when seeking.
+	comparer db.Comparer
 }
 
-// tableIter implements the db.Iterator interface.
-var _ db.Iterator = (*tableIter)(nil)
+// lazyIndex is the state of a Reader's index that is read on first use.
+type lazyIndex struct {
+	once  sync.Once
+	bh    blockHandle
+	index block
+	// fingerprint is as per Reader.indexFingerprint.
+	fingerprint uint32
+	err         error
+	// loaded is set to 1, atomically, once the index has been read.
+	loaded uint32
+}
 
-// nextBlock loads the next block and positions i.data at the first key in that
-// block which is >= the given key. If unsuccessful, it sets i.err to any error
-// encountered, which may be nil if we have simply exhausted the entire table.
-//
-// If f is non-nil, the caller is presumably looking for one specific key, as
-// opposed to iterating over a range of keys (where the minimum of that range
-// isn't necessarily in the table). In that case, i.err will be set to
-// db.ErrNotFound if f does not contain the key.
-func (i *tableIter) nextBlock(key []byte, f *filterReader) bool {
-	if !i.index.Next() {
-		i.err = i.index.err
-		return false
+// loadIndex returns r's index block, reading it from the file if that has been
+// deferred by NewLazyReader. It is safe for concurrent use, and the index is
+// read at most once; an error reading it is returned by every call.
+func (r *Reader) loadIndex() (block, error) {
+	l := r.lazyIndex
+	if l == nil {
+		return r.index, nil
 	}
-	// Load the next block.
-	v := i.index.Value()
-	h, n := decodeBlockHandle(v)
-	if n == 0 || n != len(v) {
-		i.err = errors.New("leveldb/table: corrupt index entry")
-		return false
+	l.once.Do(func() {
+		l.index, l.err = r.readCheckedBlock(l.bh, "index")
+		l.fingerprint = crc.New(l.index).Value()
+		atomic.StoreUint32(&l.loaded, 1)
+	})
+	return l.index, l.err
+}
+
+// newIndexIter returns an indexIter positioned before the first index entry
+// whose key is >= the given key.
+func (r *Reader) newIndexIter(key []byte) (*indexIter, error) {
+	i := &indexIter{}
+	if err := i.seek(r, key, nil); err != nil {
+		return nil, err
 	}
-	if f != nil && !f.mayContain(h.offset, key) {
-		i.err = db.ErrNotFound
-		return false
+	return i, nil
+}
+
+// seek repositions i before the first entry of r's index whose key is >= the
+// given key, reusing i's block iterators. If stats is non-nil, the cost of
+// the seek is added to it.
+func (i *indexIter) seek(r *Reader, key []byte, stats *SeekStats) error {
+	i.reader, i.err = r, nil
+	index, err := r.loadIndex()
+	if err != nil {
+		return err
+	}
+	c := stats.comparer(i.cmp())
+	if !r.partitionedIndex {
+		_, err := index.seekInto(&i.part, c, key, 0)
+		return err
+	}
+	if _, err := index.seekInto(&i.top, c, key, 0); err != nil {
+		return err
+	}
+	if !i.top.Next() {
+		i.part.Close()
+		return i.top.err
 	}
-	k, err := i.reader.readBlock(h)
+	if !i.loadPartition(key, stats) {
+		return i.err
+	}
+	return nil
+}
+
+// loadPartition reads the index partition whose handle is the current value
+// of i.top, and positions i.part at the first entry whose key is >= the given
+// key. If stats is non-nil, the cost of doing so is added to it.
+func (i *indexIter) loadPartition(key []byte, stats *SeekStats) bool {
+	b, err := i.readPartition(stats)
 	if err != nil {
 		i.err = err
 		return false
 	}
-	// Look for the key inside that block.
-	data, err := k.seek(i.reader.comparer, key)
-	if err != nil {
+	if _, err := b.seekInto(&i.part, stats.comparer(i.cmp()), key, 0); err != nil {
 		i.err = err
 		return false
 	}
-	i.data = data
 	return true
 }
 
-// Next implements Iterator.Next, as documented in the leveldb/db package.
-func (i *tableIter) Next() bool {
-	if i.data == nil {
-		return false
+// readPartition reads the index partition whose handle is the current value
+// of i.top. If stats is non-nil, the cost of doing so is added to it.
+func (i *indexIter) readPartition(stats *SeekStats) (block, error) {
+	v := i.top.Value()
+	h, n := decodeBlockHandle(v)
+	if n == 0 || n != len(v) {
+		return nil, errCorruptIndexEntry
 	}
-	for {
-		if i.data.Next() {
+	return i.reader.readDataBlock(h, i.reader.verifyChecksums, stats)
+}
+
+// seekBefore repositions i at the last entry of r's index whose key is < the
+// given key, such that Next returns that entry. It returns false, with i
+// exhausted, if there is no such entry. For a partitioned index, that entry
+// is in the first partition whose key is >= the given key, or is the last
+// entry of the partition before that, so at most two partitions are read.
+func (i *indexIter) seekBefore(r *Reader, key []byte) (bool, error) {
+	i.reader, i.err = r, nil
+	index, err := r.loadIndex()
+	if err != nil {
+		return false, err
+	}
+	c := i.cmp()
+	if !r.partitionedIndex {
+		return index.seekBeforeInto(&i.part, c, key, false)
+	}
+	if _, err := index.seekInto(&i.top, c, key, 0); err != nil {
+		return false, err
+	}
+	if i.top.Next() {
+		b, err := i.readPartition(nil)
+		if err != nil {
+			return false, err
+		}
+		if ok, err := b.seekBeforeInto(&i.part, c, key, false); ok || err != nil {
+			return ok, err
+		}
+	} else if i.top.err != nil {
+		return false, i.top.err
+	}
+	if ok, err := index.seekBeforeInto(&i.top, c, key, false); !ok || err != nil {
+		i.part.Close()
+		return false, err
+	}
+	i.top.Next()
+	b, err := i.readPartition(nil)
+	if err != nil {
+		return false, err
+	}
+	return b.seekBeforeInto(&i.part, c, key, false)
+}
+
+// cmp returns the Comparer that i seeks with.
+func (i *indexIter) cmp() db.Comparer {
+	if i.comparer != nil {
+		return i.comparer
+	}
+	return i.reader.comparer
+}
+
+// Next implements Iterator.Next, as documented in the leveldb/db package.
+func (i *indexIter) Next() bool {
+	for i.err == nil {
+		if i.part.Next() {
 			return true
 		}
-		if i.data.err != nil {
-			i.err = i.data.err
+		if i.part.err != nil {
+			i.err = i.part.err
 			break
 		}
-		if !i.nextBlock(nil, nil) {
+		if !i.reader.partitionedIndex || !i.top.Next() {
+			i.err = i.top.err
 			break
 		}
+		i.loadPartition(nil, nil)
 	}
-	i.Close()
 	return false
 }
 
 // Key implements Iterator.Key, as documented in the leveldb/db package.
-func (i *tableIter) Key() []byte {
-	if i.data == nil {
-		return nil
-	}
-	return i.data.Key()
+func (i *indexIter) Key() []byte {
+	return i.part.Key()
 }
 
 // Value implements Iterator.Value, as documented in the leveldb/db package.
-func (i *tableIter) Value() []byte {
-	if i.data == nil {
-		return nil
-	}
-	return i.data.Value()
+func (i *indexIter) Value() []byte {
+	return i.part.Value()
 }
 
 // Close implements Iterator.Close, as documented in the leveldb/db package.
-func (i *tableIter) Close() error {
-	i.data = nil
+func (i *indexIter) Close() error {
+	i.top.Close()
+	i.part.Close()
 	return i.err
 }
 
-type filterReader struct {
-	data    []byte
-	offsets []byte // len(offsets) must be a multiple of 4.
-	policy  db.FilterPolicy
-	shift   uint32
-}
-
-func (f *filterReader) valid() bool {
-	return f.data != nil
+// IndexIterator returns an iterator over the table's index, which has one
+// entry per data block, in order. Each entry's key is a separator: a key that
+// is >= every key in that data block and < every key in the next one. Each
+// entry's value is the encoded block handle of that data block, being its
+// offset and its length (excluding the block trailer) as two uvarints.
+//
+// If the index is partitioned, the iterator reads the index partitions as
+// needed, and iterates over their entries, so that its entries are still
+// those of the data blocks.
+func (r *Reader) IndexIterator() db.Iterator {
+	if r.err != nil {
+		return &indexIter{err: r.err}
+	}
+	i, err := r.newIndexIter(nil)
+	if err != nil {
+		return &indexIter{err: err}
+	}
+	return i
 }
 
-func (f *filterReader) init(data []byte, policy db.FilterPolicy) (ok bool) {
-	if len(data) < 5 {
-		return false
+// BlockIterator returns an iterator over the key/value pairs of a single data
+// block, given that block's encoded handle, such as the Value of an entry of
+// the IndexIterator. The block is read through the block cache, if there is
+// one.
+func (r *Reader) BlockIterator(handle []byte) (db.Iterator, error) {
+	if r.err != nil {
+		return nil, r.err
 	}
-	lastOffset := binary.LittleEndian.Uint32(data[len(data)-5:])
-	if uint64(lastOffset) > uint64(len(data)-5) {
-		return false
+	h, n := decodeBlockHandle(handle)
+	if n == 0 || n != len(handle) {
+		return nil, errors.New("leveldb/table: invalid block handle")
 	}
-	data, offsets, shift := data[:lastOffset], data[lastOffset:len(data)-1], uint32(data[len(data)-1])
-	if len(offsets)&3 != 0 {
-		return false
+	// The handle is not necessarily from this table's index, so check that
+	// the block lies within the file before allocating a buffer for it.
+	stat, err := r.file.Stat()
+	if err != nil {
+		return nil, err
 	}
-	f.data = data
-	f.offsets = offsets
-	f.policy = policy
-	f.shift = shift
-	return true
-}
-
-func (f *filterReader) mayContain(blockOffset uint64, key []byte) bool {
-	index := blockOffset >> f.shift
-	if index >= uint64(len(f.offsets)/4-1) {
-		return true
+	if err := checkBlockHandle(h, stat.Size(), "data"); err != nil {
+		return nil, err
 	}
-	i := binary.LittleEndian.Uint32(f.offsets[4*index+0:])
-	j := binary.LittleEndian.Uint32(f.offsets[4*index+4:])
-	if i >= j || uint64(j) > uint64(len(f.data)) {
-		return true
+	b, err := r.readDataBlock(h, r.verifyChecksums, nil)
+	if err != nil {
+		return nil, err
 	}
-	return f.policy.MayContain(f.data[i:j], key)
+	return r.seekDataBlock(b, nil)
 }
 
-// Reader is a table reader. It implements the DB interface, as documented
-// in the leveldb/db package.
-type Reader struct {
-	file            db.File
-	err             error
-	index           block
-	comparer        db.Comparer
-	filter          filterReader
-	verifyChecksums bool
-	// TODO: add a (goroutine-safe) LRU block cache.
-}
-
-// Reader implements the db.DB interface.
-var _ db.DB = (*Reader)(nil)
-
-// Close implements DB.Close, as documented in the leveldb/db package.
-func (r *Reader) Close() error {
+// BlockAt returns an iterator over the key/value pairs of the n'th data block,
+// counting from zero in index order, together with that block's handle. It is
+// for inspecting a table's blocks, such as when debugging. It steps over the
+// first n entries of the index, and returns an error if n is negative or the
+// table has no more than n data blocks.
+func (r *Reader) BlockAt(n int) (db.Iterator, BlockHandle, error) {
 	if r.err != nil {
-		if r.file != nil {
-			r.file.Close()
-			r.file = nil
-		}
-		return r.err
+		return nil, BlockHandle{}, r.err
 	}
-	if r.file != nil {
-		r.err = r.file.Close()
-		r.file = nil
-		if r.err != nil {
-			return r.err
+	if n < 0 {
+		return nil, BlockHandle{}, fmt.Errorf("leveldb/table: invalid block number %d", n)
+	}
+	index, err := r.newIndexIter(nil)
+	if err != nil {
+		return nil, BlockHandle{}, err
+	}
+	numBlocks := 0
+	for ; numBlocks <= n && index.Next(); numBlocks++ {
+	}
+	if numBlocks <= n {
+		if err := index.Close(); err != nil {
+			return nil, BlockHandle{}, err
 		}
+		return nil, BlockHandle{}, fmt.Errorf("leveldb/table: block number %d out of range: the table has %d data blocks", n, numBlocks)
 	}
-	// Make any future calls to Get, Find or Close return an error.
-	r.err = errors.New("leveldb/table: reader is closed")
+	v := index.Value()
+	h, m := decodeBlockHandle(v)
+	index.Close()
+	if m == 0 || m != len(v) {
+		return nil, BlockHandle{}, errCorruptIndexEntry
+	}
+	b, err := r.readDataBlock(h, r.verifyChecksums, nil)
+	if err != nil {
+		return nil, BlockHandle{}, err
+	}
+	i, err := r.seekDataBlock(b, nil)
+	if err != nil {
+		return nil, BlockHandle{}, err
+	}
+	return i, BlockHandle{h.offset, h.length}, nil
+}
+
+// seekDataBlock returns an iterator over b, one of r's data blocks, that is
+// positioned at the first key that is >= the given key. It decodes b in the
+// format of r's data blocks.
+func (r *Reader) seekDataBlock(b block, key []byte) (*blockIter, error) {
+	i := &blockIter{format: r.dataFormat, linearSeek: r.linearSeekThreshold, globalSeqNum: r.globalSeqNum}
+	steps, err := b.seekInto(i, r.comparer, key, r.seekLimit)
+	if err != nil {
+		return nil, err
+	}
+	r.checkSeekSteps(steps)
+	return i, nil
+}
+
+// Iterator is an iterator over an entire table of data. It is a two-level
+// iterator: to seek for a given key, it first looks in the index for the
+// block that contains that key, and then looks inside that block.
+//
+// The db.Iterator returned by a Reader's Find method is an *Iterator.
+type Iterator struct {
+	reader *Reader
+	data   *blockIter
+	index  *indexIter
+	err    error
+	// cur is the data block that data iterates over. dataIter is the storage
+	// for data, which is reused from block to block.
+	cur      loadedBlock
+	dataIter blockIter
+	// readahead holds the data blocks, in index order, that have been read
+	// ahead of the current block but not yet loaded.
+	readahead []loadedBlock
+	// stats, if non-nil, accumulates the cost of the initial seek.
+	stats *SeekStats
+	// cancel, if non-nil, is checked before loading each block. Once it is
+	// closed, iteration stops with ErrCanceled.
+	cancel <-chan struct{}
+	// comparer, if non-nil, overrides the reader's Comparer when seeking.
+	comparer db.Comparer
+	// verifyChecksums is whether to verify the checksums of data blocks.
+	verifyChecksums bool
+}
+
+// loadedBlock is a data block together with its handle in the table file.
+// If pooled is true, b's memory was drawn from alloc, if it is non-nil, or
+// otherwise from blockBufPool, and is owned by the Iterator, which returns it
+// once it moves to another block.
+type loadedBlock struct {
+	bh     blockHandle
+	b      block
+	pooled bool
+	alloc  db.Allocator
+	// sep is a copy of the block's index separator, if the ParanoidChecks
+	// option is set.
+	sep []byte
+}
+
+// release returns the block's memory to where it came from, if it is owned
+// by the Iterator.
+func (l *loadedBlock) release() {
+	switch {
+	case l.pooled && l.alloc != nil:
+		l.alloc.Free(l.b)
+	case l.pooled:
+		putBlockBuf(l.b)
+	}
+	*l = loadedBlock{}
+}
+
+// Iterator implements the db.Iterator interface.
+var _ db.Iterator = (*Iterator)(nil)
+
+// nextBlock loads the next block and positions i.data at the first key in that
+// block which is >= the given key. If unsuccessful, it sets i.err to any error
+// encountered, which may be nil if we have simply exhausted the entire table.
+// If the next block is the one already loaded, it is not read again.
+//
+// If f is non-nil, the caller is presumably looking for one specific key, as
+// opposed to iterating over a range of keys (where the minimum of that range
+// isn't necessarily in the table). In that case, i.err will be set to
+// db.ErrNotFound if f does not contain the key.
+func (i *Iterator) nextBlock(key []byte, f *filterReader) bool {
+	if i.cancel != nil {
+		select {
+		case <-i.cancel:
+			i.err = ErrCanceled
+			return false
+		default:
+		}
+	}
+	if len(i.readahead) > 0 {
+		i.cur.release()
+		i.cur, i.readahead = i.readahead[0], i.readahead[1:]
+	} else {
+		if !i.index.Next() {
+			i.err = i.index.err
+			return false
+		}
+		// Load the next block.
+		v := i.index.Value()
+		h, n := decodeBlockHandle(v)
+		if n == 0 || n != len(v) {
+			i.err = errCorruptIndexEntry
+			return false
+		}
+		if f != nil && !f.mayContain(h.offset, key) {
+			i.err = db.ErrNotFound
+			return false
+		}
+		if f != nil && i.stats != nil {
+			i.stats.FilterChecked = true
+		}
+		if i.cur.b == nil || i.cur.bh.offset != h.offset {
+			var sep []byte
+			if i.reader.paranoidChecks {
+				// Reading ahead moves i.index on, so copy the separator first.
+				sep = append(sep, i.index.Key()...)
+			}
+			k, pooled, err := i.readBlock(h, f == nil)
+			if err != nil {
+				i.err = err
+				return false
+			}
+			if i.reader.paranoidChecks {
+				if err := i.reader.checkBlockBounds(k, h, i.cur.sep, sep); err != nil {
+					i.err = err
+					return false
+				}
+			}
+			i.cur.release()
+			i.cur = loadedBlock{h, k, pooled, i.reader.allocator, sep}
+		}
+	}
+	// Look for the key inside that block.
+	r := i.reader
+	steps, err := i.cur.b.seekInto(&i.dataIter, i.stats.comparer(i.index.cmp()), key, r.seekLimit)
+	if err != nil {
+		i.err = err
+		return false
+	}
+	r.checkSeekSteps(steps)
+	i.data = &i.dataIter
+	return true
+}
+
+// checkBlockBounds checks, for the ParanoidChecks option, that the keys of the
+// data block b, with handle bh, are in increasing order, and are bounded by the
+// index: that they are all > lower, the previous block's separator, if lower
+// is non-nil, and <= upper, the block's own separator.
+func (r *Reader) checkBlockBounds(b block, bh blockHandle, lower, upper []byte) error {
+	i, err := r.seekDataBlock(b, nil)
+	if err != nil {
+		return err
+	}
+	var prev []byte
+	for first := true; i.Next(); first = false {
+		k := i.Key()
+		switch {
+		case first && lower != nil && r.comparer.Compare(k, lower) <= 0:
+			err = corruptionErrorf(int64(bh.offset), "data block key %q is not after the previous index separator %q", k, lower)
+		case !first && r.comparer.Compare(prev, k) >= 0:
+			err = corruptionErrorf(int64(bh.offset), "data block keys out of order: %q, %q", prev, k)
+		case r.comparer.Compare(k, upper) > 0:
+			err = corruptionErrorf(int64(bh.offset), "data block key %q is after the index separator %q", k, upper)
+		}
+		if err != nil {
+			i.Close()
+			return err
+		}
+		prev = append(prev[:0], k...)
+	}
+	return i.Close()
+}
+
+// checkSeekSteps logs a warning if seeking within a data block stepped over
+// more than the BlockSeekWarnThreshold option's number of entries.
+func (r *Reader) checkSeekSteps(steps int) {
+	if r.seekWarnThreshold > 0 && steps > r.seekWarnThreshold {
+		r.logger.Infof("leveldb/table: seeking within a data block stepped over %d entries; "+
+			"the table's block restart interval may be too large", steps)
+	}
+}
+
+// readBlock returns the data block with handle h, from the block cache if
+// possible. If readahead is true, it may also read ahead subsequent blocks.
+//
+// If there is no block cache, a block read on its own is decoded into memory
+// from blockBufPool, and pooled is true. The Iterator then owns that memory.
+// Blocks that may be in the cache are never pooled, as other iterators can
+// still refer to them.
+func (i *Iterator) readBlock(h blockHandle, readahead bool) (b block, pooled bool, err error) {
+	if i.reader.mmap != nil {
+		// Reading ahead, or into pooled memory, would only copy blocks that
+		// are already in memory.
+		b, err = i.reader.readDataBlock(h, i.verifyChecksums, i.stats)
+		return b, false, err
+	}
+	if n := i.reader.readaheadBlocks; n > 0 && readahead {
+		if c := i.reader.cache; c != nil {
+			if b, ok := c.Get(h.offset, h.length); ok {
+				if i.stats != nil {
+					i.stats.CacheHits++
+				}
+				return b, false, nil
+			}
+		}
+		if i.stats != nil {
+			i.stats.BlocksRead++
+		}
+		b, err = i.readBlocks(h, n)
+		return b, false, err
+	}
+	if i.reader.cache == nil {
+		if i.stats != nil {
+			i.stats.BlocksRead++
+		}
+		b, err = i.reader.readPooledBlock(h, i.verifyChecksums)
+		return b, err == nil, err
+	}
+	b, err = i.reader.readDataBlock(h, i.verifyChecksums, i.stats)
+	return b, false, err
+}
+
+// readBlocks reads the data block with handle h, and also reads ahead up to n
+// subsequent data blocks listed in the index, queueing them in i.readahead.
+// All of those blocks are read from the file with a single ReadAt call that
+// spans them, including any gaps between them, into memory from the
+// Allocator option, if it is set.
+func (i *Iterator) readBlocks(h blockHandle, n int) (block, error) {
+	hs := []blockHandle{h}
+	var seps [][]byte
+	if i.reader.paranoidChecks {
+		seps = append(seps, append([]byte(nil), i.index.Key()...))
+	}
+	for len(hs) <= n && i.index.Next() {
+		v := i.index.Value()
+		h, m := decodeBlockHandle(v)
+		if m == 0 || m != len(v) {
+			return nil, errCorruptIndexEntry
+		}
+		hs = append(hs, h)
+		if i.reader.paranoidChecks {
+			seps = append(seps, append([]byte(nil), i.index.Key()...))
+		}
+	}
+	if i.index.err != nil {
+		return nil, i.index.err
+	}
+	// Check that the blocks lie within the file, each after the previous
+	// one, before allocating the buffer that spans them.
+	for j, h := range hs {
+		if err := checkBlockHandle(h, i.reader.size, "data"); err != nil {
+			return nil, err
+		}
+		if j > 0 && h.offset < hs[j-1].offset+hs[j-1].length+blockTrailerLen {
+			return nil, corruptionErrorf(int64(h.offset), "data block overlaps the previous data block")
+		}
+	}
+
+	start, end := hs[0].offset, hs[len(hs)-1].offset+hs[len(hs)-1].length+blockTrailerLen
+	buf := i.reader.alloc(int(end - start))
+	if err := i.reader.readAt(buf, int64(start)); err != nil {
+		i.reader.free(buf)
+		return nil, err
+	}
+	// shared is whether an uncompressed block, which is part of buf, may be
+	// referenced, in which case buf is never freed. Otherwise, only the
+	// decompressed blocks are referenced once they are decoded.
+	shared := false
+	fail := func(err error) (block, error) {
+		if !shared {
+			i.reader.free(buf)
+		}
+		return nil, err
+	}
+	base, blocks := start, make([]loadedBlock, len(hs))
+	for j, h := range hs {
+		b, blockType, err := i.reader.checkBlock(buf[h.offset-base:h.offset-base+h.length+blockTrailerLen], h.offset, i.verifyChecksums)
+		if err != nil {
+			return fail(err)
+		}
+		shared = shared || blockType == noCompressionBlockType
+		blocks[j].bh = h
+		blocks[j].b, err = i.reader.decompress(b, blockType)
+		if err != nil {
+			return fail(err)
+		}
+		if err := i.reader.checkDecompressed(h, blockType, blocks[j].b); err != nil {
+			return fail(err)
+		}
+		if i.reader.paranoidChecks && j > 0 {
+			// The caller checks the first block.
+			if err := i.reader.checkBlockBounds(blocks[j].b, h, seps[j-1], seps[j]); err != nil {
+				return fail(err)
+			}
+			blocks[j].sep = seps[j]
+		}
+		i.reader.blockRead(h, blockType, blocks[j].b)
+		if c := i.reader.cache; c != nil {
+			c.Put(h.offset, h.length, blocks[j].b)
+		}
+	}
+	if !shared {
+		i.reader.free(buf)
+	}
+	i.readahead = blocks[1:]
+	return blocks[0].b, nil
+}
+
+// Next implements Iterator.Next, as documented in the leveldb/db package.
+func (i *Iterator) Next() bool {
+	if i.data == nil {
+		return false
+	}
+	for {
+		if i.data.Next() {
+			if i.reader.checkKey == nil || i.checkKey() {
+				return true
+			}
+			break
+		}
+		if i.data.err != nil {
+			i.err = i.data.err
+			break
+		}
+		if !i.nextBlock(nil, nil) {
+			break
+		}
+	}
+	i.Close()
+	return false
+}
+
+// Key implements Iterator.Key, as documented in the leveldb/db package.
+//
+// The key is exactly as stored in the table, as the table does not interpret
+// its keys. For a table written by package leveldb, it is an internal key:
+// the user key followed by the 8-byte trailer of the kind and sequence number.
+// The one exception is a table ingested by RocksDB, whose properties give a
+// global sequence number: an internal key stored with a zero sequence number
+// is returned with the global one instead.
+func (i *Iterator) Key() []byte {
+	if i.data == nil {
+		return nil
+	}
+	return i.data.Key()
+}
+
+// Value implements Iterator.Value, as documented in the leveldb/db package.
+//
+// Next decodes only where the value is. For a table written with the
+// ValuePrefixCompression option, whose values are built from the prefixes of
+// their predecessors, Value builds the value when it is first called, so a
+// caller that skips a value also skips copying it. Otherwise, the value is a
+// slice of the data block.
+func (i *Iterator) Value() []byte {
+	if i.data == nil {
+		return nil
+	}
+	return i.data.Value()
+}
+
+// KeyLen returns the length of the current key, as per len(i.Key()), such as
+// to account for memory before copying the key. It is a constant-time
+// operation, as Next has already decoded the key.
+func (i *Iterator) KeyLen() int {
+	if i.data == nil {
+		return 0
+	}
+	return i.data.KeyLen()
+}
+
+// ValueLen returns the length of the current value, as per len(i.Value()). It
+// is a constant-time operation, as Next has already decoded the value's
+// length, and it does not build the value as Value may.
+func (i *Iterator) ValueLen() int {
+	if i.data == nil {
+		return 0
+	}
+	return i.data.ValueLen()
+}
+
+// Progress estimates how much of the table the iterator has scanned, as a
+// number of bytes done out of a total, such as for a progress bar over a long
+// scan. The total is the length of the file up to its meta blocks, which is
+// roughly the length of the data blocks, and done is the offset of the current
+// data block. The estimate is thus only accurate to within a block, and when
+// the scan started at the first key. Once the iterator is exhausted or closed,
+// done equals total.
+func (i *Iterator) Progress() (done, total uint64) {
+	if i.reader == nil {
+		return 0, 0
+	}
+	total = i.reader.dataEnd
+	if i.data == nil || i.cur.bh.offset > total {
+		return total, total
+	}
+	return i.cur.bh.offset, total
+}
+
+// Seek moves the iterator to the first key/value pair whose key is >= the
+// given key, and returns whether there is such a pair. If there is, Key and
+// Value return that pair immediately, without a call to Next; unlike an
+// iterator returned by Find, Seek does not leave the iterator positioned
+// before the pair.
+//
+// Seek can be called repeatedly, with keys in any order, including after Next
+// has returned false. It reuses the iterator's index and data block iterators,
+// and does not read the data block again if key lies in the block that the
+// iterator is already positioned in. Once the iterator has encountered an
+// error, Seek returns false and Close returns that error.
+func (i *Iterator) Seek(key []byte) bool {
+	if i.reader == nil || i.err != nil {
+		return false
+	}
+	r := i.reader
+	i.readahead = nil
+	// The previous block's separator does not bound the block that is sought.
+	i.cur.sep = nil
+	if err := i.index.seek(r, key, nil); err != nil {
+		i.err = err
+		i.Close()
+		return false
+	}
+	if !i.nextBlock(key, nil) {
+		i.Close()
+		return false
+	}
+	return i.Next()
+}
+
+// Close implements Iterator.Close, as documented in the leveldb/db package.
+//
+// Close does not return the current block's memory to blockBufPool or the
+// Allocator option, as the last Value may still be used after Close, and Seek
+// may reuse the block.
+func (i *Iterator) Close() error {
+	i.data = nil
+	i.readahead = nil
+	return i.err
+}
+
+type filterReader struct {
+	data    []byte
+	offsets []byte // len(offsets) must be a multiple of 4.
+	policy  db.FilterPolicy
+	shift   uint32
+}
+
+func (f *filterReader) valid() bool {
+	return f.data != nil
+}
+
+func (f *filterReader) init(data []byte, policy db.FilterPolicy) (ok bool) {
+	if len(data) < 5 {
+		return false
+	}
+	lastOffset := binary.LittleEndian.Uint32(data[len(data)-5:])
+	if uint64(lastOffset) > uint64(len(data)-5) {
+		return false
+	}
+	data, offsets, shift := data[:lastOffset], data[lastOffset:len(data)-1], uint32(data[len(data)-1])
+	if len(offsets)&3 != 0 {
+		return false
+	}
+	f.data = data
+	f.offsets = offsets
+	f.policy = policy
+	f.shift = shift
+	return true
+}
+
+func (f *filterReader) mayContain(blockOffset uint64, key []byte) bool {
+	index := blockOffset >> f.shift
+	if index >= uint64(len(f.offsets)/4-1) {
+		return true
+	}
+	i := binary.LittleEndian.Uint32(f.offsets[4*index+0:])
+	j := binary.LittleEndian.Uint32(f.offsets[4*index+4:])
+	if i >= j || uint64(j) > uint64(len(f.data)) {
+		return true
+	}
+	return f.policy.MayContain(f.data[i:j], key)
+}
+
+// Reader is a table reader. It implements the DB interface, as documented
+// in the leveldb/db package.
+type Reader struct {
+	file  db.File
+	err   error
+	index block
+	// lazyIndex, if non-nil, is for a Reader returned by NewLazyReader, and
+	// holds the index, which is loaded on first use, instead of index. It is
+	// shared with the Reader's clones. Methods other than loadIndex should
+	// not use index directly.
+	lazyIndex *lazyIndex
+	filter    filterReader
+	// readerOptions are the fields derived from r's options.
+	readerOptions
+	// numDeletions is the number of deletion tombstones recorded in the
+	// properties block, if hasNumDeletions is true.
+	numDeletions    uint64
+	hasNumDeletions bool
+	// globalSeqNum is the global sequence number recorded in the properties
+	// block of a table ingested by RocksDB, or zero if there is none.
+	globalSeqNum uint64
+	// maxKeyLen and maxValueLen are the lengths of the longest key and value,
+	// as recorded in the properties block, if hasMaxLens is true. Otherwise,
+	// maxLensScan caches the lengths once they are found by scanning the
+	// table, and is shared with the Reader's clones.
+	maxKeyLen, maxValueLen int
+	hasMaxLens             bool
+	maxLensScan            *maxLensScan
+	// properties maps the names of the properties in the properties block to
+	// their values. It is nil if there is no properties block.
+	properties map[string][]byte
+	// partitionedIndex is whether index is the top level of a two-level
+	// index, whose entries are the handles of index partitions instead of
+	// data blocks.
+	partitionedIndex bool
+	// indexFingerprint is the checksum of index, computed when the index is
+	// read, which identifies the table for position tokens. A lazy index
+	// holds its own.
+	indexFingerprint uint32
+	// dataFormat is the format of the data blocks, as given by the value
+	// prefix property. Other blocks are always in the standard format.
+	dataFormat blockFormat
+	// size is the file's size when it was opened.
+	size int64
+	// mmap is the file, if it is an MmapFile.
+	mmap MmapFile
+	// singleBlock, if non-nil, is the only data block of a table whose index
+	// has one entry. Get and Has seek directly in that block.
+	singleBlock *singleBlock
+	// prefixFiltered is whether the table's filter also holds the prefixes
+	// of its keys, as extracted by a PrefixExtractor of the same name as the
+	// PrefixExtractor option.
+	prefixFiltered bool
+	// shared counts the references to file, from r and its clones.
+	shared *sharedFile
+	// rangeDels are the table's range tombstones, in the order of the range
+	// deletion block.
+	rangeDels []RangeTombstone
+	// chunk, if non-nil, holds the last chunk read as per the ReadChunkSize
+	// option. It is shared with the Reader's clones.
+	chunk *readChunk
+	// dataEnd is the offset of the metaindex block, or of the index block if
+	// there is no metaindex. The data blocks are all before that offset.
+	dataEnd uint64
+	// decompressedCRCs maps the offsets of the table's data blocks to the
+	// checksums of their decompressed contents, as recorded by the writer,
+	// if the VerifyDecompressed option is set.
+	decompressedCRCs map[uint64]uint32
+}
+
+// Reader implements the db.DB interface.
+var _ db.DB = (*Reader)(nil)
+
+// readerOptions are the fields of a Reader that are derived from its
+// db.Options, rather than from the table's contents, so that Reopen carries
+// them over as they are.
+type readerOptions struct {
+	comparer        db.Comparer
+	readaheadBlocks int
+	verifyChecksums bool
+	// seekLimit and seekWarnThreshold are the BlockSeekLimit and
+	// BlockSeekWarnThreshold options.
+	seekLimit         int
+	seekWarnThreshold int
+	// linearSeekThreshold is the LinearSeekThreshold option.
+	linearSeekThreshold int
+	logger              db.Logger
+	// onBlockRead is the OnBlockRead option.
+	onBlockRead func(db.BlockReadInfo)
+	// allocator is the Allocator option.
+	allocator db.Allocator
+	// checkComparer is whether the Comparer option was set, in which case a
+	// table that records a different comparer name is rejected. A reader
+	// with the default Comparer, such as a tool that dumps any table, reads
+	// the table whatever comparer it records.
+	checkComparer bool
+	// checkKey is the CheckKey option. If the CheckKeyContinue option is
+	// set, keyChecks records the keys that fail it, and is shared with the
+	// Reader's clones.
+	checkKey  func(key []byte) error
+	keyChecks *keyChecks
+	// cache is the data block cache, from the BlockCache option or of
+	// BlockCacheSize bytes, or nil if blocks are not cached.
+	cache db.BlockCache
+	// maxBlockSize is copied from the db.Options MaxBlockSize. If positive,
+	// it is the largest decompressed length of a block that may be read.
+	maxBlockSize int
+	// filterPolicy is the FilterPolicy option.
+	filterPolicy db.FilterPolicy
+	// paranoidChecks is the ParanoidChecks option.
+	paranoidChecks bool
+	// prefixExtractor is the PrefixExtractor option.
+	prefixExtractor db.PrefixExtractor
+	// timer, if non-nil, accumulates the time spent reading and
+	// decompressing, as per the TimeReads option. It is shared with the
+	// Reader's clones.
+	timer *readTimer
+	// verifyDecompressed is the VerifyDecompressed option.
+	verifyDecompressed bool
+	// readChunkSize is the ReadChunkSize option.
+	readChunkSize int
+}
+
+// newReaderOptions returns the readerOptions for the given db.Options.
+func newReaderOptions(o *db.Options) readerOptions {
+	ro := readerOptions{
+		comparer:            o.GetComparer(),
+		readaheadBlocks:     o.GetReadaheadBlocks(),
+		verifyChecksums:     o.GetVerifyChecksums(),
+		seekLimit:           o.GetBlockSeekLimit(),
+		seekWarnThreshold:   o.GetBlockSeekWarnThreshold(),
+		linearSeekThreshold: o.GetLinearSeekThreshold(),
+		logger:              o.GetLogger(),
+		onBlockRead:         o.GetOnBlockRead(),
+		allocator:           o.GetAllocator(),
+		checkComparer:       o != nil && o.Comparer != nil,
+		checkKey:            o.GetCheckKey(),
+		maxBlockSize:        o.GetMaxBlockSize(),
+		filterPolicy:        o.GetFilterPolicy(),
+		paranoidChecks:      o.GetParanoidChecks(),
+		prefixExtractor:     o.GetPrefixExtractor(),
+		verifyDecompressed:  o.GetVerifyDecompressed(),
+		readChunkSize:       o.GetReadChunkSize(),
+	}
+	if c := o.GetBlockCache(); c != nil {
+		ro.cache = c
+	} else if n := o.GetBlockCacheSize(); n > 0 {
+		c := &blockCache{}
+		c.init(n)
+		ro.cache = c
+	}
+	if o.GetTimeReads() {
+		ro.timer = &readTimer{}
+	}
+	if ro.checkKey != nil && o.GetCheckKeyContinue() {
+		ro.keyChecks = &keyChecks{}
+	}
+	return ro
+}
+
+// sharedFile counts the Readers, a Reader and its clones, that share a file.
+type sharedFile struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// Clone returns a new Reader for the same table as r. It shares r's file,
+// index, filter and block cache, so cloning does no I/O. A Reader is already
+// safe for concurrent use, but clones can be handed out and closed
+// independently, such as by a pool of Readers: closing r or any of its clones
+// closes the file only once r and all of its clones have been closed. Clone
+// must not be called concurrently with r's Close or Reopen methods.
+func (r *Reader) Clone() *Reader {
+	if r.err != nil {
+		return &Reader{err: r.err}
+	}
+	r.shared.mu.Lock()
+	r.shared.refs++
+	r.shared.mu.Unlock()
+	c := *r
+	return &c
+}
+
+// closeFile releases r's reference to its file, closing the file if that
+// was the last reference.
+func (r *Reader) closeFile() error {
+	f := r.file
+	r.file = nil
+	if s := r.shared; s != nil {
+		s.mu.Lock()
+		s.refs--
+		last := s.refs == 0
+		s.mu.Unlock()
+		if !last {
+			return nil
+		}
+	}
+	return f.Close()
+}
+
+// Close implements DB.Close, as documented in the leveldb/db package.
+//
+// For a Reader that has been cloned, or is a clone, the file is only closed
+// once the Reader and all of its clones have been closed.
+func (r *Reader) Close() error {
+	if r.err != nil {
+		if r.file != nil {
+			r.closeFile()
+		}
+		return r.err
+	}
+	if r.file != nil {
+		r.err = r.closeFile()
+		if r.err != nil {
+			return r.err
+		}
+	}
+	// Make any future calls to Get, Find or Close return an error.
+	r.err = errors.New("leveldb/table: reader is closed")
 	return nil
 }
 
 // Get implements DB.Get, as documented in the leveldb/db package.
+//
+// The table contains the key if it has a key that the Reader's Comparer
+// considers equal to it, even if the two keys are not byte-for-byte equal.
+// Get returns db.ErrNotFound only if the table does not contain the key. Any
+// other error, such as a corrupt block, means that Get could not tell whether
+// the key is present.
 func (r *Reader) Get(key []byte, o *db.ReadOptions) (value []byte, err error) {
 	if r.err != nil {
 		return nil, r.err
 	}
-	f := (*filterReader)(nil)
-	if r.filter.valid() {
-		f = &r.filter
-	}
-	i := r.find(key, o, f)
-	if !i.Next() || !bytes.Equal(key, i.Key()) {
-		err := i.Close()
-		if err == nil {
-			err = db.ErrNotFound
+	i := r.lookup(key, o)
+	if !i.Next() {
+		// Either the key is absent, or there was an error while looking for
+		// it, such as a corrupt block. Only the former is db.ErrNotFound.
+		if err := i.Close(); err != nil {
+			return nil, err
 		}
-		return nil, err
+		return nil, db.ErrNotFound
+	}
+	if r.comparer.Compare(key, i.Key()) != 0 {
+		// The key is absent, as the iterator is positioned at a larger key.
+		// The iterator has no error, so there is nothing else to report.
+		i.Close()
+		return nil, db.ErrNotFound
 	}
 	return i.Value(), i.Close()
 }
 
+// Has returns whether the table contains the given key. Unlike Get, it does
+// not return the value associated with that key. It returns false and a nil
+// error if the key is not in the table, and a non-nil error only if the table
+// could not be read.
+func (r *Reader) Has(key []byte, o *db.ReadOptions) (bool, error) {
+	if r.err != nil {
+		return false, r.err
+	}
+	i := r.lookup(key, o)
+	found := i.Next() && r.comparer.Compare(key, i.Key()) == 0
+	if err := i.Close(); err != nil && err != db.ErrNotFound {
+		return false, err
+	}
+	return found, nil
+}
+
 // Set is provided to implement the DB interface, but returns an error, as a
 // Reader cannot write to a table.
 func (r *Reader) Set(key, value []byte, o *db.WriteOptions) error {
@@ -359,63 +1587,662 @@ func (r *Reader) Delete(key []byte, o *db.WriteOptions) error {
 
 // Find implements DB.Find, as documented in the leveldb/db package.
 func (r *Reader) Find(key []byte, o *db.ReadOptions) db.Iterator {
-	return r.find(key, o, nil)
+	return r.find(key, o, nil, nil)
+}
+
+// FindInto is like Find, except that it repositions it, an Iterator that was
+// returned by Find or FindInto or that is the zero Iterator, instead of
+// allocating a new one. The iterator's index and data block iterators, and
+// their buffers, are reused, and the iterator's current data block is not
+// read again if the key lies in it. A caller that pools its Iterators can
+// thus look up keys without allocating.
+//
+// Any state of it from its previous use, such as an error, is discarded, and
+// the keys and values that it returned are no longer valid.
+func (r *Reader) FindInto(it *Iterator, key []byte, o *db.ReadOptions) {
+	if it.reader != r {
+		// The current block, if any, is part of another table.
+		it.cur.release()
+	}
+	it.cur.sep = nil
+	*it = Iterator{
+		index:    it.index,
+		cur:      it.cur,
+		dataIter: it.dataIter,
+	}
+	r.find(key, o, nil, it)
+}
+
+// ErrCanceled is the error returned by an iterator from FindCancelable whose
+// iteration was canceled.
+var ErrCanceled = errors.New("leveldb/table: iteration canceled")
+
+// FindCancelable is like Find, except that iteration can be canceled by
+// closing the cancel channel. The iterator checks the channel before loading
+// each data block, and once it is closed, the iterator's Next returns false
+// and its Close returns ErrCanceled. Thus a canceled scan stops within one
+// block of further work.
+func (r *Reader) FindCancelable(key []byte, o *db.ReadOptions, cancel <-chan struct{}) db.Iterator {
+	return r.find(key, o, nil, &Iterator{cancel: cancel})
+}
+
+// FindWith is like Find, except that it seeks using the Comparer c instead of
+// the table's Comparer. This is for callers that understand the table's key
+// encoding, such as to seek while ignoring a key suffix that the table's
+// Comparer uses as a tiebreak. The table's keys, including the index's
+// separators, must be in increasing or equal order according to c, or the
+// seek may skip keys. Only seeking, including later calls to the Iterator's
+// Seek method, uses c. Iteration still visits keys in the table's order.
+func (r *Reader) FindWith(key []byte, o *db.ReadOptions, c db.Comparer) db.Iterator {
+	return r.find(key, o, nil, &Iterator{comparer: c})
+}
+
+// SeekExact returns an iterator positioned at the first key/value pair whose
+// key is >= the given key, and whether that pair's key is equal to the given
+// key according to the table's Comparer. As with the Iterator's Seek method,
+// and unlike Find, Key and Value return that pair immediately, without a call
+// to Next, whether or not it is an exact match.
+//
+// If there is no such pair, the iterator is exhausted and exact is false. The
+// error is non-nil if the table could not be read; it is also returned by the
+// iterator's Close method.
+func (r *Reader) SeekExact(key []byte, o *db.ReadOptions) (iter db.Iterator, exact bool, err error) {
+	i := r.find(key, o, nil, nil)
+	if !i.Next() {
+		return i, false, i.Close()
+	}
+	return i, r.comparer.Compare(key, i.Key()) == 0, nil
+}
+
+// FindLE returns an iterator positioned at the last key/value pair whose key
+// is <= the given key, such as for a floor lookup. As with SeekExact, Key and
+// Value return that pair immediately, without a call to Next, and Next then
+// moves forwards through the table, to the following pairs. If every key is
+// greater than the given key, the iterator is exhausted, and its Close
+// returns any error in reading the table.
+//
+// FindLE seeks as Find does, to the block that holds the first key that is
+// >= the given key, and steps back from that key within the block. Only if
+// every key of that block is greater, or every block's keys are less, does it
+// step back to the previous index entry, and load that entry's block, which
+// costs about two seeks.
+func (r *Reader) FindLE(key []byte, o *db.ReadOptions) db.Iterator {
+	i := r.find(key, o, nil, nil)
+	if i.err != nil {
+		return i
+	}
+	if i.data != nil {
+		ok, err := i.cur.b.seekBeforeInto(&i.dataIter, r.comparer, key, true)
+		if err != nil {
+			i.err = err
+			i.Close()
+			return i
+		}
+		if ok {
+			i.Next()
+			return i
+		}
+	}
+	// The floor, if any, is the last key of the block before that block, or
+	// of the last block if the key is after every block's separator.
+	for _, l := range i.readahead {
+		l.release()
+	}
+	i.readahead = nil
+	ok, err := i.index.seekBefore(r, key)
+	if err != nil || !ok {
+		i.err = err
+		i.Close()
+		return i
+	}
+	if !i.nextBlock(nil, nil) {
+		i.Close()
+		return i
+	}
+	if ok, err := i.cur.b.seekBeforeInto(&i.dataIter, r.comparer, key, true); err != nil || !ok {
+		// A block with no keys has no floor, and the next block's keys are
+		// all greater.
+		i.err = err
+		i.Close()
+		return i
+	}
+	i.Next()
+	return i
+}
+
+// SeekStats describes how a seek within a table was served.
+type SeekStats struct {
+	// BlocksRead is the number of data blocks and index partitions read from
+	// the file.
+	BlocksRead int
+	// CacheHits is the number of data blocks and index partitions found in
+	// the block cache.
+	CacheHits int
+	// Comparisons is the number of key comparisons performed.
+	Comparisons int
+	// FilterChecked is whether the table's filter was consulted. Only seeks
+	// for a single key, such as those done by Get and Has, consult the filter.
+	FilterChecked bool
+}
+
+// comparer returns c, wrapped to count comparisons in s if s is non-nil.
+func (s *SeekStats) comparer(c db.Comparer) db.Comparer {
+	if s == nil {
+		return c
+	}
+	return countingComparer{c, &s.Comparisons}
+}
+
+// countingComparer is a db.Comparer that counts calls to Compare.
+type countingComparer struct {
+	db.Comparer
+	n *int
+}
+
+func (c countingComparer) Compare(a, b []byte) int {
+	*c.n++
+	return c.Comparer.Compare(a, b)
+}
+
+// SeekWithStats is like Find, except that it also returns the cost of
+// positioning the iterator: how many blocks were read and how many were found
+// in the block cache, and how many key comparisons were performed. The
+// statistics cover only the initial seek, not any subsequent calls to the
+// iterator's Next method.
+func (r *Reader) SeekWithStats(key []byte, o *db.ReadOptions) (db.Iterator, SeekStats) {
+	var stats SeekStats
+	i := r.find(key, o, nil, &Iterator{stats: &stats})
+	return i, stats
+}
+
+// Touch marks the cached data block that would contain the given key, if that
+// block is cached, as the most recently used. It never reads data blocks from
+// the file, and does nothing if r has no block cache or the block is not
+// cached. For a partitioned index, it may read an index partition, and it
+// returns any error doing so. Touch calls the block cache's Get method.
+func (r *Reader) Touch(key []byte) error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.cache == nil {
+		return nil
+	}
+	i, err := r.newIndexIter(key)
+	if err != nil {
+		return err
+	}
+	if i.Next() {
+		if h, n := decodeBlockHandle(i.Value()); n != 0 {
+			r.cache.Get(h.offset, h.length)
+		}
+	}
+	return i.Close()
+}
+
+// CompressionStats summarizes the compression of a table's data blocks.
+type CompressionStats struct {
+	// CompressedBytes is the total on-disk length of the data blocks,
+	// excluding their trailers.
+	CompressedBytes uint64
+	// UncompressedBytes is the total length of the decompressed data blocks.
+	UncompressedBytes uint64
+	// NumBlocks is the number of data blocks for each compression algorithm.
+	NumBlocks map[db.Compression]int
+}
+
+// CompressionStats returns the compression statistics of the table's data
+// blocks. It reads each block's trailer and, for compressed blocks, the
+// decompressed length in the block's header, but does not read or
+// decompress the whole block.
+func (r *Reader) CompressionStats() (CompressionStats, error) {
+	if r.err != nil {
+		return CompressionStats{}, r.err
+	}
+	i, err := r.newIndexIter(nil)
+	if err != nil {
+		return CompressionStats{}, err
+	}
+	s := CompressionStats{
+		NumBlocks: map[db.Compression]int{},
+	}
+	var trailer [blockTrailerLen]byte
+	var header [binary.MaxVarintLen32]byte
+	for i.Next() {
+		v := i.Value()
+		h, n := decodeBlockHandle(v)
+		if n == 0 || n != len(v) {
+			i.Close()
+			return CompressionStats{}, errCorruptIndexEntry
+		}
+		if err := r.readAt(trailer[:], int64(h.offset+h.length)); err != nil {
+			i.Close()
+			return CompressionStats{}, err
+		}
+		s.CompressedBytes += h.length
+		switch trailer[0] {
+		case noCompressionBlockType:
+			s.UncompressedBytes += h.length
+			s.NumBlocks[db.NoCompression]++
+		case snappyCompressionBlockType:
+			b := header[:]
+			if uint64(len(b)) > h.length {
+				b = b[:h.length]
+			}
+			if err := r.readAt(b, int64(h.offset)); err != nil {
+				i.Close()
+				return CompressionStats{}, err
+			}
+			n, err := snappy.DecodedLen(b)
+			if err != nil {
+				i.Close()
+				return CompressionStats{}, err
+			}
+			s.UncompressedBytes += uint64(n)
+			s.NumBlocks[db.SnappyCompression]++
+		default:
+			i.Close()
+			return CompressionStats{}, corruptionErrorf(int64(h.offset+h.length), "unknown block compression %d", trailer[0])
+		}
+	}
+	if err := i.Close(); err != nil {
+		return CompressionStats{}, err
+	}
+	return s, nil
+}
+
+// MaxKeyLen returns the length of the longest key in the table. It is read
+// from the table's properties, if they record it, as they do for a table
+// written by this package. Otherwise, the first call to MaxKeyLen or
+// MaxValueLen scans the entire table, without building its values, to find
+// both lengths.
+func (r *Reader) MaxKeyLen() (int, error) {
+	keyLen, _, err := r.maxLens()
+	return keyLen, err
+}
+
+// MaxValueLen returns the length of the longest value in the table. As for
+// MaxKeyLen, it is read from the table's properties if they record it, and
+// the table is otherwise scanned at most once.
+func (r *Reader) MaxValueLen() (int, error) {
+	_, valueLen, err := r.maxLens()
+	return valueLen, err
+}
+
+// CountKeys returns the number of key/value pairs in the table. If the table's
+// properties record the number of entries, that number is returned without
+// reading any data blocks. Otherwise, the table is scanned to count its keys;
+// values are not copied during that scan.
+func (r *Reader) CountKeys() (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if v, ok := r.properties[numEntriesPropertyName]; ok {
+		n, m := binary.Uvarint(v)
+		if m <= 0 || m != len(v) || n > uint64(maxInt) {
+			return 0, corruptionErrorf(-1, "bad %s property", numEntriesPropertyName)
+		}
+		return int(n), nil
+	}
+	n := 0
+	i := r.Find(nil, nil)
+	for i.Next() {
+		n++
+	}
+	if err := i.Close(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// maxInt is the largest int value.
+const maxInt = int(^uint(0) >> 1)
+
+// maxLensScan holds the lengths of the longest key and value of a table that
+// does not record them, once maxLens has scanned the table for them.
+type maxLensScan struct {
+	mu                     sync.Mutex
+	done                   bool
+	maxKeyLen, maxValueLen int
+}
+
+// maxLens returns the lengths of the longest key and value in the table, from
+// its properties or, failing that, from a scan. A failed scan is not cached.
+func (r *Reader) maxLens() (keyLen, valueLen int, err error) {
+	if r.err != nil {
+		return 0, 0, r.err
+	}
+	if r.hasMaxLens {
+		return r.maxKeyLen, r.maxValueLen, nil
+	}
+	s := r.maxLensScan
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return s.maxKeyLen, s.maxValueLen, nil
+	}
+	i := r.find(nil, nil, nil, nil)
+	for i.Next() {
+		if n := i.KeyLen(); keyLen < n {
+			keyLen = n
+		}
+		if n := i.ValueLen(); valueLen < n {
+			valueLen = n
+		}
+	}
+	if err := i.Close(); err != nil {
+		return 0, 0, err
+	}
+	s.maxKeyLen, s.maxValueLen, s.done = keyLen, valueLen, true
+	return keyLen, valueLen, nil
+}
+
+// find is like Find, except that if f is non-nil, it is consulted to rule out
+// the data block that would contain the key sought. The returned iterator is
+// i, which may be nil, or may be a new Iterator whose stats and cancel fields
+// are set. If i.stats is non-nil, the cost of the seek is added to it.
+func (r *Reader) find(key []byte, o *db.ReadOptions, f *filterReader, i *Iterator) *Iterator {
+	if i == nil {
+		i = &Iterator{}
+	}
+	if r.err != nil {
+		i.err = r.err
+		return i
+	}
+	i.reader = r
+	if i.index == nil {
+		i.index = &indexIter{}
+	}
+	i.index.comparer = i.comparer
+	i.verifyChecksums = o.GetVerifyChecksums(r.verifyChecksums)
+	i.dataIter.format = r.dataFormat
+	i.dataIter.linearSeek = r.linearSeekThreshold
+	i.dataIter.globalSeqNum = r.globalSeqNum
+	if err := i.index.seek(r, key, i.stats); err != nil {
+		// i.index is kept, so that FindInto can reuse it.
+		i.reader, i.err = nil, err
+		return i
+	}
+	i.nextBlock(key, f)
+	i.stats = nil
+	return i
+}
+
+// readDataBlock is like readBlock, except that it uses the block cache, if r
+// has one, and verify gives whether to verify the checksum of a block not in
+// the cache. If stats is non-nil, whether the block was read or found in the
+// cache is added to it.
+func (r *Reader) readDataBlock(bh blockHandle, verify bool, stats *SeekStats) (block, error) {
+	if r.cache != nil {
+		if b, ok := r.cache.Get(bh.offset, bh.length); ok {
+			if stats != nil {
+				stats.CacheHits++
+			}
+			return b, nil
+		}
+	}
+	if stats != nil {
+		stats.BlocksRead++
+	}
+	raw, blockType, err := r.readRawBlock(bh, verify)
+	if err != nil {
+		return nil, err
+	}
+	b, err := r.decompress(raw, blockType)
+	r.freeRaw(raw, blockType)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.checkDecompressed(bh, blockType, b); err != nil {
+		return nil, err
+	}
+	r.blockRead(bh, blockType, b)
+	if r.cache != nil {
+		r.cache.Put(bh.offset, bh.length, b)
+	}
+	return b, nil
+}
+
+// readBlock reads and decompresses a block from disk into memory.
+func (r *Reader) readBlock(bh blockHandle) (block, error) {
+	raw, blockType, err := r.readRawBlock(bh, r.verifyChecksums)
+	if err != nil {
+		return nil, err
+	}
+	b, err := r.decompress(raw, blockType)
+	r.freeRaw(raw, blockType)
+	return b, err
+}
+
+// readPooledBlock is like readBlock, except that the returned block's memory
+// is drawn from r.getBlockBuf. The caller owns that memory, and should pass
+// the block to r.putBlockBuf once it is no longer referenced.
+func (r *Reader) readPooledBlock(bh blockHandle, verify bool) (block, error) {
+	buf := r.getBlockBuf(int(bh.length + blockTrailerLen))
+	if err := r.readAt(buf, int64(bh.offset)); err != nil {
+		r.putBlockBuf(buf)
+		return nil, err
+	}
+	b, blockType, err := r.checkBlock(buf, bh.offset, verify)
+	if err != nil {
+		r.putBlockBuf(buf)
+		return nil, err
+	}
+	switch blockType {
+	case noCompressionBlockType:
+		r.blockRead(bh, blockType, b)
+		return b, nil
+	case snappyCompressionBlockType:
+		// The compressed bytes are not needed once they are decoded, so buf
+		// goes back to the pool either way.
+		defer r.putBlockBuf(buf)
+		n, err := snappy.DecodedLen(b)
+		if err != nil {
+			return nil, err
+		}
+		dst := r.getBlockBuf(n)
+		var start time.Time
+		if r.timer != nil {
+			start = time.Now()
+		}
+		d, err := snappy.Decode(dst, b)
+		if r.timer != nil {
+			r.timer.addDecompression(start)
+		}
+		if err != nil {
+			r.putBlockBuf(dst)
+			return nil, err
+		}
+		if err := r.checkDecompressed(bh, blockType, d); err != nil {
+			r.putBlockBuf(dst)
+			return nil, err
+		}
+		r.blockRead(bh, blockType, d)
+		return d, nil
+	}
+	r.putBlockBuf(buf)
+	return nil, corruptionErrorf(-1, "unknown block compression %d", blockType)
+}
+
+// blockRead reports to the OnBlockRead option, if set, that the block with
+// handle bh and the given block type was read and decompressed to b.
+func (r *Reader) blockRead(bh blockHandle, blockType byte, b block) {
+	if r.onBlockRead == nil {
+		return
+	}
+	c := db.NoCompression
+	if blockType == snappyCompressionBlockType {
+		c = db.SnappyCompression
+	}
+	r.onBlockRead(db.BlockReadInfo{
+		Offset:          bh.offset,
+		CompressedLen:   int(bh.length),
+		DecompressedLen: len(b),
+		Compression:     c,
+	})
+}
+
+// blockBufPool holds the memory of blocks that are no longer referenced, to be
+// reused for reading and decoding other blocks. Its elements are []byte
+// values of varying capacity.
+var blockBufPool sync.Pool
+
+// getBlockBuf returns a buffer of length n, from blockBufPool if the pooled
+// buffer is large enough.
+func getBlockBuf(n int) []byte {
+	if b, ok := blockBufPool.Get().([]byte); ok && cap(b) >= n {
+		return b[:n]
+	}
+	return make([]byte, n)
+}
+
+// putBlockBuf returns b's memory to blockBufPool. b must not be used after.
+func putBlockBuf(b []byte) {
+	blockBufPool.Put(b[:0])
+}
+
+// readRawBlock reads a block from disk into memory, verifying its checksum if
+// verify is true, but does not decompress it. It returns the block's bytes,
+// excluding the trailer, and the block type given by that trailer.
+//
+// If r's file is an MmapFile, the returned bytes alias its mapping.
+func (r *Reader) readRawBlock(bh blockHandle, verify bool) ([]byte, byte, error) {
+	b, err := r.readBlockAndTrailer(bh)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r.checkBlock(b, bh.offset, verify)
+}
+
+// readBlockAndTrailer returns the bytes of the block with handle bh followed
+// by its trailer, as stored in the file, aliasing the file's mapping if r's
+// file is an MmapFile.
+func (r *Reader) readBlockAndTrailer(bh blockHandle) ([]byte, error) {
+	if b := r.mmapAt(bh.offset, bh.length+blockTrailerLen); b != nil {
+		return b, nil
+	}
+	b := r.alloc(int(bh.length + blockTrailerLen))
+	if err := r.readAt(b, int64(bh.offset)); err != nil {
+		r.free(b)
+		return nil, err
+	}
+	return b, nil
+}
+
+// readAt reads len(b) bytes from the file starting at byte offset off. If
+// the ReadChunkSize option is set, the bytes may come from, or be read as part
+// of, a larger aligned chunk.
+func (r *Reader) readAt(b []byte, off int64) error {
+	if r.chunk != nil {
+		return r.chunk.readAt(r, b, off)
+	}
+	return r.readExactlyAt(b, off)
+}
+
+// readExactlyAt is like readAt, except that it always reads exactly len(b)
+// bytes from the file.
+func (r *Reader) readExactlyAt(b []byte, off int64) error {
+	if r.timer != nil {
+		defer r.timer.addRead(time.Now())
+	}
+	return readFullAt(r.file, b, off)
+}
+
+// readFullAt reads exactly len(b) bytes from f at offset off. An io.ReaderAt
+// should only return fewer bytes along with an error, but some, such as those
+// backed by a network stream, return short reads with a nil error, so the
+// rest is read by further calls. If f has no more bytes to give, the result
+// is a CorruptionError for the short read.
+func readFullAt(f io.ReaderAt, b []byte, off int64) error {
+	start, want := off, len(b)
+	for {
+		n, err := f.ReadAt(b, off)
+		b, off = b[n:], off+int64(n)
+		if len(b) == 0 {
+			// An io.ReaderAt may return io.EOF along with a full read, if
+			// that read ends at the end of the file.
+			return nil
+		}
+		if err == io.EOF || (err == nil && n == 0) {
+			return corruptionErrorf(off, "short read: got %d of the %d bytes at offset %d", off-start, want, start)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// checkBlock splits b, a block followed by its trailer, into the block's
+// bytes and its block type, verifying the checksum if verify is true. The
+// block's file offset is used for error messages.
+func (r *Reader) checkBlock(b []byte, offset uint64, verify bool) ([]byte, byte, error) {
+	n := len(b) - blockTrailerLen
+	if verify {
+		if err := checkChecksum(b, offset); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := r.checkBlockSize(b[:n], b[n], offset); err != nil {
+		return nil, 0, err
+	}
+	return b[:n], b[n], nil
 }
 
-func (r *Reader) find(key []byte, o *db.ReadOptions, f *filterReader) db.Iterator {
-	if r.err != nil {
-		return &tableIter{err: r.err}
+// checkBlockSize checks that the bytes b of a block of the given type do not
+// decompress to more than the MaxBlockSize option, if set. For a compressed
+// block, that decompressed length is read from the block's header, before
+// any memory is allocated to decompress it. The block's file offset is used
+// for error messages.
+func (r *Reader) checkBlockSize(b []byte, blockType byte, offset uint64) error {
+	if r.maxBlockSize <= 0 {
+		return nil
 	}
-	index, err := r.index.seek(r.comparer, key)
-	if err != nil {
-		return &tableIter{err: err}
+	n := len(b)
+	if blockType == snappyCompressionBlockType {
+		var err error
+		if n, err = snappy.DecodedLen(b); err != nil {
+			return err
+		}
 	}
-	i := &tableIter{
-		reader: r,
-		index:  index,
+	if n > r.maxBlockSize {
+		return corruptionErrorf(int64(offset), "block decompresses to %d bytes, more than the maximum block size of %d", n, r.maxBlockSize)
 	}
-	i.nextBlock(key, f)
-	return i
+	return nil
 }
 
-// readBlock reads and decompresses a block from disk into memory.
-func (r *Reader) readBlock(bh blockHandle) (block, error) {
-	b := make([]byte, bh.length+blockTrailerLen)
-	if _, err := r.file.ReadAt(b, int64(bh.offset)); err != nil {
-		return nil, err
+// checkChecksum verifies the checksum of b, a block followed by its trailer.
+// The block's file offset is used for error messages.
+func checkChecksum(b []byte, offset uint64) error {
+	n := len(b) - blockTrailerLen
+	checksum0 := binary.LittleEndian.Uint32(b[n+1:])
+	checksum1 := crc.New(b[:n+1]).Value()
+	if checksum0 != checksum1 {
+		return corruptionErrorf(int64(offset), "checksum mismatch")
 	}
-	if r.verifyChecksums {
-		checksum0 := binary.LittleEndian.Uint32(b[bh.length+1:])
-		checksum1 := crc.New(b[:bh.length+1]).Value()
-		if checksum0 != checksum1 {
-			return nil, errors.New("leveldb/table: invalid table (checksum mismatch)")
-		}
-	}
-	switch b[bh.length] {
+	return nil
+}
+
+// decompressBlock decompresses the bytes b of a block of the given type.
+func decompressBlock(b []byte, blockType byte) (block, error) {
+	switch blockType {
 	case noCompressionBlockType:
-		return b[:bh.length], nil
+		return b, nil
 	case snappyCompressionBlockType:
-		b, err := snappy.Decode(nil, b[:bh.length])
+		b, err := snappy.Decode(nil, b)
 		if err != nil {
 			return nil, err
 		}
 		return b, nil
 	}
-	return nil, fmt.Errorf("leveldb/table: unknown block compression: %d", b[bh.length])
+	return nil, corruptionErrorf(-1, "unknown block compression %d", blockType)
 }
 
-func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
-	fp := o.GetFilterPolicy()
-	if fp == nil {
-		// The only metaindex entry we care about is the filter. If o doesn't
-		// specify a filter policy, we can ignore the entire metaindex block.
-		//
-		// TODO: also return early if metaindexBH.length indicates an empty
-		// block.
+func (r *Reader) readMetaindex(metaindexBH blockHandle) error {
+	if metaindexBH.length == 0 {
+		// Even an empty block has a restart point, so a zero length handle
+		// means that there is no metaindex.
 		return nil
 	}
-
-	b, err := r.readBlock(metaindexBH)
+	b, err := r.readCheckedBlock(metaindexBH, "metaindex")
 	if err != nil {
 		return err
 	}
@@ -423,84 +2250,740 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 	if err != nil {
 		return err
 	}
-	filterName := "filter." + fp.Name()
-	filterBH := blockHandle{}
+	fp := r.filterPolicy
+	filterName := ""
+	if fp != nil {
+		filterName = "filter." + fp.Name()
+	}
+	filterBH, propertiesBH, rangeDelBH := blockHandle{}, blockHandle{}, blockHandle{}
 	for i.Next() {
-		if filterName != string(i.Key()) {
+		var bh *blockHandle
+		switch string(i.Key()) {
+		case filterName:
+			bh = &filterBH
+		case propertiesBlockName:
+			bh = &propertiesBH
+		case rangeDelBlockName:
+			bh = &rangeDelBH
+		default:
 			continue
 		}
 		var n int
-		filterBH, n = decodeBlockHandle(i.Value())
+		*bh, n = decodeBlockHandle(i.Value())
 		if n == 0 {
-			return errors.New("leveldb/table: invalid table (bad filter block handle)")
+			i.Close()
+			return corruptionErrorf(-1, "bad %s block handle", i.Key())
 		}
-		break
 	}
 	if err := i.Close(); err != nil {
 		return err
 	}
 
+	if propertiesBH != (blockHandle{}) {
+		if err := r.readProperties(propertiesBH); err != nil {
+			return err
+		}
+	}
+
+	if rangeDelBH != (blockHandle{}) {
+		if err := r.readRangeDels(rangeDelBH); err != nil {
+			return err
+		}
+	}
+
 	if filterBH != (blockHandle{}) {
 		b, err = r.readBlock(filterBH)
 		if err != nil {
 			return err
 		}
 		if !r.filter.init(b, fp) {
-			return errors.New("leveldb/table: invalid table (bad filter block)")
+			return corruptionErrorf(int64(filterBH.offset), "bad filter block")
+		}
+	}
+	return nil
+}
+
+// readProperties reads the properties block, and checks that the table was
+// written with the same Comparer that r uses.
+func (r *Reader) readProperties(propertiesBH blockHandle) error {
+	b, err := r.readCheckedBlock(propertiesBH, "properties")
+	if err != nil {
+		return err
+	}
+	i, err := b.seek(db.DefaultComparer, nil)
+	if err != nil {
+		return err
+	}
+	r.properties = map[string][]byte{}
+	hasMaxKeyLen, hasMaxValueLen := false, false
+	for i.Next() {
+		// The values are copied, as b may be part of the file's mapping, which
+		// the values returned by Properties could outlive.
+		r.properties[string(i.Key())] = append([]byte(nil), i.Value()...)
+		switch string(i.Key()) {
+		case comparerPropertyName:
+			if got, want := string(i.Value()), r.comparer.Name(); r.checkComparer && got != want {
+				i.Close()
+				return ComparerMismatchError{Table: got, Options: want}
+			}
+		case numDeletionsPropertyName:
+			v, n := binary.Uvarint(i.Value())
+			if n <= 0 || n != len(i.Value()) {
+				i.Close()
+				return corruptionErrorf(int64(propertiesBH.offset), "bad %s property", numDeletionsPropertyName)
+			}
+			r.numDeletions, r.hasNumDeletions = v, true
+		case maxKeyLenPropertyName, maxValueLenPropertyName:
+			v, n := binary.Uvarint(i.Value())
+			if n <= 0 || n != len(i.Value()) || v > uint64(maxInt) {
+				i.Close()
+				return corruptionErrorf(int64(propertiesBH.offset), "bad %s property", i.Key())
+			}
+			if string(i.Key()) == maxKeyLenPropertyName {
+				r.maxKeyLen, hasMaxKeyLen = int(v), true
+			} else {
+				r.maxValueLen, hasMaxValueLen = int(v), true
+			}
+		case globalSeqNumPropertyName:
+			v := i.Value()
+			if len(v) != 8 || binary.LittleEndian.Uint64(v) > internalKeySeqNumMax {
+				i.Close()
+				return corruptionErrorf(int64(propertiesBH.offset), "bad %s property", globalSeqNumPropertyName)
+			}
+			r.globalSeqNum = binary.LittleEndian.Uint64(v)
+		case valuePrefixPropertyName:
+			if string(i.Value()) != "1" {
+				i.Close()
+				return corruptionErrorf(int64(propertiesBH.offset), "unsupported %s property %q", valuePrefixPropertyName, i.Value())
+			}
+			r.dataFormat = valuePrefixBlockFormat
+		case decompressedCRCsPropertyName:
+			if !r.verifyDecompressed {
+				break
+			}
+			m, ok := parseDecompressedCRCs(i.Value())
+			if !ok {
+				i.Close()
+				return corruptionErrorf(int64(propertiesBH.offset), "bad %s property", decompressedCRCsPropertyName)
+			}
+			r.decompressedCRCs = m
+		case prefixExtractorPropertyName:
+			r.prefixFiltered = r.prefixExtractor != nil && string(i.Value()) == r.prefixExtractor.Name()
+		case indexTypePropertyName:
+			if len(i.Value()) != 4 {
+				i.Close()
+				return corruptionErrorf(int64(propertiesBH.offset), "bad %s property", indexTypePropertyName)
+			}
+			switch t := binary.LittleEndian.Uint32(i.Value()); t {
+			case binarySearchIndexType, hashSearchIndexType:
+			case twoLevelIndexType:
+				r.partitionedIndex = true
+			default:
+				i.Close()
+				return corruptionErrorf(int64(propertiesBH.offset), "unsupported index type %d", t)
+			}
+		}
+	}
+	r.hasMaxLens = hasMaxKeyLen && hasMaxValueLen
+	return i.Close()
+}
+
+// Properties returns the table's properties, as recorded in its properties
+// block, mapping each property name to its value. For example, the
+// "rocksdb.num.entries" property, if present, is the number of entries in
+// the table as a varint. The map includes any properties set by
+// Writer.SetUserProperties, whose names start with "user.". If the table has
+// no properties block, Properties returns an empty map. The caller may modify
+// the returned map, but should not modify the contents of its values.
+func (r *Reader) Properties() map[string][]byte {
+	m := make(map[string][]byte, len(r.properties))
+	for k, v := range r.properties {
+		m[k] = v
+	}
+	return m
+}
+
+// Size returns the size of the table's file, as it was when the table was
+// opened or last reopened. It returns zero if the table could not be opened.
+func (r *Reader) Size() int64 {
+	if r.err != nil {
+		return 0
+	}
+	return r.size
+}
+
+// DataSize returns the length of the start of the table's file that precedes
+// the metaindex block, or the index block if there is no metaindex. That is
+// the data blocks, followed by the filter, properties and other meta blocks,
+// if any. Like Size, it is known from opening the table, without any further
+// reads. It returns zero if the table could not be opened.
+func (r *Reader) DataSize() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	return r.dataEnd
+}
+
+// NumDeletions returns the number of deletion tombstones in the table, as
+// recorded in the table's properties block. It returns ok == false if the
+// table does not record that property.
+func (r *Reader) NumDeletions() (n uint64, ok bool, err error) {
+	if r.err != nil {
+		return 0, false, r.err
+	}
+	return r.numDeletions, r.hasNumDeletions, nil
+}
+
+// IndexBlock returns the table's decompressed index block, which can be
+// passed to NewReaderWithIndex to open the same file again without re-reading
+// the index. The caller should not modify the contents of the returned slice.
+// For a Reader returned by NewLazyReader, it reads the index if that has not
+// yet been done, and returns nil if the index cannot be read.
+func (r *Reader) IndexBlock() []byte {
+	index, err := r.loadIndex()
+	if err != nil {
+		return nil
+	}
+	return index
+}
+
+// validIndex returns whether b is plausibly an index block: whether its
+// restart points fit within it.
+func validIndex(b []byte) bool {
+	if len(b) < 4 {
+		return false
+	}
+	numRestarts := uint64(binary.LittleEndian.Uint32(b[len(b)-4:]))
+	return numRestarts != 0 && 4*(numRestarts+1) <= uint64(len(b))
+}
+
+// readCheckedBlock is like readBlock, except that it also checks that the
+// named block's restart points are plausible: that there is at least one, and
+// that they are increasing offsets within the block, starting at zero. The
+// restart points are fixed-size fields, so this catches a table whose blocks
+// are in some other format, such as one with big-endian restart points, when
+// the table is opened instead of when the block is first searched.
+func (r *Reader) readCheckedBlock(bh blockHandle, name string) (block, error) {
+	b, err := r.readBlock(bh)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 4 {
+		return nil, corruptionErrorf(int64(bh.offset), "%s block is too short", name)
+	}
+	numRestarts := binary.LittleEndian.Uint32(b[len(b)-4:])
+	if numRestarts == 0 || uint64(numRestarts) > uint64(len(b)-4)/4 {
+		return nil, corruptionErrorf(int64(bh.offset), "%s block has an implausible number of restart points (%d for %d bytes)", name, numRestarts, len(b))
+	}
+	n := len(b) - 4*(1+int(numRestarts))
+	prev := uint32(0)
+	for j := 0; j < int(numRestarts); j++ {
+		o := binary.LittleEndian.Uint32(b[n+4*j:])
+		// An empty block has a single restart point, at offset zero.
+		if (j == 0 && o != 0) || (j > 0 && (o <= prev || uint64(o) >= uint64(n))) {
+			return nil, corruptionErrorf(int64(bh.offset), "%s block has an implausible restart point %d at offset %d", name, j, o)
 		}
+		prev = o
+	}
+	return b, nil
+}
+
+// checkBlockHandle checks that the named block, including its trailer, lies
+// before the final footerLen bytes of a file of the given size, which are
+// always part of the footer, whatever its version.
+func checkBlockHandle(bh blockHandle, size int64, name string) error {
+	end := bh.offset + bh.length + blockTrailerLen
+	if end < bh.offset || end > uint64(size-footerLen) {
+		return corruptionErrorf(int64(bh.offset), "table truncated: %s block of length %d extends beyond the end of the file", name, bh.length)
 	}
 	return nil
 }
 
+// readFooter reads and validates the footer of f, a file of the given size,
+// and returns the metaindex and index block handles that it holds. Those
+// blocks are checked to lie within the file, so that a truncated file is
+// reported as such, instead of as a failed read. The read is timed with t, if
+// it is non-nil.
+func readFooter(f db.File, size int64, t *readTimer) (metaindexBH, indexBH blockHandle, err error) {
+	if size < footerLen {
+		return blockHandle{}, blockHandle{}, corruptionErrorf(-1, "file size is too small")
+	}
+	// Read enough for either footer. A version 0 footer is the final
+	// footerLen bytes of b.
+	var buf [versionedFooterLen]byte
+	b := buf[:]
+	if size < versionedFooterLen {
+		b = buf[versionedFooterLen-footerLen:]
+	}
+	var start time.Time
+	if t != nil {
+		start = time.Now()
+	}
+	err = readFullAt(f, b, size-int64(len(b)))
+	if t != nil {
+		t.addRead(start)
+	}
+	if _, ok := err.(CorruptionError); ok {
+		return blockHandle{}, blockHandle{}, err
+	} else if err != nil {
+		return blockHandle{}, blockHandle{}, fmt.Errorf("leveldb/table: invalid table (could not read footer): %v", err)
+	}
+	ft, err := parseFooter(b, size-int64(len(b)))
+	if err != nil {
+		return blockHandle{}, blockHandle{}, err
+	}
+	metaindexBH, indexBH = ft.metaindexHandle, ft.indexHandle
+	if err := checkBlockHandle(metaindexBH, size, "metaindex"); err != nil {
+		return blockHandle{}, blockHandle{}, err
+	}
+	if err := checkBlockHandle(indexBH, size, "index"); err != nil {
+		return blockHandle{}, blockHandle{}, err
+	}
+	return metaindexBH, indexBH, nil
+}
+
+// Validate quickly checks that r's file is plausibly a good table, without
+// reading any data blocks. It re-reads the footer, checking the magic number
+// and that the metaindex and index blocks lie within the file, then re-reads
+// the index block, checking its checksum regardless of the VerifyChecksums
+// option, and checks that the index's keys are in non-decreasing order and
+// that its block handles also lie within the file. It is much cheaper than
+// reading the entire table, and is suitable for checking tables at startup.
+func (r *Reader) Validate() error {
+	if r.err != nil {
+		return r.err
+	}
+	stat, err := r.file.Stat()
+	if err != nil {
+		return fmt.Errorf("leveldb/table: invalid table (could not stat file): %v", err)
+	}
+	_, indexBH, err := readFooter(r.file, stat.Size(), r.timer)
+	if err != nil {
+		return err
+	}
+	raw, blockType, err := r.readRawBlock(indexBH, true)
+	if err != nil {
+		return err
+	}
+	index, err := r.decompress(raw, blockType)
+	r.freeRaw(raw, blockType)
+	if err != nil {
+		return err
+	}
+	defer r.freeBlock(index, blockType)
+	i, err := index.seek(r.comparer, nil)
+	if err != nil {
+		return err
+	}
+	var prevKey []byte
+	for first := true; i.Next(); first = false {
+		if !first && r.comparer.Compare(prevKey, i.Key()) > 0 {
+			i.Close()
+			return corruptionErrorf(int64(indexBH.offset), "index keys out of order: %q, %q", prevKey, i.Key())
+		}
+		prevKey = append(prevKey[:0], i.Key()...)
+		h, m := decodeBlockHandle(i.Value())
+		if m == 0 || m != len(i.Value()) {
+			i.Close()
+			return errCorruptIndexEntry
+		}
+		name := "data"
+		if r.partitionedIndex {
+			name = "index partition"
+		}
+		if err := checkBlockHandle(h, stat.Size(), name); err != nil {
+			i.Close()
+			return err
+		}
+	}
+	return i.Close()
+}
+
 // NewReader returns a new table reader for the file. Closing the reader will
 // close the file.
 func NewReader(f db.File, o *db.Options) *Reader {
+	return newReader(f, o, nil, false)
+}
+
+// NewLazyReader is like NewReader, except that it does not read the table's
+// index until it is first needed, such as by the first Get or Find, and then
+// keeps it in memory as per NewReader. The footer, and the meta blocks such as
+// the filter and properties, are still read and validated immediately. This
+// makes opening many tables, of which only some are queried, cheaper in both
+// time and memory. An error reading the index is returned by every operation
+// that needs it.
+func NewLazyReader(f db.File, o *db.Options) *Reader {
+	return newReader(f, o, nil, true)
+}
+
+// NewReaderWithIndex is like NewReader, except that it uses the given index
+// block instead of reading it from the file. The index should be the result
+// of calling IndexBlock on a Reader for the same file, and it may be shared by
+// multiple Readers. The footer is still read and validated. If index is nil or
+// is not a valid index block, it is read from the file as per NewReader.
+func NewReaderWithIndex(f db.File, o *db.Options, index []byte) *Reader {
+	return newReader(f, o, index, false)
+}
+
+// newReader implements NewReader, NewLazyReader and NewReaderWithIndex. If
+// lazy is true and index is not valid, the index is read on first use.
+func newReader(f db.File, o *db.Options, index []byte, lazy bool) *Reader {
 	r := &Reader{
-		file:            f,
-		comparer:        o.GetComparer(),
-		verifyChecksums: o.GetVerifyChecksums(),
+		file:          f,
+		readerOptions: newReaderOptions(o),
+	}
+	if n := r.readChunkSize; n > 0 {
+		r.chunk = &readChunk{size: int64(n)}
 	}
 	if f == nil {
 		r.err = errors.New("leveldb/table: nil file")
 		return r
 	}
-	stat, err := f.Stat()
+	r.mmap, _ = f.(MmapFile)
+	r.shared = &sharedFile{refs: 1}
+	r.err = r.open(index, lazy)
+	return r
+}
+
+// open reads the footer, meta blocks and, unless it is given or lazy is true,
+// the index of r's file. It fills in those fields of r that are derived from
+// the file's contents.
+func (r *Reader) open(index []byte, lazy bool) error {
+	stat, err := r.file.Stat()
 	if err != nil {
-		r.err = fmt.Errorf("leveldb/table: invalid table (could not stat file): %v", err)
-		return r
+		return fmt.Errorf("leveldb/table: invalid table (could not stat file): %v", err)
 	}
-	var footer [footerLen]byte
-	if stat.Size() < int64(len(footer)) {
-		r.err = errors.New("leveldb/table: invalid table (file size is too small)")
-		return r
-	}
-	_, err = f.ReadAt(footer[:], stat.Size()-int64(len(footer)))
-	if err != nil && err != io.EOF {
-		r.err = fmt.Errorf("leveldb/table: invalid table (could not read footer): %v", err)
-		return r
+	r.size = stat.Size()
+	metaindexBH, indexBH, err := readFooter(r.file, r.size, r.timer)
+	if err != nil {
+		return err
 	}
-	if string(footer[footerLen-len(magic):footerLen]) != magic {
-		r.err = errors.New("leveldb/table: invalid table (bad magic number)")
-		return r
+	r.dataEnd = indexBH.offset
+	if metaindexBH.length != 0 {
+		r.dataEnd = metaindexBH.offset
 	}
 
-	// Read the metaindex.
-	metaindexBH, n := decodeBlockHandle(footer[:])
-	if n == 0 {
-		r.err = errors.New("leveldb/table: invalid table (bad metaindex block handle)")
-		return r
+	if err := r.readMetaindex(metaindexBH); err != nil {
+		return err
 	}
-	if err := r.readMetaindex(metaindexBH, o); err != nil {
-		r.err = err
-		return r
+	if !r.hasMaxLens {
+		r.maxLensScan = &maxLensScan{}
 	}
 
 	// Read the index into memory.
-	indexBH, n := decodeBlockHandle(footer[n:])
-	if n == 0 {
-		r.err = errors.New("leveldb/table: invalid table (bad index block handle)")
-		return r
+	switch {
+	case validIndex(index):
+		r.index = index
+	case lazy:
+		r.lazyIndex = &lazyIndex{bh: indexBH}
+		return nil
+	default:
+		if r.index, err = r.readCheckedBlock(indexBH, "index"); err != nil {
+			return err
+		}
 	}
-	r.index, r.err = r.readBlock(indexBH)
-	return r
+	r.indexFingerprint = crc.New(r.index).Value()
+	r.singleBlock = r.findSingleBlock()
+	return nil
+}
+
+// singleBlock is the only data block of a table whose index has one entry.
+type singleBlock struct {
+	bh blockHandle
+	// sep is the index entry's key, which is >= every key in the block.
+	sep []byte
+}
+
+// findSingleBlock returns the only data block of r, if r's index is a single
+// level with exactly one entry, or nil otherwise. Any error decoding the
+// index is left for the index's other users to report.
+func (r *Reader) findSingleBlock() *singleBlock {
+	if r.partitionedIndex {
+		return nil
+	}
+	i, err := r.index.seek(r.comparer, nil)
+	if err != nil || !i.Next() {
+		return nil
+	}
+	s := &singleBlock{sep: i.Key()}
+	h, n := decodeBlockHandle(i.Value())
+	if n == 0 || n != len(i.Value()) || i.Next() || i.Close() != nil {
+		return nil
+	}
+	s.bh = h
+	return s
+}
+
+// lookup returns an iterator positioned before the first key that is >= the
+// given key, for Get and Has, consulting the filter if there is one. The
+// iterator may be exhausted if the filter rules out the key.
+//
+// For a table with a single data block, lookup skips the index, and seeks
+// directly in that block. The key found is still checked with the CheckKey
+// option.
+func (r *Reader) lookup(key []byte, o *db.ReadOptions) db.Iterator {
+	s := r.singleBlock
+	if s == nil {
+		f := (*filterReader)(nil)
+		if r.filter.valid() {
+			f = &r.filter
+		}
+		return r.find(key, o, f, nil)
+	}
+	if r.comparer.Compare(key, s.sep) > 0 {
+		return &blockIter{eoi: true}
+	}
+	if r.filter.valid() && !r.filter.mayContain(s.bh.offset, key) {
+		return &blockIter{eoi: true}
+	}
+	b, err := r.readDataBlock(s.bh, o.GetVerifyChecksums(r.verifyChecksums), nil)
+	if err != nil {
+		return &blockIter{err: err}
+	}
+	if r.paranoidChecks {
+		if err := r.checkBlockBounds(b, s.bh, nil, s.sep); err != nil {
+			return &blockIter{err: err}
+		}
+	}
+	i, err := r.seekDataBlock(b, key)
+	if err != nil {
+		return &blockIter{err: err}
+	}
+	// The iterator is positioned before the key that Next steps to, which is
+	// checked now, as an Iterator would check it in Next.
+	if !i.eoi {
+		if err := r.checkBlockKey(i.key, s.bh.offset); err != nil {
+			return &blockIter{err: err}
+		}
+	}
+	return i
+}
+
+// Reopen re-reads the table's footer, meta blocks and index from the file, if
+// the file's size has changed since r was opened or last reopened. This is
+// for a file that may grow, such as one that is being tailed. Block cache
+// entries are kept only for those data blocks whose handles, their offset and
+// length, are the same in the old and new indexes; the blocks at those
+// offsets are assumed to be unchanged, as they are if the file is only
+// appended to. A cache from the BlockCache option is left as is, as its keys
+// are the blocks' handles. If the file cannot be read, Reopen returns an error
+// and r is unchanged.
+//
+// Reopen must not be called concurrently with any other method of r, or while
+// any iterator over r is open.
+func (r *Reader) Reopen() error {
+	if r.err != nil {
+		return r.err
+	}
+	stat, err := r.file.Stat()
+	if err != nil {
+		return fmt.Errorf("leveldb/table: invalid table (could not stat file): %v", err)
+	}
+	if stat.Size() == r.size {
+		return nil
+	}
+	// A BlockCache option keys its blocks by both offset and length, so only
+	// the default cache needs to drop blocks whose handles have changed. No
+	// data block can have been cached before a lazy index was read, so there
+	// is then nothing to drop, and neither index needs to be read.
+	lru, _ := r.cache.(*blockCache)
+	if l := r.lazyIndex; l != nil && atomic.LoadUint32(&l.loaded) == 0 {
+		lru = nil
+	}
+	var oldHandles map[uint64]uint64
+	if lru != nil {
+		if oldHandles, err = r.dataBlockHandles(); err != nil {
+			return err
+		}
+	}
+	nr := &Reader{
+		file:          r.file,
+		readerOptions: r.readerOptions,
+		mmap:          r.mmap,
+		shared:        r.shared,
+	}
+	if n := r.readChunkSize; n > 0 {
+		// The file's size has changed, so start with no chunk.
+		nr.chunk = &readChunk{size: int64(n)}
+	}
+	// A Reader returned by NewLazyReader stays lazy.
+	if err := nr.open(nil, r.lazyIndex != nil); err != nil {
+		return err
+	}
+	if lru != nil {
+		newHandles, err := nr.dataBlockHandles()
+		if err != nil {
+			return err
+		}
+		lru.retain(func(offset uint64) bool {
+			length, ok := oldHandles[offset]
+			return ok && newHandles[offset] == length
+		})
+	}
+	*r = *nr
+	return nil
+}
+
+// dataBlockHandles returns the lengths of r's data blocks, keyed by offset.
+func (r *Reader) dataBlockHandles() (map[uint64]uint64, error) {
+	i, err := r.newIndexIter(nil)
+	if err != nil {
+		return nil, err
+	}
+	m := map[uint64]uint64{}
+	for i.Next() {
+		v := i.Value()
+		h, n := decodeBlockHandle(v)
+		if n == 0 || n != len(v) {
+			i.Close()
+			return nil, errCorruptIndexEntry
+		}
+		m[h.offset] = h.length
+	}
+	if err := i.Close(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// TrimTo writes to w those key/value pairs of r whose keys are less than upto.
+// It is useful for splitting a table at a given key.
+//
+// Data blocks whose keys are all less than upto are copied verbatim, without
+// being decompressed and re-compressed, unless r and w use different data
+// block formats, or r has a global sequence number, which the output would
+// not record. Only the block that straddles upto is otherwise re-encoded.
+// The Writer w should use the same Comparer as r, and it is the caller's
+// responsibility to close w.
+//
+// The Comparer in o, if set, orders r's keys relative to upto, instead of r's
+// own Comparer. The blocks' checksums are verified if the VerifyChecksums
+// option is set in o or was set for r. A nil o means to use r's options.
+//
+// The range tombstones of r that start at or before upto's user key are
+// written to w, ending at most just after that user key, so that they still
+// delete the older entries that are kept for it. Their keys are ordered as
+// per bytes.Compare. If r has range tombstones, upto must be an internal key.
+func TrimTo(r *Reader, upto []byte, w *Writer, o *db.Options) error {
+	if r.err != nil {
+		return r.err
+	}
+	cmp, verify := r.comparer, r.verifyChecksums || o.GetVerifyChecksums()
+	if o != nil && o.Comparer != nil {
+		cmp = o.Comparer
+	}
+	if err := trimRangeDels(r, upto, w); err != nil {
+		return err
+	}
+	index, err := r.newIndexIter(nil)
+	if err != nil {
+		return err
+	}
+	for index.Next() {
+		v := index.Value()
+		h, n := decodeBlockHandle(v)
+		if n == 0 || n != len(v) {
+			index.Close()
+			return errCorruptIndexEntry
+		}
+		raw, blockType, err := r.readRawBlock(h, verify)
+		if err != nil {
+			index.Close()
+			return err
+		}
+		b, err := r.decompress(raw, blockType)
+		if err != nil {
+			r.freeRaw(raw, blockType)
+			index.Close()
+			return err
+		}
+		// The index key is >= every key in its block, so if it is < upto,
+		// then the whole block is below upto.
+		below := cmp.Compare(index.Key(), upto) < 0
+		if below && r.dataFormat == w.dataFormat && r.globalSeqNum == 0 {
+			err = w.copyBlock(raw, blockType, b)
+		} else {
+			// Re-encode those of the block's keys that are below upto. If
+			// this is the block that straddles upto, ignore any subsequent
+			// blocks.
+			err = r.trimBlock(b, upto, below, cmp, w)
+		}
+		r.freeRaw(raw, blockType)
+		r.freeBlock(b, blockType)
+		if err != nil || !below {
+			index.Close()
+			return err
+		}
+	}
+	return index.Close()
+}
+
+// trimRangeDels writes to w the range tombstones of r, clipped to upto, for
+// TrimTo.
+func trimRangeDels(r *Reader, upto []byte, w *Writer) error {
+	if len(r.rangeDels) == 0 {
+		return nil
+	}
+	ukey, _, _, ok := parseInternalKey(upto)
+	if !ok {
+		return errors.New("leveldb/table: TrimTo of a table with range tombstones needs an internal key")
+	}
+	// limit is the least user key that is greater than ukey.
+	limit := append(append([]byte(nil), ukey...), 0)
+	for _, t := range r.rangeDels {
+		if bytes.Compare(t.Start, limit) >= 0 {
+			continue
+		}
+		end := t.End
+		if bytes.Compare(end, limit) > 0 {
+			end = limit
+		}
+		if err := w.DeleteRange(t.Start, end, t.SeqNum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trimBlock writes to w the key/value pairs of the data block b, or only
+// those whose keys are less than upto if all is false, for TrimTo.
+func (r *Reader) trimBlock(b block, upto []byte, all bool, cmp db.Comparer, w *Writer) error {
+	i, err := r.seekDataBlock(b, nil)
+	if err != nil {
+		return err
+	}
+	for i.Next() && (all || cmp.Compare(i.Key(), upto) < 0) {
+		if err := w.Set(i.Key(), i.Value(), nil); err != nil {
+			i.Close()
+			return err
+		}
+	}
+	return i.Close()
+}
+
+// WriteFiltered writes to w those key/value pairs of r whose keys keep returns
+// true for, in order. It is useful for dropping keys from a table, such as a
+// range of keys, or for rewriting a table with different options, such as a
+// different compression, by keeping every key. Unlike TrimTo, it re-encodes
+// every kept key/value pair. The key passed to keep is only valid until keep
+// returns. The table's range tombstones are written to w as they are. The
+// Writer w should use the same Comparer as r, and it is the caller's
+// responsibility to close w.
+func (r *Reader) WriteFiltered(w *Writer, keep func(key []byte) bool) error {
+	for _, t := range r.rangeDels {
+		if err := w.DeleteRange(t.Start, t.End, t.SeqNum); err != nil {
+			return err
+		}
+	}
+	i := r.Find(nil, nil)
+	for i.Next() {
+		if !keep(i.Key()) {
+			continue
+		}
+		if err := w.Set(i.Key(), i.Value(), nil); err != nil {
+			i.Close()
+			return err
+		}
+	}
+	return i.Close()
 }
@@ -0,0 +1,196 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"errors"
+
+	"github.com/golang/leveldb/db"
+)
+
+// ReverseReader presents a table as if its keys were in the reverse order.
+// For example, a table written with a Comparer that orders keys decreasingly
+// can be read by a ReverseReader as if it were in increasing order. It
+// implements the DB interface, as documented in the leveldb/db package.
+//
+// A ReverseReader's Find walks the table backwards, which is less efficient
+// than walking it forwards: each data block is decoded in full before any of
+// its key/value pairs are returned.
+type ReverseReader struct {
+	r *Reader
+}
+
+// ReverseReader implements the db.DB interface.
+var _ db.DB = (*ReverseReader)(nil)
+
+// NewReverseReader returns a ReverseReader for the table read by r. Closing
+// the ReverseReader will close r.
+func NewReverseReader(r *Reader) *ReverseReader {
+	return &ReverseReader{r: r}
+}
+
+// Get implements DB.Get, as documented in the leveldb/db package.
+func (rr *ReverseReader) Get(key []byte, o *db.ReadOptions) (value []byte, err error) {
+	return rr.r.Get(key, o)
+}
+
+// Set is provided to implement the DB interface, but returns an error, as a
+// ReverseReader cannot write to a table.
+func (rr *ReverseReader) Set(key, value []byte, o *db.WriteOptions) error {
+	return errors.New("leveldb/table: cannot Set into a read-only table")
+}
+
+// Delete is provided to implement the DB interface, but returns an error, as a
+// ReverseReader cannot write to a table.
+func (rr *ReverseReader) Delete(key []byte, o *db.WriteOptions) error {
+	return errors.New("leveldb/table: cannot Delete from a read-only table")
+}
+
+// Find implements DB.Find, as documented in the leveldb/db package, where
+// 'greater than or equal to' is the reverse of the table's ordering. In terms
+// of the table's Comparer, it returns an iterator over those keys that are
+// less than or equal to the given key, in decreasing order. An empty key
+// means to iterate over the entire table, from its last key to its first.
+func (rr *ReverseReader) Find(key []byte, o *db.ReadOptions) db.Iterator {
+	r := rr.r
+	if r.err != nil {
+		return &reverseIter{err: r.err}
+	}
+	// Collect the handles of the blocks that may contain keys that are less
+	// than or equal to the key sought: every block up to and including the
+	// first block whose separator is >= that key.
+	index, err := r.newIndexIter(nil)
+	if err != nil {
+		return &reverseIter{err: err}
+	}
+	i := &reverseIter{
+		reader:          r,
+		verifyChecksums: o.GetVerifyChecksums(r.verifyChecksums),
+	}
+	for index.Next() {
+		v := index.Value()
+		h, n := decodeBlockHandle(v)
+		if n == 0 || n != len(v) {
+			index.Close()
+			return &reverseIter{err: errCorruptIndexEntry}
+		}
+		i.handles = append(i.handles, h)
+		if len(key) > 0 && r.comparer.Compare(index.Key(), key) >= 0 {
+			break
+		}
+	}
+	if err := index.Close(); err != nil {
+		return &reverseIter{err: err}
+	}
+	i.key = key
+	i.prevBlock()
+	return i
+}
+
+// Close implements DB.Close, as documented in the leveldb/db package.
+func (rr *ReverseReader) Close() error {
+	return rr.r.Close()
+}
+
+// reverseIter is an iterator that walks a table backwards.
+type reverseIter struct {
+	reader *Reader
+	// handles are the blocks yet to be visited, in table order. The iterator
+	// visits them from last to first.
+	handles []blockHandle
+	// key is the upper bound, inclusive, of the keys to return. An empty key
+	// means no upper bound. It only applies to the first block visited.
+	key []byte
+	// keys and vals hold the current block's key/value pairs, in table order,
+	// and pos is the index of the current pair. The iterator visits them from
+	// last to first.
+	keys, vals [][]byte
+	pos        int
+	// verifyChecksums is whether to verify the checksums of data blocks.
+	verifyChecksums bool
+	err             error
+}
+
+// reverseIter implements the db.Iterator interface.
+var _ db.Iterator = (*reverseIter)(nil)
+
+// prevBlock loads the previous block, returning whether there was one.
+func (i *reverseIter) prevBlock() bool {
+	if i.err != nil || len(i.handles) == 0 {
+		return false
+	}
+	h := i.handles[len(i.handles)-1]
+	i.handles = i.handles[:len(i.handles)-1]
+	b, err := i.reader.readDataBlock(h, i.verifyChecksums, nil)
+	if err != nil {
+		i.err = err
+		return false
+	}
+	d, err := i.reader.seekDataBlock(b, nil)
+	if err != nil {
+		i.err = err
+		return false
+	}
+	i.keys, i.vals = i.keys[:0], i.vals[:0]
+	for d.Next() {
+		if len(i.key) > 0 && i.reader.comparer.Compare(d.Key(), i.key) > 0 {
+			break
+		}
+		i.keys = append(i.keys, append([]byte(nil), d.Key()...))
+		v := d.Value()
+		if d.format == valuePrefixBlockFormat {
+			// The value is in d's buffer, which the next entry overwrites,
+			// instead of in b.
+			v = append([]byte(nil), v...)
+		}
+		i.vals = append(i.vals, v)
+	}
+	if err := d.Close(); err != nil {
+		i.err = err
+		return false
+	}
+	i.key = nil
+	// Position before the last key/value pair. Next will decrement pos.
+	i.pos = len(i.keys)
+	return true
+}
+
+// Next implements Iterator.Next, as documented in the leveldb/db package.
+func (i *reverseIter) Next() bool {
+	for i.err == nil {
+		if i.pos > 0 {
+			i.pos--
+			return true
+		}
+		if !i.prevBlock() {
+			break
+		}
+	}
+	i.keys, i.vals, i.pos = nil, nil, 0
+	return false
+}
+
+// Key implements Iterator.Key, as documented in the leveldb/db package.
+func (i *reverseIter) Key() []byte {
+	if i.pos >= len(i.keys) {
+		return nil
+	}
+	return i.keys[i.pos]
+}
+
+// Value implements Iterator.Value, as documented in the leveldb/db package.
+func (i *reverseIter) Value() []byte {
+	if i.pos >= len(i.keys) {
+		return nil
+	}
+	return i.vals[i.pos]
+}
+
+// Close implements Iterator.Close, as documented in the leveldb/db package.
+func (i *reverseIter) Close() error {
+	i.handles = nil
+	i.keys, i.vals, i.pos = nil, nil, 0
+	return i.err
+}
@@ -0,0 +1,27 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+// Scan calls fn for each key/value pair of the table, in order, starting at
+// the first key that is >= start. The key and value passed to fn are only
+// valid until fn returns. The scan ends when fn returns stop == true, or a
+// non-nil error, which Scan then returns. Otherwise, Scan returns any error
+// reading the table. Scan closes its iterator before returning, even if fn
+// panics.
+func (r *Reader) Scan(start []byte, fn func(key, value []byte) (stop bool, err error)) (err error) {
+	i := r.Find(start, nil)
+	defer func() {
+		if err1 := i.Close(); err == nil {
+			err = err1
+		}
+	}()
+	for i.Next() {
+		stop, err := fn(i.Key(), i.Value())
+		if err != nil || stop {
+			return err
+		}
+	}
+	return nil
+}
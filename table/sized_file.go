@@ -0,0 +1,58 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/golang/leveldb/db"
+)
+
+// NewReaderWithSize is like NewReader, except that it reads the table from
+// ra, which has the given size, instead of from a db.File. It never needs to
+// stat the table, so that ra can be a source that has a known size but no file
+// information, such as a client that reads ranges of an object in remote
+// storage. Closing the reader will close ra if ra is an io.Closer.
+func NewReaderWithSize(ra io.ReaderAt, size int64, o *db.Options) *Reader {
+	if ra == nil {
+		return NewReader(nil, o)
+	}
+	return NewReader(&sizedFile{ra: ra, sr: io.NewSectionReader(ra, 0, size)}, o)
+}
+
+// sizedFile is the read-only db.File of NewReaderWithSize.
+type sizedFile struct {
+	ra io.ReaderAt
+	sr *io.SectionReader
+}
+
+func (f *sizedFile) Read(p []byte) (int, error) {
+	return f.sr.Read(p)
+}
+
+func (f *sizedFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.sr.ReadAt(p, off)
+}
+
+func (f *sizedFile) Write(p []byte) (int, error) {
+	return 0, errors.New("leveldb/table: cannot Write to a read-only table")
+}
+
+func (f *sizedFile) Stat() (os.FileInfo, error) {
+	return memFileInfo(f.sr.Size()), nil
+}
+
+func (f *sizedFile) Sync() error {
+	return nil
+}
+
+func (f *sizedFile) Close() error {
+	if c, ok := f.ra.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
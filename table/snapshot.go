@@ -0,0 +1,158 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/golang/leveldb/db"
+)
+
+// appendInternalKey appends to dst the internal key with the given user key,
+// kind and sequence number.
+func appendInternalKey(dst, ukey []byte, kind uint8, seqNum uint64) []byte {
+	dst = append(dst, ukey...)
+	dst = append(dst, kind)
+	for j := uint(0); j < 56; j += 8 {
+		dst = append(dst, byte(seqNum>>j))
+	}
+	return dst
+}
+
+// FindAt returns an iterator over the table as of the snapshot with sequence
+// number seqNum, starting at the first user key >= ukey. The table's keys must
+// be internal keys, as used by package leveldb, ordered by the table's
+// Comparer as package leveldb orders them: increasing by user key, then
+// decreasing by sequence number. Entries newer than seqNum are skipped, and
+// for each user key the iterator yields only the newest remaining entry, as
+// its full internal key. That entry may be a deletion, so that a caller
+// reading several tables can tell that the key's older entries in other
+// tables are deleted. Two user keys are the same if their bytes are equal.
+//
+// The iterator stops with an error at a key that is not an internal key, as
+// tables with plain keys can only be read with Find.
+func (r *Reader) FindAt(ukey []byte, seqNum uint64, o *db.ReadOptions) db.Iterator {
+	if seqNum > internalKeySeqNumMax {
+		seqNum = internalKeySeqNumMax
+	}
+	// Of the entries for ukey, the seek key sorts before every one that is
+	// visible at seqNum.
+	key := appendInternalKey(nil, ukey, internalKeyKindMax, seqNum)
+	return &snapshotIter{
+		iter:   r.Find(key, o),
+		seqNum: seqNum,
+	}
+}
+
+// GetAt returns the value of the given user key as of the snapshot with
+// sequence number seqNum, being the value of that key's newest entry that is
+// not newer than seqNum. It returns db.ErrNotFound if there is no such entry,
+// or if that entry is a deletion. The table's keys must be internal keys, as
+// for FindAt.
+func (r *Reader) GetAt(ukey []byte, seqNum uint64, o *db.ReadOptions) ([]byte, error) {
+	i := r.FindAt(ukey, seqNum, o)
+	if !i.Next() {
+		if err := i.Close(); err != nil {
+			return nil, err
+		}
+		return nil, db.ErrNotFound
+	}
+	k, kind, _, _ := parseInternalKey(i.Key())
+	if !bytes.Equal(k, ukey) || kind == internalKeyKindDelete {
+		i.Close()
+		return nil, db.ErrNotFound
+	}
+	return i.Value(), i.Close()
+}
+
+// NewDBIterator returns an iterator that merges iters, iterators over the
+// internal keys of overlapping tables, as a database reads them at the
+// snapshot with sequence number seqNum. The iterators' keys must be ordered
+// by the internal key Comparer icmp, as package leveldb orders them, and may
+// be positioned by the caller, such as by seeking each table to the same
+// internal key. The returned iterator skips entries newer than seqNum, and
+// for each user key yields only the newest remaining entry, as its full
+// internal key, unless that entry is a deletion, in which case it yields
+// nothing for that user key. As for FindAt, two user keys are the same if
+// their bytes are equal, and a key that is not an internal key stops the
+// iterator with an error.
+//
+// Closing the returned iterator closes all of iters, and returns the first
+// error of any of them.
+func NewDBIterator(icmp db.Comparer, seqNum uint64, iters ...db.Iterator) db.Iterator {
+	if seqNum > internalKeySeqNumMax {
+		seqNum = internalKeySeqNumMax
+	}
+	return &snapshotIter{
+		iter:          db.NewMergingIterator(icmp, iters...),
+		seqNum:        seqNum,
+		hideDeletions: true,
+	}
+}
+
+// snapshotIter is the iterator returned by FindAt and NewDBIterator.
+type snapshotIter struct {
+	iter   db.Iterator
+	seqNum uint64
+	// hideDeletions is whether to skip the user keys whose newest visible
+	// entry is a deletion, rather than yield that deletion.
+	hideDeletions bool
+	// prev is a copy of the user key of the entry most recently yielded, and
+	// hasPrev is whether there is one.
+	prev    []byte
+	hasPrev bool
+	err     error
+}
+
+// snapshotIter implements the db.Iterator interface.
+var _ db.Iterator = (*snapshotIter)(nil)
+
+// Next implements Iterator.Next, as documented in the leveldb/db package.
+func (i *snapshotIter) Next() bool {
+	if i.err != nil {
+		return false
+	}
+	for i.iter.Next() {
+		ukey, kind, seqNum, ok := parseInternalKey(i.iter.Key())
+		if !ok {
+			i.err = fmt.Errorf("leveldb/table: key %q is not an internal key", i.iter.Key())
+			return false
+		}
+		if seqNum > i.seqNum || (i.hasPrev && bytes.Equal(ukey, i.prev)) {
+			continue
+		}
+		i.prev, i.hasPrev = append(i.prev[:0], ukey...), true
+		if kind == internalKeyKindDelete && i.hideDeletions {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// Key implements Iterator.Key, as documented in the leveldb/db package.
+func (i *snapshotIter) Key() []byte {
+	if i.err != nil {
+		return nil
+	}
+	return i.iter.Key()
+}
+
+// Value implements Iterator.Value, as documented in the leveldb/db package.
+func (i *snapshotIter) Value() []byte {
+	if i.err != nil {
+		return nil
+	}
+	return i.iter.Value()
+}
+
+// Close implements Iterator.Close, as documented in the leveldb/db package.
+func (i *snapshotIter) Close() error {
+	if err := i.iter.Close(); i.err == nil {
+		i.err = err
+	}
+	return i.err
+}
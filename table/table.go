@@ -110,23 +110,192 @@ is a key that is >= every key in block i and is < every key i block i+1. The
 successor for the final block is a key that is >= every key in block N-1. The
 index block restart interval is 1: every entry is a restart point.
 
+RocksDB-compatible tables may instead have a partitioned, two-level index, as
+recorded by the "rocksdb.block.based.table.index.type" property described
+below. The index block then maps separators to the block handles of index
+partitions, each of which is in turn an index block for a contiguous run of
+data blocks. Index partitions are read as needed, instead of all at once.
+
 The table footer is exactly 48 bytes long:
   - the block handle for the metaindex block,
   - the block handle for the index block,
   - padding to take the two items above up to 40 bytes,
   - an 8-byte magic string.
 
+That is the footer of format version 0, which is the only version that this
+package writes. RocksDB-compatible tables of later format versions have a
+different magic string, and a 53 byte footer:
+  - a 1-byte checksum type,
+  - the block handles and padding, as above, taking up 40 bytes,
+  - the 4-byte little-endian format version,
+  - an 8-byte magic string.
+Version 1 tables are otherwise the same as version 0 tables, provided that
+their checksum type is CRC-32C. Readers reject other versions, whose blocks
+may be encoded differently.
+
 A block handle is an offset and a length; the length does not include the 5
-byte trailer. Both numbers are varint-encoded, with no padding between the two
-values. The maximum size of an encoded block handle is therefore 20 bytes.
+byte trailer. Blocks are typically contiguous, but some writers pad each block
+to start at an aligned offset, such as for direct I/O. Readers only ever use a
+block handle's exact offset and length, so any padding between blocks is
+ignored, even when a single read spans several blocks. Both numbers are
+varint-encoded, with no padding between the two values. The maximum size of an
+encoded block handle is therefore 20 bytes.
+
+The metaindex block maps the names of meta blocks to their block handles. The
+C++ LevelDB implementation only writes a "filter.<name>" meta block, but
+RocksDB-compatible tables may also have a "rocksdb.properties" meta block. That
+properties block is a regular block (with a restart interval of 1) that maps
+property names to their values, such as "rocksdb.comparator" mapping to the
+name of the Comparer used to write the table. This package only writes a
+properties block when there are properties, such as the name of a non-default
+Comparer, that a reader should check.
+
+Tables written with the ValuePrefixCompression option have a
+"leveldb-go.value.prefix.compression" property whose value is "1". In their
+data blocks, but not in any other blocks, each entry also has the number of
+bytes that its value shares with the previous entry's value, as a varint after
+the number of unshared key bytes. The entry's value bytes are then only the
+unshared bytes. As with keys, an entry at a restart point shares no bytes of
+its value.
+
+Tables written with both a FilterPolicy and a PrefixExtractor have a
+"rocksdb.prefix.extractor.name" property whose value is the PrefixExtractor's
+name. Each of their filters holds the prefixes of the filtered keys, as well as
+the keys themselves.
+
+A table may also have a "rocksdb.range_del" meta block of range tombstones,
+each of which deletes the user keys from a start key, inclusive, to an end key,
+exclusive, that are older than the tombstone. It is a regular block whose keys
+are internal keys, as used by package leveldb: the start key followed by an
+8-byte trailer of the kind 0x0f and the tombstone's 7-byte little-endian
+sequence number. Each value is the end key.
+
+Tables written with the VerifyDecompressed option have a
+"leveldb-go.decompressed.crcs" property that holds a checksum of each data
+block's decompressed contents, in the same masked CRC-32C form as the block
+trailers. For each data block, in order, it holds the block's offset as a
+varint followed by the 4-byte little-endian checksum.
+
+Tables written by this package that have a properties block for any of the
+reasons above also have "leveldb-go.max.key.len" and "leveldb-go.max.value.len"
+properties that hold the lengths of the table's longest key and longest value,
+as varints. Other tables are scanned for those lengths when they are needed.
+
+Properties set by Writer.SetUserProperties have names that start with "user.",
+after all of the other properties that this package writes.
 */
 
+import (
+	"fmt"
+)
+
+// CorruptionError is the error returned when a table is invalid or corrupt.
+type CorruptionError struct {
+	// Offset is the file offset of the invalid data, or -1 if it is unknown.
+	Offset int64
+	// Reason describes how the table is invalid.
+	Reason string
+}
+
+func (e CorruptionError) Error() string {
+	if e.Offset < 0 {
+		return "leveldb/table: invalid table (" + e.Reason + ")"
+	}
+	return fmt.Sprintf("leveldb/table: invalid table (%s, at offset %d)", e.Reason, e.Offset)
+}
+
+// ComparerMismatchError is the error returned when a table records that it
+// was written with a differently named Comparer than the one that it is read
+// with.
+type ComparerMismatchError struct {
+	// Table is the name of the Comparer that the table was written with.
+	Table string
+	// Options is the name of the Comparer that the table is read with.
+	Options string
+}
+
+func (e ComparerMismatchError) Error() string {
+	return fmt.Sprintf("leveldb/table: comparer mismatch: table uses %q, options specify %q", e.Table, e.Options)
+}
+
+// corruptionErrorf returns a CorruptionError for the given offset, whose
+// reason is formatted according to a format specifier.
+func corruptionErrorf(offset int64, format string, args ...interface{}) error {
+	return CorruptionError{
+		Offset: offset,
+		Reason: fmt.Sprintf(format, args...),
+	}
+}
+
+// errCorruptIndexEntry is the error returned for an invalid index block entry.
+var errCorruptIndexEntry error = CorruptionError{
+	Offset: -1,
+	Reason: "corrupt index entry",
+}
+
 const (
 	blockTrailerLen = 5
 	footerLen       = 48
 
 	magic = "\x57\xfb\x80\x8b\x24\x75\x47\xdb"
 
+	// A versioned footer, of format version 1 or later, ends with
+	// versionedMagic instead of magic. The checksum type in such a footer
+	// must be crc32cChecksumType, and the format version must be at most
+	// maxFormatVersion.
+	versionedFooterLen = 53
+	versionedMagic     = "\xf7\xcf\xf4\x85\xb7\x41\xe2\x88"
+	crc32cChecksumType = 1
+	maxFormatVersion   = 1
+
+	// These names are part of the file format and should not be changed.
+	propertiesBlockName         = "rocksdb.properties"
+	rangeDelBlockName           = "rocksdb.range_del"
+	comparerPropertyName        = "rocksdb.comparator"
+	numDeletionsPropertyName    = "rocksdb.deleted.keys"
+	numEntriesPropertyName      = "rocksdb.num.entries"
+	indexTypePropertyName       = "rocksdb.block.based.table.index.type"
+	prefixExtractorPropertyName = "rocksdb.prefix.extractor.name"
+
+	// globalSeqNumPropertyName is the property of a table written for
+	// ingestion by RocksDB, holding the sequence number of all of the
+	// table's entries as an 8-byte little-endian value. The entries' keys,
+	// and its range tombstones, are stored with a zero sequence number, which
+	// readers replace with the global one. A zero value means that there is
+	// no global sequence number.
+	globalSeqNumPropertyName = "rocksdb.external_sst_file.global_seqno"
+
+	// userPropertyPrefix starts the names of the properties set by
+	// Writer.SetUserProperties.
+	userPropertyPrefix = "user."
+
+	// valuePrefixPropertyName is this package's own property, whose value is
+	// "1" if the data blocks' values share prefixes.
+	valuePrefixPropertyName = "leveldb-go.value.prefix.compression"
+
+	// decompressedCRCsPropertyName is this package's own property, holding
+	// the checksums of the data blocks' decompressed contents.
+	decompressedCRCsPropertyName = "leveldb-go.decompressed.crcs"
+
+	// maxKeyLenPropertyName and maxValueLenPropertyName are this package's
+	// own properties, holding the lengths of the table's longest key and
+	// value as varints.
+	maxKeyLenPropertyName   = "leveldb-go.max.key.len"
+	maxValueLenPropertyName = "leveldb-go.max.value.len"
+
+	// rangeDelKind is the internal key kind of every key of the range
+	// deletion block. It is part of the file format and should not be
+	// changed.
+	rangeDelKind = 0x0f
+
+	// The index type property gives the structure of the index block. It is
+	// a 4-byte little-endian value. These constants are part of the file
+	// format and should not be changed. A hash search index is also a binary
+	// search index, with additional meta blocks that this package ignores.
+	binarySearchIndexType = 0
+	hashSearchIndexType   = 1
+	twoLevelIndexType     = 2
+
 	// The block type gives the per-block compression format.
 	// These constants are part of the file format and should not be changed.
 	// They are different from the db.Compression constants because the latter
@@ -7,19 +7,27 @@ package table
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/leveldb/bloom"
+	"github.com/golang/leveldb/crc"
 	"github.com/golang/leveldb/db"
 	"github.com/golang/leveldb/memfs"
+	"github.com/golang/snappy"
 )
 
 // nonsenseWords are words that aren't in ../testdata/h.txt.
@@ -198,6 +206,13 @@ var (
 )
 
 func build(compression db.Compression, fp db.FilterPolicy) (db.File, error) {
+	return buildWithOptions(&db.Options{
+		Compression:  compression,
+		FilterPolicy: fp,
+	})
+}
+
+func buildWithOptions(o *db.Options) (db.File, error) {
 	// Create a sorted list of wordCount's keys.
 	keys := make([]string, len(wordCount))
 	i := 0
@@ -215,10 +230,7 @@ func build(compression db.Compression, fp db.FilterPolicy) (db.File, error) {
 	}
 	defer f0.Close()
 	tmpFileCount++
-	w := NewWriter(f0, &db.Options{
-		Compression:  compression,
-		FilterPolicy: fp,
-	})
+	w := NewWriter(f0, o)
 	for _, k := range keys {
 		v := wordCount[k]
 		if err := w.Set([]byte(k), []byte(v), nil); err != nil {
@@ -390,6 +402,20 @@ func TestWriter(t *testing.T) {
 	}
 }
 
+func TestWriterBlockRestartInterval(t *testing.T) {
+	for _, interval := range []int{1, 2, 3, 5, 16, 100, 1 << 20} {
+		f, err := buildWithOptions(&db.Options{
+			BlockRestartInterval: interval,
+		})
+		if err != nil {
+			t.Fatalf("interval=%d: %v", interval, err)
+		}
+		if err := check(f, nil); err != nil {
+			t.Fatalf("interval=%d: %v", interval, err)
+		}
+	}
+}
+
 func testNoCompressionOutput(t *testing.T, fp db.FilterPolicy) {
 	filename := "../testdata/h.no-compression.ldb"
 	if fp != nil {
@@ -529,3 +555,7424 @@ func TestFinalBlockIsWritten(t *testing.T) {
 		}
 	}
 }
+
+func TestBinaryKeys(t *testing.T) {
+	// The keys are in increasing order, and include NUL bytes and high bytes,
+	// including keys that are prefixes of other keys up to a NUL byte.
+	keys := []string{
+		"\x00",
+		"\x00\x00",
+		"\x00\x00\x01",
+		"\x00\x01",
+		"a",
+		"a\x00",
+		"a\x00\x00b",
+		"a\x00b",
+		"a\x01",
+		"ab",
+		"ab\x00",
+		"ab\xff",
+		"\x7f",
+		"\x80",
+		"\x80\x00",
+		"\xfe\xff",
+		"\xff",
+		"\xff\x00",
+		"\xff\xff",
+		"\xff\xff\xff",
+	}
+	// absent are keys that are not in the table, but which differ from keys
+	// in the table only by NUL bytes or high bytes.
+	absent := []string{
+		"\x00\x00\x00",
+		"\x00\x02",
+		"a\x00\x00",
+		"a\x00c",
+		"ab\xfe",
+		"\xff\xff\x00",
+		"\xff\xff\xff\xff",
+	}
+
+	for _, blockRestartInterval := range []int{1, 2, 16} {
+		mem := memfs.New()
+		f0, err := mem.Create("bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f0, &db.Options{
+			BlockRestartInterval: blockRestartInterval,
+			BlockSize:            32,
+		})
+		for i, k := range keys {
+			if err := w.Set([]byte(k), []byte(fmt.Sprintf("v%d\x00", i)), nil); err != nil {
+				t.Fatalf("interval=%d: Set %q: %v", blockRestartInterval, k, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		f1, err := mem.Open("bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(f1, &db.Options{
+			VerifyChecksums: true,
+		})
+		for i, k := range keys {
+			v, err := r.Get([]byte(k), nil)
+			if want := fmt.Sprintf("v%d\x00", i); err != nil || string(v) != want {
+				t.Errorf("interval=%d: Get %q: got (%q, %v), want (%q, nil)",
+					blockRestartInterval, k, v, err, want)
+			}
+
+			// Find should position the iterator at k exactly, and iterate over
+			// the remaining keys in order.
+			iter := r.Find([]byte(k), nil)
+			for j, kWant := range keys[i:] {
+				if !iter.Next() || string(iter.Key()) != kWant {
+					t.Errorf("interval=%d: Find %q: j=%d: got %q, want %q",
+						blockRestartInterval, k, j, iter.Key(), kWant)
+					break
+				}
+			}
+			if err := iter.Close(); err != nil {
+				t.Errorf("interval=%d: Find %q: Close: %v", blockRestartInterval, k, err)
+			}
+		}
+		for _, k := range absent {
+			if v, err := r.Get([]byte(k), nil); err != db.ErrNotFound {
+				t.Errorf("interval=%d: Get %q: got (%q, %v), want ErrNotFound", blockRestartInterval, k, v, err)
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOversizedBlocks(t *testing.T) {
+	const blockSize = 64
+	// Every second value is much larger than the block size, so that each of
+	// those values finishes the block that it is added to, making that block
+	// oversized.
+	keys, values := []string{}, []string{}
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("k%02d", i))
+		if i%2 == 0 {
+			values = append(values, strings.Repeat(string('a'+byte(i)), 10*blockSize+i))
+		} else {
+			values = append(values, fmt.Sprintf("v%02d", i))
+		}
+	}
+
+	mem := memfs.New()
+	f0, err := mem.Create("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, &db.Options{
+		BlockSize:   blockSize,
+		Compression: db.NoCompression,
+	})
+	for i := range keys {
+		if err := w.Set([]byte(keys[i]), []byte(values[i]), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f1, err := mem.Open("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f1, nil)
+	defer r.Close()
+
+	// Each oversized block holds an oversized value and at most the small
+	// value before it, so the first len(keys)/2 blocks are all oversized, and
+	// are followed by a final block holding the last small value.
+	index, err := r.index.seek(r.comparer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nBlocks := 0
+	for index.Next() {
+		h, _ := decodeBlockHandle(index.Value())
+		if nBlocks < len(keys)/2 && h.length <= blockSize {
+			t.Errorf("block %d: length %d, want > %d", nBlocks, h.length, blockSize)
+		}
+		nBlocks++
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if nBlocks != len(keys)/2+1 {
+		t.Errorf("number of blocks: got %d, want %d", nBlocks, len(keys)/2+1)
+	}
+
+	for i, k := range keys {
+		if v, err := r.Get([]byte(k), nil); err != nil || string(v) != values[i] {
+			t.Errorf("Get %q: got (%d bytes, %v), want (%d bytes, nil)", k, len(v), err, len(values[i]))
+		}
+		// Seek to a key between k's predecessor and k. For example, seeking
+		// "k04~" should find "k05".
+		iter := r.Find([]byte(k[:len(k)-1]+string(k[len(k)-1]-1)+"~"), nil)
+		if !iter.Next() || string(iter.Key()) != k || string(iter.Value()) != values[i] {
+			t.Errorf("Find before %q: got key %q", k, iter.Key())
+		}
+		if err := iter.Close(); err != nil {
+			t.Errorf("Find before %q: %v", k, err)
+		}
+	}
+}
+
+func TestTrimTo(t *testing.T) {
+	keys := make([]string, 0, len(wordCount))
+	for k := range wordCount {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, compression := range []db.Compression{db.NoCompression, db.SnappyCompression} {
+		for _, upto := range []string{"", "a", "bat", "k", "polonius", "zz", "~"} {
+			desc := fmt.Sprintf("compression=%d, upto=%q", compression, upto)
+			f, err := buildWithOptions(&db.Options{
+				BlockSize:   512,
+				Compression: compression,
+			})
+			if err != nil {
+				t.Fatalf("%s: %v", desc, err)
+			}
+			r := NewReader(f, nil)
+
+			mem := memfs.New()
+			f0, err := mem.Create("trimmed")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Use different Writer options, so that the verbatim check below
+			// would fail if blocks were re-encoded instead of copied.
+			otherCompression := db.NoCompression
+			if compression == db.NoCompression {
+				otherCompression = db.SnappyCompression
+			}
+			w := NewWriter(f0, &db.Options{
+				BlockSize:   4096,
+				Compression: otherCompression,
+			})
+			if err := TrimTo(r, []byte(upto), w, &db.Options{VerifyChecksums: true}); err != nil {
+				t.Fatalf("%s: TrimTo: %v", desc, err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("%s: writer close: %v", desc, err)
+			}
+
+			// Check that the output contains exactly those keys below upto.
+			f1, err := mem.Open("trimmed")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r1 := NewReader(f1, &db.Options{
+				VerifyChecksums: true,
+			})
+			i, n := r1.Find(nil, nil), 0
+			for ; i.Next(); n++ {
+				if n >= len(keys) || string(i.Key()) != keys[n] || string(i.Value()) != wordCount[keys[n]] {
+					t.Fatalf("%s: entry #%d: got %q:%q", desc, n, i.Key(), i.Value())
+				}
+			}
+			if err := i.Close(); err != nil {
+				t.Fatalf("%s: %v", desc, err)
+			}
+			if want := sort.SearchStrings(keys, upto); n != want {
+				t.Fatalf("%s: got %d entries, want %d", desc, n, want)
+			}
+
+			// Check that the blocks wholly below upto were copied verbatim. The
+			// copied blocks are at the start of both files.
+			index, err := r.index.seek(r.comparer, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verbatim := uint64(0)
+			for index.Next() && string(index.Key()) < upto {
+				h, _ := decodeBlockHandle(index.Value())
+				verbatim = h.offset + h.length + blockTrailerLen
+			}
+			if err := index.Close(); err != nil {
+				t.Fatal(err)
+			}
+			got, want := make([]byte, verbatim), make([]byte, verbatim)
+			if _, err := f1.ReadAt(got, 0); err != nil {
+				t.Fatalf("%s: %v", desc, err)
+			}
+			if _, err := f.ReadAt(want, 0); err != nil {
+				t.Fatalf("%s: %v", desc, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("%s: the first %d bytes were not copied verbatim", desc, verbatim)
+			}
+
+			if err := r1.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestTrimToRangeTombstones(t *testing.T) {
+	o := &db.Options{Comparer: testInternalKeyComparer{}}
+	mem := memfs.New()
+	f0, err := mem.Create("in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, o)
+	for j, ukey := range []string{"a", "c", "e", "g"} {
+		if err := w.Set(makeTestInternalKey(ukey, internalKeyKindSet, uint64(j+1)), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tomb := range [][2]string{{"b", "d"}, {"c", "z"}, {"f", "h"}} {
+		if err := w.DeleteRange([]byte(tomb[0]), []byte(tomb[1]), 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := mem.Open("in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f1, o)
+	defer r.Close()
+
+	// write writes a table with f, and returns its range tombstones.
+	write := func(name string, f func(w *Writer) error) string {
+		f0, err := mem.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f0, o)
+		if err := f(w); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f1, err := mem.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(f1, o)
+		defer r.Close()
+		var got []string
+		for _, tomb := range r.RangeTombstones() {
+			got = append(got, fmt.Sprintf("%q-%q.%d", tomb.Start, tomb.End, tomb.SeqNum))
+		}
+		return strings.Join(got, ",")
+	}
+
+	// The tombstones are clipped to end just after the user key "e", as the
+	// output keeps e's entries that are newer than upto.
+	got := write("trimmed", func(w *Writer) error {
+		return TrimTo(r, makeTestInternalKey("e", internalKeyKindSet, 3), w, nil)
+	})
+	if want := `"b"-"d".10,"c"-"e\x00".10`; got != want {
+		t.Errorf("TrimTo: got %s, want %s", got, want)
+	}
+	got = write("filtered", func(w *Writer) error {
+		return r.WriteFiltered(w, func([]byte) bool { return false })
+	})
+	if want := `"b"-"d".10,"c"-"z".10,"f"-"h".10`; got != want {
+		t.Errorf("WriteFiltered: got %s, want %s", got, want)
+	}
+
+	// The tombstones' user keys cannot be clipped to a key that is not an
+	// internal key.
+	f2, err := mem.Create("bad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = NewWriter(f2, o)
+	if err := TrimTo(r, []byte("e"), w, nil); err == nil {
+		t.Error("TrimTo with a user key: got nil error")
+	}
+	w.Close()
+}
+
+func TestWriteFiltered(t *testing.T) {
+	f, err := buildWithOptions(&db.Options{
+		BlockSize:   512,
+		Compression: db.NoCompression,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, nil)
+	defer r.Close()
+
+	// Drop the keys in the range ["k", "p"), and recompress the rest.
+	keep := func(key []byte) bool {
+		return string(key) < "k" || string(key) >= "p"
+	}
+	var want []string
+	for k := range wordCount {
+		if keep([]byte(k)) {
+			want = append(want, k)
+		}
+	}
+	sort.Strings(want)
+	if len(want) == 0 || len(want) == len(wordCount) {
+		t.Fatalf("got %d of %d keys kept, want some but not all", len(want), len(wordCount))
+	}
+
+	mem := memfs.New()
+	f0, err := mem.Create("filtered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, &db.Options{
+		Compression: db.SnappyCompression,
+	})
+	if err := r.WriteFiltered(w, keep); err != nil {
+		t.Fatalf("WriteFiltered: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("writer close: %v", err)
+	}
+
+	f1, err := mem.Open("filtered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1 := NewReader(f1, nil)
+	defer r1.Close()
+	i, n := r1.Find(nil, nil), 0
+	for ; i.Next(); n++ {
+		if n >= len(want) || string(i.Key()) != want[n] || string(i.Value()) != wordCount[want[n]] {
+			t.Fatalf("entry #%d: got %q:%q", n, i.Key(), i.Value())
+		}
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(want) {
+		t.Fatalf("got %d entries, want %d", n, len(want))
+	}
+
+	// An error from the Writer stops the copy.
+	f2, err := mem.Create("unordered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = NewWriter(f2, nil)
+	if err := w.Set([]byte("~"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	err = r.WriteFiltered(w, func(key []byte) bool {
+		calls++
+		return true
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("out of order: got (%v, %d calls), want an error after 1 call", err, calls)
+	}
+	w.Close()
+}
+
+// readCountingFile is a db.File that counts the number of ReadAt calls.
+type readCountingFile struct {
+	db.File
+	nReadAt int
+}
+
+func (f *readCountingFile) ReadAt(p []byte, off int64) (int, error) {
+	f.nReadAt++
+	return f.File.ReadAt(p, off)
+}
+
+func TestWriterBloomFilterAvoidsReads(t *testing.T) {
+	f, err := build(db.DefaultCompression, bloom.FilterPolicy(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf := &readCountingFile{File: f}
+	c := &countingFilterPolicy{
+		FilterPolicy: bloom.FilterPolicy(10),
+	}
+	r := NewReader(cf, &db.Options{
+		FilterPolicy: c,
+	})
+	defer r.Close()
+	if !r.filter.valid() {
+		t.Fatal("the written table has no filter block")
+	}
+
+	for k, v := range wordCount {
+		if v1, err := r.Get([]byte(k), nil); err != nil || string(v1) != v {
+			t.Fatalf("Get %q: got (%q, %v), want (%q, nil)", k, v1, err, v)
+		}
+	}
+	if c.falseNegatives != 0 {
+		t.Errorf("false negatives: got %d, want 0", c.falseNegatives)
+	}
+
+	// Look up keys that are not in the table but are within its key range, so
+	// that they are not rejected by the index alone. A true negative from the
+	// filter should not read any data block.
+	key := []byte("m!....")
+	for i := 0; i < 1000; i++ {
+		binary.LittleEndian.PutUint32(key[2:6], uint32(i))
+		nReadAt, nTrueNegatives := cf.nReadAt, c.trueNegatives
+		if _, err := r.Get(key, nil); err != db.ErrNotFound {
+			t.Fatalf("Get %q: got %v, want ErrNotFound", key, err)
+		}
+		if c.trueNegatives > nTrueNegatives && cf.nReadAt != nReadAt {
+			t.Fatalf("Get %q: filter rejected the key, but %d blocks were read", key, cf.nReadAt-nReadAt)
+		}
+	}
+	if c.trueNegatives < 900 {
+		t.Errorf("true negatives: got %d, want >= 900", c.trueNegatives)
+	}
+}
+
+// eofFile is a db.File whose ReadAt returns io.EOF even for full reads.
+type eofFile struct {
+	db.File
+}
+
+func (f eofFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	if err == nil {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func TestReaderAtEOF(t *testing.T) {
+	f, err := os.Open(filepath.FromSlash("../testdata/h.ldb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := check(eofFile{f}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A short read is still an error, even if accompanied by io.EOF.
+	f, err = os.Open(filepath.FromSlash("../testdata/h.ldb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(eofFile{f}, nil)
+	defer r.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.readBlock(blockHandle{uint64(stat.Size()) - 10, 100}); err == nil {
+		t.Fatal("short read: got nil error")
+	}
+}
+
+// reverseComparer orders non-empty keys in decreasing bytewise order. As the
+// db.Comparer contract requires, the empty key is less than any other key.
+type reverseComparer struct{}
+
+func (reverseComparer) Compare(a, b []byte) int {
+	if len(a) == 0 || len(b) == 0 {
+		return bytes.Compare(a, b)
+	}
+	return bytes.Compare(b, a)
+}
+
+func (reverseComparer) Name() string {
+	return "leveldb.ReverseBytewiseComparator"
+}
+
+func (reverseComparer) AppendSeparator(dst, a, b []byte) []byte {
+	return append(dst, a...)
+}
+
+func TestCustomComparer(t *testing.T) {
+	keys := make([]string, 0, len(wordCount))
+	for k := range wordCount {
+		keys = append(keys, k)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+
+	mem := memfs.New()
+	f0, err := mem.Create("reverse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, &db.Options{
+		BlockSize: 256,
+		Comparer:  reverseComparer{},
+	})
+	for _, k := range keys {
+		if err := w.Set([]byte(k), []byte(wordCount[k]), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening the table with an explicitly set, wrong comparer is an error.
+	f1, err := mem.Open("reverse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f1, &db.Options{
+		Comparer: db.DefaultComparer,
+	})
+	want := ComparerMismatchError{
+		Table:   reverseComparer{}.Name(),
+		Options: db.DefaultComparer.Name(),
+	}
+	if err := r.Close(); err != want {
+		t.Fatalf("default comparer: got %v, want %v", err, want)
+	}
+	// Without a Comparer option, the table opens, as for a tool that dumps
+	// any table.
+	for _, o := range []*db.Options{nil, {}} {
+		f1, err = mem.Open("reverse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = NewReader(f1, o)
+		if i := r.Find(nil, nil); !i.Next() || i.Close() != nil {
+			t.Errorf("options %v: could not iterate over the table", o)
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("options %v: %v", o, err)
+		}
+	}
+
+	// Opening the table with the right comparer works, and seeks respect the
+	// reversed ordering.
+	f1, err = mem.Open("reverse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = NewReader(f1, &db.Options{
+		Comparer: reverseComparer{},
+	})
+	defer r.Close()
+	for k, v := range wordCount {
+		if v1, err := r.Get([]byte(k), nil); err != nil || string(v1) != v {
+			t.Fatalf("Get %q: got (%q, %v), want (%q, nil)", k, v1, err, v)
+		}
+	}
+	for _, start := range []string{"zzz", "polonius", "k", "c", "a", "\x00"} {
+		// Under the reverse ordering, the keys >= start are those
+		// bytewise <= start.
+		want := sort.Search(len(keys), func(i int) bool { return keys[i] <= start })
+		i := r.Find([]byte(start), nil)
+		for j := want; i.Next(); j++ {
+			if j >= len(keys) || string(i.Key()) != keys[j] {
+				t.Fatalf("Find %q: entry #%d: got %q", start, j-want, i.Key())
+			}
+		}
+		if err := i.Close(); err != nil {
+			t.Fatalf("Find %q: %v", start, err)
+		}
+	}
+}
+
+// appendTestBlock appends to dst a snappy-compressed block, including its
+// trailer, holding the given key/value pairs. Every entry is a restart point.
+func appendTestBlock(dst []byte, kvs ...string) []byte {
+	var b, restarts []byte
+	var tmp [binary.MaxVarintLen64]byte
+	for i := 0; i < len(kvs); i += 2 {
+		binary.LittleEndian.PutUint32(tmp[:4], uint32(len(b)))
+		restarts = append(restarts, tmp[:4]...)
+		b = append(b, 0)
+		b = append(b, tmp[:binary.PutUvarint(tmp[:], uint64(len(kvs[i])))]...)
+		b = append(b, tmp[:binary.PutUvarint(tmp[:], uint64(len(kvs[i+1])))]...)
+		b = append(b, kvs[i]...)
+		b = append(b, kvs[i+1]...)
+	}
+	nRestarts := len(kvs) / 2
+	if nRestarts == 0 {
+		// Every block must have at least one restart point.
+		restarts, nRestarts = make([]byte, 4), 1
+	}
+	b = append(b, restarts...)
+	binary.LittleEndian.PutUint32(tmp[:4], uint32(nRestarts))
+	b = append(b, tmp[:4]...)
+	return appendTestRawBlock(dst, snappy.Encode(nil, b), snappyCompressionBlockType)
+}
+
+// appendTestRawBlock appends to dst the already encoded block b and its
+// trailer.
+func appendTestRawBlock(dst, b []byte, blockType byte) []byte {
+	var trailer [blockTrailerLen]byte
+	trailer[0] = blockType
+	binary.LittleEndian.PutUint32(trailer[1:], crc.New(b).Update(trailer[:1]).Value())
+	return append(append(dst, b...), trailer[:]...)
+}
+
+// appendTestFooter appends to dst a table footer.
+func appendTestFooter(dst []byte, metaindexBH, indexBH blockHandle) []byte {
+	var footer [footerLen]byte
+	n := encodeBlockHandle(footer[:], metaindexBH)
+	encodeBlockHandle(footer[n:], indexBH)
+	copy(footer[footerLen-len(magic):], magic)
+	return append(dst, footer[:]...)
+}
+
+// readTestFile returns the contents of f.
+func readTestFile(t *testing.T, f db.File) []byte {
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, stat.Size())
+	if _, err := f.ReadAt(b, 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// writeTestFile returns a db.File with the given contents.
+func writeTestFile(t *testing.T, b []byte) db.File {
+	mem := memfs.New()
+	f0, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f0.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := f0.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f1
+}
+
+func TestCompressedMetaBlocks(t *testing.T) {
+	f, err := os.Open(filepath.FromSlash("../testdata/h.bloom.no-compression.ldb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	orig := readTestFile(t, f)
+
+	// Find the filter block and the index block of the original table.
+	footer := orig[len(orig)-footerLen:]
+	metaindexBH, n := decodeBlockHandle(footer)
+	indexBH, _ := decodeBlockHandle(footer[n:])
+	r := NewReader(writeTestFile(t, orig), nil)
+	metaindex, err := r.readBlock(metaindexBH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := metaindex.seek(db.DefaultComparer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filterName := "filter." + bloom.FilterPolicy(10).Name()
+	if !i.Next() || string(i.Key()) != filterName {
+		t.Fatalf("metaindex: got key %q, want %q", i.Key(), filterName)
+	}
+	filterBH, _ := decodeBlockHandle(i.Value())
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	filter, err := r.readBlock(filterBH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Re-write the table's meta blocks, snappy-compressing both the filter
+	// block and the metaindex block. The data blocks precede the filter block
+	// and are unchanged. The index block is copied verbatim.
+	b := append([]byte(nil), orig[:filterBH.offset]...)
+	newFilterBH := blockHandle{offset: uint64(len(b))}
+	b = appendTestRawBlock(b, snappy.Encode(nil, filter), snappyCompressionBlockType)
+	newFilterBH.length = uint64(len(b)) - newFilterBH.offset - blockTrailerLen
+	var tmp [2 * binary.MaxVarintLen64]byte
+	newMetaindexBH := blockHandle{offset: uint64(len(b))}
+	b = appendTestBlock(b, filterName, string(tmp[:encodeBlockHandle(tmp[:], newFilterBH)]))
+	newMetaindexBH.length = uint64(len(b)) - newMetaindexBH.offset - blockTrailerLen
+	newIndexBH := blockHandle{uint64(len(b)), indexBH.length}
+	b = append(b, orig[indexBH.offset:indexBH.offset+indexBH.length+blockTrailerLen]...)
+	b = appendTestFooter(b, newMetaindexBH, newIndexBH)
+
+	c := &countingFilterPolicy{
+		FilterPolicy: bloom.FilterPolicy(10),
+	}
+	if err := check(writeTestFile(t, b), c); err != nil {
+		t.Fatal(err)
+	}
+	if c.truePositives != len(wordCount) {
+		t.Errorf("true positives: got %d, want %d", c.truePositives, len(wordCount))
+	}
+	if c.trueNegatives == 0 {
+		t.Errorf("true negatives: got 0, want > 0")
+	}
+}
+
+func TestReadahead(t *testing.T) {
+	f, err := buildWithOptions(&db.Options{
+		BlockSize: 256,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nReadAts := map[int]int{}
+	for _, readaheadBlocks := range []int{0, 1, 4, 1000} {
+		cf := &readCountingFile{File: f}
+		r := NewReader(cf, &db.Options{
+			ReadaheadBlocks: readaheadBlocks,
+			VerifyChecksums: true,
+		})
+		for _, start := range []string{"", "k", "youth", "~"} {
+			i := r.Find([]byte(start), nil)
+			n := 0
+			for ; i.Next(); n++ {
+				if v := wordCount[string(i.Key())]; string(i.Value()) != v {
+					t.Fatalf("readahead=%d, start=%q: %q: got value %q, want %q",
+						readaheadBlocks, start, i.Key(), i.Value(), v)
+				}
+			}
+			if err := i.Close(); err != nil {
+				t.Fatalf("readahead=%d, start=%q: %v", readaheadBlocks, start, err)
+			}
+			want := 0
+			for k := range wordCount {
+				if k >= start {
+					want++
+				}
+			}
+			if n != want {
+				t.Fatalf("readahead=%d, start=%q: got %d entries, want %d", readaheadBlocks, start, n, want)
+			}
+		}
+		// Get doesn't read ahead.
+		for k, v := range wordCount {
+			if v1, err := r.Get([]byte(k), nil); err != nil || string(v1) != v {
+				t.Fatalf("readahead=%d: Get %q: got (%q, %v), want (%q, nil)", readaheadBlocks, k, v1, err, v)
+			}
+		}
+
+		// Count the reads for a full scan.
+		nReadAt := cf.nReadAt
+		i := r.Find(nil, nil)
+		for i.Next() {
+		}
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+		nReadAts[readaheadBlocks] = cf.nReadAt - nReadAt
+	}
+	if nReadAts[1] >= nReadAts[0] || nReadAts[4] >= nReadAts[1] || nReadAts[1000] != 1 {
+		t.Fatalf("full scan ReadAt calls: got %v, want strictly decreasing, ending with 1", nReadAts)
+	}
+}
+
+func TestReadaheadCorruptHandles(t *testing.T) {
+	var b []byte
+	var hs []blockHandle
+	for _, k := range []string{"a", "b"} {
+		bh := blockHandle{offset: uint64(len(b))}
+		b = appendTestBlock(b, k, k)
+		bh.length = uint64(len(b)) - bh.offset - blockTrailerLen
+		hs = append(hs, bh)
+	}
+	testCases := []struct {
+		desc   string
+		second blockHandle
+	}{
+		{"beyond the end of the file", blockHandle{hs[1].offset, 1 << 20}},
+		{"before the first block's end", hs[0]},
+	}
+	for _, tc := range testCases {
+		var tmp0, tmp1 [MaxBlockHandleLen]byte
+		c := append([]byte(nil), b...)
+		indexBH := blockHandle{offset: uint64(len(c))}
+		c = appendTestBlock(c,
+			"a", string(tmp0[:encodeBlockHandle(tmp0[:], hs[0])]),
+			"b", string(tmp1[:encodeBlockHandle(tmp1[:], tc.second)]))
+		indexBH.length = uint64(len(c)) - indexBH.offset - blockTrailerLen
+		c = appendTestFooter(c, blockHandle{}, indexBH)
+
+		// The handles are checked before the buffer that spans the blocks is
+		// allocated, so a bad length is reported as such, rather than as a
+		// failed read of that many bytes.
+		r := NewReader(writeTestFile(t, c), &db.Options{ReadaheadBlocks: 4})
+		i := r.Find(nil, nil)
+		for i.Next() {
+		}
+		if err, ok := i.Close().(CorruptionError); !ok || err.Offset != int64(tc.second.offset) {
+			t.Errorf("%s: got %v, want a CorruptionError at offset %d", tc.desc, i.Close(), tc.second.offset)
+		}
+		r.Close()
+	}
+}
+
+func BenchmarkScan(b *testing.B) {
+	f, err := buildWithOptions(&db.Options{
+		BlockSize: 1024,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, readaheadBlocks := range []int{0, 16} {
+		b.Run(fmt.Sprintf("readahead=%d", readaheadBlocks), func(b *testing.B) {
+			// There is no block cache, so every scan is a cold scan. The
+			// reads/op metric counts the ReadAt calls, each of which would be
+			// a disk read for an on-disk table.
+			cf := &readCountingFile{File: f}
+			r := NewReader(cf, &db.Options{
+				ReadaheadBlocks: readaheadBlocks,
+			})
+			nReadAt := cf.nReadAt
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				i := r.Find(nil, nil)
+				for i.Next() {
+				}
+				if err := i.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(cf.nReadAt-nReadAt)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func TestHas(t *testing.T) {
+	for _, fp := range []db.FilterPolicy{nil, bloom.FilterPolicy(10)} {
+		f, err := os.Open(filepath.FromSlash("../testdata/h.bloom.no-compression.ldb"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(f, &db.Options{
+			FilterPolicy: fp,
+		})
+		for k := range wordCount {
+			if ok, err := r.Has([]byte(k), nil); !ok || err != nil {
+				t.Fatalf("fp=%v: Has %q: got (%t, %v), want (true, nil)", fp, k, ok, err)
+			}
+		}
+		for _, s := range nonsenseWords {
+			if ok, err := r.Has([]byte(s), nil); ok || err != nil {
+				t.Fatalf("fp=%v: Has %q: got (%t, %v), want (false, nil)", fp, s, ok, err)
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHasCorruption(t *testing.T) {
+	f, err := os.Open(filepath.FromSlash("../testdata/h.no-compression.ldb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := readTestFile(t, f)
+	f.Close()
+	// Corrupt the first data block.
+	b[10] ^= 0xff
+	r := NewReader(writeTestFile(t, b), &db.Options{
+		VerifyChecksums: true,
+	})
+	defer r.Close()
+	if ok, err := r.Has([]byte(minWord), nil); ok || err == nil {
+		t.Fatalf("Has %q: got (%t, %v), want (false, non-nil error)", minWord, ok, err)
+	}
+}
+
+func TestMaxKeyAndValueLen(t *testing.T) {
+	wantKeyLen, wantValueLen := 0, 0
+	for k, v := range wordCount {
+		if wantKeyLen < len(k) {
+			wantKeyLen = len(k)
+		}
+		if wantValueLen < len(v) {
+			wantValueLen = len(v)
+		}
+	}
+	testCases := []struct {
+		desc                     string
+		kvs                      []string
+		wantKeyLen, wantValueLen int
+	}{
+		{"empty", nil, 0, 0},
+		{"one", []string{"abc", "de"}, 3, 2},
+		{"mixed", []string{"a", strings.Repeat("v", 5000), strings.Repeat("k", 300), "", "z", "vv"}, 300, 5000},
+	}
+	for _, tc := range testCases {
+		mem := memfs.New()
+		f0, err := mem.Create("f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f0, &db.Options{
+			BlockSize: 100,
+		})
+		// The lengths are only recorded in a table that has a properties
+		// block for another reason, such as a user property.
+		if err := w.SetUserProperties(map[string][]byte{"desc": []byte(tc.desc)}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(tc.kvs); i += 2 {
+			if err := w.Set([]byte(tc.kvs[i]), []byte(tc.kvs[i+1]), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f1, err := mem.Open("f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The lengths are read from the table's properties, without reading
+		// any data blocks.
+		reads := 0
+		r := NewReader(f1, &db.Options{
+			OnBlockRead: func(db.BlockReadInfo) {
+				reads++
+			},
+		})
+		if got, err := r.MaxKeyLen(); got != tc.wantKeyLen || err != nil {
+			t.Errorf("%s: MaxKeyLen: got (%d, %v), want (%d, nil)", tc.desc, got, err, tc.wantKeyLen)
+		}
+		if got, err := r.MaxValueLen(); got != tc.wantValueLen || err != nil {
+			t.Errorf("%s: MaxValueLen: got (%d, %v), want (%d, nil)", tc.desc, got, err, tc.wantValueLen)
+		}
+		if reads != 0 {
+			t.Errorf("%s: got %d block reads, want 0", tc.desc, reads)
+		}
+		r.Close()
+	}
+
+	// The lengths are also recorded for data blocks that TrimTo copies
+	// verbatim.
+	src, err := buildWithOptions(&db.Options{
+		BlockSize: 512,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := memfs.New()
+	f0, err := mem.Create("trimmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, &db.Options{
+		VerifyDecompressed: true,
+	})
+	if err := TrimTo(NewReader(src, nil), []byte("\xff"), w, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := mem.Open("trimmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trimmed := NewReader(f1, nil)
+	if !trimmed.hasMaxLens || trimmed.maxKeyLen != wantKeyLen || trimmed.maxValueLen != wantValueLen {
+		t.Errorf("TrimTo: got recorded lengths (%d, %d), want (%d, %d)",
+			trimmed.maxKeyLen, trimmed.maxValueLen, wantKeyLen, wantValueLen)
+	}
+	trimmed.Close()
+
+	// A table written with the default options, like one written by the C++
+	// LevelDB implementation, does not record the lengths, so it is scanned,
+	// but only once for both lengths.
+	f, err := os.Open(filepath.FromSlash("../testdata/h.ldb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reads := 0
+	r := NewReader(f, &db.Options{
+		OnBlockRead: func(db.BlockReadInfo) {
+			reads++
+		},
+	})
+	defer r.Close()
+	if got, err := r.MaxKeyLen(); got != wantKeyLen || err != nil {
+		t.Errorf("h.ldb: MaxKeyLen: got (%d, %v), want (%d, nil)", got, err, wantKeyLen)
+	}
+	if reads == 0 {
+		t.Errorf("h.ldb: MaxKeyLen: got no block reads, want a scan")
+	}
+	reads = 0
+	if got, err := r.MaxValueLen(); got != wantValueLen || err != nil {
+		t.Errorf("h.ldb: MaxValueLen: got (%d, %v), want (%d, nil)", got, err, wantValueLen)
+	}
+	if reads != 0 {
+		t.Errorf("h.ldb: MaxValueLen: got %d block reads, want 0", reads)
+	}
+}
+
+func TestPaddedBlocks(t *testing.T) {
+	const alignment = 512
+	f, err := os.Open(filepath.FromSlash("../testdata/h.no-compression.ldb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := readTestFile(t, f)
+	r := NewReader(f, nil)
+	index, err := r.index.seek(r.comparer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Re-write the table, padding each block to start at a multiple of the
+	// alignment. The padding is filled with bytes that look like an entry, so
+	// that reading it as data would be detected.
+	var b []byte
+	var indexKVs []string
+	var tmp [2 * binary.MaxVarintLen64]byte
+	for index.Next() {
+		h, _ := decodeBlockHandle(index.Value())
+		for len(b)%alignment != 0 {
+			b = append(b, "\x00\x01\x01xy"[len(b)%5])
+		}
+		newH := blockHandle{uint64(len(b)), h.length}
+		b = append(b, orig[h.offset:h.offset+h.length+blockTrailerLen]...)
+		indexKVs = append(indexKVs, string(index.Key()), string(tmp[:encodeBlockHandle(tmp[:], newH)]))
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(indexKVs) < 4 {
+		t.Fatalf("table has %d data blocks, want at least 2", len(indexKVs)/2)
+	}
+	for len(b)%alignment != 0 {
+		b = append(b, 0)
+	}
+	metaindexBH := blockHandle{offset: uint64(len(b))}
+	b = appendTestBlock(b)
+	metaindexBH.length = uint64(len(b)) - metaindexBH.offset - blockTrailerLen
+	indexBH := blockHandle{offset: uint64(len(b))}
+	b = appendTestBlock(b, indexKVs...)
+	indexBH.length = uint64(len(b)) - indexBH.offset - blockTrailerLen
+	b = appendTestFooter(b, metaindexBH, indexBH)
+
+	padded := writeTestFile(t, b)
+	if err := check(padded, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading ahead spans the padding between blocks, which must not be
+	// mistaken for data.
+	for _, readaheadBlocks := range []int{1, 3, 100} {
+		cf := &readCountingFile{File: padded}
+		r := NewReader(cf, &db.Options{
+			ReadaheadBlocks: readaheadBlocks,
+			VerifyChecksums: true,
+		})
+		i, n := r.Find(nil, nil), 0
+		for ; i.Next(); n++ {
+			if v := wordCount[string(i.Key())]; string(i.Value()) != v {
+				t.Fatalf("readahead=%d: %q: got value %q, want %q", readaheadBlocks, i.Key(), i.Value(), v)
+			}
+		}
+		if err := i.Close(); err != nil {
+			t.Fatalf("readahead=%d: %v", readaheadBlocks, err)
+		}
+		if n != len(wordCount) {
+			t.Fatalf("readahead=%d: got %d entries, want %d", readaheadBlocks, n, len(wordCount))
+		}
+	}
+}
+
+func TestNewReaderWithIndex(t *testing.T) {
+	f, err := build(db.DefaultCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r0 := NewReader(f, nil)
+	index := r0.IndexBlock()
+	if len(index) == 0 {
+		t.Fatal("IndexBlock: got empty index")
+	}
+
+	// Re-opening with the index should read the footer but not the index.
+	cf := &readCountingFile{File: f}
+	r1 := NewReaderWithIndex(cf, nil, index)
+	if cf.nReadAt != 2 {
+		t.Errorf("ReadAt calls: got %d, want 2 (footer and metaindex)", cf.nReadAt)
+	}
+	if &r1.IndexBlock()[0] != &index[0] {
+		t.Errorf("the index block is not shared")
+	}
+	for k, v := range wordCount {
+		if v1, err := r1.Get([]byte(k), nil); err != nil || string(v1) != v {
+			t.Fatalf("Get %q: got (%q, %v), want (%q, nil)", k, v1, err, v)
+		}
+	}
+
+	// An invalid index is ignored, and the index is read from the file.
+	cf = &readCountingFile{File: f}
+	r2 := NewReaderWithIndex(cf, nil, []byte("\xff\xff\xff\xff"))
+	if cf.nReadAt != 3 {
+		t.Errorf("invalid index: ReadAt calls: got %d, want 3", cf.nReadAt)
+	}
+	if v, err := r2.Get([]byte(minWord), nil); err != nil || string(v) != wordCount[minWord] {
+		t.Fatalf("invalid index: Get %q: got (%q, %v)", minWord, v, err)
+	}
+
+	// The footer is still validated.
+	r3 := NewReaderWithIndex(writeTestFile(t, make([]byte, 100)), nil, index)
+	if err := r3.Close(); err == nil {
+		t.Errorf("bad footer: got nil error")
+	}
+}
+
+func TestBlockCache(t *testing.T) {
+	c := &blockCache{}
+	c.init(10)
+	c.set(0, make(block, 4))
+	c.set(10, make(block, 4))
+	if _, ok := c.get(0); !ok {
+		t.Fatal("get 0: got false, want true")
+	}
+	// Offset 10 is now the least recently used, and is evicted.
+	c.set(20, make(block, 4))
+	if _, ok := c.get(10); ok {
+		t.Error("get 10: got true, want false")
+	}
+	if _, ok := c.get(0); !ok {
+		t.Error("get 0: got false, want true")
+	}
+	if _, ok := c.get(20); !ok {
+		t.Error("get 20: got false, want true")
+	}
+	// Blocks larger than the capacity are not cached.
+	c.set(30, make(block, 11))
+	if _, ok := c.get(30); ok {
+		t.Error("get 30: got true, want false")
+	}
+	if c.size != 8 || len(c.nodes) != 2 {
+		t.Errorf("size, len(nodes): got %d, %d, want 8, 2", c.size, len(c.nodes))
+	}
+	// Replacing a block updates the size.
+	c.set(20, make(block, 6))
+	if c.size != 10 || len(c.nodes) != 2 {
+		t.Errorf("size, len(nodes): got %d, %d, want 10, 2", c.size, len(c.nodes))
+	}
+	if _, ok := c.get(0); !ok {
+		t.Error("get 0: got false, want true")
+	}
+	if _, ok := c.get(10); ok {
+		t.Error("get 10: got true, want false")
+	}
+}
+
+func TestReaderTouch(t *testing.T) {
+	// Write a table whose data blocks each hold one 100 byte value.
+	mem := memfs.New()
+	f0, err := mem.Create("touch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, &db.Options{
+		BlockSize:   100,
+		Compression: db.NoCompression,
+	})
+	xxx := bytes.Repeat([]byte("x"), 100)
+	for _, k := range []string{"a", "b", "c", "d"} {
+		if err := w.Set([]byte(k), xxx, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := mem.Open("touch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf := &readCountingFile{File: f1}
+	// The cache can hold two blocks.
+	r := NewReader(cf, &db.Options{
+		BlockCacheSize: 250,
+	})
+	defer r.Close()
+
+	get := func(key string, wantReads int) {
+		t.Helper()
+		nReadAt := cf.nReadAt
+		if _, err := r.Get([]byte(key), nil); err != nil {
+			t.Fatalf("Get %q: %v", key, err)
+		}
+		if got := cf.nReadAt - nReadAt; got != wantReads {
+			t.Fatalf("Get %q: got %d reads, want %d", key, got, wantReads)
+		}
+	}
+	touch := func(key string) {
+		t.Helper()
+		nReadAt := cf.nReadAt
+		if err := r.Touch([]byte(key)); err != nil {
+			t.Fatalf("Touch %q: %v", key, err)
+		}
+		if got := cf.nReadAt - nReadAt; got != 0 {
+			t.Fatalf("Touch %q: got %d reads, want 0", key, got)
+		}
+	}
+
+	get("a", 1)
+	get("b", 1)
+	get("a", 0)
+	get("b", 0)
+	// Touching an uncached block does not read it.
+	touch("c")
+	touch("zzz")
+	// Without the Touch, reading "c" would evict "a".
+	touch("a")
+	get("c", 1)
+	get("a", 0)
+	get("b", 1)
+}
+
+func TestCompressionStats(t *testing.T) {
+	for _, filename := range []string{"h.ldb", "h.no-compression.ldb"} {
+		f, err := os.Open(filepath.FromSlash("../testdata/" + filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(f, nil)
+
+		// Compute the expected stats by reading every data block in full.
+		want := CompressionStats{
+			NumBlocks: map[db.Compression]int{},
+		}
+		index, err := r.index.seek(r.comparer, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for index.Next() {
+			h, _ := decodeBlockHandle(index.Value())
+			raw, blockType, err := r.readRawBlock(h, r.verifyChecksums)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := decompressBlock(raw, blockType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want.CompressedBytes += uint64(len(raw))
+			want.UncompressedBytes += uint64(len(b))
+			if blockType == snappyCompressionBlockType {
+				want.NumBlocks[db.SnappyCompression]++
+			} else {
+				want.NumBlocks[db.NoCompression]++
+			}
+		}
+		if err := index.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := r.CompressionStats()
+		if err != nil {
+			t.Fatalf("%s: %v", filename, err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s:\ngot  %v\nwant %v", filename, got, want)
+		}
+		if filename == "h.ldb" && got.NumBlocks[db.SnappyCompression] == 0 {
+			t.Errorf("%s: no snappy-compressed blocks", filename)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReverseReader(t *testing.T) {
+	keys := make([]string, 0, len(wordCount))
+	for k := range wordCount {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// Write a table in decreasing bytewise order.
+	mem := memfs.New()
+	f0, err := mem.Create("descending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, &db.Options{
+		BlockSize: 256,
+		Comparer:  reverseComparer{},
+	})
+	for j := len(keys) - 1; j >= 0; j-- {
+		if err := w.Set([]byte(keys[j]), []byte(wordCount[keys[j]]), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := mem.Open("descending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := NewReverseReader(NewReader(f1, &db.Options{
+		Comparer: reverseComparer{},
+	}))
+	defer rr.Close()
+
+	for k, v := range wordCount {
+		if v1, err := rr.Get([]byte(k), nil); err != nil || string(v1) != v {
+			t.Fatalf("Get %q: got (%q, %v), want (%q, nil)", k, v1, err, v)
+		}
+	}
+	for _, s := range nonsenseWords {
+		if _, err := rr.Get([]byte(s), nil); err != db.ErrNotFound {
+			t.Fatalf("Get %q: got %v, want ErrNotFound", s, err)
+		}
+	}
+
+	// Find yields the keys >= start, in increasing bytewise order.
+	starts := append([]string{minWord, maxWord, "k", "polonius", "youth"}, nonsenseWords...)
+	for _, start := range starts {
+		j := sort.SearchStrings(keys, start)
+		i := rr.Find([]byte(start), nil)
+		for ; i.Next(); j++ {
+			if j >= len(keys) || string(i.Key()) != keys[j] || string(i.Value()) != wordCount[keys[j]] {
+				t.Fatalf("Find %q: got %q:%q", start, i.Key(), i.Value())
+			}
+		}
+		if err := i.Close(); err != nil {
+			t.Fatalf("Find %q: %v", start, err)
+		}
+		if j != len(keys) {
+			t.Fatalf("Find %q: stopped before key %q", start, keys[j])
+		}
+	}
+}
+
+func TestTruncatedTable(t *testing.T) {
+	f, err := os.Open(filepath.FromSlash("../testdata/h.ldb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := readTestFile(t, f)
+	f.Close()
+	footer := orig[len(orig)-footerLen:]
+	metaindexBH, n := decodeBlockHandle(footer)
+	indexBH, _ := decodeBlockHandle(footer[n:])
+	if metaindexBH.offset >= indexBH.offset {
+		t.Fatalf("the metaindex block does not precede the index block")
+	}
+
+	testCases := []struct {
+		desc       string
+		length     uint64
+		wantOffset uint64
+	}{
+		{"mid-index", indexBH.offset + indexBH.length/2, indexBH.offset},
+		{"index trailer", indexBH.offset + indexBH.length + 1, indexBH.offset},
+		{"mid-metaindex", metaindexBH.offset + 1, metaindexBH.offset},
+		{"data", metaindexBH.offset / 2, metaindexBH.offset},
+	}
+	for _, tc := range testCases {
+		// Truncate the file, but keep its footer, so that the magic number
+		// is still valid.
+		b := append(append([]byte(nil), orig[:tc.length]...), footer...)
+		r := NewReader(writeTestFile(t, b), nil)
+		err := r.Close()
+		cerr, ok := err.(CorruptionError)
+		if !ok {
+			t.Errorf("%s: got %v (%T), want a CorruptionError", tc.desc, err, err)
+			continue
+		}
+		if cerr.Offset != int64(tc.wantOffset) || !strings.Contains(cerr.Reason, "truncated") {
+			t.Errorf("%s: got %v, want truncated at offset %d", tc.desc, err, tc.wantOffset)
+		}
+	}
+
+	// The untruncated table is still valid.
+	if err := check(writeTestFile(t, orig), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFormatVersion(t *testing.T) {
+	f, err := os.Open(filepath.FromSlash("../testdata/h.ldb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := readTestFile(t, f)
+	f.Close()
+	body, footer := orig[:len(orig)-footerLen], orig[len(orig)-footerLen:]
+
+	// versioned returns the table with its footer rewritten as a versioned
+	// footer, with the given checksum type and format version.
+	versioned := func(checksumType byte, version uint32) []byte {
+		var v [versionedFooterLen]byte
+		v[0] = checksumType
+		copy(v[1:], footer[:footerLen-len(magic)])
+		binary.LittleEndian.PutUint32(v[versionedFooterLen-len(versionedMagic)-4:], version)
+		copy(v[versionedFooterLen-len(versionedMagic):], versionedMagic)
+		return append(append([]byte(nil), body...), v[:]...)
+	}
+
+	// Format version 1 tables are read like version 0 tables.
+	if err := check(writeTestFile(t, versioned(crc32cChecksumType, 1)), nil); err != nil {
+		t.Fatalf("version 1: %v", err)
+	}
+
+	testCases := []struct {
+		desc         string
+		checksumType byte
+		version      uint32
+		want         string
+	}{
+		{"version 0", crc32cChecksumType, 0, "unsupported table format version 0"},
+		{"version 2", crc32cChecksumType, 2, "unsupported table format version 2"},
+		{"version 5", crc32cChecksumType, 5, "unsupported table format version 5"},
+		{"xxHash", 2, 1, "unsupported checksum type 2"},
+	}
+	for _, tc := range testCases {
+		r := NewReader(writeTestFile(t, versioned(tc.checksumType, tc.version)), nil)
+		err := r.Close()
+		if _, ok := err.(CorruptionError); !ok || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v (%T), want a CorruptionError containing %q", tc.desc, err, err, tc.want)
+		}
+	}
+}
+
+func TestParseFooter(t *testing.T) {
+	const off = 1000
+	handles := footer{
+		metaindexHandle: blockHandle{100, 20},
+		indexHandle:     blockHandle{130, 1 << 40},
+	}
+	encode := func(f footer) []byte {
+		b := make([]byte, f.len())
+		if n := f.encode(b); n != f.len() {
+			t.Fatalf("encode: got %d bytes, want %d", n, f.len())
+		}
+		return b
+	}
+
+	// Footers of both formats round-trip, with or without preceding bytes.
+	v0 := handles
+	v1 := handles
+	v1.version, v1.checksumType = 1, crc32cChecksumType
+	for _, f := range []footer{v0, v1} {
+		b := encode(f)
+		for _, prefix := range []string{"", "xxxxx"} {
+			got, err := parseFooter(append([]byte(prefix), b...), off)
+			want := f
+			want.checksumType = crc32cChecksumType
+			if err != nil || got != want {
+				t.Errorf("version %d, prefix %q: got (%+v, %v), want (%+v, nil)", f.version, prefix, got, err, want)
+			}
+		}
+	}
+	// The Writer encodes a version 0 footer.
+	f0, err := buildWithOptions(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := readTestFile(t, f0)
+	if got, err := parseFooter(b[len(b)-footerLen:], int64(len(b)-footerLen)); err != nil || got.version != 0 {
+		t.Errorf("Writer: got (%+v, %v), want a version 0 footer", got, err)
+	}
+
+	badHandles := encode(v0)
+	for j := 0; j < footerHandlesLen; j++ {
+		badHandles[j] = 0xff
+	}
+	badIndexHandle := encode(v1)
+	n := 1 + encodeBlockHandle(badIndexHandle[1:], v1.metaindexHandle)
+	for j := n; j < 1+footerHandlesLen; j++ {
+		badIndexHandle[j] = 0x80
+	}
+	unknownChecksum := encode(v1)
+	unknownChecksum[0] = 2
+	version2 := v1
+	version2.version = 2
+	testCases := []struct {
+		desc       string
+		b          []byte
+		wantOffset int64
+		want       string
+	}{
+		{"short", encode(v0)[1:], -1, "file size is too small"},
+		{"short versioned", encode(v1)[1:], -1, "file size is too small"},
+		{"bad magic", append(encode(v0)[:footerLen-1], 0), off + footerLen - int64(len(magic)), "bad magic number"},
+		{"bad metaindex handle", badHandles, off, "bad metaindex block handle"},
+		{"bad index handle", badIndexHandle, off, "bad index block handle"},
+		{"unknown checksum type", unknownChecksum, off, "unsupported checksum type 2"},
+		{"version 2", encode(version2), off + versionedFooterLen - int64(len(versionedMagic)) - 4, "unsupported table format version 2"},
+	}
+	for _, tc := range testCases {
+		_, err := parseFooter(tc.b, off)
+		cerr, ok := err.(CorruptionError)
+		if !ok || cerr.Offset != tc.wantOffset || !strings.Contains(cerr.Reason, tc.want) {
+			t.Errorf("%s: got %v, want a CorruptionError at offset %d containing %q", tc.desc, err, tc.wantOffset, tc.want)
+		}
+	}
+}
+
+// testLogger is a db.Logger that records its messages.
+type testLogger struct {
+	msgs []string
+}
+
+func (l *testLogger) Infof(format string, args ...interface{}) {
+	l.msgs = append(l.msgs, fmt.Sprintf(format, args...))
+}
+
+func TestBlockSeekLimit(t *testing.T) {
+	// Write a pathological table with a single data block that has a single
+	// restart point.
+	f, err := buildWithOptions(&db.Options{
+		BlockRestartInterval: 1 << 20,
+		BlockSize:            1 << 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Seeking to minWord steps over no entries. Seeking to maxWord steps over
+	// every other entry.
+	logger := &testLogger{}
+	r := NewReader(f, &db.Options{
+		BlockSeekWarnThreshold: 100,
+		Logger:                 logger,
+	})
+	if _, err := r.Get([]byte(minWord), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(logger.msgs) != 0 {
+		t.Fatalf("Get %q: got warnings %q, want none", minWord, logger.msgs)
+	}
+	if _, err := r.Get([]byte(maxWord), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(logger.msgs) != 1 || !strings.Contains(logger.msgs[0], fmt.Sprintf("%d entries", len(wordCount)-1)) {
+		t.Fatalf("Get %q: got warnings %q, want one for %d entries", maxWord, logger.msgs, len(wordCount)-1)
+	}
+
+	r = NewReader(f, &db.Options{
+		BlockSeekLimit: 100,
+	})
+	if _, err := r.Get([]byte(minWord), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Get([]byte(maxWord), nil); err == nil {
+		t.Fatalf("Get %q: got nil error, want a seek limit error", maxWord)
+	} else if _, ok := err.(CorruptionError); !ok {
+		t.Fatalf("Get %q: got %v (%T), want a CorruptionError", maxWord, err, err)
+	}
+
+	// A well built table does not trigger the limit.
+	f, err = build(db.DefaultCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = NewReader(f, &db.Options{
+		BlockSeekLimit: 16,
+	})
+	for k := range wordCount {
+		if _, err := r.Get([]byte(k), nil); err != nil {
+			t.Fatalf("Get %q: %v", k, err)
+		}
+	}
+}
+
+func TestIteratorSeek(t *testing.T) {
+	// Write a table whose data blocks each hold two 40 byte values.
+	mem := memfs.New()
+	f0, err := mem.Create("seek")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, &db.Options{
+		BlockSize:   100,
+		Compression: db.NoCompression,
+	})
+	keys := []string{"b", "d", "f", "h", "j", "l"}
+	for _, k := range keys {
+		if err := w.Set([]byte(k), bytes.Repeat([]byte(k), 40), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := mem.Open("seek")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf := &readCountingFile{File: f1}
+	r := NewReader(cf, nil)
+	defer r.Close()
+
+	i := r.Find([]byte("zzz"), nil).(*Iterator)
+	if i.Next() {
+		t.Fatalf("Find past the end: got %q, want no more keys", i.Key())
+	}
+	testCases := []struct {
+		key, want string
+		wantReads int
+	}{
+		{"a", "b", 1},
+		{"b", "b", 0},
+		{"c", "d", 0},
+		{"k", "l", 1},
+		{"i", "j", 0},
+		{"e", "f", 1},
+		{"zzz", "", 0},
+		{"g", "h", 1},
+		{"", "b", 1},
+	}
+	for _, tc := range testCases {
+		nReadAt := cf.nReadAt
+		if got := i.Seek([]byte(tc.key)); got != (tc.want != "") {
+			t.Fatalf("Seek %q: got %t, want %t", tc.key, got, tc.want != "")
+		}
+		if got := cf.nReadAt - nReadAt; got != tc.wantReads {
+			t.Fatalf("Seek %q: got %d reads, want %d", tc.key, got, tc.wantReads)
+		}
+		if tc.want == "" {
+			continue
+		}
+		if got := string(i.Key()); got != tc.want {
+			t.Fatalf("Seek %q: got key %q, want %q", tc.key, got, tc.want)
+		}
+		if got, want := string(i.Value()), strings.Repeat(tc.want, 40); got != want {
+			t.Fatalf("Seek %q: got value %q, want %q", tc.key, got, want)
+		}
+	}
+	// After the last Seek, Next continues from the first key.
+	var got []string
+	for i.Next() {
+		got = append(got, string(i.Key()))
+	}
+	if got, want := strings.Join(got, ","), strings.Join(keys[1:], ","); got != want {
+		t.Fatalf("Next after Seek: got %q, want %q", got, want)
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testInternalKeyComparer orders internal keys as package leveldb does:
+// increasing by user key, then decreasing by sequence number and kind.
+type testInternalKeyComparer struct{}
+
+func (testInternalKeyComparer) Compare(a, b []byte) int {
+	ua, ka, sa, _ := parseInternalKey(a)
+	ub, kb, sb, _ := parseInternalKey(b)
+	if c := bytes.Compare(ua, ub); c != 0 {
+		return c
+	}
+	if sa != sb {
+		if sa > sb {
+			return -1
+		}
+		return +1
+	}
+	return int(kb) - int(ka)
+}
+
+func (testInternalKeyComparer) Name() string {
+	return "leveldb.InternalKeyComparator"
+}
+
+func (testInternalKeyComparer) AppendSeparator(dst, a, b []byte) []byte {
+	return append(dst, a...)
+}
+
+// makeTestInternalKey makes an internal key from a user key, a kind and a
+// sequence number.
+func makeTestInternalKey(ukey string, kind uint8, seqNum uint64) []byte {
+	b := append([]byte(ukey), kind)
+	for j := 0; j < 7; j++ {
+		b = append(b, byte(seqNum>>uint(8*j)))
+	}
+	return b
+}
+
+func TestMergeSortedInto(t *testing.T) {
+	const (
+		del = internalKeyKindDelete
+		set = internalKeyKindSet
+	)
+	type entry struct {
+		ukey   string
+		kind   uint8
+		seqNum uint64
+	}
+	inputs := [][]entry{
+		{{"a", set, 1}, {"b", set, 2}, {"d", set, 3}},
+		{{"a", set, 5}, {"b", del, 6}, {"c", set, 4}},
+		{{"a", del, 9}, {"c", set, 8}, {"d", set, 7}, {"e", del, 10}},
+	}
+	o := &db.Options{
+		Comparer:    testInternalKeyComparer{},
+		BlockSize:   32,
+		Compression: db.NoCompression,
+	}
+	mem := memfs.New()
+	var rs []*Reader
+	for n, input := range inputs {
+		name := fmt.Sprintf("in%d", n)
+		f, err := mem.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f, o)
+		for _, e := range input {
+			k := makeTestInternalKey(e.ukey, e.kind, e.seqNum)
+			if err := w.Set(k, []byte(fmt.Sprintf("%s%d", e.ukey, e.seqNum)), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f, err = mem.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(f, o)
+		defer r.Close()
+		rs = append(rs, r)
+	}
+
+	testCases := []struct {
+		snapshot      uint64
+		dropDeletions bool
+		want          string
+	}{
+		{0, false, "a.DEL.9 b.DEL.6 c.SET.8 d.SET.7 e.DEL.10"},
+		{0, true, "c.SET.8 d.SET.7"},
+		{6, false, "a.DEL.9 a.SET.5 b.DEL.6 c.SET.8 c.SET.4 d.SET.7 d.SET.3 e.DEL.10"},
+		{6, true, "a.DEL.9 a.SET.5 c.SET.8 c.SET.4 d.SET.7 d.SET.3 e.DEL.10"},
+		{1, false, "a.DEL.9 a.SET.5 a.SET.1 b.DEL.6 b.SET.2 c.SET.8 c.SET.4 d.SET.7 d.SET.3 e.DEL.10"},
+	}
+	for i, tc := range testCases {
+		name := fmt.Sprintf("out%d", i)
+		f, err := mem.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f, o)
+		var progress []MergeStats
+		stats, err := MergeSortedInto(w, rs, &MergeOptions{
+			Snapshot:      tc.snapshot,
+			DropDeletions: tc.dropDeletions,
+			Progress: func(s MergeStats) {
+				progress = append(progress, s)
+			},
+		})
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if stats.Read != 10 || stats.Written+stats.Dropped != stats.Read {
+			t.Errorf("%d: got stats %+v, want 10 read", i, stats)
+		}
+		if len(progress) != 10 || progress[9] != stats {
+			t.Errorf("%d: got %d progress calls ending in %+v, want 10 ending in %+v",
+				i, len(progress), progress[len(progress)-1], stats)
+		}
+
+		f, err = mem.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(f, o)
+		var got []string
+		iter := r.Find(nil, nil)
+		for iter.Next() {
+			ukey, kind, seqNum, ok := parseInternalKey(iter.Key())
+			if !ok {
+				t.Fatalf("%d: invalid internal key %q", i, iter.Key())
+			}
+			if want := fmt.Sprintf("%s%d", ukey, seqNum); string(iter.Value()) != want {
+				t.Errorf("%d: %q: got value %q, want %q", i, iter.Key(), iter.Value(), want)
+			}
+			kindStr := "SET"
+			if kind == internalKeyKindDelete {
+				kindStr = "DEL"
+			}
+			got = append(got, fmt.Sprintf("%s.%s.%d", ukey, kindStr, seqNum))
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if got := strings.Join(got, " "); got != tc.want {
+			t.Errorf("%d: got  %s\nwant %s", i, got, tc.want)
+		}
+		if stats.Written != len(strings.Fields(tc.want)) {
+			t.Errorf("%d: got %d written, want %d", i, stats.Written, len(strings.Fields(tc.want)))
+		}
+	}
+}
+
+func TestMergeSortedIntoRangeTombstones(t *testing.T) {
+	o := &db.Options{
+		Comparer:    testInternalKeyComparer{},
+		Compression: db.NoCompression,
+	}
+	mem := memfs.New()
+	var rs []*Reader
+	for n, build := range []func(w *Writer) error{
+		func(w *Writer) error {
+			for j, ukey := range []string{"a", "b", "c", "d"} {
+				if err := w.Set(makeTestInternalKey(ukey, internalKeyKindSet, uint64(j+1)), nil, nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		func(w *Writer) error {
+			if err := w.DeleteRange([]byte("b"), []byte("d"), 5); err != nil {
+				return err
+			}
+			return w.Set(makeTestInternalKey("c", internalKeyKindSet, 6), nil, nil)
+		},
+	} {
+		name := fmt.Sprintf("in%d", n)
+		f, err := mem.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f, o)
+		if err := build(w); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f, err = mem.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(f, o)
+		defer r.Close()
+		rs = append(rs, r)
+	}
+
+	testCases := []struct {
+		snapshot      uint64
+		dropDeletions bool
+		want          string
+		wantTombs     int
+	}{
+		// The tombstone deletes b.2 and c.3 for every snapshot.
+		{0, false, "a.1 c.6 d.4", 1},
+		{0, true, "a.1 c.6 d.4", 0},
+		// The snapshot at 3 still sees b.2 and c.3, and the tombstone must be
+		// kept to delete them at later snapshots.
+		{3, false, "a.1 b.2 c.6 c.3 d.4", 1},
+		{3, true, "a.1 b.2 c.6 c.3 d.4", 1},
+	}
+	for i, tc := range testCases {
+		name := fmt.Sprintf("out%d", i)
+		f, err := mem.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f, o)
+		stats, err := MergeSortedInto(w, rs, &MergeOptions{
+			Snapshot:      tc.snapshot,
+			DropDeletions: tc.dropDeletions,
+		})
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if stats.Read != 5 || stats.Written != len(strings.Fields(tc.want)) {
+			t.Errorf("%d: got stats %+v, want 5 read and %d written", i, stats, len(strings.Fields(tc.want)))
+		}
+
+		f, err = mem.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(f, o)
+		var got []string
+		iter := r.Find(nil, nil)
+		for iter.Next() {
+			ukey, _, seqNum, _ := parseInternalKey(iter.Key())
+			got = append(got, fmt.Sprintf("%s.%d", ukey, seqNum))
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if got := strings.Join(got, " "); got != tc.want {
+			t.Errorf("%d: got %q, want %q", i, got, tc.want)
+		}
+		tombs := r.RangeTombstones()
+		if len(tombs) != tc.wantTombs {
+			t.Errorf("%d: got %d range tombstones, want %d", i, len(tombs), tc.wantTombs)
+		}
+		for _, tomb := range tombs {
+			if string(tomb.Start) != "b" || string(tomb.End) != "d" || tomb.SeqNum != 5 {
+				t.Errorf("%d: got range tombstone %q-%q.%d, want \"b\"-\"d\".5", i, tomb.Start, tomb.End, tomb.SeqNum)
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+}
+
+func TestBlockSeekCorruptRestarts(t *testing.T) {
+	// Build an uncompressed block whose every entry is a restart point.
+	var b, restarts []byte
+	for _, k := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		restarts = append(restarts, byte(len(b)), 0, 0, 0)
+		b = append(b, 0, 1, 1, k[0], k[0])
+	}
+	n := len(b)
+	b = append(b, restarts...)
+	b = append(b, byte(len(restarts)/4), 0, 0, 0)
+	trailerLen := len(b) - n
+
+	seek := func(k block, wantErr bool) {
+		t.Helper()
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("block %q: panic: %v", []byte(k), r)
+			}
+		}()
+		gotErr := false
+		for _, key := range []string{"", "a", "b", "c", "d", "dd", "e", "f", "g", "h", "zz"} {
+			i, err := k.seek(db.DefaultComparer, []byte(key))
+			if err != nil {
+				if _, ok := err.(CorruptionError); !ok {
+					t.Fatalf("block %q: seek %q: got %v, want a CorruptionError", []byte(k), key, err)
+				}
+				gotErr = true
+				continue
+			}
+			for i.Next() {
+			}
+			i.Close()
+		}
+		if wantErr && !gotErr {
+			t.Fatalf("block %q: got no error, want a CorruptionError", []byte(k))
+		}
+	}
+
+	seek(block(b), false)
+	// Blocks that are truncated from the front keep their restart count but
+	// lose some of their restart points.
+	for j := len(b) - trailerLen + 1; j < len(b); j++ {
+		seek(block(b[j:]), true)
+	}
+	// Blocks with bogus restart counts.
+	for _, numRestarts := range []uint32{0, 9, uint32(len(b) / 4), 1 << 31, 1<<32 - 1} {
+		k := append(block(nil), b...)
+		binary.LittleEndian.PutUint32(k[len(k)-4:], numRestarts)
+		seek(k, true)
+	}
+	// Blocks with bogus restart offsets.
+	rng := rand.New(rand.NewSource(1))
+	for j := 0; j < 8; j++ {
+		for _, o := range []uint32{uint32(n), uint32(n + 1), 1 << 31, 1<<32 - 1, uint32(n) + rng.Uint32()%(1<<31)} {
+			k := append(block(nil), b...)
+			binary.LittleEndian.PutUint32(k[n+4*j:], o)
+			seek(k, true)
+		}
+		// A restart offset that points at an entry which is not a restart
+		// point, since it shares a prefix with the previous key.
+		k := append(block(nil), b...)
+		k[5*j] = 1
+		seek(k, j != 0)
+	}
+}
+
+// writeTestTableWithProperties writes a table with one data block holding the
+// given key/value pairs, and a properties block holding the given property
+// name/value pairs, which must be in increasing order.
+func writeTestTableWithProperties(t *testing.T, kvs []string, props ...string) db.File {
+	var tmp [2 * binary.MaxVarintLen64]byte
+	dataBH := blockHandle{}
+	b := appendTestBlock(nil, kvs...)
+	dataBH.length = uint64(len(b)) - blockTrailerLen
+	propsBH := blockHandle{offset: uint64(len(b))}
+	b = appendTestBlock(b, props...)
+	propsBH.length = uint64(len(b)) - propsBH.offset - blockTrailerLen
+	metaindexBH := blockHandle{offset: uint64(len(b))}
+	b = appendTestBlock(b, propertiesBlockName, string(tmp[:encodeBlockHandle(tmp[:], propsBH)]))
+	metaindexBH.length = uint64(len(b)) - metaindexBH.offset - blockTrailerLen
+	indexBH := blockHandle{offset: uint64(len(b))}
+	// The index's separator must be >= the data block's last key.
+	b = appendTestBlock(b, "\xff", string(tmp[:encodeBlockHandle(tmp[:], dataBH)]))
+	indexBH.length = uint64(len(b)) - indexBH.offset - blockTrailerLen
+	b = appendTestFooter(b, metaindexBH, indexBH)
+	return writeTestFile(t, b)
+}
+
+func TestNumDeletions(t *testing.T) {
+	f, err := os.Open(filepath.FromSlash("../testdata/h.ldb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, nil)
+	if n, ok, err := r.NumDeletions(); n != 0 || ok || err != nil {
+		t.Fatalf("h.ldb: got (%d, %t, %v), want (0, false, nil)", n, ok, err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r = NewReader(writeTestTableWithProperties(t, []string{"a", "1", "b", "2"},
+		numDeletionsPropertyName, "\x2a",
+	), nil)
+	if n, ok, err := r.NumDeletions(); n != 42 || !ok || err != nil {
+		t.Fatalf("got (%d, %t, %v), want (42, true, nil)", n, ok, err)
+	}
+	if v, err := r.Get([]byte("b"), nil); string(v) != "2" || err != nil {
+		t.Fatalf("Get: got (%q, %v), want (\"2\", nil)", v, err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r = NewReader(writeTestTableWithProperties(t, []string{"a", "1"},
+		numDeletionsPropertyName, "\xff",
+	), nil)
+	if _, _, err := r.NumDeletions(); err == nil {
+		t.Fatal("bad property: got nil error, want non-nil")
+	}
+	r.Close()
+}
+
+func TestBlockIterCorruptEntries(t *testing.T) {
+	// k maps "apple", "apricot", "banana" to empty strings; see TestBlockIter.
+	k := []byte("\x00\x05\x00apple\x02\x05\x00ricot\x00\x06\x00banana\x00\x00\x00\x00\x01\x00\x00\x00")
+	n := len(k) - 8
+	check := func(b block) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("block %q: panic: %v", []byte(b), r)
+			}
+		}()
+		for _, key := range []string{"", "apple", "apricot", "b", "banana", "c"} {
+			i, err := b.seek(db.DefaultComparer, []byte(key))
+			if err != nil {
+				return err
+			}
+			for i.Next() {
+			}
+			if err := i.Close(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	testCases := []struct {
+		desc  string
+		entry string
+	}{
+		{"truncated shared varint", "\x80"},
+		{"truncated unshared varint", "\x00\x80"},
+		{"truncated value length varint", "\x00\x01\x80"},
+		{"shared prefix longer than previous key", "\x01\x01\x00a"},
+		{"key longer than block", "\x00\x7f\x00a"},
+		{"value longer than block", "\x00\x01\x7fa"},
+		{"huge key and value lengths", "\x00\xff\xff\xff\xff\xff\xff\xff\xff\x7f\xff\xff\xff\xff\xff\xff\xff\xff\x7fa"},
+	}
+	for _, tc := range testCases {
+		b := append([]byte(tc.entry), "\x00\x00\x00\x00\x01\x00\x00\x00"...)
+		err := check(block(b))
+		if _, ok := err.(CorruptionError); !ok {
+			t.Errorf("%s: got %v, want a CorruptionError", tc.desc, err)
+		}
+	}
+
+	// Randomly mutate and truncate the entries of k, leaving its restart
+	// points intact. None of the results may cause a panic.
+	rng := rand.New(rand.NewSource(1))
+	for j := 0; j < 10000; j++ {
+		b := append([]byte(nil), k[:n]...)
+		for m := 1 + rng.Intn(3); m > 0; m-- {
+			b[rng.Intn(len(b))] = byte(rng.Intn(256))
+		}
+		b = b[:rng.Intn(len(b)+1)]
+		b = append(b, k[n:]...)
+		check(block(b))
+	}
+}
+
+func TestBlockLengthOverflow(t *testing.T) {
+	// entry returns a block of a single entry with the given lengths, and a
+	// few bytes of key and value.
+	entry := func(lengths ...uint64) block {
+		var b []byte
+		var tmp [binary.MaxVarintLen64]byte
+		for _, v := range lengths {
+			b = append(b, tmp[:binary.PutUvarint(tmp[:], v)]...)
+		}
+		b = append(b, "abc"...)
+		return block(append(b, "\x00\x00\x00\x00\x01\x00\x00\x00"...))
+	}
+	const (
+		maxInt32  = 1<<31 - 1
+		maxUint32 = 1<<32 - 1
+		maxUint64 = 1<<64 - 1
+	)
+	testCases := []struct {
+		desc    string
+		format  blockFormat
+		lengths []uint64
+	}{
+		{"key length past int32", standardBlockFormat, []uint64{0, maxInt32 + 1, 0}},
+		{"key length at uint32", standardBlockFormat, []uint64{0, maxUint32, 0}},
+		{"value length past int32", standardBlockFormat, []uint64{0, 1, maxInt32 + 1}},
+		{"value length past int64", standardBlockFormat, []uint64{0, 1, 1 << 63}},
+		// The sums of these lengths wrap around, in 64 or 32 bits, to 3, the
+		// number of bytes after the lengths.
+		{"key and value lengths wrapping", standardBlockFormat, []uint64{0, maxUint64, 4}},
+		{"value and key lengths wrapping", standardBlockFormat, []uint64{0, 4, maxUint64}},
+		{"key and value lengths wrapping in uint32", standardBlockFormat, []uint64{0, maxUint32, 4}},
+		{"shared value length past int32", valuePrefixBlockFormat, []uint64{0, 1, maxInt32 + 1, 1}},
+		{"value-prefix lengths wrapping", valuePrefixBlockFormat, []uint64{0, maxUint64, 0, 4}},
+	}
+	for _, tc := range testCases {
+		b := entry(tc.lengths...)
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("%s: panic: %v", tc.desc, r)
+				}
+			}()
+			i := &blockIter{format: tc.format}
+			_, err := b.seekInto(i, db.DefaultComparer, nil, 0)
+			if err == nil {
+				for i.Next() {
+				}
+				err = i.Close()
+			}
+			if _, ok := err.(CorruptionError); !ok {
+				t.Errorf("%s: got %v, want a CorruptionError", tc.desc, err)
+			}
+
+			// BlockStats counts entries without decoding them.
+			r := &Reader{dataFormat: tc.format}
+			_, err = r.countEntries(blockHandle{}, 0, len(b)-8, func(off, n int) ([]byte, error) {
+				return b[off : off+n], nil
+			})
+			if _, ok := err.(CorruptionError); !ok {
+				t.Errorf("%s: countEntries: got %v, want a CorruptionError", tc.desc, err)
+			}
+		}()
+	}
+}
+
+func TestValidate(t *testing.T) {
+	f, err := os.Open(filepath.FromSlash("../testdata/h.ldb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	orig := readTestFile(t, f)
+	footer := orig[len(orig)-footerLen:]
+	metaindexBH, n := decodeBlockHandle(footer)
+	indexBH, _ := decodeBlockHandle(footer[n:])
+
+	withFooter := func(metaindexBH, indexBH blockHandle) []byte {
+		b := append([]byte(nil), orig[:len(orig)-footerLen]...)
+		return appendTestFooter(b, metaindexBH, indexBH)
+	}
+	flipByte := func(offset uint64) []byte {
+		b := append([]byte(nil), orig...)
+		b[offset] ^= 0x01
+		return b
+	}
+	// A table whose index keys are out of order, but whose blocks are
+	// otherwise valid.
+	var tmp [2 * binary.MaxVarintLen64]byte
+	unordered := appendTestBlock(nil, "a", "1", "b", "2")
+	dataBH := blockHandle{0, uint64(len(unordered)) - blockTrailerLen}
+	unorderedIndexBH := blockHandle{offset: uint64(len(unordered))}
+	h := string(tmp[:encodeBlockHandle(tmp[:], dataBH)])
+	unordered = appendTestBlock(unordered, "c", h, "b", h)
+	unorderedIndexBH.length = uint64(len(unordered)) - unorderedIndexBH.offset - blockTrailerLen
+	unordered = appendTestFooter(unordered, blockHandle{}, unorderedIndexBH)
+
+	testCases := []struct {
+		desc    string
+		b       []byte
+		wantErr bool
+	}{
+		{"valid", orig, false},
+		{"empty metaindex", withFooter(blockHandle{}, indexBH), false},
+		{"bad magic", flipByte(uint64(len(orig) - 1)), true},
+		{"index beyond file", withFooter(metaindexBH, blockHandle{indexBH.offset, 1 << 20}), true},
+		{"metaindex beyond file", withFooter(blockHandle{metaindexBH.offset, 1 << 20}, indexBH), true},
+		{"index checksum mismatch", flipByte(indexBH.offset + 1), true},
+		{"index keys out of order", unordered, true},
+	}
+	for _, tc := range testCases {
+		r := NewReader(writeTestFile(t, tc.b), nil)
+		err := r.Validate()
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("%s: got error %v, want error: %t", tc.desc, err, tc.wantErr)
+		}
+		r.Close()
+	}
+}
+
+// writeTestPartitionedTable writes a table with a two-level index. Its data
+// blocks hold the keys "a" to "h", two keys per block, and map each key to
+// its upper-case equivalent. Each index partition holds two data blocks.
+func writeTestPartitionedTable(t *testing.T, indexType string) db.File {
+	var tmp [2 * binary.MaxVarintLen64]byte
+	handle := func(bh blockHandle) string {
+		return string(tmp[:encodeBlockHandle(tmp[:], bh)])
+	}
+	var b []byte
+	appendBlock := func(kvs ...string) blockHandle {
+		bh := blockHandle{offset: uint64(len(b))}
+		b = appendTestBlock(b, kvs...)
+		bh.length = uint64(len(b)) - bh.offset - blockTrailerLen
+		return bh
+	}
+	d0 := appendBlock("a", "A", "b", "B")
+	d1 := appendBlock("c", "C", "d", "D")
+	d2 := appendBlock("e", "E", "f", "F")
+	d3 := appendBlock("g", "G", "h", "H")
+	p0 := appendBlock("b", handle(d0), "d", handle(d1))
+	p1 := appendBlock("f", handle(d2), "h", handle(d3))
+	props := appendBlock(indexTypePropertyName, indexType)
+	metaindex := appendBlock(propertiesBlockName, handle(props))
+	index := appendBlock("d", handle(p0), "h", handle(p1))
+	b = appendTestFooter(b, metaindex, index)
+	return writeTestFile(t, b)
+}
+
+func TestPartitionedIndex(t *testing.T) {
+	cf := &readCountingFile{File: writeTestPartitionedTable(t, "\x02\x00\x00\x00")}
+	r := NewReader(cf, &db.Options{
+		BlockCacheSize: 1 << 20,
+	})
+	defer r.Close()
+	if err := r.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	const keys = "abcdefgh"
+	testCases := []struct {
+		start, want string
+	}{
+		{"", "abcdefgh"},
+		{"a", "abcdefgh"},
+		{"b", "bcdefgh"},
+		{"bb", "cdefgh"},
+		{"d", "defgh"},
+		{"e", "efgh"},
+		{"g", "gh"},
+		{"h", "h"},
+		{"i", ""},
+	}
+	for _, tc := range testCases {
+		var got []byte
+		i := r.Find([]byte(tc.start), nil)
+		for i.Next() {
+			if want := bytes.ToUpper(i.Key()); !bytes.Equal(i.Value(), want) {
+				t.Fatalf("start=%q: %q: got value %q, want %q", tc.start, i.Key(), i.Value(), want)
+			}
+			got = append(got, i.Key()...)
+		}
+		if err := i.Close(); err != nil {
+			t.Fatalf("start=%q: %v", tc.start, err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("start=%q: got keys %q, want %q", tc.start, got, tc.want)
+		}
+	}
+
+	// Once the index partitions and data blocks are cached, Get does not
+	// read from the file.
+	for pass := 0; pass < 2; pass++ {
+		nReadAt := cf.nReadAt
+		for _, k := range keys {
+			v, err := r.Get([]byte{byte(k)}, nil)
+			if err != nil || string(v) != strings.ToUpper(string(k)) {
+				t.Fatalf("Get %q: got (%q, %v), want (%q, nil)", k, v, err, strings.ToUpper(string(k)))
+			}
+		}
+		if _, err := r.Get([]byte("i"), nil); err != db.ErrNotFound {
+			t.Fatalf("Get %q: got %v, want ErrNotFound", "i", err)
+		}
+		if got := cf.nReadAt - nReadAt; pass == 1 && got != 0 {
+			t.Fatalf("second pass: got %d reads, want 0", got)
+		}
+	}
+
+	i := r.Find(nil, nil).(*Iterator)
+	for _, k := range []string{"f", "c", "cc", "a", "h"} {
+		want := string(k[0] + byte(len(k)-1))
+		if !i.Seek([]byte(k)) || string(i.Key()) != want {
+			t.Fatalf("Seek %q: got %q, want %q", k, i.Key(), want)
+		}
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := r.CompressionStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stats.NumBlocks[db.SnappyCompression]; got != 4 {
+		t.Errorf("CompressionStats: got %d snappy blocks, want 4", got)
+	}
+
+	// Touch reports an error reading an index partition.
+	sf := &swappableFile{writeTestPartitionedTable(t, "\x02\x00\x00\x00")}
+	tr := NewReader(sf, &db.Options{
+		BlockCacheSize: 1 << 20,
+	})
+	sf.File = NewMemFile(nil)
+	if err := tr.Touch([]byte("a")); err == nil {
+		t.Error("Touch with an unreadable partition: got nil error, want non-nil")
+	}
+	tr.Close()
+
+	bad := NewReader(writeTestPartitionedTable(t, "\x07\x00\x00\x00"), nil)
+	if _, err := bad.Get([]byte("a"), nil); err == nil {
+		t.Error("unsupported index type: got nil error, want non-nil")
+	}
+	bad.Close()
+}
+
+func TestProperties(t *testing.T) {
+	f, err := os.Open(filepath.FromSlash("../testdata/h.ldb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, nil)
+	if got := r.Properties(); got == nil || len(got) != 0 {
+		t.Errorf("h.ldb: got %q, want an empty map", got)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r = NewReader(writeTestTableWithProperties(t, []string{"a", "1"},
+		"rocksdb.data.size", "\x17",
+		numDeletionsPropertyName, "\x00",
+		"rocksdb.num.entries", "\x01",
+	), nil)
+	defer r.Close()
+	got := r.Properties()
+	want := map[string]string{
+		"rocksdb.data.size":      "\x17",
+		numDeletionsPropertyName: "\x00",
+		"rocksdb.num.entries":    "\x01",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d properties, want %d", len(got), len(want))
+	}
+	for k, v := range want {
+		if string(got[k]) != v {
+			t.Errorf("property %q: got %q, want %q", k, got[k], v)
+		}
+	}
+	// Modifying the returned map does not affect the Reader.
+	delete(got, "rocksdb.num.entries")
+	if _, ok := r.Properties()["rocksdb.num.entries"]; !ok {
+		t.Error("deleting from the returned map modified the Reader's properties")
+	}
+}
+
+// encodeTestValuePrefixBlock encodes the key/value pairs kvs as an
+// uncompressed valuePrefixBlockFormat block, with the given restart interval.
+func encodeTestValuePrefixBlock(restartInterval int, kvs ...string) block {
+	var b, restarts []byte
+	var tmp [binary.MaxVarintLen64]byte
+	var prevKey, prevValue string
+	for i := 0; i < len(kvs); i += 2 {
+		key, value := kvs[i], kvs[i+1]
+		var sk, sv int
+		if (i/2)%restartInterval == 0 {
+			binary.LittleEndian.PutUint32(tmp[:4], uint32(len(b)))
+			restarts = append(restarts, tmp[:4]...)
+		} else {
+			for sk < len(key) && sk < len(prevKey) && key[sk] == prevKey[sk] {
+				sk++
+			}
+			for sv < len(value) && sv < len(prevValue) && value[sv] == prevValue[sv] {
+				sv++
+			}
+		}
+		for _, v := range []int{sk, len(key) - sk, sv, len(value) - sv} {
+			b = append(b, tmp[:binary.PutUvarint(tmp[:], uint64(v))]...)
+		}
+		b = append(b, key[sk:]...)
+		b = append(b, value[sv:]...)
+		prevKey, prevValue = key, value
+	}
+	b = append(b, restarts...)
+	binary.LittleEndian.PutUint32(tmp[:4], uint32(len(restarts)/4))
+	return block(append(b, tmp[:4]...))
+}
+
+func TestValuePrefixBlockLazyValues(t *testing.T) {
+	// Values that share long, varying prefixes with their predecessors.
+	rng := rand.New(rand.NewSource(1))
+	var kvs []string
+	value := []byte("v")
+	for j := 0; j < 200; j++ {
+		value = value[:rng.Intn(len(value)+1)]
+		for m := rng.Intn(5); m > 0; m-- {
+			value = append(value, "abcd"[rng.Intn(4)])
+		}
+		kvs = append(kvs, fmt.Sprintf("k%04d", j), string(value))
+	}
+	for _, restartInterval := range []int{1, 4, 1000} {
+		k := encodeTestValuePrefixBlock(restartInterval, kvs...)
+
+		// Iterating over the keys alone builds no values.
+		i := &blockIter{format: valuePrefixBlockFormat}
+		if _, err := k.seekInto(i, db.DefaultComparer, nil, 0); err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; i.Next(); n++ {
+			if want := len(kvs[2*n+1]); i.ValueLen() != want {
+				t.Fatalf("restartInterval=%d: entry %d: got value length %d, want %d", restartInterval, n, i.ValueLen(), want)
+			}
+		}
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if len(i.valBuf) != 0 {
+			t.Errorf("restartInterval=%d: got a %d byte value buffer, want none", restartInterval, len(i.valBuf))
+		}
+
+		// Asking for some of the values, some of them more than once, gives
+		// the same values as asking for all of them.
+		for _, p := range []int{1, 3, 10} {
+			if _, err := k.seekInto(i, db.DefaultComparer, nil, 0); err != nil {
+				t.Fatal(err)
+			}
+			for n := 0; i.Next(); n++ {
+				if rng.Intn(p) != 0 {
+					continue
+				}
+				for m := 1 + rng.Intn(2); m > 0; m-- {
+					if got, want := string(i.Value()), kvs[2*n+1]; got != want {
+						t.Fatalf("restartInterval=%d, p=%d: entry %d: got %q, want %q", restartInterval, p, n, got, want)
+					}
+				}
+			}
+			if err := i.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestValuePrefixBlock(t *testing.T) {
+	kvs := []string{
+		"apple", "fruit/red/1",
+		"apricot", "fruit/red/12",
+		"banana", "fruit/yellow",
+		"beet", "fruit/yellow",
+		"carrot", "",
+		"cherry", "fruit/red/1",
+		"date", "fruit/brown",
+	}
+	for _, restartInterval := range []int{1, 2, 16} {
+		k := encodeTestValuePrefixBlock(restartInterval, kvs...)
+		for j := 0; j <= len(kvs)/2; j++ {
+			seekKey := ""
+			if j < len(kvs)/2 {
+				seekKey = kvs[2*j]
+			}
+			i := &blockIter{format: valuePrefixBlockFormat}
+			if _, err := k.seekInto(i, db.DefaultComparer, []byte(seekKey), 0); err != nil {
+				t.Fatalf("restartInterval=%d, key=%q: %v", restartInterval, seekKey, err)
+			}
+			want := kvs[2*j:]
+			if seekKey == "" {
+				want = kvs
+			}
+			for ; len(want) > 0; want = want[2:] {
+				if !i.Next() {
+					t.Fatalf("restartInterval=%d, key=%q: Next got false, want %q", restartInterval, seekKey, want[0])
+				}
+				if string(i.Key()) != want[0] || string(i.Value()) != want[1] {
+					t.Fatalf("restartInterval=%d, key=%q: got %q/%q, want %q/%q",
+						restartInterval, seekKey, i.Key(), i.Value(), want[0], want[1])
+				}
+			}
+			if i.Next() {
+				t.Fatalf("restartInterval=%d, key=%q: Next got true, want false", restartInterval, seekKey)
+			}
+			if err := i.Close(); err != nil {
+				t.Fatalf("restartInterval=%d, key=%q: %v", restartInterval, seekKey, err)
+			}
+		}
+	}
+
+	// A value cannot share more bytes than the previous value has.
+	k := encodeTestValuePrefixBlock(2, "a", "xy", "b", "xyz")
+	k[len("\x00\x01\x00\x02axy")+2] = 3
+	i := &blockIter{format: valuePrefixBlockFormat}
+	if _, err := k.seekInto(i, db.DefaultComparer, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !i.Next() || string(i.Value()) != "xy" {
+		t.Fatalf("got %q, want %q", i.Value(), "xy")
+	}
+	if i.Next() {
+		t.Fatalf("got %q/%q, want no more entries", i.Key(), i.Value())
+	}
+	if err := i.Close(); err == nil {
+		t.Fatal("got nil error, want a CorruptionError")
+	} else if _, ok := err.(CorruptionError); !ok {
+		t.Fatalf("got %v, want a CorruptionError", err)
+	}
+}
+
+func TestSeekWithStats(t *testing.T) {
+	f, err := build(db.DefaultCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, &db.Options{
+		BlockCacheSize: 1 << 20,
+	})
+	defer r.Close()
+
+	seek := func(key string, wantRead, wantHits int) SeekStats {
+		t.Helper()
+		i, stats := r.SeekWithStats([]byte(key), nil)
+		if !i.Next() || string(i.Key()) < key {
+			t.Fatalf("SeekWithStats %q: got key %q", key, i.Key())
+		}
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if stats.BlocksRead != wantRead || stats.CacheHits != wantHits {
+			t.Fatalf("SeekWithStats %q: got %d read and %d cache hits, want %d and %d",
+				key, stats.BlocksRead, stats.CacheHits, wantRead, wantHits)
+		}
+		if stats.Comparisons == 0 || stats.FilterChecked {
+			t.Fatalf("SeekWithStats %q: got %d comparisons, filter checked %t, want > 0 and false",
+				key, stats.Comparisons, stats.FilterChecked)
+		}
+		return stats
+	}
+	miss := seek("king", 1, 0)
+	hit := seek("king", 0, 1)
+	if miss.Comparisons != hit.Comparisons {
+		t.Errorf("got %d comparisons on a cache miss, but %d on a cache hit", miss.Comparisons, hit.Comparisons)
+	}
+
+	// For a partitioned index, the index partition is also read.
+	r = NewReader(writeTestPartitionedTable(t, "\x02\x00\x00\x00"), &db.Options{
+		BlockCacheSize: 1 << 20,
+	})
+	defer r.Close()
+	seek("e", 2, 0)
+	seek("e", 0, 2)
+	seek("f", 0, 2)
+	seek("a", 2, 0)
+}
+
+func TestCountKeys(t *testing.T) {
+	// Without a properties block, the table is scanned.
+	f, err := build(db.DefaultCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf := &readCountingFile{File: f}
+	r := NewReader(cf, nil)
+	nReadAt := cf.nReadAt
+	if n, err := r.CountKeys(); n != len(wordCount) || err != nil {
+		t.Errorf("scan: got (%d, %v), want (%d, nil)", n, err, len(wordCount))
+	}
+	if cf.nReadAt == nReadAt {
+		t.Errorf("scan: read no data blocks")
+	}
+	r.Close()
+
+	// With a properties block, no data blocks are read. The property is
+	// deliberately inconsistent with the table's contents.
+	cf = &readCountingFile{File: writeTestTableWithProperties(t, []string{"a", "1", "b", "2"},
+		numEntriesPropertyName, "\x80\x01",
+	)}
+	r = NewReader(cf, nil)
+	nReadAt = cf.nReadAt
+	if n, err := r.CountKeys(); n != 128 || err != nil {
+		t.Errorf("property: got (%d, %v), want (128, nil)", n, err)
+	}
+	if cf.nReadAt != nReadAt {
+		t.Errorf("property: got %d reads, want 0", cf.nReadAt-nReadAt)
+	}
+	r.Close()
+
+	r = NewReader(writeTestTableWithProperties(t, []string{"a", "1"},
+		numEntriesPropertyName, "\x80",
+	), nil)
+	if _, err := r.CountKeys(); err == nil {
+		t.Errorf("bad property: got nil error, want non-nil")
+	}
+	r.Close()
+}
+
+func TestConcat(t *testing.T) {
+	// Write three non-overlapping tables, and an empty table between them.
+	mem := memfs.New()
+	runs := [][]string{
+		{"a", "b", "c"},
+		{"d", "dd", "g"},
+		{},
+		{"h", "i", "j", "k"},
+	}
+	var readers []*Reader
+	for n, run := range runs {
+		name := fmt.Sprintf("run%d", n)
+		f, err := mem.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f, &db.Options{
+			BlockSize: 1,
+		})
+		for _, k := range run {
+			if err := w.Set([]byte(k), []byte(strings.ToUpper(k)), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f, err = mem.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readers = append(readers, NewReader(f, nil))
+	}
+	c := Concat(readers, nil)
+
+	present := map[string]bool{}
+	for _, run := range runs {
+		for _, k := range run {
+			present[k] = true
+		}
+	}
+	for _, k := range []string{"", "0", "a", "bb", "c", "d", "e", "g", "gg", "h", "k", "z"} {
+		want, wantErr := strings.ToUpper(k), error(nil)
+		if !present[k] {
+			want, wantErr = "", db.ErrNotFound
+		}
+		v, err := c.Get([]byte(k), nil)
+		if string(v) != want || err != wantErr {
+			t.Errorf("Get %q: got (%q, %v), want (%q, %v)", k, v, err, want, wantErr)
+		}
+	}
+
+	testCases := []struct {
+		start, want string
+	}{
+		{"", "a b c d dd g h i j k"},
+		{"a", "a b c d dd g h i j k"},
+		{"c", "c d dd g h i j k"},
+		{"cc", "d dd g h i j k"},
+		{"e", "g h i j k"},
+		{"gg", "h i j k"},
+		{"j", "j k"},
+		{"z", ""},
+	}
+	for _, tc := range testCases {
+		var got []string
+		i := c.Find([]byte(tc.start), nil)
+		for i.Next() {
+			if want := strings.ToUpper(string(i.Key())); string(i.Value()) != want {
+				t.Errorf("start=%q: %q: got value %q, want %q", tc.start, i.Key(), i.Value(), want)
+			}
+			got = append(got, string(i.Key()))
+		}
+		if err := i.Close(); err != nil {
+			t.Fatalf("start=%q: %v", tc.start, err)
+		}
+		if got := strings.Join(got, " "); got != tc.want {
+			t.Errorf("start=%q: got %q, want %q", tc.start, got, tc.want)
+		}
+	}
+
+	// Tables that are out of order are rejected.
+	if _, err := Concat([]*Reader{readers[1], readers[0]}, nil).Get([]byte("a"), nil); err == nil {
+		t.Fatal("out of order: got nil error, want non-nil")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get([]byte("a"), nil); err == nil {
+		t.Fatal("Get after Close: got nil error, want non-nil")
+	}
+}
+
+func TestFindPastLastKey(t *testing.T) {
+	f, err := build(db.DefaultCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf := &readCountingFile{File: f}
+	r := NewReader(cf, nil)
+	defer r.Close()
+
+	// The index's final entry is a successor of the table's last key: "z" for
+	// "youth". Seeking past that successor exhausts the index, and so the
+	// iterator is done without reading a data block.
+	var lastKey string
+	for k := range wordCount {
+		if k > lastKey {
+			lastKey = k
+		}
+	}
+	for _, key := range []string{"z\x00", "za", "\xff"} {
+		nReadAt := cf.nReadAt
+		i := r.Find([]byte(key), nil)
+		if i.Next() {
+			t.Errorf("Find %q: got key %q, want none", key, i.Key())
+		}
+		if err := i.Close(); err != nil {
+			t.Errorf("Find %q: %v", key, err)
+		}
+		if got := cf.nReadAt - nReadAt; got != 0 {
+			t.Errorf("Find %q: got %d reads, want 0", key, got)
+		}
+	}
+	// Seeking to the last key, or to a key between it and the successor, does
+	// read the final data block.
+	for _, key := range []string{lastKey, lastKey + "a"} {
+		nReadAt := cf.nReadAt
+		i := r.Find([]byte(key), nil)
+		i.Next()
+		if err := i.Close(); err != nil {
+			t.Errorf("Find %q: %v", key, err)
+		}
+		if got := cf.nReadAt - nReadAt; got != 1 {
+			t.Errorf("Find %q: got %d reads, want 1", key, got)
+		}
+	}
+}
+
+func TestFindCancelable(t *testing.T) {
+	f, err := build(db.DefaultCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, nil)
+	defer r.Close()
+
+	count := func(i db.Iterator, cancel chan struct{}, cancelAfter int) (int, error) {
+		n := 0
+		for i.Next() {
+			n++
+			if n == cancelAfter {
+				close(cancel)
+			}
+		}
+		return n, i.Close()
+	}
+
+	// An uncanceled scan visits every key.
+	if n, err := count(r.FindCancelable(nil, nil, make(chan struct{})), nil, -1); n != len(wordCount) || err != nil {
+		t.Fatalf("uncanceled: got (%d, %v), want (%d, nil)", n, err, len(wordCount))
+	}
+
+	// A scan canceled part way through stops before loading the next block.
+	cancel := make(chan struct{})
+	i := r.FindCancelable(nil, nil, cancel).(*Iterator)
+	d, err := i.cur.b.seek(db.DefaultComparer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockLen := 0
+	for d.Next() {
+		blockLen++
+	}
+	n, err := count(i, cancel, 10)
+	if err != ErrCanceled {
+		t.Fatalf("canceled: got error %v, want ErrCanceled", err)
+	}
+	if n != blockLen {
+		t.Fatalf("canceled: got %d keys, want the first block's %d keys", n, blockLen)
+	}
+
+	// A scan canceled before it starts returns no keys.
+	cancel = make(chan struct{})
+	close(cancel)
+	if n, err := count(r.FindCancelable(nil, nil, cancel), nil, -1); n != 0 || err != ErrCanceled {
+		t.Fatalf("canceled before Find: got (%d, %v), want (0, ErrCanceled)", n, err)
+	}
+}
+
+func TestPooledBlocks(t *testing.T) {
+	for _, compression := range []db.Compression{db.NoCompression, db.SnappyCompression} {
+		f, err := buildWithOptions(&db.Options{
+			BlockSize:   1024,
+			Compression: compression,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Without a block cache, scans decode into pooled memory.
+		r := NewReader(f, nil)
+
+		// A value returned by Get must not be overwritten by later scans.
+		key := minWord
+		got, err := r.Get([]byte(key), nil)
+		if err != nil {
+			t.Fatalf("compression=%d: Get %q: %v", compression, key, err)
+		}
+
+		// Interleave two scans, so that each recycles blocks while the other
+		// is still reading its own.
+		i0, i1 := r.Find(nil, nil), r.Find(nil, nil)
+		n := 0
+		for i0.Next() {
+			if !i1.Next() {
+				t.Fatalf("compression=%d: second iterator stopped early", compression)
+			}
+			for _, i := range []db.Iterator{i0, i1} {
+				if k, v := string(i.Key()), string(i.Value()); v != wordCount[k] {
+					t.Fatalf("compression=%d: key %q: got value %q, want %q", compression, k, v, wordCount[k])
+				}
+			}
+			n++
+		}
+		if err := i0.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := i1.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n != len(wordCount) {
+			t.Errorf("compression=%d: got %d keys, want %d", compression, n, len(wordCount))
+		}
+		if string(got) != wordCount[key] {
+			t.Errorf("compression=%d: Get %q: value changed to %q, want %q", compression, key, got, wordCount[key])
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	f := writeTestTableWithProperties(t, []string{"a\x00", "1", "b", "long value"})
+	r := NewReader(f, nil)
+	defer r.Close()
+
+	testCases := []struct {
+		o    *DumpOptions
+		want string
+	}{
+		{nil, "" +
+			"block 0: offset 0, length %d, index key \"\\xff\"\n" +
+			"  \"a\\x00\": \"1\"\n" +
+			"  \"b\": \"long value\"\n"},
+		{&DumpOptions{Hex: true, MaxValueLen: 4}, "" +
+			"block 0: offset 0, length %d, index key ff\n" +
+			"  6100: 31\n" +
+			"  62: 6c6f6e67... (10 bytes)\n"},
+	}
+	dataLen := len(appendTestBlock(nil, "a\x00", "1", "b", "long value")) - blockTrailerLen
+	for _, tc := range testCases {
+		var buf bytes.Buffer
+		if err := r.Dump(&buf, tc.o); err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf(tc.want, dataLen); buf.String() != want {
+			t.Errorf("%+v: got\n%s\nwant\n%s", tc.o, buf.String(), want)
+		}
+	}
+}
+
+func TestWriterNonIncreasingKeys(t *testing.T) {
+	testCases := []struct {
+		desc string
+		keys []string
+	}{
+		{"equal", []string{"a", "b", "b"}},
+		{"out of order", []string{"a", "c", "b"}},
+	}
+	for _, tc := range testCases {
+		f, err := memFileSystem.Create(fmt.Sprintf("/tmp%d", tmpFileCount))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpFileCount++
+		w := NewWriter(f, nil)
+		n := len(tc.keys) - 1
+		for _, k := range tc.keys[:n] {
+			if err := w.Set([]byte(k), nil, nil); err != nil {
+				t.Fatalf("%s: Set %q: %v", tc.desc, k, err)
+			}
+		}
+		err = w.Set([]byte(tc.keys[n]), nil, nil)
+		if err == nil || !strings.Contains(err.Error(), "non-increasing") {
+			t.Errorf("%s: Set %q: got %v, want a non-increasing key order error", tc.desc, tc.keys[n], err)
+		}
+		// The error is sticky, so that no table with duplicate or unordered
+		// keys can be written.
+		if err1 := w.Set([]byte("z"), nil, nil); err1 != err {
+			t.Errorf("%s: later Set: got %v, want %v", tc.desc, err1, err)
+		}
+		if err1 := w.Close(); err1 != err {
+			t.Errorf("%s: Close: got %v, want %v", tc.desc, err1, err)
+		}
+	}
+}
+
+// testUserKeyComparer orders internal keys by their user keys alone, ignoring
+// their trailers.
+type testUserKeyComparer struct{}
+
+func (testUserKeyComparer) Compare(a, b []byte) int {
+	ua, _, _, _ := parseInternalKey(a)
+	ub, _, _, _ := parseInternalKey(b)
+	return bytes.Compare(ua, ub)
+}
+
+func (testUserKeyComparer) Name() string {
+	return "test.UserKeyComparer"
+}
+
+func (testUserKeyComparer) AppendSeparator(dst, a, b []byte) []byte {
+	return append(dst, a...)
+}
+
+func TestFindWith(t *testing.T) {
+	f, err := memFileSystem.Create(fmt.Sprintf("/tmp%d", tmpFileCount))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := fmt.Sprintf("/tmp%d", tmpFileCount)
+	tmpFileCount++
+	o := &db.Options{
+		BlockSize: 1,
+		Comparer:  testInternalKeyComparer{},
+	}
+	w := NewWriter(f, o)
+	for _, ukey := range []string{"a", "b", "c"} {
+		for seqNum := uint64(3); seqNum > 0; seqNum-- {
+			if err := w.Set(makeTestInternalKey(ukey, internalKeyKindSet, seqNum), []byte(fmt.Sprintf("%s%d", ukey, seqNum)), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = memFileSystem.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, o)
+	defer r.Close()
+
+	key := makeTestInternalKey("b", internalKeyKindSet, 0)
+	testCases := []struct {
+		desc string
+		iter db.Iterator
+		want string
+	}{
+		// Sequence number 0 sorts after every "b" entry in the table's order.
+		{"Find", r.Find(key, nil), "c3"},
+		// Ignoring the trailer, the seek stops at the newest "b" entry.
+		{"FindWith", r.FindWith(key, nil, testUserKeyComparer{}), "b3"},
+	}
+	for _, tc := range testCases {
+		if !tc.iter.Next() {
+			t.Fatalf("%s: Next returned false: %v", tc.desc, tc.iter.Close())
+		}
+		if got := string(tc.iter.Value()); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.desc, got, tc.want)
+		}
+		// Iteration is still in the table's order.
+		if tc.desc == "FindWith" {
+			var got []string
+			for tc.iter.Next() {
+				got = append(got, string(tc.iter.Value()))
+			}
+			if s := strings.Join(got, " "); s != "b2 b1 c3 c2 c1" {
+				t.Errorf("%s: then got %q, want %q", tc.desc, s, "b2 b1 c3 c2 c1")
+			}
+			// Seek also uses the overriding comparer.
+			if i := tc.iter.(*Iterator); !i.Seek(makeTestInternalKey("a", internalKeyKindSet, 0)) || string(i.Value()) != "a3" {
+				t.Errorf("%s: Seek: got %q, want %q", tc.desc, i.Value(), "a3")
+			}
+		}
+		if err := tc.iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOnBlockRead(t *testing.T) {
+	f, err := buildWithOptions(&db.Options{
+		BlockSize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := NewReader(f, nil).CompressionStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	numBlocks := 0
+	for _, n := range want.NumBlocks {
+		numBlocks += n
+	}
+	if numBlocks < 2 {
+		t.Fatalf("got %d blocks, want at least 2", numBlocks)
+	}
+
+	for _, o := range []*db.Options{
+		{},
+		{ReadaheadBlocks: 4},
+		{BlockCacheSize: 1 << 20},
+	} {
+		var got []db.BlockReadInfo
+		o.OnBlockRead = func(info db.BlockReadInfo) {
+			got = append(got, info)
+		}
+		r := NewReader(f, o)
+		for pass := 0; pass < 2; pass++ {
+			i := r.Find(nil, nil)
+			for i.Next() {
+			}
+			if err := i.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		wantReads := 2 * numBlocks
+		if o.BlockCacheSize > 0 {
+			// The second pass only hits the cache.
+			wantReads = numBlocks
+		}
+		if len(got) != wantReads {
+			t.Errorf("%+v: got %d block reads, want %d", o, len(got), wantReads)
+			continue
+		}
+		compressed, decompressed := 0, 0
+		numByCompression := map[db.Compression]int{}
+		for _, info := range got[:numBlocks] {
+			numByCompression[info.Compression]++
+			compressed += info.CompressedLen
+			decompressed += info.DecompressedLen
+		}
+		if uint64(compressed) != want.CompressedBytes || uint64(decompressed) != want.UncompressedBytes {
+			t.Errorf("%+v: got %d compressed and %d decompressed bytes, want %d and %d",
+				o, compressed, decompressed, want.CompressedBytes, want.UncompressedBytes)
+		}
+		for c, n := range want.NumBlocks {
+			if numByCompression[c] != n {
+				t.Errorf("%+v: compression %d: got %d blocks, want %d", o, c, numByCompression[c], n)
+			}
+		}
+	}
+}
+
+func TestCountingFile(t *testing.T) {
+	f, err := build(db.DefaultCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := NewReader(f, nil).CompressionStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	numBlocks := 0
+	for _, n := range stats.NumBlocks {
+		numBlocks += n
+	}
+
+	cf := NewCountingFile(f)
+	r := NewReader(cf, nil)
+	openReads, openBytes := cf.Counts()
+	if openReads == 0 || openBytes == 0 {
+		t.Fatalf("NewReader: got %d reads of %d bytes, want some", openReads, openBytes)
+	}
+
+	// Without a block cache, every scan reads each data block and its
+	// trailer once.
+	for pass := 1; pass <= 2; pass++ {
+		i := r.Find(nil, nil)
+		for i.Next() {
+		}
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+		reads, bytes := cf.Counts()
+		wantReads := openReads + int64(pass*numBlocks)
+		wantBytes := openBytes + int64(pass)*int64(stats.CompressedBytes+uint64(numBlocks*blockTrailerLen))
+		if reads != wantReads || bytes != wantBytes {
+			t.Errorf("pass %d: got %d reads of %d bytes, want %d reads of %d bytes", pass, reads, bytes, wantReads, wantBytes)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetNotFound(t *testing.T) {
+	f, err := buildWithOptions(&db.Options{
+		BlockSize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := readTestFile(t, f)
+	r := NewReader(writeTestFile(t, orig), nil)
+	defer r.Close()
+
+	// A key that is present.
+	if v, err := r.Get([]byte(maxWord), nil); err != nil || string(v) != wordCount[maxWord] {
+		t.Fatalf("present: got (%q, %v), want (%q, nil)", v, err, wordCount[maxWord])
+	}
+	// A key that is absent, but would be in the final data block.
+	absent := []byte(maxWord + "\x00")
+	if v, err := r.Get(absent, nil); err != db.ErrNotFound {
+		t.Fatalf("absent: got (%q, %v), want ErrNotFound", v, err)
+	}
+
+	// Corrupt the final data block. Looking for the absent key is then an
+	// error, not db.ErrNotFound.
+	i, err := r.newIndexIter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last blockHandle
+	for i.Next() {
+		last, _ = decodeBlockHandle(i.Value())
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b := append([]byte(nil), orig...)
+	b[last.offset+last.length/2] ^= 0xff
+	rc := NewReader(writeTestFile(t, b), &db.Options{
+		VerifyChecksums: true,
+	})
+	defer rc.Close()
+	_, err = rc.Get(absent, nil)
+	if _, ok := err.(CorruptionError); !ok {
+		t.Fatalf("absent, corrupt block: got %v (%T), want a CorruptionError", err, err)
+	}
+	// Keys in the other blocks are unaffected.
+	if v, err := rc.Get([]byte(minWord), nil); err != nil || string(v) != wordCount[minWord] {
+		t.Fatalf("present, other block: got (%q, %v), want (%q, nil)", v, err, wordCount[minWord])
+	}
+}
+
+func TestIndexIterator(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		f        db.File
+		wantKeys string
+	}{
+		{"flat", writeTestTableWithProperties(t, []string{"a", "A", "b", "B"}), "\xff"},
+		{"partitioned", writeTestPartitionedTable(t, "\x02\x00\x00\x00"), "bdfh"},
+	}
+	for _, tc := range testCases {
+		r := NewReader(tc.f, nil)
+		var keys []byte
+		var offset uint64
+		i := r.IndexIterator()
+		for i.Next() {
+			h, n := decodeBlockHandle(i.Value())
+			if n == 0 || n != len(i.Value()) {
+				t.Fatalf("%s: %q: invalid block handle %q", tc.desc, i.Key(), i.Value())
+			}
+			// The test tables' data blocks are contiguous, from the start of
+			// the file.
+			if h.offset != offset {
+				t.Errorf("%s: %q: got offset %d, want %d", tc.desc, i.Key(), h.offset, offset)
+			}
+			offset = h.offset + h.length + blockTrailerLen
+			keys = append(keys, i.Key()...)
+		}
+		if err := i.Close(); err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		if string(keys) != tc.wantKeys {
+			t.Errorf("%s: got keys %q, want %q", tc.desc, keys, tc.wantKeys)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// A closed Reader's index iterator is empty, and returns an error.
+		i = r.IndexIterator()
+		if i.Next() || i.Close() == nil {
+			t.Errorf("%s: closed reader: got a non-empty iterator, or a nil error", tc.desc)
+		}
+	}
+}
+
+func TestMultiGet(t *testing.T) {
+	for _, fp := range []db.FilterPolicy{nil, bloom.FilterPolicy(10)} {
+		f, err := buildWithOptions(&db.Options{
+			BlockSize:    1024,
+			FilterPolicy: fp,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cf := NewCountingFile(f)
+		r := NewReader(cf, &db.Options{
+			FilterPolicy: fp,
+		})
+
+		// Look up every key, in a shuffled order, along with duplicates and
+		// absent keys.
+		var keys [][]byte
+		for k := range wordCount {
+			keys = append(keys, []byte(k), []byte(k+"\x00"))
+		}
+		keys = append(keys, []byte(minWord), nil, []byte("\xff"))
+		rng := rand.New(rand.NewSource(1))
+		for j := range keys {
+			k := rng.Intn(j + 1)
+			keys[j], keys[k] = keys[k], keys[j]
+		}
+
+		// MultiGet reads blocks concurrently, so use a CountingFile, whose
+		// counts are safe for concurrent use.
+		nReadAt, _ := cf.Counts()
+		values, errs := r.MultiGet(keys, nil)
+		nMultiGetReads, _ := cf.Counts()
+		nMultiGetReads -= nReadAt
+		for j, key := range keys {
+			want, wantErr := r.Get(key, nil)
+			if !bytes.Equal(values[j], want) || errs[j] != wantErr {
+				t.Errorf("fp=%v: %q: got (%q, %v), want (%q, %v)", fp, key, values[j], errs[j], want, wantErr)
+			}
+		}
+		// Every data block is read exactly once.
+		stats, err := r.CompressionStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		numBlocks := 0
+		for _, n := range stats.NumBlocks {
+			numBlocks += n
+		}
+		if nMultiGetReads != int64(numBlocks) {
+			t.Errorf("fp=%v: got %d reads, want %d", fp, nMultiGetReads, numBlocks)
+		}
+
+		if values, errs := r.MultiGet(nil, nil); len(values) != 0 || len(errs) != 0 {
+			t.Errorf("fp=%v: no keys: got %d values and %d errors, want none", fp, len(values), len(errs))
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, errs := r.MultiGet(keys[:1], nil); errs[0] == nil {
+			t.Errorf("fp=%v: closed reader: got nil error", fp)
+		}
+	}
+}
+
+// concurrencyTrackingFile is a File that records the largest number of
+// ReadAt calls that are in progress at once. Each ReadAt call sleeps, so
+// that concurrent calls overlap.
+type concurrencyTrackingFile struct {
+	db.File
+	mu        sync.Mutex
+	cur, peak int
+}
+
+func (f *concurrencyTrackingFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	f.cur++
+	if f.cur > f.peak {
+		f.peak = f.cur
+	}
+	f.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	n, err := f.File.ReadAt(p, off)
+	f.mu.Lock()
+	f.cur--
+	f.mu.Unlock()
+	return n, err
+}
+
+func TestMultiGetParallelism(t *testing.T) {
+	f, err := buildWithOptions(&db.Options{
+		BlockSize: 64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf := &concurrencyTrackingFile{File: f}
+	r := NewReader(cf, nil)
+	defer r.Close()
+	stats, err := r.CompressionStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	numBlocks := 0
+	for _, n := range stats.NumBlocks {
+		numBlocks += n
+	}
+	if numBlocks <= 2*multiGetParallelism {
+		t.Fatalf("got %d blocks, want more than %d", numBlocks, 2*multiGetParallelism)
+	}
+
+	var keys [][]byte
+	for k := range wordCount {
+		keys = append(keys, []byte(k))
+	}
+	values, errs := r.MultiGet(keys, nil)
+	for j, key := range keys {
+		if want := wordCount[string(key)]; errs[j] != nil || string(values[j]) != want {
+			t.Errorf("%q: got (%q, %v), want (%q, nil)", key, values[j], errs[j], want)
+		}
+	}
+	if cf.peak > multiGetParallelism {
+		t.Errorf("got %d concurrent reads, want at most %d", cf.peak, multiGetParallelism)
+	}
+}
+
+func TestReadOptionsChecksumVerification(t *testing.T) {
+	orig := readTestFile(t, writeTestTableWithProperties(t, []string{"a", "value"}))
+	b := append([]byte(nil), orig...)
+	b[bytes.Index(b, []byte("value"))+4] = 'E'
+
+	testCases := []struct {
+		verifyChecksums bool
+		cv              db.ChecksumVerification
+		wantErr         bool
+	}{
+		{false, db.DefaultChecksumVerification, false},
+		{false, db.ChecksumsAlways, true},
+		{false, db.ChecksumsNever, false},
+		{true, db.DefaultChecksumVerification, true},
+		{true, db.ChecksumsAlways, true},
+		{true, db.ChecksumsNever, false},
+	}
+	for _, tc := range testCases {
+		r := NewReader(writeTestFile(t, b), &db.Options{
+			VerifyChecksums: tc.verifyChecksums,
+		})
+		ro := &db.ReadOptions{
+			ChecksumVerification: tc.cv,
+		}
+		v, err := r.Get([]byte("a"), ro)
+		if tc.wantErr {
+			if _, ok := err.(CorruptionError); !ok {
+				t.Errorf("verify=%t, cv=%d: Get: got (%q, %v), want a CorruptionError", tc.verifyChecksums, tc.cv, v, err)
+			}
+		} else if err != nil || string(v) != "valuE" {
+			t.Errorf("verify=%t, cv=%d: Get: got (%q, %v), want (%q, nil)", tc.verifyChecksums, tc.cv, v, err, "valuE")
+		}
+		// Find uses the same per-call setting.
+		i := r.Find(nil, ro)
+		for i.Next() {
+		}
+		if err := i.Close(); (err != nil) != tc.wantErr {
+			t.Errorf("verify=%t, cv=%d: Find: got %v, want error %t", tc.verifyChecksums, tc.cv, err, tc.wantErr)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSavePosition(t *testing.T) {
+	f, err := buildWithOptions(&db.Options{
+		BlockSize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, nil)
+	defer r.Close()
+
+	// Read the table in pages, resuming each page from the previous one's
+	// saved position, after that page's iterator has been closed.
+	const pageSize = 100
+	var keys []string
+	i := r.Find(nil, nil).(*Iterator)
+	if token := i.SavePosition(); token != nil {
+		t.Fatalf("before Next: got token %q, want nil", token)
+	}
+	for {
+		n := 0
+		for n < pageSize && i.Next() {
+			keys = append(keys, string(i.Key()))
+			n++
+		}
+		token := i.SavePosition()
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n < pageSize {
+			if token != nil {
+				t.Fatalf("after the last key: got token %q, want nil", token)
+			}
+			break
+		}
+		i = r.ResumeIterator(token, nil).(*Iterator)
+	}
+	if len(keys) != len(wordCount) {
+		t.Fatalf("got %d keys, want %d", len(keys), len(wordCount))
+	}
+	for j := 1; j < len(keys); j++ {
+		if keys[j-1] >= keys[j] {
+			t.Fatalf("keys out of order or repeated: %q, %q", keys[j-1], keys[j])
+		}
+	}
+
+	// A token for a different table, or a malformed token, is rejected.
+	i = r.Find(nil, nil).(*Iterator)
+	if !i.Next() {
+		t.Fatal("Next returned false")
+	}
+	token := i.SavePosition()
+	i.Close()
+
+	// A lazily loaded index has the same fingerprint as the index loaded by
+	// NewReader, so the token resumes on a lazy reader for the same table.
+	f1, err := buildWithOptions(&db.Options{
+		BlockSize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lazy := NewLazyReader(f1, nil)
+	defer lazy.Close()
+	li := lazy.ResumeIterator(token, nil)
+	if !li.Next() || string(li.Key()) != keys[1] {
+		t.Errorf("lazy reader: got %q, want %q", li.Key(), keys[1])
+	}
+	if err := li.Close(); err != nil {
+		t.Errorf("lazy reader: %v", err)
+	}
+
+	other := NewReader(writeTestTableWithProperties(t, []string{string(token[5:]), "v"}), nil)
+	defer other.Close()
+	for _, tc := range []struct {
+		desc  string
+		r     *Reader
+		token []byte
+	}{
+		{"different table", other, token},
+		{"truncated", r, token[:3]},
+		{"bad version", r, append([]byte{0}, token[1:]...)},
+		{"missing key", r, append(append([]byte(nil), token...), "\x00"...)},
+	} {
+		i := tc.r.ResumeIterator(tc.token, nil)
+		if i.Next() || i.Close() != errInvalidPosition {
+			t.Errorf("%s: got a valid iterator, want errInvalidPosition", tc.desc)
+		}
+	}
+}
+
+func TestEmptyTable(t *testing.T) {
+	// The Writer writes an empty table as one empty data block. The C++
+	// LevelDB implementation writes no data blocks at all, and other writers
+	// may write blocks that are only a zero restart count.
+	f0, err := memFileSystem.Create(fmt.Sprintf("/tmp%d", tmpFileCount))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := fmt.Sprintf("/tmp%d", tmpFileCount)
+	tmpFileCount++
+	w := NewWriter(f0, nil)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := memFileSystem.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A table whose one data block is only a zero restart count.
+	var tmp [2 * binary.MaxVarintLen64]byte
+	noRestarts := appendTestRawBlock(nil, []byte{0, 0, 0, 0}, noCompressionBlockType)
+	indexBH := blockHandle{offset: uint64(len(noRestarts))}
+	noRestarts = appendTestBlock(noRestarts, "", string(tmp[:encodeBlockHandle(tmp[:], blockHandle{0, 4})]))
+	indexBH.length = uint64(len(noRestarts)) - indexBH.offset - blockTrailerLen
+	metaindexBH := blockHandle{offset: uint64(len(noRestarts))}
+	noRestarts = appendTestBlock(noRestarts)
+	metaindexBH.length = uint64(len(noRestarts)) - metaindexBH.offset - blockTrailerLen
+	noRestarts = appendTestFooter(noRestarts, metaindexBH, indexBH)
+
+	for _, tc := range []struct {
+		desc string
+		f    db.File
+	}{
+		{"Writer", f1},
+		{"no data blocks", writeTestTableWithoutData(t)},
+		{"no restarts", writeTestFile(t, noRestarts)},
+	} {
+		testEmptyTable(t, tc.desc, NewReader(tc.f, nil))
+	}
+}
+
+// writeTestTableWithoutData writes a table with no data blocks, as the C++
+// LevelDB implementation does for a table with no keys.
+func writeTestTableWithoutData(t *testing.T) db.File {
+	metaindexBH := blockHandle{}
+	b := appendTestBlock(nil)
+	metaindexBH.length = uint64(len(b)) - blockTrailerLen
+	indexBH := blockHandle{offset: uint64(len(b))}
+	b = appendTestBlock(b)
+	indexBH.length = uint64(len(b)) - indexBH.offset - blockTrailerLen
+	return writeTestFile(t, appendTestFooter(b, metaindexBH, indexBH))
+}
+
+// testEmptyTable checks that every read path of r, a table with no keys,
+// returns cleanly. It closes r.
+func testEmptyTable(t *testing.T, desc string, r *Reader) {
+	defer r.Close()
+	if err := r.Validate(); err != nil {
+		t.Errorf("%s: Validate: %v", desc, err)
+	}
+	if v, err := r.Get([]byte("a"), nil); err != db.ErrNotFound {
+		t.Errorf("%s: Get: got (%q, %v), want ErrNotFound", desc, v, err)
+	}
+	if ok, err := r.Has([]byte("a"), nil); ok || err != nil {
+		t.Errorf("%s: Has: got (%t, %v), want (false, nil)", desc, ok, err)
+	}
+	if _, errs := r.MultiGet([][]byte{[]byte("a")}, nil); errs[0] != db.ErrNotFound {
+		t.Errorf("%s: MultiGet: got %v, want ErrNotFound", desc, errs[0])
+	}
+	// Every iterator is immediately done, without error.
+	iters := map[string]db.Iterator{
+		"Find(nil)":           r.Find(nil, nil),
+		"Find(a)":             r.Find([]byte("a"), nil),
+		"FindWith":            r.FindWith([]byte("a"), nil, db.DefaultComparer),
+		"ReverseReader.Find":  NewReverseReader(r).Find(nil, nil),
+		"Concat.Find":         Concat([]*Reader{r}, nil).Find(nil, nil),
+		"NewCopyingIterator":  db.NewCopyingIterator(r.Find(nil, nil)),
+		"SeekWithStats(nil)":  func() db.Iterator { i, _ := r.SeekWithStats(nil, nil); return i }(),
+		"SeekWithStats(a)":    func() db.Iterator { i, _ := r.SeekWithStats([]byte("a"), nil); return i }(),
+		"FindCancelable(nil)": r.FindCancelable(nil, nil, make(chan struct{})),
+	}
+	for name, i := range iters {
+		if i.Next() {
+			t.Errorf("%s: %s: got key %q, want none", desc, name, i.Key())
+		}
+		if err := i.Close(); err != nil {
+			t.Errorf("%s: %s: %v", desc, name, err)
+		}
+	}
+	i := r.Find(nil, nil).(*Iterator)
+	if i.Seek([]byte("a")) {
+		t.Errorf("%s: Seek: got key %q, want none", desc, i.Key())
+	}
+	if token := i.SavePosition(); token != nil {
+		t.Errorf("%s: SavePosition: got %q, want nil", desc, token)
+	}
+	if err := i.Close(); err != nil {
+		t.Errorf("%s: Seek: %v", desc, err)
+	}
+	if n, err := r.CountKeys(); n != 0 || err != nil {
+		t.Errorf("%s: CountKeys: got (%d, %v), want (0, nil)", desc, n, err)
+	}
+	if n, err := r.MaxKeyLen(); n != 0 || err != nil {
+		t.Errorf("%s: MaxKeyLen: got (%d, %v), want (0, nil)", desc, n, err)
+	}
+	// The table's layout, as described by CompressionStats and Dump, may
+	// still include an empty data block.
+	if _, err := r.CompressionStats(); err != nil {
+		t.Errorf("%s: CompressionStats: %v", desc, err)
+	}
+	var buf bytes.Buffer
+	if err := r.Dump(&buf, nil); err != nil {
+		t.Errorf("%s: Dump: %v", desc, err)
+	}
+	if strings.Contains(buf.String(), "  ") {
+		t.Errorf("%s: Dump: got key/value pairs:\n%s", desc, buf.String())
+	}
+}
+
+func TestBlockIterator(t *testing.T) {
+	f, err := buildWithOptions(&db.Options{
+		BlockSize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, nil)
+	defer r.Close()
+
+	// Iterating over each block in turn visits every key in the table.
+	n := 0
+	index := r.IndexIterator()
+	for index.Next() {
+		i, err := r.BlockIterator(index.Value())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i.Next() {
+			if k, v := string(i.Key()), string(i.Value()); v != wordCount[k] {
+				t.Fatalf("key %q: got value %q, want %q", k, v, wordCount[k])
+			}
+			n++
+		}
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(wordCount) {
+		t.Errorf("got %d keys, want %d", n, len(wordCount))
+	}
+
+	var tmp [2 * binary.MaxVarintLen64]byte
+	for _, h := range [][]byte{
+		nil,
+		append(tmp[:encodeBlockHandle(tmp[:], blockHandle{0, 10})], 0),
+		tmp[:encodeBlockHandle(tmp[:], blockHandle{1 << 40, 10})],
+		tmp[:encodeBlockHandle(tmp[:], blockHandle{0, 1 << 40})],
+	} {
+		if _, err := r.BlockIterator(h); err == nil {
+			t.Errorf("handle %q: got nil error", h)
+		}
+	}
+}
+
+func TestValuePrefixCompression(t *testing.T) {
+	keys := make([]string, 0, len(wordCount))
+	for k := range wordCount {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, compression := range []db.Compression{db.NoCompression, db.SnappyCompression} {
+		desc := fmt.Sprintf("compression=%d", compression)
+		opts := &db.Options{
+			BlockSize:              512,
+			Compression:            compression,
+			ValuePrefixCompression: true,
+		}
+		f, err := buildWithOptions(opts)
+		if err != nil {
+			t.Fatalf("%s: %v", desc, err)
+		}
+		if err := check(f, nil); err != nil {
+			t.Fatalf("%s: %v", desc, err)
+		}
+		r := NewReader(f, nil)
+		if r.dataFormat != valuePrefixBlockFormat {
+			t.Fatalf("%s: got data format %d, want %d", desc, r.dataFormat, valuePrefixBlockFormat)
+		}
+
+		// Check MultiGet.
+		bKeys := make([][]byte, len(keys))
+		for j, k := range keys {
+			bKeys[j] = []byte(k)
+		}
+		values, errs := r.MultiGet(bKeys, nil)
+		for j, k := range keys {
+			if errs[j] != nil || string(values[j]) != wordCount[k] {
+				t.Fatalf("%s: MultiGet %q: got (%q, %v), want (%q, nil)", desc, k, values[j], errs[j], wordCount[k])
+			}
+		}
+
+		// Check GetMulti, which steps one block iterator across the several
+		// keys of each block, so that it must copy each value out of that
+		// iterator's buffer.
+		values, errs = r.GetMulti(bKeys, nil)
+		for j, k := range keys {
+			if errs[j] != nil || string(values[j]) != wordCount[k] {
+				t.Fatalf("%s: GetMulti %q: got (%q, %v), want (%q, nil)", desc, k, values[j], errs[j], wordCount[k])
+			}
+		}
+
+		// Check iterating in reverse.
+		rr := NewReverseReader(r)
+		i, n := rr.Find(nil, nil), len(keys)
+		for i.Next() {
+			n--
+			if n < 0 || string(i.Key()) != keys[n] || string(i.Value()) != wordCount[keys[n]] {
+				t.Fatalf("%s: reverse entry #%d: got %q:%q", desc, n, i.Key(), i.Value())
+			}
+		}
+		if err := i.Close(); err != nil {
+			t.Fatalf("%s: %v", desc, err)
+		}
+		if n != 0 {
+			t.Fatalf("%s: reverse: got %d entries, want %d", desc, len(keys)-n, len(keys))
+		}
+
+		// Check trimming into tables of either data block format.
+		for _, valuePrefix := range []bool{false, true} {
+			mem := memfs.New()
+			f0, err := mem.Create("trimmed")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := NewWriter(f0, &db.Options{
+				BlockSize:              512,
+				ValuePrefixCompression: valuePrefix,
+			})
+			if err := TrimTo(r, []byte("k"), w, nil); err != nil {
+				t.Fatalf("%s, valuePrefix=%t: TrimTo: %v", desc, valuePrefix, err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("%s, valuePrefix=%t: writer close: %v", desc, valuePrefix, err)
+			}
+			f1, err := mem.Open("trimmed")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r1 := NewReader(f1, &db.Options{
+				VerifyChecksums: true,
+			})
+			i, n := r1.Find(nil, nil), 0
+			for ; i.Next(); n++ {
+				if n >= len(keys) || string(i.Key()) != keys[n] || string(i.Value()) != wordCount[keys[n]] {
+					t.Fatalf("%s, valuePrefix=%t: entry #%d: got %q:%q", desc, valuePrefix, n, i.Key(), i.Value())
+				}
+			}
+			if err := i.Close(); err != nil {
+				t.Fatalf("%s, valuePrefix=%t: %v", desc, valuePrefix, err)
+			}
+			if n == 0 || n >= len(keys) || keys[n] < "k" || keys[n-1] >= "k" {
+				t.Fatalf("%s, valuePrefix=%t: got %d entries", desc, valuePrefix, n)
+			}
+			if err := r1.Close(); err != nil {
+				t.Fatalf("%s, valuePrefix=%t: %v", desc, valuePrefix, err)
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatalf("%s: %v", desc, err)
+		}
+	}
+
+	// A table without the property is read in the standard format, and a
+	// table with an unknown value of the property is rejected.
+	f := writeTestTableWithProperties(t, []string{"a", "x", "b", "x"})
+	if r := NewReader(f, nil); r.dataFormat != standardBlockFormat {
+		t.Fatalf("got data format %d, want %d", r.dataFormat, standardBlockFormat)
+	}
+	f = writeTestTableWithProperties(t, []string{"a", "x"}, valuePrefixPropertyName, "2")
+	if _, err := NewReader(f, nil).Get([]byte("a"), nil); err == nil {
+		t.Fatal("unknown property value: got nil error")
+	} else if _, ok := err.(CorruptionError); !ok {
+		t.Fatalf("unknown property value: got %v, want a CorruptionError", err)
+	}
+}
+
+func TestBlockStats(t *testing.T) {
+	for _, valuePrefix := range []bool{false, true} {
+		for _, restartInterval := range []int{1, 4, 16} {
+			desc := fmt.Sprintf("valuePrefix=%t, restartInterval=%d", valuePrefix, restartInterval)
+			f, err := buildWithOptions(&db.Options{
+				BlockRestartInterval:   restartInterval,
+				BlockSize:              512,
+				ValuePrefixCompression: valuePrefix,
+			})
+			if err != nil {
+				t.Fatalf("%s: %v", desc, err)
+			}
+			r := NewReader(f, nil)
+			s, err := r.BlockStats()
+			if err != nil {
+				t.Fatalf("%s: %v", desc, err)
+			}
+			if s.NumKeys != len(wordCount) {
+				t.Errorf("%s: NumKeys: got %d, want %d", desc, s.NumKeys, len(wordCount))
+			}
+			numBlocks, i := 0, r.IndexIterator()
+			for i.Next() {
+				numBlocks++
+			}
+			if err := i.Close(); err != nil {
+				t.Fatalf("%s: %v", desc, err)
+			}
+			if s.NumBlocks != numBlocks {
+				t.Errorf("%s: NumBlocks: got %d, want %d", desc, s.NumBlocks, numBlocks)
+			}
+			// Every block but the last is a full block of about 512 bytes.
+			if n := s.KeysPerBlock(); n < float64(len(wordCount))/float64(numBlocks) || n > float64(len(wordCount))/float64(numBlocks-1) {
+				t.Errorf("%s: KeysPerBlock: got %g", desc, n)
+			}
+			if minRestarts := (s.NumKeys + restartInterval - 1) / restartInterval; s.NumRestarts < minRestarts || s.NumRestarts > minRestarts+numBlocks {
+				t.Errorf("%s: NumRestarts: got %d, want about %d", desc, s.NumRestarts, minRestarts)
+			}
+			if n := s.BytesPerRestart(); n <= 0 || n > float64(512*restartInterval) {
+				t.Errorf("%s: BytesPerRestart: got %g", desc, n)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatalf("%s: %v", desc, err)
+			}
+		}
+	}
+
+	// A table with no keys has one empty data block, with one restart point.
+	s, err := NewReader(writeTestTableWithProperties(t, nil), nil).BlockStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != (BlockStats{NumBlocks: 1, NumRestarts: 1}) || s.KeysPerBlock() != 0 || s.BytesPerRestart() != 0 {
+		t.Fatalf("empty table: got %+v", s)
+	}
+}
+
+func TestBlockStatsCorruptHandles(t *testing.T) {
+	var b []byte
+	var hs []blockHandle
+	for _, k := range []string{"a", "b"} {
+		bh := blockHandle{offset: uint64(len(b))}
+		b = appendTestBlock(b, k, k)
+		bh.length = uint64(len(b)) - bh.offset - blockTrailerLen
+		hs = append(hs, bh)
+	}
+	testCases := []struct {
+		desc   string
+		second blockHandle
+	}{
+		{"beyond the end of the file", blockHandle{hs[1].offset, 1 << 40}},
+		{"wrapping around", blockHandle{hs[1].offset, 1<<64 - 1 - blockTrailerLen}},
+	}
+	for _, tc := range testCases {
+		var tmp0, tmp1 [MaxBlockHandleLen]byte
+		c := append([]byte(nil), b...)
+		indexBH := blockHandle{offset: uint64(len(c))}
+		c = appendTestBlock(c,
+			"a", string(tmp0[:encodeBlockHandle(tmp0[:], hs[0])]),
+			"b", string(tmp1[:encodeBlockHandle(tmp1[:], tc.second)]))
+		indexBH.length = uint64(len(c)) - indexBH.offset - blockTrailerLen
+		c = appendTestFooter(c, blockHandle{}, indexBH)
+
+		// The handles are checked before they are used to read the blocks,
+		// so a bad length is reported as a CorruptionError, rather than as a
+		// failed read or allocation of that many bytes.
+		r := NewReader(writeTestFile(t, c), nil)
+		_, err := r.BlockStats()
+		if e, ok := err.(CorruptionError); !ok || e.Offset != int64(tc.second.offset) {
+			t.Errorf("%s: BlockStats: got %v, want a CorruptionError at offset %d", tc.desc, err, tc.second.offset)
+		}
+		err = r.ForEachBlock(func([]byte, BlockHandle) error {
+			return nil
+		})
+		if e, ok := err.(CorruptionError); !ok || e.Offset != int64(tc.second.offset) {
+			t.Errorf("%s: ForEachBlock: got %v, want a CorruptionError at offset %d", tc.desc, err, tc.second.offset)
+		}
+		r.Close()
+	}
+}
+
+// foldCaseComparer orders keys as bytes.Compare orders their ASCII lower-case
+// forms, so that keys differing only in case are equal.
+type foldCaseComparer struct{}
+
+func (foldCaseComparer) Compare(a, b []byte) int {
+	return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b))
+}
+
+func (foldCaseComparer) Name() string {
+	return "test.FoldCaseComparer"
+}
+
+func (foldCaseComparer) AppendSeparator(dst, a, b []byte) []byte {
+	return append(dst, a...)
+}
+
+func TestGetComparerEquality(t *testing.T) {
+	mem := memfs.New()
+	f0, err := mem.Create("foldcase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &db.Options{
+		BlockRestartInterval: 2,
+		BlockSize:            32,
+		Comparer:             foldCaseComparer{},
+	}
+	w := NewWriter(f0, o)
+	kvs := []string{"apple", "1", "Banana", "2", "CHERRY", "3", "date", "4", "Elderberry", "5"}
+	for j := 0; j < len(kvs); j += 2 {
+		if err := w.Set([]byte(kvs[j]), []byte(kvs[j+1]), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := mem.Open("foldcase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f1, o)
+	defer r.Close()
+
+	testCases := []struct {
+		key, value string
+	}{
+		{"apple", "1"},
+		{"APPLE", "1"},
+		{"banana", "2"},
+		{"Cherry", "3"},
+		{"DATE", "4"},
+		{"elderberry", "5"},
+		{"apples", ""},
+		{"fig", ""},
+	}
+	for _, tc := range testCases {
+		want := db.ErrNotFound
+		if tc.value != "" {
+			want = nil
+		}
+		v, err := r.Get([]byte(tc.key), nil)
+		if err != want || string(v) != tc.value {
+			t.Errorf("Get %q: got (%q, %v), want (%q, %v)", tc.key, v, err, tc.value, want)
+		}
+		if found, err := r.Has([]byte(tc.key), nil); err != nil || found != (want == nil) {
+			t.Errorf("Has %q: got (%t, %v), want (%t, nil)", tc.key, found, err, want == nil)
+		}
+		values, errs := r.MultiGet([][]byte{[]byte(tc.key)}, nil)
+		if errs[0] != want || string(values[0]) != tc.value {
+			t.Errorf("MultiGet %q: got (%q, %v), want (%q, %v)", tc.key, values[0], errs[0], tc.value, want)
+		}
+	}
+}
+
+func TestMaxBlockSize(t *testing.T) {
+	value := strings.Repeat("x", 10000)
+	f := writeTestTableWithProperties(t, []string{"a", value, "b", "y"})
+	for _, maxBlockSize := range []int{0, 100000, 1000} {
+		r := NewReader(f, &db.Options{
+			MaxBlockSize: maxBlockSize,
+		})
+		v, err := r.Get([]byte("a"), nil)
+		if maxBlockSize == 1000 {
+			if _, ok := err.(CorruptionError); !ok {
+				t.Errorf("maxBlockSize=%d: got (%d bytes, %v), want a CorruptionError", maxBlockSize, len(v), err)
+			}
+			continue
+		}
+		if err != nil || string(v) != value {
+			t.Errorf("maxBlockSize=%d: got (%d bytes, %v), want (%d bytes, nil)", maxBlockSize, len(v), err, len(value))
+		}
+	}
+
+	// A compressed block's claimed length is checked before decompressing.
+	r := &Reader{readerOptions: readerOptions{maxBlockSize: 1 << 20}}
+	var header [binary.MaxVarintLen64]byte
+	forged := header[:binary.PutUvarint(header[:], 1<<30)]
+	if err := r.checkBlockSize(forged, snappyCompressionBlockType, 0); err == nil {
+		t.Fatal("forged block: got nil error")
+	} else if _, ok := err.(CorruptionError); !ok {
+		t.Fatalf("forged block: got %v, want a CorruptionError", err)
+	}
+}
+
+func TestSeekExact(t *testing.T) {
+	f := writeTestTableWithProperties(t, []string{"b", "1", "d", "2", "f", "3"})
+	r := NewReader(f, nil)
+	defer r.Close()
+
+	testCases := []struct {
+		key   string
+		exact bool
+		// want are the keys from the iterator's initial position onwards.
+		want string
+	}{
+		{"", false, "bdf"},
+		{"b", true, "bdf"},
+		{"c", false, "df"},
+		{"d", true, "df"},
+		{"e", false, "f"},
+		{"f", true, "f"},
+		{"g", false, ""},
+	}
+	for _, tc := range testCases {
+		i, exact, err := r.SeekExact([]byte(tc.key), nil)
+		if err != nil {
+			t.Errorf("key=%q: %v", tc.key, err)
+			continue
+		}
+		if exact != tc.exact {
+			t.Errorf("key=%q: got exact %t, want %t", tc.key, exact, tc.exact)
+		}
+		got := ""
+		if len(tc.want) > 0 {
+			// The iterator is positioned at the first pair, before any Next.
+			got = string(i.Key())
+			for i.Next() {
+				got += string(i.Key())
+			}
+		} else if i.Next() {
+			got = string(i.Key())
+		}
+		if err := i.Close(); err != nil {
+			t.Errorf("key=%q: %v", tc.key, err)
+		}
+		if got != tc.want {
+			t.Errorf("key=%q: got keys %q, want %q", tc.key, got, tc.want)
+		}
+	}
+}
+
+func TestFileChecksum(t *testing.T) {
+	// Write a table with an incompressible value, so that the file is more
+	// than one chunk long.
+	value := make([]byte, 2*fileChecksumChunkSize)
+	rand.New(rand.NewSource(1)).Read(value)
+	b := readTestFile(t, writeTestTableWithProperties(t, []string{"a", string(value)}))
+	if len(b) <= fileChecksumChunkSize {
+		t.Fatalf("table is %d bytes, want more than one chunk", len(b))
+	}
+	want := crc.New(b).Value()
+
+	// The checksum does not depend on the Reader's options.
+	for _, o := range []*db.Options{nil, {VerifyChecksums: true, BlockCacheSize: 1 << 20}} {
+		r := NewReader(writeTestFile(t, b), o)
+		if got, err := r.FileChecksum(); err != nil || got != want {
+			t.Errorf("got (%#x, %v), want (%#x, nil)", got, err, want)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Corrupting a data block, which the Reader does not read when opening
+	// the table, changes the file checksum.
+	b[len(b)/2] ^= 1
+	r := NewReader(writeTestFile(t, b), nil)
+	if got, err := r.FileChecksum(); err != nil || got == want {
+		t.Errorf("corrupted file: got (%#x, %v), want a different checksum", got, err)
+	}
+}
+
+func TestLazyReader(t *testing.T) {
+	f, err := build(db.DefaultCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := NewReader(f, nil).IndexBlock()
+
+	// Opening the table does not read the index, and concurrent first uses
+	// of the index all see it.
+	r := NewLazyReader(f, nil)
+	if r.index != nil {
+		t.Fatal("NewLazyReader read the index")
+	}
+	var wg sync.WaitGroup
+	for j := 0; j < 8; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k, v := range wordCount {
+				if v1, err := r.Get([]byte(k), nil); err != nil || string(v1) != v {
+					t.Errorf("Get %q: got (%q, %v), want (%q, nil)", k, v1, err, v)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got := r.IndexBlock(); !bytes.Equal(got, want) {
+		t.Errorf("IndexBlock: got %d bytes, want %d", len(got), len(want))
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupt index is reported by each use, not by NewLazyReader.
+	b := readTestFile(t, f)
+	_, indexBH, err := readFooter(f, int64(len(b)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[indexBH.offset] ^= 0xff
+	r = NewLazyReader(writeTestFile(t, b), &db.Options{VerifyChecksums: true})
+	if r.err != nil {
+		t.Fatalf("NewLazyReader: %v", r.err)
+	}
+	for j := 0; j < 2; j++ {
+		if _, err := r.Get([]byte("the"), nil); err == nil || err == db.ErrNotFound {
+			t.Errorf("Get #%d: got %v, want a corruption error", j, err)
+		}
+	}
+	if i := r.Find(nil, nil); i.Next() || i.Close() == nil {
+		t.Error("Find: got no error")
+	}
+}
+
+// swappableFile is a db.File whose underlying file can be replaced, to
+// simulate a file that changes while it is open.
+type swappableFile struct {
+	db.File
+}
+
+func TestReopen(t *testing.T) {
+	keys := make([]string, 0, len(wordCount))
+	for k := range wordCount {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// The second table has the same keys as the first, followed by more, so
+	// that all but the last of the first table's data blocks are unchanged.
+	var files [2]db.File
+	for j, n := range []int{len(keys) / 2, len(keys)} {
+		mem := memfs.New()
+		f0, err := mem.Create("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f0, &db.Options{
+			BlockSize:   512,
+			Compression: db.NoCompression,
+		})
+		for _, k := range keys[:n] {
+			if err := w.Set([]byte(k), []byte(wordCount[k]), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if files[j], err = mem.Open("test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var handles [2]map[uint64]uint64
+	for j, f := range files {
+		var err error
+		if handles[j], err = NewReader(f, nil).dataBlockHandles(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantReads := 0
+	for offset, length := range handles[1] {
+		if l, ok := handles[0][offset]; !ok || l != length {
+			wantReads++
+		}
+	}
+	if wantReads == 0 || wantReads == len(handles[1]) {
+		t.Fatalf("%d of %d blocks changed, want some but not all", wantReads, len(handles[1]))
+	}
+
+	sf := &swappableFile{files[0]}
+	reads := 0
+	r := NewReader(sf, &db.Options{
+		BlockCacheSize: 1 << 20,
+		OnBlockRead: func(db.BlockReadInfo) {
+			reads++
+		},
+	})
+	scan := func(want []string) {
+		t.Helper()
+		i, n := r.Find(nil, nil), 0
+		for ; i.Next(); n++ {
+			if n >= len(want) || string(i.Key()) != want[n] || string(i.Value()) != wordCount[want[n]] {
+				t.Fatalf("entry #%d: got %q:%q", n, i.Key(), i.Value())
+			}
+		}
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n != len(want) {
+			t.Fatalf("got %d entries, want %d", n, len(want))
+		}
+	}
+	scan(keys[:len(keys)/2])
+	if reads != len(handles[0]) {
+		t.Fatalf("first scan: got %d block reads, want %d", reads, len(handles[0]))
+	}
+
+	// Reopening an unchanged file does nothing.
+	if err := r.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	reads = 0
+	scan(keys[:len(keys)/2])
+	if reads != 0 {
+		t.Fatalf("unchanged file: got %d block reads, want 0", reads)
+	}
+
+	// Reopening a grown file reads only the new and changed blocks.
+	sf.File = files[1]
+	if err := r.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	reads = 0
+	scan(keys)
+	if reads != wantReads {
+		t.Fatalf("grown file: got %d block reads, want %d", reads, wantReads)
+	}
+	for _, k := range keys {
+		if v, err := r.Get([]byte(k), nil); err != nil || string(v) != wordCount[k] {
+			t.Fatalf("Get %q: got (%q, %v), want (%q, nil)", k, v, err, wordCount[k])
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReopenLazy(t *testing.T) {
+	var files [2]db.File
+	for j, keys := range [][]string{{"a", "b"}, {"a", "b", "c"}} {
+		mem := memfs.New()
+		f0, err := mem.Create("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f0, nil)
+		for _, k := range keys {
+			if err := w.Set([]byte(k), []byte(k), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if files[j], err = mem.Open("test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A Reader returned by NewLazyReader is still lazy after Reopen, whether
+	// or not it had read its index, and keeps its options.
+	for _, readIndex := range []bool{false, true} {
+		sf := &swappableFile{files[0]}
+		r := NewLazyReader(sf, &db.Options{
+			BlockCacheSize: 1 << 20,
+			ReadChunkSize:  1 << 10,
+		})
+		if readIndex {
+			if v, err := r.Get([]byte("a"), nil); err != nil || string(v) != "a" {
+				t.Fatalf("readIndex=%t: Get a: got (%q, %v)", readIndex, v, err)
+			}
+		}
+		sf.File = files[1]
+		if err := r.Reopen(); err != nil {
+			t.Fatalf("readIndex=%t: %v", readIndex, err)
+		}
+		if l := r.lazyIndex; l == nil || (!readIndex && l.loaded != 0) {
+			t.Errorf("readIndex=%t: the index is no longer lazy", readIndex)
+		}
+		if r.cache == nil || r.chunk == nil || r.chunk.size != 1<<10 {
+			t.Errorf("readIndex=%t: the options were not kept", readIndex)
+		}
+		if v, err := r.Get([]byte("c"), nil); err != nil || string(v) != "c" {
+			t.Errorf("readIndex=%t: Get c: got (%q, %v)", readIndex, v, err)
+		}
+		r.Close()
+	}
+}
+
+func TestBlockHandleEncoding(t *testing.T) {
+	for _, h := range []BlockHandle{
+		{0, 0},
+		{1, 2},
+		{127, 128},
+		{1 << 32, 4096},
+		{math.MaxUint64, math.MaxUint64},
+	} {
+		b := EncodeBlockHandle([]byte("prefix"), h)
+		if string(b[:6]) != "prefix" {
+			t.Fatalf("%v: prefix was overwritten: %q", h, b)
+		}
+		b = b[6:]
+		// The encoding is the same as that of the unexported helpers.
+		var tmp [MaxBlockHandleLen]byte
+		if n := encodeBlockHandle(tmp[:], blockHandle{h.Offset, h.Length}); string(tmp[:n]) != string(b) {
+			t.Fatalf("%v: got encoding %x, want %x", h, b, tmp[:n])
+		}
+		h1, n := DecodeBlockHandle(append(b, "suffix"...))
+		if h1 != h || n != len(b) {
+			t.Fatalf("%v: decoded (%v, %d), want (%v, %d)", h, h1, n, h, len(b))
+		}
+	}
+
+	// Invalid encodings decode to zero.
+	for _, b := range []string{
+		"",
+		"\x01",
+		"\x80",
+		"\x01\x80",
+		"\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01\x01",
+	} {
+		if h, n := DecodeBlockHandle([]byte(b)); h != (BlockHandle{}) || n != 0 {
+			t.Errorf("%q: got (%v, %d), want zero", b, h, n)
+		}
+	}
+
+	// The values of an IndexIterator are encoded BlockHandles.
+	f, err := build(db.DefaultCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, nil)
+	defer r.Close()
+	i := r.IndexIterator()
+	for i.Next() {
+		h, n := DecodeBlockHandle(i.Value())
+		if n != len(i.Value()) {
+			t.Fatalf("index value %x: decoded %d bytes", i.Value(), n)
+		}
+		if _, err := r.BlockIterator(EncodeBlockHandle(nil, h)); err != nil {
+			t.Fatalf("BlockIterator(%v): %v", h, err)
+		}
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testMmapFile is an MmapFile whose mapping is the byte slice b.
+type testMmapFile struct {
+	db.File
+	b []byte
+	// calls is the number of calls to MmapAt.
+	calls int
+}
+
+func (f *testMmapFile) MmapAt(off int64, n int) []byte {
+	f.calls++
+	if off < 0 || off > int64(len(f.b)) || int64(n) > int64(len(f.b))-off {
+		return nil
+	}
+	return f.b[off : off+int64(n)]
+}
+
+func TestMmapFile(t *testing.T) {
+	f, err := build(db.NoCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := readTestFile(t, f)
+	mf := &testMmapFile{File: writeTestFile(t, b), b: b}
+	if err := check(mf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if mf.calls == 0 {
+		t.Fatal("MmapAt was not called")
+	}
+
+	mf = &testMmapFile{File: writeTestFile(t, b), b: b}
+	r := NewReader(mf, &db.Options{
+		ReadaheadBlocks: 4,
+		VerifyChecksums: true,
+	})
+	defer r.Close()
+
+	// Values alias the mapping.
+	v, err := r.Get([]byte("the"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliased := false
+	for j := 0; j < len(mf.b); j++ {
+		if !bytes.HasPrefix(mf.b[j:], v) {
+			continue
+		}
+		// Changing the mapping at the value's location changes the value.
+		v0 := v[0]
+		mf.b[j] ^= 0xff
+		aliased = v[0] != v0
+		mf.b[j] ^= 0xff
+		if aliased {
+			break
+		}
+	}
+	if !aliased {
+		t.Fatal("value does not alias the mapping")
+	}
+
+	// Blocks outside the mapping are read with ReadAt.
+	mf.b = mf.b[:len(mf.b)/2]
+	i, n := r.Find(nil, nil), 0
+	for ; i.Next(); n++ {
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(wordCount) {
+		t.Fatalf("got %d keys, want %d", n, len(wordCount))
+	}
+}
+
+func TestInternalKeysRoundTrip(t *testing.T) {
+	// Key returns the stored keys, so the internal key trailers written by
+	// package leveldb are preserved, through both Find and Get.
+	mem := memfs.New()
+	f0, err := mem.Create("internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &db.Options{
+		Comparer:             testInternalKeyComparer{},
+		BlockRestartInterval: 2,
+		BlockSize:            64,
+	}
+	w := NewWriter(f0, o)
+	var keys [][]byte
+	for j, ukey := range []string{"a", "a", "b", "c", "c", "c", "d"} {
+		// Newer entries for the same user key sort first.
+		k := makeTestInternalKey(ukey, uint8(j%2), uint64(100-j))
+		keys = append(keys, k)
+		if err := w.Set(k, []byte(ukey), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := mem.Open("internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f1, o)
+	defer r.Close()
+
+	i, n := r.Find(nil, nil), 0
+	for ; i.Next(); n++ {
+		if !bytes.Equal(i.Key(), keys[n]) {
+			t.Fatalf("entry #%d: got key %x, want %x", n, i.Key(), keys[n])
+		}
+		ukey, kind, seqNum, ok := parseInternalKey(i.Key())
+		if !ok || string(ukey) != string(i.Value()) || kind != uint8(n%2) || seqNum != uint64(100-n) {
+			t.Fatalf("entry #%d: got (%q, %d, %d, %t)", n, ukey, kind, seqNum, ok)
+		}
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(keys) {
+		t.Fatalf("got %d entries, want %d", n, len(keys))
+	}
+	for _, k := range keys {
+		if _, err := r.Get(k, nil); err != nil {
+			t.Errorf("Get %x: %v", k, err)
+		}
+	}
+}
+
+func TestGzipFile(t *testing.T) {
+	f, err := build(db.DefaultCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	z := gzip.NewWriter(&buf)
+	if _, err := z.Write(readTestFile(t, f)); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := check(NewGzipFile(writeTestFile(t, buf.Bytes())), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	gf := NewGzipFile(writeTestFile(t, buf.Bytes()))
+	if _, err := gf.Write([]byte("x")); err == nil {
+		t.Error("Write: got nil error")
+	}
+	stat, err := gf.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stat.Size(), int64(len(readTestFile(t, f))); got != want {
+		t.Errorf("Size: got %d, want %d", got, want)
+	}
+
+	// A file that is not gzip-compressed is an error for every read.
+	gf = NewGzipFile(writeTestFile(t, readTestFile(t, f)))
+	for j := 0; j < 2; j++ {
+		if _, err := gf.ReadAt(make([]byte, 1), 0); err == nil {
+			t.Errorf("ReadAt #%d: got nil error", j)
+		}
+	}
+	if r := NewReader(gf, nil); r.err == nil {
+		t.Error("NewReader: got nil error")
+	}
+}
+
+// writeTestSmallTable writes a table with a single data block, holding the
+// keys "k00", "k02", ..., "k98" with values "v00", "v02", ..., "v98".
+func writeTestSmallTable(t testing.TB, o *db.Options) db.File {
+	mem := memfs.New()
+	f0, err := mem.Create("small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, o)
+	for j := 0; j < 100; j += 2 {
+		if err := w.Set([]byte(fmt.Sprintf("k%02d", j)), []byte(fmt.Sprintf("v%02d", j)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := mem.Open("small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f1
+}
+
+func TestSingleBlock(t *testing.T) {
+	f, err := build(db.DefaultCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := NewReader(f, nil); r.singleBlock != nil {
+		t.Fatal("multi-block table: got a single block")
+	}
+
+	for _, fp := range []db.FilterPolicy{nil, bloom.FilterPolicy(10)} {
+		f := writeTestSmallTable(t, &db.Options{FilterPolicy: fp})
+		reads := 0
+		r := NewReader(f, &db.Options{
+			FilterPolicy: fp,
+			OnBlockRead: func(db.BlockReadInfo) {
+				reads++
+			},
+		})
+		if r.singleBlock == nil {
+			t.Fatalf("filter=%v: got no single block", fp != nil)
+		}
+		for j := 0; j < 100; j++ {
+			key := []byte(fmt.Sprintf("k%02d", j))
+			v, err := r.Get(key, nil)
+			found, hasErr := r.Has(key, nil)
+			if j%2 == 1 {
+				if err != db.ErrNotFound || found || hasErr != nil {
+					t.Fatalf("filter=%v: %q: got (%q, %v) and (%t, %v), want not found", fp != nil, key, v, err, found, hasErr)
+				}
+				continue
+			}
+			if want := fmt.Sprintf("v%02d", j); err != nil || string(v) != want || !found || hasErr != nil {
+				t.Fatalf("filter=%v: %q: got (%q, %v) and (%t, %v), want %q", fp != nil, key, v, err, found, hasErr, want)
+			}
+		}
+
+		// A key beyond the separator is not found without reading the block.
+		reads = 0
+		if _, err := r.Get([]byte("z"), nil); err != db.ErrNotFound {
+			t.Fatalf("filter=%v: Get %q: got %v, want ErrNotFound", fp != nil, "z", err)
+		}
+		if reads != 0 {
+			t.Fatalf("filter=%v: Get %q: got %d block reads, want 0", fp != nil, "z", reads)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A corrupt block is an error, rather than db.ErrNotFound.
+	b := readTestFile(t, writeTestSmallTable(t, nil))
+	b[0] ^= 0xff
+	r := NewReader(writeTestFile(t, b), &db.Options{VerifyChecksums: true})
+	if r.singleBlock == nil {
+		t.Fatal("corrupt table: got no single block")
+	}
+	if _, err := r.Get([]byte("k00"), nil); err == nil || err == db.ErrNotFound {
+		t.Fatalf("corrupt table: got %v, want a checksum error", err)
+	}
+	if _, err := r.Has([]byte("k00"), nil); err == nil {
+		t.Fatal("corrupt table: Has got nil error")
+	}
+}
+
+func BenchmarkGetSingleBlock(b *testing.B) {
+	for _, fastPath := range []bool{false, true} {
+		b.Run(fmt.Sprintf("fastPath=%t", fastPath), func(b *testing.B) {
+			r := NewReader(writeTestSmallTable(b, nil), &db.Options{
+				BlockCacheSize: 1 << 20,
+			})
+			if !fastPath {
+				r.singleBlock = nil
+			}
+			keys := make([][]byte, 100)
+			for j := range keys {
+				keys[j] = []byte(fmt.Sprintf("k%02d", j))
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				r.Get(keys[n%len(keys)], nil)
+			}
+		})
+	}
+}
+
+// writeTestTableWithIndex writes a table whose data blocks have the given
+// key/value pairs, and whose index has the given separators, one per block.
+// The separators need not bound their blocks. The table has no meta blocks.
+func writeTestTableWithIndex(t *testing.T, blocks [][]string, seps []string) db.File {
+	var (
+		b     []byte
+		index []string
+		tmp   [MaxBlockHandleLen]byte
+	)
+	for j, kvs := range blocks {
+		bh := blockHandle{offset: uint64(len(b))}
+		b = appendTestBlock(b, kvs...)
+		bh.length = uint64(len(b)) - bh.offset - blockTrailerLen
+		index = append(index, seps[j], string(tmp[:encodeBlockHandle(tmp[:], bh)]))
+	}
+	indexBH := blockHandle{offset: uint64(len(b))}
+	b = appendTestBlock(b, index...)
+	indexBH.length = uint64(len(b)) - indexBH.offset - blockTrailerLen
+	b = appendTestFooter(b, blockHandle{}, indexBH)
+	return writeTestFile(t, b)
+}
+
+func TestParanoidChecks(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		blocks [][]string
+		seps   []string
+	}{
+		{
+			"key after its block's separator",
+			[][]string{{"a", "1", "b", "2", "c", "3"}, {"d", "4"}},
+			[]string{"b", "z"},
+		},
+		{
+			"key not after the previous block's separator",
+			[][]string{{"a", "1", "b", "2"}, {"c", "3", "d", "4"}},
+			[]string{"c", "z"},
+		},
+		{
+			"keys out of order",
+			[][]string{{"a", "1"}, {"c", "3", "b", "2"}},
+			[]string{"a", "z"},
+		},
+	}
+	for _, tc := range testCases {
+		f := writeTestTableWithIndex(t, tc.blocks, tc.seps)
+		for _, readahead := range []int{0, 4} {
+			for _, paranoid := range []bool{false, true} {
+				r := NewReader(f, &db.Options{
+					ParanoidChecks:  paranoid,
+					ReadaheadBlocks: readahead,
+				})
+				i := r.Find(nil, nil)
+				for i.Next() {
+				}
+				err := i.Close()
+				if !paranoid {
+					if err != nil {
+						t.Errorf("%s, readahead=%d: without ParanoidChecks: %v", tc.desc, readahead, err)
+					}
+					continue
+				}
+				if _, ok := err.(CorruptionError); !ok {
+					t.Errorf("%s, readahead=%d: got %v, want a CorruptionError", tc.desc, readahead, err)
+				}
+			}
+		}
+	}
+
+	// A Get in a single-block table is checked too.
+	f := writeTestTableWithIndex(t, [][]string{{"a", "1", "b", "2", "c", "3"}}, []string{"b"})
+	r := NewReader(f, &db.Options{ParanoidChecks: true})
+	if _, err := r.Get([]byte("a"), nil); err == nil {
+		t.Error("single block: got nil error")
+	} else if _, ok := err.(CorruptionError); !ok {
+		t.Errorf("single block: got %v, want a CorruptionError", err)
+	}
+	r.Close()
+
+	// MultiGet returns the same errors as Get. A Get of a key that is absent
+	// from its block goes on to check the next block, so the keys are each in
+	// the block that the index gives.
+	files := []db.File{f}
+	for _, tc := range testCases {
+		files = append(files, writeTestTableWithIndex(t, tc.blocks, tc.seps))
+	}
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("d")}
+	for n, f := range files {
+		r := NewReader(f, &db.Options{ParanoidChecks: true})
+		values, errs := r.MultiGet(keys, nil)
+		for j, k := range keys {
+			v, err := r.Get(k, nil)
+			if !bytes.Equal(values[j], v) || fmt.Sprint(errs[j]) != fmt.Sprint(err) {
+				t.Errorf("table %d: MultiGet %q: got (%q, %v), want (%q, %v)", n, k, values[j], errs[j], v, err)
+			}
+		}
+		r.Close()
+	}
+
+	// Well built tables pass the checks, including after seeks.
+	f, err := buildWithOptions(&db.Options{BlockSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, readahead := range []int{0, 4} {
+		r := NewReader(f, &db.Options{
+			ParanoidChecks:  true,
+			ReadaheadBlocks: readahead,
+		})
+		i, n := r.Find(nil, nil), 0
+		for ; i.Next(); n++ {
+		}
+		if err := i.Close(); err != nil || n != len(wordCount) {
+			t.Fatalf("readahead=%d: got (%d keys, %v), want (%d keys, nil)", readahead, n, err, len(wordCount))
+		}
+		it := r.Find([]byte("m"), nil).(*Iterator)
+		for _, k := range []string{"zz", "a", "king", "b", "youth"} {
+			it.Seek([]byte(k))
+			for it.Next() {
+			}
+		}
+		if err := it.Close(); err != nil {
+			t.Fatalf("readahead=%d: seeks: %v", readahead, err)
+		}
+		for k := range wordCount {
+			if _, err := r.Get([]byte(k), nil); err != nil {
+				t.Fatalf("readahead=%d: Get %q: %v", readahead, k, err)
+			}
+		}
+	}
+}
+
+// closeCountingFile is a db.File that counts the calls to its Close method.
+type closeCountingFile struct {
+	db.File
+	closes int
+}
+
+func (f *closeCountingFile) Close() error {
+	f.closes++
+	return f.File.Close()
+}
+
+func TestClone(t *testing.T) {
+	for _, lazy := range []bool{false, true} {
+		desc := fmt.Sprintf("lazy=%t", lazy)
+		f, err := build(db.DefaultCompression, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cf := &closeCountingFile{File: f}
+		newReader := NewReader
+		if lazy {
+			newReader = NewLazyReader
+		}
+		r := newReader(cf, &db.Options{BlockCacheSize: 1 << 20})
+		clones := []*Reader{r, r.Clone()}
+		clones = append(clones, clones[1].Clone())
+
+		// The clones share the index, whichever of them loads it.
+		var wg sync.WaitGroup
+		for _, c := range clones {
+			wg.Add(1)
+			go func(c *Reader) {
+				defer wg.Done()
+				for k, v := range wordCount {
+					if v1, err := c.Get([]byte(k), nil); err != nil || string(v1) != v {
+						t.Errorf("%s: Get %q: got (%q, %v), want (%q, nil)", desc, k, v1, err, v)
+						return
+					}
+				}
+			}(c)
+		}
+		wg.Wait()
+
+		// Closing a Reader does not affect its clones, and the file is closed
+		// once, when the last of them is closed.
+		for j, c := range clones {
+			if err := c.Close(); err != nil {
+				t.Fatalf("%s: Close #%d: %v", desc, j, err)
+			}
+			if _, err := c.Get([]byte("the"), nil); err == nil {
+				t.Fatalf("%s: Get after Close #%d: got nil error", desc, j)
+			}
+			want := 0
+			if j == len(clones)-1 {
+				want = 1
+			}
+			if cf.closes != want {
+				t.Fatalf("%s: after Close #%d: file closed %d times, want %d", desc, j, cf.closes, want)
+			}
+			if j < len(clones)-1 {
+				if _, err := clones[j+1].Get([]byte("the"), nil); err != nil {
+					t.Fatalf("%s: Get on clone after Close #%d: %v", desc, j, err)
+				}
+			}
+		}
+	}
+
+	// Cloning a Reader that failed to open gives its error.
+	r := NewReader(writeTestFile(t, []byte("not a table")), nil)
+	if err := r.Clone().Close(); err == nil || err != r.err {
+		t.Fatalf("got %v, want %v", err, r.err)
+	}
+}
+
+func TestForEachBlock(t *testing.T) {
+	f, err := buildWithOptions(&db.Options{BlockSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A long key is longer than firstKeyPeekLen.
+	longKey := strings.Repeat("a", 2*firstKeyPeekLen)
+	g := writeTestTableWithIndex(t,
+		[][]string{{"0", "x"}, {longKey, "y", longKey + "b", "z"}, {}, {"c", "w"}},
+		[]string{"0", longKey + "b", longKey + "b", "c"})
+	for _, tc := range []struct {
+		desc string
+		f    db.File
+		o    *db.Options
+	}{
+		{"uncompressed", f, nil},
+		{"snappy", g, nil},
+		{"value prefix", nil, &db.Options{BlockSize: 512, ValuePrefixCompression: true}},
+	} {
+		if tc.f == nil {
+			if tc.f, err = buildWithOptions(tc.o); err != nil {
+				t.Fatal(err)
+			}
+		}
+		r := NewReader(tc.f, nil)
+
+		// Find the expected first keys by reading each block in full.
+		var want []string
+		index := r.IndexIterator()
+		for index.Next() {
+			i, err := r.BlockIterator(index.Value())
+			if err != nil {
+				t.Fatalf("%s: %v", tc.desc, err)
+			}
+			if i.Next() {
+				want = append(want, string(i.Key()))
+			}
+			if err := i.Close(); err != nil {
+				t.Fatalf("%s: %v", tc.desc, err)
+			}
+		}
+		if err := index.Close(); err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+
+		var got []string
+		var offset uint64
+		err := r.ForEachBlock(func(firstKey []byte, h BlockHandle) error {
+			if len(got) > 0 && h.Offset <= offset {
+				t.Errorf("%s: handle %v is not after offset %d", tc.desc, h, offset)
+			}
+			offset = h.Offset
+			got = append(got, string(firstKey))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("%s: got first keys %q, want %q", tc.desc, got, want)
+		}
+
+		// An error from fn stops the walk.
+		errStop, n := errors.New("stop"), 0
+		err = r.ForEachBlock(func([]byte, BlockHandle) error {
+			n++
+			return errStop
+		})
+		if err != errStop || n != 1 {
+			t.Errorf("%s: got (%v, %d calls), want (%v, 1 call)", tc.desc, err, n, errStop)
+		}
+	}
+}
+
+func TestLinearSeekThreshold(t *testing.T) {
+	// Use a restart interval of 1 so that every key is at a restart point,
+	// and blocks of up to a few dozen restart points.
+	f, err := buildWithOptions(&db.Options{
+		BlockRestartInterval: 1,
+		BlockSize:            512,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wordKeys []string
+	for k := range wordCount {
+		wordKeys = append(wordKeys, k)
+	}
+	sort.Strings(wordKeys)
+	for _, threshold := range []int{0, 1, 8, 1 << 20} {
+		r := NewReader(f, &db.Options{
+			LinearSeekThreshold: threshold,
+		})
+		for j, k := range wordKeys {
+			if v, err := r.Get([]byte(k), nil); err != nil || string(v) != wordCount[k] {
+				t.Fatalf("threshold=%d: Get %q: got (%q, %v), want (%q, nil)", threshold, k, v, err, wordCount[k])
+			}
+			// Seeking to just after k finds the next key.
+			i := r.Find([]byte(k+"\x00"), nil)
+			if j+1 < len(wordKeys) {
+				if !i.Next() || string(i.Key()) != wordKeys[j+1] {
+					t.Fatalf("threshold=%d: Find %q: got %q, want %q", threshold, k+"\x00", i.Key(), wordKeys[j+1])
+				}
+			} else if i.Next() {
+				t.Fatalf("threshold=%d: Find %q: got %q, want none", threshold, k+"\x00", i.Key())
+			}
+			if err := i.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLinearSeekThreshold(b *testing.B) {
+	keys := make([][]byte, 0, len(wordCount))
+	for k := range wordCount {
+		keys = append(keys, []byte(k))
+	}
+	for _, blockSize := range []int{256, 1024, 4096, 16384} {
+		f, err := buildWithOptions(&db.Options{
+			BlockSize: blockSize,
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, linear := range []bool{false, true} {
+			b.Run(fmt.Sprintf("blockSize=%d/linear=%t", blockSize, linear), func(b *testing.B) {
+				o := &db.Options{BlockCacheSize: 1 << 20}
+				if linear {
+					o.LinearSeekThreshold = 1 << 20
+				}
+				r := NewReader(f, o)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for n := 0; n < b.N; n++ {
+					if _, err := r.Get(keys[n%len(keys)], nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestVerifyAll(t *testing.T) {
+	// The third block's separator is before its last key.
+	f := writeTestTableWithIndex(t,
+		[][]string{{"a", "1", "b", "2"}, {"c", "3", "d", "4"}, {"e", "5", "f", "6"}, {"g", "7", "h", "8"}},
+		[]string{"b", "d", "e", "h"})
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, stat.Size())
+	if _, err := f.ReadAt(b, 0); err != nil {
+		t.Fatal(err)
+	}
+	var handles []BlockHandle
+	err = NewReader(writeTestFile(t, b), nil).ForEachBlock(func(_ []byte, h BlockHandle) error {
+		handles = append(handles, h)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(writeTestFile(t, b), nil)
+	got, err := r.VerifyAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Offset != int64(handles[2].Offset) {
+		t.Fatalf("got %v, want one error at offset %d", got, handles[2].Offset)
+	}
+
+	// Corrupt the checksums of the first and last blocks.
+	b[handles[0].Offset] ^= 0xff
+	b[handles[3].Offset] ^= 0xff
+	r = NewReader(writeTestFile(t, b), nil)
+	got, err = r.VerifyAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offsets []int64
+	for _, e := range got {
+		offsets = append(offsets, e.Offset)
+	}
+	want := []int64{int64(handles[0].Offset), int64(handles[2].Offset), int64(handles[3].Offset)}
+	if fmt.Sprint(offsets) != fmt.Sprint(want) {
+		t.Fatalf("got errors %v at offsets %v, want offsets %v", got, offsets, want)
+	}
+	for _, e := range []CorruptionError{got[0], got[2]} {
+		if !strings.Contains(e.Reason, "checksum mismatch") {
+			t.Errorf("got %v, want a checksum mismatch", e)
+		}
+	}
+
+	// A table that cannot be opened has a single error.
+	r = NewReader(writeTestFile(t, b[:len(b)-1]), nil)
+	if got, err := r.VerifyAll(); err != nil || len(got) != 1 {
+		t.Fatalf("truncated table: got (%v, %v), want one error", got, err)
+	}
+
+	// A good table has no errors.
+	f, err = build(db.DefaultCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := NewReader(f, nil).VerifyAll(); err != nil || len(got) != 0 {
+		t.Fatalf("good table: got (%v, %v), want no errors", got, err)
+	}
+}
+
+// fixedPrefix is a db.PrefixExtractor whose prefixes are the first n bytes
+// of each key.
+type fixedPrefix int
+
+func (n fixedPrefix) Name() string {
+	return fmt.Sprintf("test.fixed.%d", int(n))
+}
+
+func (n fixedPrefix) Prefix(key []byte) []byte {
+	if len(key) < int(n) {
+		return nil
+	}
+	return key[:n]
+}
+
+func TestPrefixIterator(t *testing.T) {
+	// Every key has a two-byte prefix, and only those prefixes whose second
+	// byte is even are present.
+	var keys []string
+	for c0 := 'a'; c0 <= 'z'; c0++ {
+		for c1 := 'a'; c1 <= 'z'; c1 += 2 {
+			for j := 0; j < 20; j++ {
+				keys = append(keys, fmt.Sprintf("%c%c%02d", c0, c1, j))
+			}
+		}
+	}
+	value := strings.Repeat("v", 100)
+	writeTable := func(o *db.Options) db.File {
+		mem := memfs.New()
+		f0, err := mem.Create("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f0, o)
+		for _, k := range keys {
+			if err := w.Set([]byte(k), []byte(value), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f1, err := mem.Open("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f1
+	}
+	filtered := writeTable(&db.Options{
+		FilterPolicy:    bloom.FilterPolicy(10),
+		PrefixExtractor: fixedPrefix(2),
+	})
+	unfiltered := writeTable(&db.Options{
+		FilterPolicy: bloom.FilterPolicy(10),
+	})
+
+	// scan iterates over every two-byte prefix, checking the keys found, and
+	// returns the number of data blocks read for the absent prefixes.
+	scan := func(desc string, f db.File, extractor db.PrefixExtractor) int {
+		nRead, absent := 0, false
+		r := NewReader(f, &db.Options{
+			FilterPolicy:    bloom.FilterPolicy(10),
+			PrefixExtractor: extractor,
+			OnBlockRead: func(db.BlockReadInfo) {
+				if absent {
+					nRead++
+				}
+			},
+		})
+		for c0 := 'a'; c0 <= 'z'; c0++ {
+			for c1 := 'a'; c1 <= 'z'; c1++ {
+				prefix := fmt.Sprintf("%c%c", c0, c1)
+				absent = (c1-'a')%2 == 1
+				var want, got []string
+				for _, k := range keys {
+					if strings.HasPrefix(k, prefix) {
+						want = append(want, k)
+					}
+				}
+				i := r.NewPrefixIterator([]byte(prefix), nil)
+				for i.Next() {
+					if string(i.Value()) != value {
+						t.Fatalf("%s: prefix %q: key %q has value %q", desc, prefix, i.Key(), i.Value())
+					}
+					got = append(got, string(i.Key()))
+				}
+				if err := i.Close(); err != nil {
+					t.Fatalf("%s: prefix %q: %v", desc, prefix, err)
+				}
+				if strings.Join(got, ",") != strings.Join(want, ",") {
+					t.Fatalf("%s: prefix %q: got %q, want %q", desc, prefix, got, want)
+				}
+			}
+		}
+		return nRead
+	}
+	nFiltered := scan("filtered", filtered, fixedPrefix(2))
+	nUnfiltered := scan("unfiltered", unfiltered, fixedPrefix(2))
+	// A table whose PrefixExtractor has a different name has no prefix
+	// filtering, and neither does a reader with no PrefixExtractor.
+	nOtherName := scan("other name", filtered, fixedPrefix(3))
+	nNoExtractor := scan("no extractor", filtered, nil)
+	if nUnfiltered == 0 || nFiltered*10 > nUnfiltered {
+		t.Errorf("blocks read for absent prefixes: got %d with prefix filtering, %d without, want far fewer with",
+			nFiltered, nUnfiltered)
+	}
+	if nOtherName != nUnfiltered || nNoExtractor != nUnfiltered {
+		t.Errorf("blocks read for absent prefixes: got %d for a different extractor name, %d for no extractor, want %d",
+			nOtherName, nNoExtractor, nUnfiltered)
+	}
+
+	// The table records the PrefixExtractor's name.
+	r := NewReader(filtered, nil)
+	if got, want := string(r.Properties()[prefixExtractorPropertyName]), fixedPrefix(2).Name(); got != want {
+		t.Errorf("prefix extractor property: got %q, want %q", got, want)
+	}
+}
+
+func TestBigEndianRestarts(t *testing.T) {
+	f, err := build(db.NoCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := readTestFile(t, f)
+	_, indexBH, err := readFooter(f, int64(len(b)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rewrite the index block's restart points and restart count as if by a
+	// big-endian writer, with a valid checksum.
+	index := b[indexBH.offset : indexBH.offset+indexBH.length]
+	for j := len(index) - 4; j >= 0; j -= 4 {
+		binary.BigEndian.PutUint32(index[j:], binary.LittleEndian.Uint32(index[j:]))
+		if j < len(index)-4 && binary.BigEndian.Uint32(index[j:]) == 0 {
+			// That was the first restart point.
+			break
+		}
+	}
+	trailer := b[indexBH.offset+indexBH.length:]
+	binary.LittleEndian.PutUint32(trailer[1:], crc.New(b[indexBH.offset:indexBH.offset+indexBH.length+1]).Value())
+
+	for _, lazy := range []bool{false, true} {
+		var r *Reader
+		if lazy {
+			r = NewLazyReader(writeTestFile(t, b), nil)
+		} else {
+			r = NewReader(writeTestFile(t, b), nil)
+		}
+		_, err := r.Get([]byte("the"), nil)
+		if e, ok := err.(CorruptionError); !ok || e.Offset != int64(indexBH.offset) {
+			t.Errorf("lazy=%t: got %v, want a CorruptionError at offset %d", lazy, err, indexBH.offset)
+		}
+	}
+}
+
+func TestMemFile(t *testing.T) {
+	f, err := build(db.DefaultCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := readTestFile(t, f)
+	mf := NewMemFile(b)
+	stat, err := mf.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != int64(len(b)) {
+		t.Fatalf("Stat: got size %d, want %d", stat.Size(), len(b))
+	}
+	if err := check(mf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mf.Write([]byte("x")); err == nil {
+		t.Fatal("Write: got nil error")
+	}
+	if got := mf.MmapAt(int64(len(b))-1, 2); got != nil {
+		t.Fatalf("MmapAt beyond the end: got %q, want nil", got)
+	}
+}
+
+func TestMemFileMetaValues(t *testing.T) {
+	mem := memfs.New()
+	f0, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, &db.Options{Compression: db.NoCompression})
+	if err := w.Set(makeTestInternalKey("a", internalKeyKindSet, 1), []byte("v"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.DeleteRange([]byte("b"), []byte("c"), 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetUserProperties(map[string][]byte{"x": []byte("y")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := readTestFile(t, f1)
+	f1.Close()
+
+	// The properties and range tombstones outlive the MemFile's contents,
+	// which are overwritten as if the file were unmapped.
+	r := NewReader(NewMemFile(b), nil)
+	props, tombs := r.Properties(), r.RangeTombstones()
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for j := range b {
+		b[j] = 0
+	}
+	if got := string(props["user.x"]); got != "y" {
+		t.Errorf("property user.x: got %q, want \"y\"", got)
+	}
+	if len(tombs) != 1 || string(tombs[0].Start) != "b" || string(tombs[0].End) != "c" {
+		t.Errorf("RangeTombstones: got %v, want one tombstone from \"b\" to \"c\"", tombs)
+	}
+}
+
+func TestFindLE(t *testing.T) {
+	f := writeTestTableWithIndex(t,
+		[][]string{{"b", "1", "d", "2"}, {"f", "3", "h", "4"}},
+		[]string{"d", "h"})
+	r := NewReader(f, nil)
+	testCases := []struct {
+		key  string
+		want string
+	}{
+		{"", ""},
+		{"a", ""},
+		{"b", "b,d,f,h"},
+		{"c", "b,d,f,h"},
+		{"d", "d,f,h"},
+		// The floor is the last key of the previous block.
+		{"e", "d,f,h"},
+		{"f", "f,h"},
+		{"g", "f,h"},
+		{"h", "h"},
+		{"z", "h"},
+	}
+	for _, tc := range testCases {
+		if got := scanFindLE(t, r, tc.key); got != tc.want {
+			t.Errorf("FindLE %q: got %q, want %q", tc.key, got, tc.want)
+		}
+	}
+
+	// For a partitioned index, the floor may be in the previous partition.
+	pr := NewReader(writeTestPartitionedTable(t, "\x02\x00\x00\x00"), nil)
+	defer pr.Close()
+	for _, tc := range []struct {
+		key  string
+		want string
+	}{
+		{"", ""},
+		{"a", "a,b,c,d,e,f,g,h"},
+		{"bb", "b,c,d,e,f,g,h"},
+		{"dd", "d,e,f,g,h"},
+		{"ee", "e,f,g,h"},
+		{"z", "h"},
+	} {
+		if got := scanFindLE(t, pr, tc.key); got != tc.want {
+			t.Errorf("partitioned: FindLE %q: got %q, want %q", tc.key, got, tc.want)
+		}
+	}
+
+	// Check every key, and the keys between them, of tables with several
+	// restart points per block, ordered by both the default Comparer and by
+	// one that orders non-empty keys in reverse.
+	for _, cmp := range []db.Comparer{db.DefaultComparer, reverseComparer{}} {
+		keys := make([]string, 0, len(wordCount))
+		for k := range wordCount {
+			keys = append(keys, k)
+		}
+		if cmp == db.DefaultComparer {
+			sort.Strings(keys)
+		} else {
+			sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+		}
+		o := &db.Options{
+			BlockRestartInterval: 3,
+			BlockSize:            256,
+			Comparer:             cmp,
+		}
+		mem := memfs.New()
+		f0, err := mem.Create("floor")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f0, o)
+		for _, k := range keys {
+			if err := w.Set([]byte(k), []byte(wordCount[k]), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f1, err := mem.Open("floor")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(f1, o)
+		queries := []string{"", "\x00", "\xff"}
+		for _, k := range keys {
+			queries = append(queries, k, k+"\x00", k[:len(k)-1])
+		}
+		for _, q := range queries {
+			// n is the number of keys that are <= q.
+			n := sort.Search(len(keys), func(j int) bool {
+				return cmp.Compare([]byte(keys[j]), []byte(q)) > 0
+			})
+			i := r.FindLE([]byte(q), nil)
+			if n == 0 {
+				if i.Key() != nil {
+					t.Errorf("%s: FindLE %q: got %q, want none", cmp.Name(), q, i.Key())
+				}
+			} else if string(i.Key()) != keys[n-1] || string(i.Value()) != wordCount[keys[n-1]] {
+				t.Errorf("%s: FindLE %q: got %q:%q, want %q", cmp.Name(), q, i.Key(), i.Value(), keys[n-1])
+			} else if n < len(keys) && (!i.Next() || string(i.Key()) != keys[n]) {
+				t.Errorf("%s: FindLE %q, then Next: got %q, want %q", cmp.Name(), q, i.Key(), keys[n])
+			}
+			if err := i.Close(); err != nil {
+				t.Fatalf("%s: FindLE %q: %v", cmp.Name(), q, err)
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// scanFindLE returns the keys from FindLE of the given key to the end of r,
+// joined by commas.
+func scanFindLE(t *testing.T, r *Reader, key string) string {
+	t.Helper()
+	i := r.FindLE([]byte(key), nil)
+	var got []string
+	if k := i.Key(); k != nil {
+		got = append(got, string(k))
+		for i.Next() {
+			got = append(got, string(i.Key()))
+		}
+	}
+	if err := i.Close(); err != nil {
+		t.Fatalf("FindLE %q: %v", key, err)
+	}
+	return strings.Join(got, ",")
+}
+
+func TestUserProperties(t *testing.T) {
+	mem := memfs.New()
+	f0, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, &db.Options{Comparer: foldCaseComparer{}})
+	if err := w.SetUserProperties(map[string][]byte{"job": []byte("j1"), "created": []byte("t0")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	// A later call replaces the value of the same name.
+	if err := w.SetUserProperties(map[string][]byte{"job": []byte("j2")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetUserProperties(map[string][]byte{"late": nil}); err == nil {
+		t.Fatal("SetUserProperties after Close: got nil error")
+	}
+
+	f1, err := mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f1, &db.Options{Comparer: foldCaseComparer{}})
+	got := r.Properties()
+	want := map[string]string{
+		comparerPropertyName:    foldCaseComparer{}.Name(),
+		maxKeyLenPropertyName:   "\x01",
+		maxValueLenPropertyName: "\x01",
+		"user.created":          "t0",
+		"user.job":              "j2",
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %d properties, want %d", len(got), len(want))
+	}
+	for k, v := range want {
+		if string(got[k]) != v {
+			t.Errorf("property %q: got %q, want %q", k, got[k], v)
+		}
+	}
+	if v, err := r.Get([]byte("a"), nil); err != nil || string(v) != "1" {
+		t.Errorf("Get: got (%q, %v), want (\"1\", nil)", v, err)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	f, err := build(db.DefaultCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := readTestFile(t, f)
+	nRead := 0
+	o := &db.Options{
+		OnBlockRead: func(db.BlockReadInfo) { nRead++ },
+	}
+	r := NewReader(writeTestFile(t, b), o)
+	var handles []BlockHandle
+	if err := r.ForEachBlock(func(_ []byte, h BlockHandle) error {
+		handles = append(handles, h)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	nRead = 0
+	if err := r.Scrub(); err != nil {
+		t.Fatalf("good table: %v", err)
+	}
+	// The data blocks are not decompressed.
+	if nRead != 0 {
+		t.Errorf("good table: got %d block reads reported, want 0", nRead)
+	}
+
+	h := handles[len(handles)/2]
+	b[h.Offset+h.Length/2] ^= 0xff
+	err = NewReader(writeTestFile(t, b), nil).Scrub()
+	if e, ok := err.(CorruptionError); !ok || e.Offset != int64(h.Offset) || !strings.Contains(e.Reason, "checksum mismatch") {
+		t.Fatalf("corrupt table: got %v, want a checksum mismatch at offset %d", err, h.Offset)
+	}
+}
+
+func TestIteratorProgress(t *testing.T) {
+	f, err := buildWithOptions(&db.Options{BlockSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, nil)
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := r.Find(nil, nil).(*Iterator)
+	var prevDone, total uint64
+	nChanges := 0
+	for i.Next() {
+		done, tot := i.Progress()
+		if tot == 0 || tot >= uint64(stat.Size()) {
+			t.Fatalf("got total %d, want in (0, %d)", tot, stat.Size())
+		}
+		if done < prevDone || done >= tot {
+			t.Fatalf("got done %d after %d, want non-decreasing and < %d", done, prevDone, tot)
+		}
+		if done != prevDone {
+			nChanges++
+		}
+		prevDone, total = done, tot
+	}
+	if nChanges < 5 {
+		t.Errorf("got %d changes of progress, want one per block", nChanges)
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if done, tot := i.Progress(); done != total || tot != total {
+		t.Errorf("exhausted: got (%d, %d), want (%d, %d)", done, tot, total, total)
+	}
+}
+
+func TestKeyValueLen(t *testing.T) {
+	for _, o := range []*db.Options{nil, {ValuePrefixCompression: true}} {
+		f, err := buildWithOptions(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i := NewReader(f, o).Find(nil, nil).(*Iterator)
+		if i.KeyLen() != 0 || i.ValueLen() != 0 {
+			t.Errorf("before Next: got lengths (%d, %d), want (0, 0)", i.KeyLen(), i.ValueLen())
+		}
+		n := 0
+		for ; i.Next(); n++ {
+			if i.KeyLen() != len(i.Key()) || i.ValueLen() != len(i.Value()) {
+				t.Fatalf("key %q: got lengths (%d, %d), want (%d, %d)",
+					i.Key(), i.KeyLen(), i.ValueLen(), len(i.Key()), len(i.Value()))
+			}
+		}
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n != len(wordCount) {
+			t.Errorf("got %d keys, want %d", n, len(wordCount))
+		}
+		if i.KeyLen() != 0 || i.ValueLen() != 0 {
+			t.Errorf("after Close: got lengths (%d, %d), want (0, 0)", i.KeyLen(), i.ValueLen())
+		}
+	}
+}
+
+// rangeReader is an io.ReaderAt with no Stat method, like a client that
+// reads ranges of a remote object. It counts the calls to Close.
+type rangeReader struct {
+	b      []byte
+	closed int
+}
+
+func (r *rangeReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(r.b)) {
+		return 0, errors.New("rangeReader: offset out of range")
+	}
+	n := copy(p, r.b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *rangeReader) Close() error {
+	r.closed++
+	return nil
+}
+
+func TestNewReaderWithSize(t *testing.T) {
+	f, err := build(db.DefaultCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := readTestFile(t, f)
+	// The table is followed by bytes that are not part of it, which the size
+	// excludes.
+	ra := &rangeReader{b: append(append([]byte(nil), b...), "trailing garbage"...)}
+	r := NewReaderWithSize(ra, int64(len(b)), nil)
+	for k, v := range wordCount {
+		if v1, err := r.Get([]byte(k), nil); err != nil || string(v1) != v {
+			t.Fatalf("Get %q: got (%q, %v), want (%q, nil)", k, v1, err, v)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if ra.closed != 1 {
+		t.Errorf("got %d calls to Close, want 1", ra.closed)
+	}
+
+	// The wrong size does not find the footer.
+	if _, err := NewReaderWithSize(ra, int64(len(b))-1, nil).Get([]byte("the"), nil); err == nil {
+		t.Error("wrong size: got nil error")
+	}
+}
+
+func TestRangeTombstones(t *testing.T) {
+	mem := memfs.New()
+	f0, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, nil)
+	for j := 0; j < 10; j++ {
+		if err := w.Set(makeTestInternalKey(fmt.Sprintf("k%02d", j), internalKeyKindSet, 5), []byte("v"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The second tombstone is older than the keys that it covers.
+	for _, td := range []RangeTombstone{
+		{[]byte("k08"), []byte("k09"), 20},
+		{[]byte("k02"), []byte("k05"), 10},
+		{[]byte("k07"), []byte("k08"), 3},
+	} {
+		if err := w.DeleteRange(td.Start, td.End, td.SeqNum); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f1, nil)
+
+	var starts []string
+	for _, td := range r.RangeTombstones() {
+		starts = append(starts, fmt.Sprintf("%s-%s@%d", td.Start, td.End, td.SeqNum))
+	}
+	if got, want := strings.Join(starts, ","), "k02-k05@10,k07-k08@3,k08-k09@20"; got != want {
+		t.Errorf("RangeTombstones: got %q, want %q", got, want)
+	}
+
+	testCases := []struct {
+		snapshot uint64
+		want     string
+	}{
+		{0, "k00,k01,k05,k06,k07,k09"},
+		{15, "k00,k01,k05,k06,k07,k08,k09"},
+		{5, "k00,k01,k02,k03,k04,k05,k06,k07,k08,k09"},
+	}
+	for _, tc := range testCases {
+		i := r.FindLive(nil, nil, &RangeDelOptions{Snapshot: tc.snapshot})
+		var got []string
+		for i.Next() {
+			got = append(got, string(i.Key()[:len(i.Key())-8]))
+		}
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if g := strings.Join(got, ","); g != tc.want {
+			t.Errorf("snapshot=%d: got %q, want %q", tc.snapshot, g, tc.want)
+		}
+	}
+
+	// A table without range tombstones iterates as per Find.
+	f, err := build(db.DefaultCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = NewReader(f, nil)
+	if n := len(r.RangeTombstones()); n != 0 {
+		t.Errorf("table without range tombstones: got %d tombstones", n)
+	}
+	if _, ok := r.FindLive(nil, nil, nil).(*Iterator); !ok {
+		t.Errorf("table without range tombstones: FindLive did not return a plain Iterator")
+	}
+}
+
+func TestDecodeBlock(t *testing.T) {
+	// Encode a block whose keys share prefixes, with a restart interval of 2.
+	w := &Writer{blockRestartInterval: 2}
+	kvs := []string{"apple", "1", "apricot", "2", "banana", "3", "band", "4", "bandana", "5"}
+	for j := 0; j < len(kvs); j += 2 {
+		w.append([]byte(kvs[j]), []byte(kvs[j+1]), w.nEntries%w.blockRestartInterval == 0)
+		w.prevKey = append(w.prevKey[:0], kvs[j]...)
+	}
+	b := w.buf
+	for _, x := range w.restarts {
+		b = append(b, byte(x), byte(x>>8), byte(x>>16), byte(x>>24))
+	}
+	b = append(b, byte(len(w.restarts)), 0, 0, 0)
+
+	i := DecodeBlock(b, nil)
+	var got []string
+	for i.Next() {
+		got = append(got, string(i.Key()), string(i.Value()))
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, ",") != strings.Join(kvs, ",") {
+		t.Fatalf("got %q, want %q", got, kvs)
+	}
+
+	s := DecodeBlock(b, nil).(interface {
+		db.Iterator
+		Seek(key []byte) bool
+	})
+	for _, tc := range []struct{ key, want string }{
+		{"band", "band"}, {"b", "banana"}, {"apz", "banana"}, {"a", "apple"}, {"z", ""},
+	} {
+		ok := s.Seek([]byte(tc.key))
+		if got := string(s.Key()); ok != (tc.want != "") || (ok && got != tc.want) {
+			t.Errorf("Seek %q: got (%t, %q), want %q", tc.key, ok, got, tc.want)
+		}
+	}
+
+	// Malformed blocks yield errors, not panics.
+	rng := rand.New(rand.NewSource(1))
+	for n := 0; n < 1000; n++ {
+		bad := append([]byte(nil), b...)
+		bad[rng.Intn(len(bad))] = byte(rng.Intn(256))
+		bad = bad[:rng.Intn(len(bad)+1)]
+		i := DecodeBlock(bad, nil)
+		for i.Next() {
+		}
+		i.Close()
+	}
+	if err := DecodeBlock([]byte{1, 2}, nil).Close(); err == nil {
+		t.Error("short block: got nil error")
+	}
+}
+
+// alignedReadFile is a db.File that records whether every ReadAt, other
+// than those at the end of the file, is of whole chunks.
+type alignedReadFile struct {
+	db.File
+	chunkSize, size int64
+	nReadAt         int
+	unaligned       []string
+}
+
+func (f *alignedReadFile) ReadAt(p []byte, off int64) (int, error) {
+	f.nReadAt++
+	if end := off + int64(len(p)); off%f.chunkSize != 0 || (end%f.chunkSize != 0 && end != f.size) {
+		f.unaligned = append(f.unaligned, fmt.Sprintf("[%d, %d)", off, end))
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func TestReadChunkSize(t *testing.T) {
+	f, err := buildWithOptions(&db.Options{BlockSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nReadAts := map[int]int{}
+	for _, chunkSize := range []int{0, 4096, 16384} {
+		af := &alignedReadFile{File: f, chunkSize: int64(chunkSize), size: stat.Size()}
+		if chunkSize == 0 {
+			af.chunkSize = 1
+		}
+		r := NewReader(af, &db.Options{ReadChunkSize: chunkSize})
+		// The footer is read exactly.
+		af.unaligned = nil
+		for k, v := range wordCount {
+			if v1, err := r.Get([]byte(k), nil); err != nil || string(v1) != v {
+				t.Fatalf("chunkSize=%d: Get %q: got (%q, %v), want (%q, nil)", chunkSize, k, v1, err, v)
+			}
+		}
+		if len(af.unaligned) != 0 {
+			t.Errorf("chunkSize=%d: got unaligned reads %v", chunkSize, af.unaligned)
+		}
+		i := r.Find(nil, nil)
+		nReadAt := af.nReadAt
+		for i.Next() {
+		}
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+		nReadAts[chunkSize] = af.nReadAt - nReadAt
+	}
+	if !(nReadAts[16384] < nReadAts[4096] && nReadAts[4096] < nReadAts[0]) {
+		t.Errorf("full scan ReadAt calls: got %v, want fewer for larger chunks", nReadAts)
+	}
+}
+
+func TestNoMetaindexFooter(t *testing.T) {
+	// The footer of every LevelDB format holds both a metaindex and an index
+	// block handle, but the earliest tables, with no meta blocks, may have a
+	// zero metaindex handle instead of a handle to an empty block.
+	f := writeTestTableWithIndex(t,
+		[][]string{{"a", "1", "b", "2"}, {"c", "3"}},
+		[]string{"b", "c"})
+	b := readTestFile(t, f)
+	if got := b[len(b)-footerLen : len(b)-footerLen+2]; got[0] != 0 || got[1] != 0 {
+		t.Fatalf("got metaindex handle bytes %x, want a zero handle", got)
+	}
+	r := NewReader(writeTestFile(t, b), nil)
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "2"}, {"c", "3"}} {
+		if v, err := r.Get([]byte(kv[0]), nil); err != nil || string(v) != kv[1] {
+			t.Errorf("Get %q: got (%q, %v), want (%q, nil)", kv[0], v, err, kv[1])
+		}
+	}
+	if err := r.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+	if n := len(r.Properties()); n != 0 {
+		t.Errorf("got %d properties, want 0", n)
+	}
+
+	// A footer with an unknown magic number is not guessed at.
+	copy(b[len(b)-len(magic):], "\x00\x01\x02\x03\x04\x05\x06\x07")
+	if _, err := NewReader(writeTestFile(t, b), nil).Get([]byte("a"), nil); err == nil || !strings.Contains(err.Error(), "bad magic number") {
+		t.Errorf("unknown magic: got %v, want a bad magic number error", err)
+	}
+}
+
+func TestGetMulti(t *testing.T) {
+	for _, fp := range []db.FilterPolicy{nil, bloom.FilterPolicy(10)} {
+		f, err := buildWithOptions(&db.Options{
+			BlockSize:    1024,
+			FilterPolicy: fp,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cf := NewCountingFile(f)
+		r := NewReader(cf, &db.Options{
+			FilterPolicy: fp,
+		})
+
+		// Look up every key, in order, along with duplicates and absent keys,
+		// followed by a few keys out of order.
+		var strs []string
+		for k := range wordCount {
+			strs = append(strs, k, k, k+"\x00")
+		}
+		strs = append(strs, "", "\xff")
+		sort.Strings(strs)
+		var keys [][]byte
+		for _, s := range strs {
+			keys = append(keys, []byte(s))
+		}
+		keys = append(keys, []byte(minWord), []byte("\xff"), nil)
+
+		nReadAt, _ := cf.Counts()
+		values, errs := r.GetMulti(keys, nil)
+		nGetMultiReads, _ := cf.Counts()
+		nGetMultiReads -= nReadAt
+		for j, key := range keys {
+			want, wantErr := r.Get(key, nil)
+			if !bytes.Equal(values[j], want) || errs[j] != wantErr {
+				t.Errorf("fp=%v: %q: got (%q, %v), want (%q, %v)", fp, key, values[j], errs[j], want, wantErr)
+			}
+		}
+		// Every data block is read once for the sorted keys, and the first
+		// block again for the out of order key.
+		stats, err := r.CompressionStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		numBlocks := 0
+		for _, n := range stats.NumBlocks {
+			numBlocks += n
+		}
+		if nGetMultiReads != int64(numBlocks+1) {
+			t.Errorf("fp=%v: got %d reads, want %d", fp, nGetMultiReads, numBlocks+1)
+		}
+
+		if values, errs := r.GetMulti(nil, nil); len(values) != 0 || len(errs) != 0 {
+			t.Errorf("fp=%v: no keys: got %d values and %d errors, want none", fp, len(values), len(errs))
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, errs := r.GetMulti(keys[:1], nil); errs[0] == nil {
+			t.Errorf("fp=%v: closed reader: got nil error", fp)
+		}
+	}
+}
+
+func TestVerifyDecompressed(t *testing.T) {
+	// A table written with VerifyDecompressed records a checksum for each
+	// of its data blocks.
+	f, err := buildWithOptions(&db.Options{
+		BlockSize:          1024,
+		VerifyDecompressed: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, &db.Options{VerifyDecompressed: true})
+	i, err := r.newIndexIter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numBlocks := 0
+	for ; i.Next(); numBlocks++ {
+		h, _ := decodeBlockHandle(i.Value())
+		b, err := r.readBlock(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := r.decompressedCRCs[h.offset], crc.New(b).Value(); got != want {
+			t.Errorf("block at offset %d: got checksum %#x, want %#x", h.offset, got, want)
+		}
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if numBlocks < 2 || len(r.decompressedCRCs) != numBlocks {
+		t.Errorf("got %d checksums for %d blocks", len(r.decompressedCRCs), numBlocks)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A compressed data block whose decompressed contents do not match the
+	// recorded checksum is corrupt, but only if the reader verifies them.
+	kvs := []string{"a", "1", "b", "2"}
+	raw := appendTestBlock(nil, kvs...)
+	decoded, err := snappy.Decode(nil, raw[:len(raw)-blockTrailerLen])
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum := crc.New(decoded).Value()
+	testCases := []struct {
+		checksum uint32
+		verify   bool
+		wantErr  bool
+	}{
+		{checksum, true, false},
+		{checksum, false, false},
+		{checksum + 1, true, true},
+		{checksum + 1, false, false},
+	}
+	for _, tc := range testCases {
+		prop := string(appendDecompressedCRC(nil, 0, tc.checksum))
+		r := NewReader(writeTestTableWithProperties(t, kvs, decompressedCRCsPropertyName, prop), &db.Options{
+			VerifyDecompressed: tc.verify,
+		})
+		_, getErr := r.Get([]byte("a"), nil)
+		iter := r.Find(nil, nil)
+		for iter.Next() {
+		}
+		iterErr := iter.Close()
+		for _, err := range []error{getErr, iterErr} {
+			if _, ok := err.(CorruptionError); ok != tc.wantErr {
+				t.Errorf("checksum %#x, verify %t: got error %v, want corruption %t", tc.checksum, tc.verify, err, tc.wantErr)
+			}
+		}
+		r.Close()
+	}
+
+	// A malformed checksum property is only an error if it is used.
+	for _, verify := range []bool{false, true} {
+		r := NewReader(writeTestTableWithProperties(t, kvs, decompressedCRCsPropertyName, "\x00\x01"), &db.Options{
+			VerifyDecompressed: verify,
+		})
+		if _, err := r.Get([]byte("a"), nil); (err != nil) != verify {
+			t.Errorf("malformed property, verify %t: got error %v", verify, err)
+		}
+		r.Close()
+	}
+}
+
+func TestFindInto(t *testing.T) {
+	var keys []string
+	for k := range wordCount {
+		keys = append(keys, k, k+"\x00")
+	}
+	sort.Strings(keys)
+	keys = append(keys, "", "\xff")
+	rng := rand.New(rand.NewSource(1))
+	for j := range keys {
+		k := rng.Intn(j + 1)
+		keys[j], keys[k] = keys[k], keys[j]
+	}
+
+	f, err := buildWithOptions(&db.Options{
+		BlockSize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r0, r1 := NewReader(f, nil), NewReader(writeTestSmallTable(t, nil), nil)
+	defer r0.Close()
+	defer r1.Close()
+
+	// next returns the first two keys of an iterator, and its error.
+	next := func(i db.Iterator) string {
+		var s []string
+		for n := 0; n < 2 && i.Next(); n++ {
+			s = append(s, string(i.Key())+"="+string(i.Value()))
+		}
+		return fmt.Sprintf("%q %v", s, i.Close())
+	}
+	var it Iterator
+	for j, key := range keys {
+		// Alternate between the two tables from time to time.
+		r := r0
+		if j%7 == 3 {
+			r = r1
+		}
+		r.FindInto(&it, []byte(key), nil)
+		if got, want := next(&it), next(r.Find([]byte(key), nil)); got != want {
+			t.Errorf("%q: got %s, want %s", key, got, want)
+		}
+	}
+
+	// An iterator's error is discarded when it is reused.
+	it = Iterator{err: errors.New("stale")}
+	r0.FindInto(&it, nil, nil)
+	if !it.Next() || it.Close() != nil {
+		t.Errorf("stale error: got %v", it.Close())
+	}
+
+	// An error seeking the index does not discard the index iterator.
+	sf := &swappableFile{writeTestPartitionedTable(t, "\x02\x00\x00\x00")}
+	r2 := NewReader(sf, nil)
+	defer r2.Close()
+	good := sf.File
+	sf.File = NewMemFile(nil)
+	r2.FindInto(&it, []byte("a"), nil)
+	if it.Next() || it.Close() == nil {
+		t.Fatal("unreadable partition: got nil error, want non-nil")
+	}
+	index := it.index
+	sf.File = good
+	r2.FindInto(&it, []byte("a"), nil)
+	if !it.Next() || string(it.Key()) != "a" || it.Close() != nil {
+		t.Errorf("after an error: got %q, %v, want \"a\", nil", it.Key(), it.Close())
+	}
+	if it.index != index {
+		t.Error("after an error: the index iterator was reallocated")
+	}
+}
+
+func BenchmarkFindInto(b *testing.B) {
+	f, err := buildWithOptions(&db.Options{
+		BlockSize: 1024,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	r := NewReader(f, nil)
+	defer r.Close()
+	var keys [][]byte
+	for k := range wordCount {
+		keys = append(keys, []byte(k))
+	}
+	b.Run("Find", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			i := r.Find(keys[n%len(keys)], nil)
+			i.Next()
+			i.Close()
+		}
+	})
+	b.Run("FindInto", func(b *testing.B) {
+		var i Iterator
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			r.FindInto(&i, keys[n%len(keys)], nil)
+			i.Next()
+			i.Close()
+		}
+	})
+}
+
+func TestBlockAt(t *testing.T) {
+	f, err := buildWithOptions(&db.Options{
+		BlockSize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, nil)
+	defer r.Close()
+
+	// BlockAt(n) returns the n'th block of the index.
+	n := 0
+	index := r.IndexIterator()
+	for ; index.Next(); n++ {
+		want, _ := DecodeBlockHandle(index.Value())
+		i, h, err := r.BlockAt(n)
+		if err != nil {
+			t.Fatalf("block %d: %v", n, err)
+		}
+		if h != want {
+			t.Errorf("block %d: got handle %+v, want %+v", n, h, want)
+		}
+		j, err := r.BlockIterator(index.Value())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i.Next() {
+			if !j.Next() || !bytes.Equal(i.Key(), j.Key()) || !bytes.Equal(i.Value(), j.Value()) {
+				t.Fatalf("block %d: mismatch at key %q", n, i.Key())
+			}
+		}
+		if j.Next() {
+			t.Errorf("block %d: missing key %q", n, j.Key())
+		}
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+		j.Close()
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n < 2 {
+		t.Fatalf("got %d blocks, want several", n)
+	}
+
+	for _, bad := range []int{-1, n, n + 1} {
+		if _, _, err := r.BlockAt(bad); err == nil || !strings.Contains(err.Error(), "block number") {
+			t.Errorf("BlockAt(%d): got %v, want an invalid block number error", bad, err)
+		}
+	}
+}
+
+func TestFindAt(t *testing.T) {
+	const (
+		del = internalKeyKindDelete
+		set = internalKeyKindSet
+	)
+	o := &db.Options{
+		Comparer:  testInternalKeyComparer{},
+		BlockSize: 32,
+	}
+	mem := memfs.New()
+	f0, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, o)
+	for _, e := range []struct {
+		ukey   string
+		kind   uint8
+		seqNum uint64
+	}{
+		{"a", set, 9}, {"a", set, 5}, {"a", set, 2},
+		{"b", del, 7}, {"b", set, 3},
+		{"c", set, 8},
+		{"d", set, 4}, {"d", del, 1},
+	} {
+		v := fmt.Sprintf("%s%d", e.ukey, e.seqNum)
+		if err := w.Set(makeTestInternalKey(e.ukey, e.kind, e.seqNum), []byte(v), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f1, o)
+	defer r.Close()
+
+	testCases := []struct {
+		ukey   string
+		seqNum uint64
+		want   string
+		get    string
+	}{
+		{"", 10, "a9 b7(del) c8 d4", "not found"},
+		{"a", 10, "a9 b7(del) c8 d4", "a9"},
+		{"a", 6, "a5 b3 d4", "a5"},
+		{"a", 2, "a2 d1(del)", "a2"},
+		{"a", 1, "d1(del)", "not found"},
+		{"b", 7, "b7(del) d4", "not found"},
+		{"b", 4, "b3 d4", "b3"},
+		{"bb", 10, "c8 d4", "not found"},
+		{"d", 3, "d1(del)", "not found"},
+		{"e", 10, "", "not found"},
+	}
+	for _, tc := range testCases {
+		var got []string
+		i := r.FindAt([]byte(tc.ukey), tc.seqNum, nil)
+		for i.Next() {
+			_, kind, _, _ := parseInternalKey(i.Key())
+			s := string(i.Value())
+			if kind == del {
+				s += "(del)"
+			}
+			got = append(got, s)
+		}
+		if err := i.Close(); err != nil {
+			t.Errorf("%q@%d: %v", tc.ukey, tc.seqNum, err)
+		}
+		if g := strings.Join(got, " "); g != tc.want {
+			t.Errorf("FindAt %q@%d: got %q, want %q", tc.ukey, tc.seqNum, g, tc.want)
+		}
+
+		v, err := r.GetAt([]byte(tc.ukey), tc.seqNum, nil)
+		g := string(v)
+		if err == db.ErrNotFound {
+			g = "not found"
+		} else if err != nil {
+			g = err.Error()
+		}
+		if g != tc.get {
+			t.Errorf("GetAt %q@%d: got %q, want %q", tc.ukey, tc.seqNum, g, tc.get)
+		}
+	}
+
+	// A table with plain keys cannot be read at a snapshot.
+	plain := NewReader(writeTestSmallTable(t, nil), nil)
+	defer plain.Close()
+	i := plain.FindAt(nil, 10, nil)
+	if i.Next() {
+		t.Errorf("plain keys: got key %q, want none", i.Key())
+	}
+	if err := i.Close(); err == nil || !strings.Contains(err.Error(), "not an internal key") {
+		t.Errorf("plain keys: got %v, want an error", err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	f, err := buildWithOptions(&db.Options{
+		BlockSize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, nil)
+	defer r.Close()
+
+	// A full scan visits every key in order.
+	var prev string
+	n := 0
+	err = r.Scan(nil, func(key, value []byte) (bool, error) {
+		if k := string(key); k <= prev && n > 0 {
+			t.Fatalf("keys out of order: %q, %q", prev, k)
+		} else if string(value) != wordCount[k] {
+			t.Fatalf("key %q: got value %q, want %q", k, value, wordCount[k])
+		}
+		prev = string(key)
+		n++
+		return false, nil
+	})
+	if err != nil || n != len(wordCount) {
+		t.Fatalf("full scan: got %d keys and error %v, want %d keys", n, err, len(wordCount))
+	}
+
+	// Stopping, or returning an error, ends the scan early.
+	n = 0
+	if err := r.Scan([]byte("the"), func(key, value []byte) (bool, error) {
+		n++
+		return n == 3, nil
+	}); err != nil || n != 3 {
+		t.Errorf("stop: got %d keys and error %v, want 3 keys", n, err)
+	}
+	errStop := errors.New("stop")
+	n = 0
+	if err := r.Scan(nil, func(key, value []byte) (bool, error) {
+		n++
+		return false, errStop
+	}); err != errStop || n != 1 {
+		t.Errorf("error: got %d keys and error %v, want 1 key and %v", n, err, errStop)
+	}
+
+	// A panic in fn propagates to the caller of Scan.
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("panic: got no panic")
+			}
+		}()
+		r.Scan(nil, func(key, value []byte) (bool, error) {
+			panic("scan")
+		})
+	}()
+
+	// An error reading the table is returned.
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Scan(nil, func(key, value []byte) (bool, error) { return false, nil }); err == nil {
+		t.Error("closed reader: got nil error")
+	}
+}
+
+// longSeparatorComparer is the default Comparer, except that its separators
+// are never shortened.
+type longSeparatorComparer struct{}
+
+func (longSeparatorComparer) Compare(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+func (longSeparatorComparer) Name() string {
+	return "leveldb.BytewiseComparator"
+}
+
+func (longSeparatorComparer) AppendSeparator(dst, a, b []byte) []byte {
+	return append(dst, a...)
+}
+
+func TestIndexSeparators(t *testing.T) {
+	// The Writer's index separators come from the Comparer's AppendSeparator,
+	// which the default Comparer shortens, both between blocks and after the
+	// last block.
+	indexLen := map[bool]int{}
+	for _, long := range []bool{false, true} {
+		o := &db.Options{BlockSize: 256}
+		if long {
+			o.Comparer = longSeparatorComparer{}
+		}
+		f, err := buildWithOptions(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(f, o)
+		var lastKeys []string
+		index := r.IndexIterator()
+		for index.Next() {
+			sep := append([]byte(nil), index.Key()...)
+			i, err := r.BlockIterator(index.Value())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var last []byte
+			for i.Next() {
+				last = append(last[:0], i.Key()...)
+			}
+			if err := i.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Compare(last, sep) > 0 {
+				t.Errorf("long=%t: separator %q is before the block's last key %q", long, sep, last)
+			}
+			if long && !bytes.Equal(sep, last) {
+				t.Errorf("long=%t: got separator %q, want the block's last key %q", long, sep, last)
+			}
+			lastKeys = append(lastKeys, string(last))
+			indexLen[long] += len(sep)
+		}
+		if err := index.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if len(lastKeys) < 2 {
+			t.Fatalf("long=%t: got %d blocks, want several", long, len(lastKeys))
+		}
+		for k := range wordCount {
+			if v, err := r.Get([]byte(k), nil); err != nil || string(v) != wordCount[k] {
+				t.Fatalf("long=%t: Get %q: got (%q, %v)", long, k, v, err)
+			}
+		}
+		r.Close()
+	}
+	if indexLen[false] >= indexLen[true] {
+		t.Errorf("got %d bytes of shortened separators, want fewer than the %d bytes of keys", indexLen[false], indexLen[true])
+	}
+}
+
+func TestTimeReads(t *testing.T) {
+	f, err := buildWithOptions(&db.Options{
+		BlockSize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, timeReads := range []bool{false, true} {
+		cf := NewCountingFile(f)
+		r := NewReader(cf, &db.Options{
+			TimeReads: timeReads,
+		})
+		c := r.Clone()
+		for _, r := range []*Reader{r, c} {
+			i := r.Find(nil, nil)
+			for i.Next() {
+			}
+			if err := i.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// The stats are shared with the clone, and count every read.
+		s := r.Stats()
+		if c.Stats() != s {
+			t.Errorf("timeReads=%t: clone's stats %+v differ from %+v", timeReads, c.Stats(), s)
+		}
+		reads, _ := cf.Counts()
+		if !timeReads {
+			if s != (TimingStats{}) {
+				t.Errorf("timeReads=%t: got %+v, want zero stats", timeReads, s)
+			}
+		} else if s.Reads != reads {
+			t.Errorf("timeReads=%t: got %+v, want %d timed reads", timeReads, s, reads)
+		}
+		c.Close()
+		r.Close()
+	}
+
+	// Decompressing a compressed block is timed.
+	r := NewReader(writeTestTableWithProperties(t, []string{"a", "1"}), &db.Options{
+		TimeReads: true,
+	})
+	defer r.Close()
+	n := r.Stats().Decompressions
+	if _, err := r.Get([]byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := r.Stats(); s.Decompressions != n+1 {
+		t.Errorf("got %+v, want %d decompressions", s, n+1)
+	}
+}
+
+func TestIndexCompression(t *testing.T) {
+	// appendBlock appends a block of the given key/value pairs to b, either
+	// compressed or not, and returns its handle.
+	appendBlock := func(b []byte, compressed bool, kvs ...string) ([]byte, blockHandle) {
+		bh := blockHandle{offset: uint64(len(b))}
+		raw := appendTestBlock(nil, kvs...)
+		if compressed {
+			b = append(b, raw...)
+		} else {
+			decoded, err := snappy.Decode(nil, raw[:len(raw)-blockTrailerLen])
+			if err != nil {
+				t.Fatal(err)
+			}
+			b = appendTestRawBlock(b, decoded, noCompressionBlockType)
+		}
+		bh.length = uint64(len(b)) - bh.offset - blockTrailerLen
+		return b, bh
+	}
+	handle := func(bh blockHandle) string {
+		return string(EncodeBlockHandle(nil, BlockHandle{bh.offset, bh.length}))
+	}
+	for _, indexCompressed := range []bool{false, true} {
+		b, d0 := appendBlock(nil, !indexCompressed, "a", "1", "b", "2")
+		b, d1 := appendBlock(b, !indexCompressed, "c", "3")
+		b, indexBH := appendBlock(b, indexCompressed, "b", handle(d0), "c", handle(d1))
+		b = appendTestFooter(b, blockHandle{}, indexBH)
+		if got := b[indexBH.offset+indexBH.length] == snappyCompressionBlockType; got != indexCompressed {
+			t.Fatalf("indexCompressed=%t: got index block type %d", indexCompressed, b[indexBH.offset+indexBH.length])
+		}
+
+		for _, lazy := range []bool{false, true} {
+			f := writeTestFile(t, b)
+			r := NewReader(f, nil)
+			if lazy {
+				r = NewLazyReader(f, nil)
+			}
+			for _, kv := range [][2]string{{"a", "1"}, {"b", "2"}, {"c", "3"}} {
+				if v, err := r.Get([]byte(kv[0]), nil); err != nil || string(v) != kv[1] {
+					t.Errorf("indexCompressed=%t, lazy=%t: Get %q: got (%q, %v), want (%q, nil)",
+						indexCompressed, lazy, kv[0], v, err, kv[1])
+				}
+			}
+			if err := r.Validate(); err != nil {
+				t.Errorf("indexCompressed=%t, lazy=%t: Validate: %v", indexCompressed, lazy, err)
+			}
+			r.Close()
+		}
+	}
+}
+
+func TestCheckKey(t *testing.T) {
+	f, err := buildWithOptions(&db.Options{
+		BlockSize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flag the keys that contain an "x".
+	var keys, want []string
+	for k := range wordCount {
+		keys = append(keys, k)
+		if strings.Contains(k, "x") {
+			want = append(want, k)
+		}
+	}
+	sort.Strings(keys)
+	sort.Strings(want)
+	if len(want) < 2 {
+		t.Fatalf("got %d keys with an x, want several", len(want))
+	}
+	errX := errors.New("has an x")
+	checkKey := func(key []byte) error {
+		if bytes.IndexByte(key, 'x') >= 0 {
+			return errX
+		}
+		return nil
+	}
+
+	// By default, iteration stops at the first bad key.
+	r := NewReader(f, &db.Options{CheckKey: checkKey})
+	n := 0
+	i := r.Find(nil, nil)
+	for i.Next() {
+		n++
+	}
+	err = i.Close()
+	e, ok := err.(KeyCheckError)
+	if !ok || string(e.Key) != want[0] || e.Err != errX {
+		t.Fatalf("stop: got error %v, want a KeyCheckError for %q", err, want[0])
+	}
+	if wantN := sort.SearchStrings(keys, want[0]); n != wantN {
+		t.Errorf("stop: got %d keys before the bad key, want %d", n, wantN)
+	}
+	if got := r.KeyCheckErrors(); got != nil {
+		t.Errorf("stop: got %d recorded errors, want none", len(got))
+	}
+	// The offset is that of the bad key's data block.
+	index := r.IndexIterator()
+	found := false
+	for index.Next() && !found {
+		if h, _ := DecodeBlockHandle(index.Value()); h.Offset != e.Offset {
+			continue
+		}
+		bi, err := r.BlockIterator(index.Value())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for bi.Next() && !found {
+			found = string(bi.Key()) == want[0]
+		}
+		bi.Close()
+	}
+	index.Close()
+	if !found {
+		t.Errorf("stop: offset %d is not that of the bad key's block", e.Offset)
+	}
+	r.Close()
+
+	// With CheckKeyContinue, every bad key is recorded, once, even though the
+	// clone visits it again.
+	r = NewReader(f, &db.Options{CheckKey: checkKey, CheckKeyContinue: true})
+	c := r.Clone()
+	for _, r := range []*Reader{r, c} {
+		n := 0
+		i := r.Find(nil, nil)
+		for i.Next() {
+			n++
+		}
+		if err := i.Close(); err != nil || n != len(wordCount) {
+			t.Errorf("continue: got %d keys and error %v, want %d keys", n, err, len(wordCount))
+		}
+	}
+	var got []string
+	for _, e := range r.KeyCheckErrors() {
+		got = append(got, string(e.Key))
+	}
+	if g, w := strings.Join(got, ","), strings.Join(want, ","); g != w {
+		t.Errorf("continue: got bad keys %s, want %s", g, w)
+	}
+	// KeyCheckErrors clears the recorded failures, so that a bad key visited
+	// after it is recorded again.
+	if got := c.KeyCheckErrors(); got != nil {
+		t.Errorf("continue: got %d recorded errors after they were cleared, want none", len(got))
+	}
+	i = c.Find(nil, nil)
+	for i.Next() {
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(r.KeyCheckErrors()); got != len(want) {
+		t.Errorf("continue: got %d recorded errors after a rescan, want %d", got, len(want))
+	}
+	c.Close()
+	r.Close()
+}
+
+func TestCheckKeyPointLookups(t *testing.T) {
+	var keys [][]byte
+	for k := range wordCount {
+		keys = append(keys, []byte(k))
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	errX := errors.New("has an x")
+	checkKey := func(key []byte) error {
+		if bytes.IndexByte(key, 'x') >= 0 {
+			return errX
+		}
+		return nil
+	}
+	numX := 0
+	for _, k := range keys {
+		if bytes.IndexByte(k, 'x') >= 0 {
+			numX++
+		}
+	}
+
+	// The keys are checked by every point lookup, whether the table has one
+	// data block, which skips the index, or many.
+	for _, blockSize := range []int{1024, 1 << 20} {
+		f, err := buildWithOptions(&db.Options{
+			BlockSize: blockSize,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(f, &db.Options{CheckKey: checkKey})
+		if single := r.singleBlock != nil; single != (blockSize == 1<<20) {
+			t.Fatalf("blockSize=%d: got single block %t", blockSize, single)
+		}
+		multiValues, multiErrs := r.MultiGet(keys, nil)
+		getMultiValues, getMultiErrs := r.GetMulti(keys, nil)
+		for j, k := range keys {
+			wantV, bad := wordCount[string(k)], bytes.IndexByte(k, 'x') >= 0
+			check := func(method, v string, err error) {
+				t.Helper()
+				if !bad {
+					if err != nil || v != wantV {
+						t.Errorf("blockSize=%d: %s %q: got (%q, %v), want (%q, nil)", blockSize, method, k, v, err, wantV)
+					}
+					return
+				}
+				if e, ok := err.(KeyCheckError); !ok || !bytes.Equal(e.Key, k) || e.Err != errX {
+					t.Errorf("blockSize=%d: %s %q: got error %v, want a KeyCheckError", blockSize, method, k, err)
+				}
+			}
+			v, err := r.Get(k, nil)
+			check("Get", string(v), err)
+			has, err := r.Has(k, nil)
+			if err == nil && !has {
+				err = db.ErrNotFound
+			}
+			check("Has", wantV, err)
+			check("MultiGet", string(multiValues[j]), multiErrs[j])
+			check("GetMulti", string(getMultiValues[j]), getMultiErrs[j])
+		}
+		r.Close()
+
+		// With CheckKeyContinue, every lookup succeeds, and each bad key is
+		// recorded once, however many times it is looked up.
+		r = NewReader(f, &db.Options{CheckKey: checkKey, CheckKeyContinue: true})
+		for _, k := range keys {
+			if v, err := r.Get(k, nil); err != nil || string(v) != wordCount[string(k)] {
+				t.Errorf("blockSize=%d: continue: Get %q: got (%q, %v)", blockSize, k, v, err)
+			}
+			if has, err := r.Has(k, nil); err != nil || !has {
+				t.Errorf("blockSize=%d: continue: Has %q: got (%t, %v)", blockSize, k, has, err)
+			}
+		}
+		for _, method := range []func([][]byte, *db.ReadOptions) ([][]byte, []error){r.MultiGet, r.GetMulti} {
+			values, errs := method(keys, nil)
+			for j, k := range keys {
+				if errs[j] != nil || string(values[j]) != wordCount[string(k)] {
+					t.Errorf("blockSize=%d: continue: %q: got (%q, %v)", blockSize, k, values[j], errs[j])
+				}
+			}
+		}
+		if got, want := len(r.KeyCheckErrors()), numX; got != want {
+			t.Errorf("blockSize=%d: continue: got %d recorded errors, want %d", blockSize, got, want)
+		}
+		r.Close()
+	}
+}
+
+func TestSizeAndDataSize(t *testing.T) {
+	for _, fp := range []db.FilterPolicy{nil, bloom.FilterPolicy(10)} {
+		f, err := buildWithOptions(&db.Options{
+			BlockSize:    1024,
+			FilterPolicy: fp,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := readTestFile(t, f)
+		metaindexBH, indexBH, err := readFooter(f, int64(len(b)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantDataSize := indexBH.offset
+		if metaindexBH.length != 0 {
+			wantDataSize = metaindexBH.offset
+		}
+
+		cf := NewCountingFile(f)
+		r := NewReader(cf, &db.Options{FilterPolicy: fp})
+		reads, _ := cf.Counts()
+		if got := r.Size(); got != int64(len(b)) {
+			t.Errorf("fp=%v: Size: got %d, want %d", fp, got, len(b))
+		}
+		if got := r.DataSize(); got != wantDataSize {
+			t.Errorf("fp=%v: DataSize: got %d, want %d", fp, got, wantDataSize)
+		}
+		if n, _ := cf.Counts(); n != reads {
+			t.Errorf("fp=%v: got %d reads, want none", fp, n-reads)
+		}
+		r.Close()
+	}
+
+	r := NewReader(writeTestFile(t, []byte("short")), nil)
+	if r.Size() != 0 || r.DataSize() != 0 {
+		t.Errorf("invalid table: got Size %d and DataSize %d, want zero", r.Size(), r.DataSize())
+	}
+}
+
+// shortReadFile is a db.File whose ReadAt returns at most max bytes per call,
+// with a nil error, and no bytes at or beyond end.
+type shortReadFile struct {
+	db.File
+	max int
+	end int64
+}
+
+func (f *shortReadFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.end {
+		return 0, nil
+	}
+	if int64(len(p)) > f.end-off {
+		p = p[:f.end-off]
+	}
+	if len(p) > f.max {
+		p = p[:f.max]
+	}
+	n, err := f.File.ReadAt(p, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func TestShortReads(t *testing.T) {
+	f, err := buildWithOptions(&db.Options{
+		BlockSize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Short reads are continued until the whole block is read.
+	r := NewReader(&shortReadFile{File: f, max: 7, end: stat.Size()}, &db.Options{
+		VerifyChecksums: true,
+	})
+	for k, v := range wordCount {
+		if got, err := r.Get([]byte(k), nil); err != nil || string(got) != v {
+			t.Fatalf("Get %q: got (%q, %v), want (%q, nil)", k, got, err, v)
+		}
+	}
+	if err := r.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+	r.Close()
+
+	// A file that stops giving bytes before the end of a block is corrupt.
+	r = NewReader(&shortReadFile{File: f, max: 7, end: 100}, nil)
+	_, err = r.Get([]byte("the"), nil)
+	if _, ok := err.(CorruptionError); !ok || !strings.Contains(err.Error(), "short read") {
+		t.Errorf("truncated reads: got %v, want a short read CorruptionError", err)
+	}
+	r.Close()
+}
+
+// sliceIter is a db.Iterator over a slice of key/value pairs, recording
+// whether it was closed and returning err from Close.
+type sliceIter struct {
+	kvs    [][2][]byte
+	pos    int
+	err    error
+	closed bool
+}
+
+func (i *sliceIter) Next() bool {
+	if i.pos >= len(i.kvs) {
+		return false
+	}
+	i.pos++
+	return true
+}
+
+func (i *sliceIter) Key() []byte   { return i.kvs[i.pos-1][0] }
+func (i *sliceIter) Value() []byte { return i.kvs[i.pos-1][1] }
+
+func (i *sliceIter) Close() error {
+	i.closed = true
+	return i.err
+}
+
+func TestNewDBIterator(t *testing.T) {
+	const (
+		del = internalKeyKindDelete
+		set = internalKeyKindSet
+	)
+	// Each level's entries are a user key, kind and sequence number.
+	type entry struct {
+		ukey   string
+		kind   uint8
+		seqNum uint64
+	}
+	levels := [][]entry{
+		{{"a", set, 9}, {"c", del, 8}, {"e", set, 7}},
+		{{"a", set, 5}, {"b", set, 6}, {"c", set, 4}, {"d", del, 3}},
+		{{"a", set, 1}, {"c", set, 2}, {"d", set, 1}, {"e", del, 2}},
+	}
+	// newIters returns an iterator over each level. Each entry's value is its
+	// user key and sequence number.
+	newIters := func() []*sliceIter {
+		var iters []*sliceIter
+		for _, l := range levels {
+			i := &sliceIter{}
+			for _, e := range l {
+				i.kvs = append(i.kvs, [2][]byte{
+					makeTestInternalKey(e.ukey, e.kind, e.seqNum),
+					[]byte(fmt.Sprintf("%s%d", e.ukey, e.seqNum)),
+				})
+			}
+			iters = append(iters, i)
+		}
+		return iters
+	}
+
+	testCases := []struct {
+		seqNum uint64
+		want   string
+	}{
+		{10, "a9 b6 e7"},
+		{8, "a5 b6 e7"},
+		{6, "a5 b6 c4"},
+		{3, "a1 c2"},
+		{2, "a1 c2 d1"},
+		{0, ""},
+	}
+	for _, tc := range testCases {
+		iters := newIters()
+		var dbIters []db.Iterator
+		for _, i := range iters {
+			dbIters = append(dbIters, i)
+		}
+		i := NewDBIterator(testInternalKeyComparer{}, tc.seqNum, dbIters...)
+		var got []string
+		for i.Next() {
+			got = append(got, string(i.Value()))
+		}
+		if err := i.Close(); err != nil {
+			t.Errorf("seqNum=%d: %v", tc.seqNum, err)
+		}
+		if g := strings.Join(got, " "); g != tc.want {
+			t.Errorf("seqNum=%d: got %q, want %q", tc.seqNum, g, tc.want)
+		}
+		for j, it := range iters {
+			if !it.closed {
+				t.Errorf("seqNum=%d: iterator %d was not closed", tc.seqNum, j)
+			}
+		}
+	}
+
+	// An error from any input is returned, and every input is still closed.
+	iters := newIters()
+	errLevel := errors.New("level 1")
+	iters[1].err = errLevel
+	i := NewDBIterator(testInternalKeyComparer{}, 10, iters[0], iters[1], iters[2])
+	for i.Next() {
+	}
+	if err := i.Close(); err != errLevel {
+		t.Errorf("error: got %v, want %v", err, errLevel)
+	}
+	for j, it := range iters {
+		if !it.closed {
+			t.Errorf("error: iterator %d was not closed", j)
+		}
+	}
+}
+
+// countingAllocator is a db.Allocator that tracks the slices that it has
+// allocated and that have not yet been freed.
+type countingAllocator struct {
+	mu            sync.Mutex
+	allocs, frees int
+	live          map[*byte]bool
+	badFree       bool
+}
+
+func (a *countingAllocator) Alloc(n int) []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// Allocate one extra byte, so that even an empty slice can be tracked.
+	b := make([]byte, n, n+1)
+	a.allocs++
+	a.live[&b[:1][0]] = true
+	return b
+}
+
+func (a *countingAllocator) Free(b []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.frees++
+	p := &b[:1][0]
+	if !a.live[p] {
+		a.badFree = true
+	}
+	delete(a.live, p)
+}
+
+func (a *countingAllocator) numLive() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.live)
+}
+
+func TestAllocator(t *testing.T) {
+	// Build a table of two snappy-compressed data blocks and an uncompressed
+	// index block.
+	b := appendTestBlock(nil, "a", "1", "b", "2")
+	d0 := blockHandle{0, uint64(len(b)) - blockTrailerLen}
+	b = appendTestBlock(b, "c", "3")
+	d1 := blockHandle{d0.length + blockTrailerLen, uint64(len(b)) - d0.length - 2*blockTrailerLen}
+	handle := func(bh blockHandle) string {
+		return string(EncodeBlockHandle(nil, BlockHandle{bh.offset, bh.length}))
+	}
+	index := appendTestBlock(nil, "b", handle(d0), "c", handle(d1))
+	decoded, err := snappy.Decode(nil, index[:len(index)-blockTrailerLen])
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexBH := blockHandle{uint64(len(b)), uint64(len(decoded))}
+	b = appendTestRawBlock(b, decoded, noCompressionBlockType)
+	b = appendTestFooter(b, blockHandle{}, indexBH)
+
+	a := &countingAllocator{live: map[*byte]bool{}}
+	r := NewReader(writeTestFile(t, b), &db.Options{Allocator: a})
+	defer r.Close()
+	if a.allocs == 0 {
+		t.Fatal("the index block was not read with the Allocator")
+	}
+
+	// Get reads a block and decompresses it, and only the decompressed block,
+	// which holds the returned value, is still referenced.
+	allocs, frees := a.allocs, a.frees
+	if v, err := r.Get([]byte("c"), nil); err != nil || string(v) != "3" {
+		t.Fatalf("Get: got (%q, %v), want (\"3\", nil)", v, err)
+	}
+	if a.allocs-allocs != 2 || a.frees-frees != 1 {
+		t.Errorf("Get: got %d allocations and %d frees, want 2 and 1", a.allocs-allocs, a.frees-frees)
+	}
+
+	// An iterator owns the memory of its blocks, and frees each block as it
+	// moves on to the next one. The last block is kept after Close, as its
+	// last value may still be used.
+	live := a.numLive()
+	allocs = a.allocs
+	var got []string
+	i := r.Find(nil, nil)
+	for i.Next() {
+		got = append(got, string(i.Key())+":"+string(i.Value()))
+	}
+	if err := i.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if s := strings.Join(got, ","); s != "a:1,b:2,c:3" {
+		t.Errorf("Find: got %q, want \"a:1,b:2,c:3\"", s)
+	}
+	if a.allocs-allocs != 4 {
+		t.Errorf("Find: got %d allocations, want 4", a.allocs-allocs)
+	}
+	if n := a.numLive(); n != live+1 {
+		t.Errorf("Find: got %d live allocations after Close, want %d", n, live+1)
+	}
+
+	// Validate and TrimTo free every block that they read.
+	live = a.numLive()
+	if err := r.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if n := a.numLive(); n != live {
+		t.Errorf("Validate: got %d live allocations, want %d", n, live)
+	}
+	f, err := memfs.New().Create("trimmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, nil)
+	if err := TrimTo(r, []byte("c"), w, nil); err != nil {
+		t.Fatalf("TrimTo: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := a.numLive(); n != live {
+		t.Errorf("TrimTo: got %d live allocations, want %d", n, live)
+	}
+	if a.badFree {
+		t.Error("memory that was not from Alloc was passed to Free")
+	}
+}
+
+func TestAllocatorReadahead(t *testing.T) {
+	b := readTestFile(t, writeTestTableWithIndex(t,
+		[][]string{{"a", "1", "b", "2"}, {"c", "3"}},
+		[]string{"b", "c"}))
+	a := &countingAllocator{live: map[*byte]bool{}}
+	r := NewReader(writeTestFile(t, b), &db.Options{Allocator: a, ReadaheadBlocks: 4})
+	defer r.Close()
+
+	// The span of both snappy-compressed blocks is read into one buffer from
+	// the Allocator, which is freed once both blocks are decompressed.
+	allocs, live := a.allocs, a.numLive()
+	i := r.Find(nil, nil)
+	n := 0
+	for ; i.Next(); n++ {
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("got %d entries, want 3", n)
+	}
+	if a.allocs-allocs != 3 {
+		t.Errorf("got %d allocations, want 3", a.allocs-allocs)
+	}
+	if got := a.numLive(); got != live+2 {
+		t.Errorf("got %d live allocations, want %d", got, live+2)
+	}
+	if a.badFree {
+		t.Error("memory that was not from Alloc was passed to Free")
+	}
+}
+
+func TestAllocatorVerify(t *testing.T) {
+	b := readTestFile(t, writeTestTableWithIndex(t,
+		[][]string{{"a", "1", "b", "2"}, {"c", "3"}},
+		[]string{"b", "c"}))
+	for _, mmap := range []bool{false, true} {
+		// A memory-mapped block is not from the Allocator, so it must not be
+		// passed to Free.
+		f := writeTestFile(t, b)
+		if mmap {
+			f = NewMemFile(b)
+		}
+		a := &countingAllocator{live: map[*byte]bool{}}
+		r := NewReader(f, &db.Options{Allocator: a})
+		live := a.numLive()
+		corruptions, err := r.VerifyAll()
+		if len(corruptions) != 0 || err != nil {
+			t.Errorf("mmap=%t: VerifyAll: got (%v, %v), want no corruptions", mmap, corruptions, err)
+		}
+		if err := r.Scrub(); err != nil {
+			t.Errorf("mmap=%t: Scrub: %v", mmap, err)
+		}
+		if n := a.numLive(); n != live {
+			t.Errorf("mmap=%t: got %d live allocations, want %d", mmap, n, live)
+		}
+		if a.badFree {
+			t.Errorf("mmap=%t: memory that was not from Alloc was passed to Free", mmap)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// mapBlockCache is a db.BlockCache that keeps every block in a map.
+type mapBlockCache struct {
+	mu         sync.Mutex
+	blocks     map[BlockHandle][]byte
+	gets, hits int
+}
+
+func (c *mapBlockCache) Get(offset, length uint64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gets++
+	b, ok := c.blocks[BlockHandle{offset, length}]
+	if ok {
+		c.hits++
+	}
+	return b, ok
+}
+
+func (c *mapBlockCache) Put(offset, length uint64, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blocks[BlockHandle{offset, length}] = b
+}
+
+func TestBlockCacheOption(t *testing.T) {
+	f, err := buildWithOptions(&db.Options{
+		BlockSize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &mapBlockCache{blocks: map[BlockHandle][]byte{}}
+	cf := NewCountingFile(f)
+	// The BlockCache option takes the place of BlockCacheSize.
+	r := NewReader(cf, &db.Options{
+		BlockCache:     c,
+		BlockCacheSize: 1,
+	})
+	defer r.Close()
+	if _, ok := r.cache.(*blockCache); ok {
+		t.Fatal("the BlockCache option was not used")
+	}
+
+	// The first scan puts every data block in the cache, and the second
+	// finds them there.
+	openReads, _ := cf.Counts()
+	for pass := 0; pass < 2; pass++ {
+		i := r.Find(nil, nil)
+		n := 0
+		for i.Next() {
+			n++
+		}
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n != len(wordCount) {
+			t.Fatalf("pass %d: got %d keys, want %d", pass, n, len(wordCount))
+		}
+	}
+	numBlocks := len(c.blocks)
+	if numBlocks < 2 {
+		t.Fatalf("got %d cached blocks, want several", numBlocks)
+	}
+	if reads, _ := cf.Counts(); reads-openReads != int64(numBlocks) {
+		t.Errorf("got %d reads for two scans, want %d", reads-openReads, numBlocks)
+	}
+	if c.hits != numBlocks {
+		t.Errorf("got %d cache hits, want %d", c.hits, numBlocks)
+	}
+
+	// Get, Touch and the data in the cache agree.
+	reads, _ := cf.Counts()
+	gets := c.gets
+	if v, err := r.Get([]byte(minWord), nil); err != nil || string(v) != wordCount[minWord] {
+		t.Errorf("Get %q: got (%q, %v), want (%q, nil)", minWord, v, err, wordCount[minWord])
+	}
+	if err := r.Touch([]byte(minWord)); err != nil {
+		t.Errorf("Touch %q: %v", minWord, err)
+	}
+	if got, _ := cf.Counts(); got != reads {
+		t.Errorf("Get and Touch: got %d reads, want 0", got-reads)
+	}
+	if c.gets-gets != 2 {
+		t.Errorf("Get and Touch: got %d cache lookups, want 2", c.gets-gets)
+	}
+}
+
+func TestGlobalSeqNum(t *testing.T) {
+	const (
+		del = internalKeyKindDelete
+		set = internalKeyKindSet
+	)
+	// writeTable writes a table of two data blocks, whose keys are stored
+	// with a zero sequence number, with the given properties.
+	writeTable := func(props ...string) db.File {
+		handle := func(bh blockHandle) string {
+			return string(EncodeBlockHandle(nil, BlockHandle{bh.offset, bh.length}))
+		}
+		var b []byte
+		appendBlock := func(kvs ...string) blockHandle {
+			bh := blockHandle{offset: uint64(len(b))}
+			b = appendTestBlock(b, kvs...)
+			bh.length = uint64(len(b)) - bh.offset - blockTrailerLen
+			return bh
+		}
+		ik := func(ukey string, kind uint8) string {
+			return string(makeTestInternalKey(ukey, kind, 0))
+		}
+		d0 := appendBlock(ik("a", set), "a", ik("b", set), "b", ik("c", del), "")
+		d1 := appendBlock(ik("d", set), "d", ik("e", set), "e")
+		propsBH := appendBlock(props...)
+		metaindexBH := appendBlock(propertiesBlockName, handle(propsBH))
+		indexBH := appendBlock(ik("c", del), handle(d0), ik("e", set), handle(d1))
+		b = appendTestFooter(b, metaindexBH, indexBH)
+		return writeTestFile(t, b)
+	}
+	o := &db.Options{Comparer: testInternalKeyComparer{}}
+	seqNum100 := string([]byte{100, 0, 0, 0, 0, 0, 0, 0})
+	r := NewReader(writeTable(globalSeqNumPropertyName, seqNum100), o)
+	defer r.Close()
+
+	scan := func(i db.Iterator) string {
+		var got []string
+		for i.Next() {
+			ukey, kind, seqNum, ok := parseInternalKey(i.Key())
+			if !ok {
+				t.Fatalf("got key %q, want an internal key", i.Key())
+			}
+			got = append(got, fmt.Sprintf("%s.%d.%d", ukey, kind, seqNum))
+		}
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(got, ",")
+	}
+	if got, want := scan(r.Find(nil, nil)), "a.1.100,b.1.100,c.0.100,d.1.100,e.1.100"; got != want {
+		t.Errorf("Find: got %q, want %q", got, want)
+	}
+	// Every entry is newer than a seek key with a smaller sequence number,
+	// including the last entry of the first block.
+	if got, want := scan(r.Find(makeTestInternalKey("c", set, 50), nil)), "d.1.100,e.1.100"; got != want {
+		t.Errorf("Find c.50: got %q, want %q", got, want)
+	}
+	if got, want := scan(r.Find(makeTestInternalKey("c", set, 100), nil)), "c.0.100,d.1.100,e.1.100"; got != want {
+		t.Errorf("Find c.100: got %q, want %q", got, want)
+	}
+	if got := scan(r.FindAt([]byte("a"), 99, nil)); got != "" {
+		t.Errorf("FindAt a.99: got %q, want none", got)
+	}
+	if v, err := r.GetAt([]byte("d"), 100, nil); err != nil || string(v) != "d" {
+		t.Errorf("GetAt d.100: got (%q, %v), want (\"d\", nil)", v, err)
+	}
+	if _, err := r.GetAt([]byte("d"), 99, nil); err != db.ErrNotFound {
+		t.Errorf("GetAt d.99: got %v, want ErrNotFound", err)
+	}
+	if _, err := r.GetAt([]byte("c"), 100, nil); err != db.ErrNotFound {
+		t.Errorf("GetAt c.100: got %v, want ErrNotFound", err)
+	}
+	var firstKeys []string
+	err := r.ForEachBlock(func(firstKey []byte, h BlockHandle) error {
+		_, _, seqNum, _ := parseInternalKey(firstKey)
+		firstKeys = append(firstKeys, fmt.Sprintf("%s.%d", firstKey[:1], seqNum))
+		return nil
+	})
+	if got, want := strings.Join(firstKeys, ","), "a.100,d.100"; err != nil || got != want {
+		t.Errorf("ForEachBlock: got (%q, %v), want (%q, nil)", got, err, want)
+	}
+	// TrimTo writes every key with the global sequence number, including
+	// those of a block that is wholly below upto, as the output table has no
+	// global sequence number of its own.
+	mem := memfs.New()
+	f0, err := mem.Create("trimmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, o)
+	if err := TrimTo(r, makeTestInternalKey("e", set, 100), w, nil); err != nil {
+		t.Fatalf("TrimTo: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := mem.Open("trimmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trimmed := NewReader(f1, o)
+	if got, want := scan(trimmed.Find(nil, nil)), "a.1.100,b.1.100,c.0.100,d.1.100"; got != want {
+		t.Errorf("TrimTo: got %q, want %q", got, want)
+	}
+	trimmed.Close()
+
+	// A table without the property, or with a zero value, is read as stored.
+	for _, props := range [][]string{nil, {globalSeqNumPropertyName, string(make([]byte, 8))}} {
+		r := NewReader(writeTable(props...), o)
+		if got, want := scan(r.Find(nil, nil)), "a.1.0,b.1.0,c.0.0,d.1.0,e.1.0"; got != want {
+			t.Errorf("props %q: got %q, want %q", props, got, want)
+		}
+		r.Close()
+	}
+
+	// A malformed property is an error.
+	for _, v := range []string{seqNum100[:7], "\xff\xff\xff\xff\xff\xff\xff\xff"} {
+		r := NewReader(writeTable(globalSeqNumPropertyName, v), o)
+		if _, err := r.Get(makeTestInternalKey("a", set, 0), nil); err == nil {
+			t.Errorf("property %q: got nil error, want non-nil", v)
+		}
+		r.Close()
+	}
+}
+
+func TestGlobalSeqNumRangeTombstones(t *testing.T) {
+	const set = internalKeyKindSet
+	o := &db.Options{Comparer: testInternalKeyComparer{}}
+
+	// The ingested table has a range tombstone from "b" to "d", which, like
+	// its keys, is stored with a zero sequence number.
+	handle := func(bh blockHandle) string {
+		return string(EncodeBlockHandle(nil, BlockHandle{bh.offset, bh.length}))
+	}
+	var b []byte
+	appendBlock := func(kvs ...string) blockHandle {
+		bh := blockHandle{offset: uint64(len(b))}
+		b = appendTestBlock(b, kvs...)
+		bh.length = uint64(len(b)) - bh.offset - blockTrailerLen
+		return bh
+	}
+	d0 := appendBlock(string(makeTestInternalKey("a", set, 0)), "a", string(makeTestInternalKey("e", set, 0)), "e")
+	propsBH := appendBlock(globalSeqNumPropertyName, string([]byte{100, 0, 0, 0, 0, 0, 0, 0}))
+	rangeDelBH := appendBlock(string(appendRangeDelKey(nil, []byte("b"), 0)), "d")
+	metaindexBH := appendBlock(propertiesBlockName, handle(propsBH), rangeDelBlockName, handle(rangeDelBH))
+	indexBH := appendBlock(string(makeTestInternalKey("e", set, 0)), handle(d0))
+	b = appendTestFooter(b, metaindexBH, indexBH)
+	ingested := NewReader(writeTestFile(t, b), o)
+	defer ingested.Close()
+
+	tombs := func(ts []RangeTombstone) string {
+		var s []string
+		for _, t := range ts {
+			s = append(s, fmt.Sprintf("%s-%s.%d", t.Start, t.End, t.SeqNum))
+		}
+		return strings.Join(s, ",")
+	}
+	const wantTombs = "b-d.100"
+	if got := tombs(ingested.RangeTombstones()); got != wantTombs {
+		t.Fatalf("RangeTombstones: got %q, want %q", got, wantTombs)
+	}
+
+	// The tombstone deletes an older table's key, and is carried into the
+	// output of a merge with the global sequence number.
+	mem := memfs.New()
+	f0, err := mem.Create("older")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, o)
+	if err := w.Set(makeTestInternalKey("c", set, 50), []byte("c"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := mem.Open("older")
+	if err != nil {
+		t.Fatal(err)
+	}
+	older := NewReader(f1, o)
+	defer older.Close()
+
+	f2, err := mem.Create("merged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = NewWriter(f2, o)
+	if _, err := MergeSortedInto(w, []*Reader{ingested, older}, nil); err != nil {
+		t.Fatalf("MergeSortedInto: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f3, err := mem.Open("merged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := NewReader(f3, o)
+	defer merged.Close()
+	var keys []string
+	i := merged.Find(nil, nil)
+	for i.Next() {
+		ukey, _, seqNum, _ := parseInternalKey(i.Key())
+		keys = append(keys, fmt.Sprintf("%s.%d", ukey, seqNum))
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(keys, ","), "a.100,e.100"; got != want {
+		t.Errorf("merged keys: got %q, want %q", got, want)
+	}
+	if got := tombs(merged.RangeTombstones()); got != wantTombs {
+		t.Errorf("merged RangeTombstones: got %q, want %q", got, wantTombs)
+	}
+}
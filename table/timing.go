@@ -0,0 +1,83 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// TimingStats is the time that a Reader has spent reading from its file and
+// decompressing blocks, as measured with the TimeReads option.
+type TimingStats struct {
+	// Reads is the number of reads from the file, and ReadTime is the total
+	// time that they took. Blocks of a memory-mapped file are not read.
+	Reads    int64
+	ReadTime time.Duration
+	// Decompressions is the number of compressed blocks decompressed, and
+	// DecompressTime is the total time that decompressing them took.
+	Decompressions int64
+	DecompressTime time.Duration
+}
+
+// readTimer accumulates a Reader's TimingStats. Its fields are accessed
+// atomically, as the Reader and its clones may be used concurrently.
+type readTimer struct {
+	reads, readNanos, decompressions, decompressNanos int64
+}
+
+// Stats returns the time that the table has spent reading from its file and
+// decompressing blocks, including that of its clones. It is zero unless the
+// TimeReads option was set.
+func (r *Reader) Stats() TimingStats {
+	t := r.timer
+	if t == nil {
+		return TimingStats{}
+	}
+	return TimingStats{
+		Reads:          atomic.LoadInt64(&t.reads),
+		ReadTime:       time.Duration(atomic.LoadInt64(&t.readNanos)),
+		Decompressions: atomic.LoadInt64(&t.decompressions),
+		DecompressTime: time.Duration(atomic.LoadInt64(&t.decompressNanos)),
+	}
+}
+
+// addRead adds a read that started at start.
+func (t *readTimer) addRead(start time.Time) {
+	atomic.AddInt64(&t.reads, 1)
+	atomic.AddInt64(&t.readNanos, int64(time.Since(start)))
+}
+
+// addDecompression adds a decompression that started at start.
+func (t *readTimer) addDecompression(start time.Time) {
+	atomic.AddInt64(&t.decompressions, 1)
+	atomic.AddInt64(&t.decompressNanos, int64(time.Since(start)))
+}
+
+// decompress is like decompressBlock, except that it decodes into memory from
+// the Allocator option, if it is set, and measures the time that
+// decompressing takes, if r times its reads.
+func (r *Reader) decompress(b []byte, blockType byte) (block, error) {
+	if blockType == noCompressionBlockType {
+		return b, nil
+	}
+	var start time.Time
+	if r.timer != nil {
+		start = time.Now()
+	}
+	var (
+		d   block
+		err error
+	)
+	if r.allocator != nil && blockType == snappyCompressionBlockType {
+		d, err = r.decodeSnappy(b)
+	} else {
+		d, err = decompressBlock(b, blockType)
+	}
+	if r.timer != nil {
+		r.timer.addDecompression(start)
+	}
+	return d, err
+}
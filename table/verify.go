@@ -0,0 +1,151 @@
+// Copyright 2013 The LevelDB-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+// VerifyAll reads the whole table, verifying every block's checksum regardless
+// of the VerifyChecksums option, and returns every problem that it finds,
+// instead of only the first. For each data block, it checks that the block's
+// handle lies within the file, that the block has a valid checksum and
+// decompresses, and that its keys are in increasing order and bounded by the
+// index, as per the ParanoidChecks option. It also checks that the index's
+// keys are in non-decreasing order. A bad data block is reported once, and
+// the verification continues with the next block.
+//
+// If the footer, meta blocks or index cannot be read as a table, that is the
+// only CorruptionError returned. The non-nil error return is for any other
+// error, such as a failure to read the file, which stops the verification.
+func (r *Reader) VerifyAll() ([]CorruptionError, error) {
+	var corruptions []CorruptionError
+	// add adds err to corruptions if err is a CorruptionError, filling in the
+	// given offset if err's offset is unknown, and returns any other error.
+	add := func(err error, offset int64) error {
+		e, ok := err.(CorruptionError)
+		if !ok {
+			return err
+		}
+		if e.Offset < 0 {
+			e.Offset = offset
+		}
+		corruptions = append(corruptions, e)
+		return nil
+	}
+
+	if r.err != nil {
+		return corruptions, add(r.err, -1)
+	}
+	i, err := r.newIndexIter(nil)
+	if err != nil {
+		return corruptions, add(err, -1)
+	}
+	var prevSep, sep []byte
+	for i.Next() {
+		prevSep, sep = sep, append(prevSep[:0], i.Key()...)
+		if prevSep != nil && r.comparer.Compare(prevSep, sep) > 0 {
+			add(corruptionErrorf(-1, "index keys out of order: %q, %q", prevSep, sep), -1)
+		}
+		v := i.Value()
+		h, n := decodeBlockHandle(v)
+		if n == 0 || n != len(v) {
+			add(errCorruptIndexEntry, -1)
+			continue
+		}
+		if err := r.verifyDataBlock(h, prevSep, sep); err != nil {
+			if err := add(err, int64(h.offset)); err != nil {
+				i.Close()
+				return corruptions, err
+			}
+		}
+	}
+	return corruptions, add(i.Close(), -1)
+}
+
+// verifyDataBlock checks the data block with handle h, as per VerifyAll,
+// bypassing the block cache. It returns a CorruptionError if the block is
+// corrupt. The lower and upper bounds of the block's keys are as per
+// checkBlockBounds.
+func (r *Reader) verifyDataBlock(h blockHandle, lower, upper []byte) error {
+	if err := checkBlockHandle(h, r.size, "data"); err != nil {
+		return err
+	}
+	b, err := r.readBlockAndTrailer(h)
+	if err != nil {
+		return err
+	}
+	raw, blockType, err := r.checkBlock(b, h.offset, true)
+	if err == nil {
+		var d block
+		if d, err = r.decompress(raw, blockType); err == nil {
+			err = r.checkBlockBounds(d, h, lower, upper)
+			if blockType != noCompressionBlockType {
+				// An uncompressed d is part of b.
+				r.freeBlock(d, blockType)
+			}
+		}
+	}
+	r.freeRead(b)
+	if _, ok := err.(CorruptionError); err != nil && !ok {
+		// The file was read, so any other error is from decompressing the
+		// block's bytes.
+		err = corruptionErrorf(int64(h.offset), "could not decompress block: %v", err)
+	}
+	return err
+}
+
+// Scrub reads every data block of the table, and its metaindex and index
+// blocks, and verifies their checksums, regardless of the VerifyChecksums
+// option. Unlike VerifyAll, it does not decompress or decode the data blocks,
+// which makes it much cheaper for compressed tables, but it only detects
+// corruption that the checksums detect. It returns the first error found. It
+// bypasses the block cache.
+func (r *Reader) Scrub() error {
+	if r.err != nil {
+		return r.err
+	}
+	metaindexBH, indexBH, err := readFooter(r.file, r.size, r.timer)
+	if err != nil {
+		return err
+	}
+	if metaindexBH.length > 0 {
+		if err := r.verifyBlock(metaindexBH); err != nil {
+			return err
+		}
+	}
+	if err := r.verifyBlock(indexBH); err != nil {
+		return err
+	}
+	i, err := r.newIndexIter(nil)
+	if err != nil {
+		return err
+	}
+	for i.Next() {
+		v := i.Value()
+		h, n := decodeBlockHandle(v)
+		if n == 0 || n != len(v) {
+			i.Close()
+			return errCorruptIndexEntry
+		}
+		if err := checkBlockHandle(h, r.size, "data"); err != nil {
+			i.Close()
+			return err
+		}
+		if err := r.verifyBlock(h); err != nil {
+			i.Close()
+			return err
+		}
+	}
+	return i.Close()
+}
+
+// verifyBlock reads the block with handle bh and verifies its checksum,
+// without decompressing it.
+func (r *Reader) verifyBlock(bh blockHandle) error {
+	b, err := r.readBlockAndTrailer(bh)
+	if err != nil {
+		return err
+	}
+	err = checkChecksum(b, bh.offset)
+	r.freeRead(b)
+	return err
+}
@@ -6,10 +6,12 @@ package table
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 
 	"github.com/golang/leveldb/crc"
 	"github.com/golang/leveldb/db"
@@ -32,6 +34,13 @@ const filterBaseLog = 11
 
 type filterWriter struct {
 	policy db.FilterPolicy
+	// prefix, if non-nil, extracts the key prefixes that are also added to
+	// the filters. lastPrefix is the last prefix added to the current
+	// filter, if hasPrefix is true, so that a run of keys with the same
+	// prefix adds it once.
+	prefix     db.PrefixExtractor
+	lastPrefix []byte
+	hasPrefix  bool
 	// block holds the keys for the current block. The buffers are re-used for
 	// each new block.
 	block struct {
@@ -51,6 +60,16 @@ func (f *filterWriter) hasKeys() bool {
 func (f *filterWriter) appendKey(key []byte) {
 	f.block.data = append(f.block.data, key...)
 	f.block.lengths = append(f.block.lengths, len(key))
+	if f.prefix == nil {
+		return
+	}
+	p := f.prefix.Prefix(key)
+	if p == nil || (f.hasPrefix && bytes.Equal(p, f.lastPrefix)) {
+		return
+	}
+	f.block.data = append(f.block.data, p...)
+	f.block.lengths = append(f.block.lengths, len(p))
+	f.lastPrefix, f.hasPrefix = append(f.lastPrefix[:0], p...), true
 }
 
 func (f *filterWriter) appendOffset() error {
@@ -82,6 +101,7 @@ func (f *filterWriter) emit() error {
 	f.block.data = f.block.data[:0]
 	f.block.lengths = f.block.lengths[:0]
 	f.block.keys = f.block.keys[:0]
+	f.hasPrefix = false
 	return nil
 }
 
@@ -125,6 +145,10 @@ type Writer struct {
 	blockSize            int
 	cmp                  db.Comparer
 	compression          db.Compression
+	// dataFormat is the format of the data blocks, as given by the
+	// ValuePrefixCompression option. Other blocks are always in the standard
+	// format.
+	dataFormat blockFormat
 	// A table is a series of blocks and a block's index entry contains a
 	// separator key between one block and the next. Thus, a finished block
 	// cannot be written until the first key in the next block is seen.
@@ -137,6 +161,9 @@ type Writer struct {
 	offset uint64
 	// prevKey is a copy of the key most recently passed to Set.
 	prevKey []byte
+	// prevValue is a copy of the value most recently passed to Set, if the
+	// data blocks share value prefixes.
+	prevValue []byte
 	// indexKeys and indexEntries hold the separator keys between each block
 	// and the successor key for the final block. indexKeys contains the key's
 	// bytes concatenated together. The keyLen field of each indexEntries
@@ -157,6 +184,22 @@ type Writer struct {
 	compressedBuf []byte
 	// filter accumulates the filter block.
 	filter filterWriter
+	// verifyDecompressed is whether to record the checksums of the data
+	// blocks' decompressed contents. If so, lastCRC is that checksum of the
+	// block most recently finished, and decompressedCRCs holds the encoded
+	// value of the decompressedCRCsPropertyName property.
+	verifyDecompressed bool
+	lastCRC            uint32
+	decompressedCRCs   []byte
+	// maxKeyLen and maxValueLen are the lengths of the longest key and value
+	// added so far.
+	maxKeyLen, maxValueLen int
+	// rangeDels are the range tombstones added by DeleteRange, in the order
+	// that they were added.
+	rangeDels []RangeTombstone
+	// userProperties are the properties set by SetUserProperties, by name,
+	// excluding the userPropertyPrefix.
+	userProperties map[string][]byte
 	// tmp is a scratch buffer, large enough to hold either footerLen bytes,
 	// blockTrailerLen bytes, or (5 * binary.MaxVarintLen64) bytes.
 	tmp [50]byte
@@ -180,7 +223,7 @@ func (w *Writer) Delete(key []byte, o *db.WriteOptions) error {
 // Find is provided to implement the DB interface, but returns an error, as a
 // Writer cannot read from a table.
 func (w *Writer) Find(key []byte, o *db.ReadOptions) db.Iterator {
-	return &tableIter{
+	return &Iterator{
 		err: errors.New("leveldb/table: cannot Find from a write-only table"),
 	}
 }
@@ -199,7 +242,8 @@ func (w *Writer) Set(key, value []byte, o *db.WriteOptions) error {
 		w.filter.appendKey(key)
 	}
 	w.flushPendingBH(key)
-	w.append(key, value, w.nEntries%w.blockRestartInterval == 0)
+	w.appendFormat(key, value, w.nEntries%w.blockRestartInterval == 0, w.dataFormat)
+	w.recordLens(len(key), len(value))
 	// If the estimated block size is sufficiently large, finish the current block.
 	if len(w.buf)+4*(len(w.restarts)+1) >= w.blockSize {
 		bh, err := w.finishBlock()
@@ -207,6 +251,7 @@ func (w *Writer) Set(key, value []byte, o *db.WriteOptions) error {
 			w.err = err
 			return w.err
 		}
+		w.recordCRC(bh)
 		w.pendingBH = bh
 	}
 	return nil
@@ -228,20 +273,34 @@ func (w *Writer) flushPendingBH(key []byte) {
 
 // append appends a key/value pair, which may also be a restart point.
 func (w *Writer) append(key, value []byte, restart bool) {
-	nShared := 0
+	w.appendFormat(key, value, restart, standardBlockFormat)
+}
+
+// appendFormat is like append, for a block of the given format.
+func (w *Writer) appendFormat(key, value []byte, restart bool, format blockFormat) {
+	nShared, vShared := 0, 0
 	if restart {
 		w.restarts = append(w.restarts, uint32(len(w.buf)))
 	} else {
 		nShared = db.SharedPrefixLen(w.prevKey, key)
+		if format == valuePrefixBlockFormat {
+			vShared = db.SharedPrefixLen(w.prevValue, value)
+		}
 	}
 	w.prevKey = append(w.prevKey[:0], key...)
+	if format == valuePrefixBlockFormat {
+		w.prevValue = append(w.prevValue[:0], value...)
+	}
 	w.nEntries++
 	n := binary.PutUvarint(w.tmp[0:], uint64(nShared))
 	n += binary.PutUvarint(w.tmp[n:], uint64(len(key)-nShared))
-	n += binary.PutUvarint(w.tmp[n:], uint64(len(value)))
+	if format == valuePrefixBlockFormat {
+		n += binary.PutUvarint(w.tmp[n:], uint64(vShared))
+	}
+	n += binary.PutUvarint(w.tmp[n:], uint64(len(value)-vShared))
 	w.buf = append(w.buf, w.tmp[:n]...)
 	w.buf = append(w.buf, key[nShared:]...)
-	w.buf = append(w.buf, value...)
+	w.buf = append(w.buf, value[vShared:]...)
 }
 
 // finishBlock finishes the current block and returns its block handle, which is
@@ -260,6 +319,9 @@ func (w *Writer) finishBlock() (blockHandle, error) {
 	}
 	binary.LittleEndian.PutUint32(tmp4, uint32(len(w.restarts)))
 	w.buf = append(w.buf, tmp4...)
+	if w.verifyDecompressed {
+		w.lastCRC = crc.New(w.buf).Value()
+	}
 
 	// Compress the buffer, discarding the result if the improvement
 	// isn't at least 12.5%.
@@ -288,6 +350,91 @@ func (w *Writer) finishBlock() (blockHandle, error) {
 	return bh, err
 }
 
+// copyBlock appends an already encoded data block, such as one read from
+// another table, to the table. The bytes raw are written verbatim, with
+// blockType giving their compression, and b is the decompressed form of raw.
+// Any key/value pairs previously passed to Set are first finished into their
+// own block. The block's keys must all be greater than those keys.
+func (w *Writer) copyBlock(raw []byte, blockType byte, b block) error {
+	if w.err != nil {
+		return w.err
+	}
+	i := &blockIter{format: w.dataFormat}
+	if _, err := b.seekInto(i, w.cmp, nil, 0); err != nil {
+		w.err = err
+		return w.err
+	}
+	n := 0
+	for ; i.Next(); n++ {
+		key := i.Key()
+		if n == 0 {
+			if w.cmp.Compare(w.prevKey, key) >= 0 {
+				i.Close()
+				w.err = fmt.Errorf("leveldb/table: copyBlock called in non-increasing key order: %q, %q", w.prevKey, key)
+				return w.err
+			}
+			if w.nEntries > 0 {
+				bh, err := w.finishBlock()
+				if err != nil {
+					i.Close()
+					w.err = err
+					return w.err
+				}
+				w.recordCRC(bh)
+				w.pendingBH = bh
+			}
+			w.flushPendingBH(key)
+		}
+		if w.filter.policy != nil {
+			w.filter.appendKey(key)
+		}
+		w.recordLens(i.KeyLen(), i.ValueLen())
+		w.prevKey = append(w.prevKey[:0], key...)
+	}
+	if err := i.Close(); err != nil {
+		w.err = err
+		return w.err
+	}
+	if n == 0 {
+		// The block was empty, so there is nothing to copy.
+		return nil
+	}
+	bh, err := w.writeRawBlock(raw, blockType)
+	if err != nil {
+		w.err = err
+		return w.err
+	}
+	if w.verifyDecompressed {
+		w.lastCRC = crc.New(b).Value()
+		w.recordCRC(bh)
+	}
+	if w.filter.policy != nil {
+		w.filter.finishBlock(w.offset)
+	}
+	w.pendingBH = bh
+	return nil
+}
+
+// recordLens records the lengths of a key and value added to the table, for
+// the maximum key and value length properties.
+func (w *Writer) recordLens(keyLen, valueLen int) {
+	if w.maxKeyLen < keyLen {
+		w.maxKeyLen = keyLen
+	}
+	if w.maxValueLen < valueLen {
+		w.maxValueLen = valueLen
+	}
+}
+
+// recordCRC records w.lastCRC as the checksum of the decompressed contents
+// of the data block with handle bh, if the writer records those checksums.
+func (w *Writer) recordCRC(bh blockHandle) {
+	if !w.verifyDecompressed {
+		return
+	}
+	w.decompressedCRCs = appendDecompressedCRC(w.decompressedCRCs, bh.offset, w.lastCRC)
+}
+
 func (w *Writer) writeRawBlock(b []byte, blockType byte) (blockHandle, error) {
 	w.tmp[0] = blockType
 
@@ -332,6 +479,7 @@ func (w *Writer) Close() (err error) {
 			w.err = err
 			return w.err
 		}
+		w.recordCRC(bh)
 		w.pendingBH = bh
 		w.flushPendingBH(nil)
 	}
@@ -341,23 +489,50 @@ func (w *Writer) Close() (err error) {
 	tmp := w.tmp[3*binary.MaxVarintLen64 : 5*binary.MaxVarintLen64]
 
 	// Write the filter block.
+	var filterBH blockHandle
 	if w.filter.policy != nil {
 		b, err := w.filter.finish()
 		if err != nil {
 			w.err = err
 			return w.err
 		}
-		bh, err := w.writeRawBlock(b, noCompressionBlockType)
+		filterBH, err = w.writeRawBlock(b, noCompressionBlockType)
 		if err != nil {
 			w.err = err
 			return w.err
 		}
-		n := encodeBlockHandle(tmp, bh)
-		w.append([]byte("filter."+w.filter.policy.Name()), tmp[:n], true)
+	}
+
+	// Write the properties block, if there are any properties.
+	propertiesBH, err := w.writeProperties()
+	if err != nil {
+		w.err = err
+		return w.err
+	}
+
+	// Write the range deletion block, if there are any range tombstones.
+	rangeDelBH, err := w.writeRangeDels()
+	if err != nil {
+		w.err = err
+		return w.err
 	}
 
 	// Write the metaindex block. It might be an empty block, if the filter
-	// policy is nil.
+	// policy is nil and there are no properties or range tombstones. Its keys
+	// are in increasing order: "filter." < "rocksdb.properties" <
+	// "rocksdb.range_del".
+	if filterBH != (blockHandle{}) {
+		n := encodeBlockHandle(tmp, filterBH)
+		w.append([]byte("filter."+w.filter.policy.Name()), tmp[:n], true)
+	}
+	if propertiesBH != (blockHandle{}) {
+		n := encodeBlockHandle(tmp, propertiesBH)
+		w.append([]byte(propertiesBlockName), tmp[:n], true)
+	}
+	if rangeDelBH != (blockHandle{}) {
+		n := encodeBlockHandle(tmp, rangeDelBH)
+		w.append([]byte(rangeDelBlockName), tmp[:n], true)
+	}
 	metaindexBlockHandle, err := w.finishBlock()
 	if err != nil {
 		w.err = err
@@ -379,14 +554,11 @@ func (w *Writer) Close() (err error) {
 	}
 
 	// Write the table footer.
-	footer := w.tmp[:footerLen]
-	for i := range footer {
-		footer[i] = 0
-	}
-	n := encodeBlockHandle(footer, metaindexBlockHandle)
-	encodeBlockHandle(footer[n:], indexBlockHandle)
-	copy(footer[footerLen-len(magic):], magic)
-	if _, err := w.writer.Write(footer); err != nil {
+	n := footer{
+		metaindexHandle: metaindexBlockHandle,
+		indexHandle:     indexBlockHandle,
+	}.encode(w.tmp[:])
+	if _, err := w.writer.Write(w.tmp[:n]); err != nil {
 		w.err = err
 		return w.err
 	}
@@ -404,6 +576,67 @@ func (w *Writer) Close() (err error) {
 	return nil
 }
 
+// SetUserProperties sets properties to be written to the table's properties
+// block when the Writer is closed, such as to record where the table came
+// from. Each property's name is "user." followed by its key in props, so that
+// it cannot collide with the properties that this package or RocksDB write,
+// and Reader.Properties returns it under that name. A later call adds to, or
+// replaces, the properties of earlier calls. The Writer retains the values,
+// which must not be modified until the Writer is closed.
+func (w *Writer) SetUserProperties(props map[string][]byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.userProperties == nil {
+		w.userProperties = make(map[string][]byte, len(props))
+	}
+	for name, v := range props {
+		w.userProperties[name] = v
+	}
+	return nil
+}
+
+// writeProperties writes the properties block, if there are any properties,
+// and returns its block handle. It returns a zero block handle if there are
+// no properties.
+func (w *Writer) writeProperties() (blockHandle, error) {
+	// The table records the Comparer name only if it isn't the default, and
+	// the maximum key and value lengths only if it records something else,
+	// so that tables written with the default options are identical to those
+	// written by the C++ LevelDB implementation. The properties are in
+	// increasing order: "leveldb-go." < "rocksdb." < "user.".
+	name := w.cmp.Name()
+	if !w.verifyDecompressed && w.dataFormat != valuePrefixBlockFormat && name == db.DefaultComparer.Name() &&
+		w.filter.prefix == nil && len(w.userProperties) == 0 {
+		return blockHandle{}, nil
+	}
+	if w.verifyDecompressed {
+		w.append([]byte(decompressedCRCsPropertyName), w.decompressedCRCs, true)
+	}
+	// The lengths are encoded in v rather than w.tmp, which append uses.
+	var v [binary.MaxVarintLen64]byte
+	w.append([]byte(maxKeyLenPropertyName), v[:binary.PutUvarint(v[:], uint64(w.maxKeyLen))], true)
+	w.append([]byte(maxValueLenPropertyName), v[:binary.PutUvarint(v[:], uint64(w.maxValueLen))], true)
+	if w.dataFormat == valuePrefixBlockFormat {
+		w.append([]byte(valuePrefixPropertyName), []byte("1"), true)
+	}
+	if name != db.DefaultComparer.Name() {
+		w.append([]byte(comparerPropertyName), []byte(name), true)
+	}
+	if w.filter.prefix != nil {
+		w.append([]byte(prefixExtractorPropertyName), []byte(w.filter.prefix.Name()), true)
+	}
+	names := make([]string, 0, len(w.userProperties))
+	for name := range w.userProperties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w.append([]byte(userPropertyPrefix+name), w.userProperties[name], true)
+	}
+	return w.finishBlock()
+}
+
 // NewWriter returns a new table writer for the file. Closing the writer will
 // close the file.
 func NewWriter(f db.File, o *db.Options) *Writer {
@@ -419,6 +652,14 @@ func NewWriter(f db.File, o *db.Options) *Writer {
 		prevKey:  make([]byte, 0, 256),
 		restarts: make([]uint32, 0, 256),
 	}
+	if o.GetValuePrefixCompression() {
+		w.dataFormat = valuePrefixBlockFormat
+	}
+	w.verifyDecompressed = o.GetVerifyDecompressed()
+	if w.filter.policy != nil {
+		// Prefixes are only filtered as part of a table's filter.
+		w.filter.prefix = o.GetPrefixExtractor()
+	}
 	if f == nil {
 		w.err = errors.New("leveldb/table: nil file")
 		return w